@@ -12,7 +12,8 @@ import (
 
 var DB *gorm.DB
 
-func ConnectEnvDBConfig() {
+// GetDSN builds the Postgres connection string from the DB_* environment variables
+func GetDSN() string {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	dbUser := os.Getenv("DB_USER")
@@ -20,15 +21,16 @@ func ConnectEnvDBConfig() {
 	dbName := os.Getenv("DB_NAME")
 	dbSSLMode := os.Getenv("DB_SSLMODE")
 
-	var dsn string
-
 	if dbPassword == "" {
-		dsn = fmt.Sprintf("host=%s user=%s dbname=%s port=%s sslmode=%s",
+		return fmt.Sprintf("host=%s user=%s dbname=%s port=%s sslmode=%s",
 			dbHost, dbUser, dbName, dbPort, dbSSLMode)
-	} else {
-		dsn = fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
-			dbHost, dbUser, dbPassword, dbName, dbPort, dbSSLMode)
 	}
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s",
+		dbHost, dbUser, dbPassword, dbName, dbPort, dbSSLMode)
+}
+
+func ConnectEnvDBConfig() {
+	dsn := GetDSN()
 
 	var err error
 
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
+)
+
+type MatchmakingController struct {
+	matchmakingService *service.MatchmakingService
+}
+
+func NewMatchmakingController(ms *service.MatchmakingService) *MatchmakingController {
+	return &MatchmakingController{matchmakingService: ms}
+}
+
+// GetRecommendedProjects returns projects whose open roles best match the user's skills
+func (ctrl *MatchmakingController) GetRecommendedProjects(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	recommendations, err := ctrl.matchmakingService.GetRecommendedProjects(userID, matchLimit(c))
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, recommendations, "Recommended projects retrieved successfully")
+}
+
+// GetRoleCandidates returns ready users ranked against a project role, for the project creator
+func (ctrl *MatchmakingController) GetRoleCandidates(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	projectID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid project ID")
+	}
+
+	roleID, err := strconv.ParseUint(c.Params("role_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	candidates, err := ctrl.matchmakingService.GetRoleCandidates(uint(projectID), uint(roleID), userID, matchLimit(c))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, candidates, "Role candidates retrieved successfully")
+}
+
+func matchLimit(c *fiber.Ctx) int {
+	limit, _ := strconv.Atoi(c.Query("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	return limit
+}
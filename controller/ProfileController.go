@@ -85,8 +85,9 @@ func (ctrl *ProfileController) UpdateProfile(c *fiber.Ctx) error {
 		dto.Phone = &phone
 	}
 
-	if password := c.FormValue("password"); password != "" {
-		dto.Password = &password
+	// Changing the password needs the current one, see AuthController.ChangePassword
+	if c.FormValue("password") != "" {
+		return helper.Message400("Password cannot be changed here, use PUT /api/auth/password")
 	}
 
 	aboutMe := c.FormValue("about_me")
@@ -1,11 +1,223 @@
 package controller
 
-import "fmt"
+import (
+	"strconv"
 
-func Role() {
-	fmt.Println("oto")
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
+)
+
+type RolePermissionController struct {
+	rolePermissionService *service.RolePermissionService
+}
+
+func NewRolePermissionController(rps *service.RolePermissionService) *RolePermissionController {
+	return &RolePermissionController{rolePermissionService: rps}
+}
+
+// GetMyPermissions returns the roles and effective permissions of the authenticated user
+func (ctrl *RolePermissionController) GetMyPermissions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	roles, err := ctrl.rolePermissionService.GetUserRoles(userID)
+	if err != nil {
+		return helper.Message404(err.Error())
+	}
+
+	permissions, err := ctrl.rolePermissionService.GetUserPermissions(userID)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"roles":       roles,
+		"permissions": permissions,
+	}, "Permissions retrieved successfully")
+}
+
+// GetRoles lists every role with its permissions
+func (ctrl *RolePermissionController) GetRoles(c *fiber.Ctx) error {
+	roles, err := ctrl.rolePermissionService.GetAllRoles()
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, roles, "Roles retrieved successfully")
+}
+
+// GetRole retrieves a single role
+func (ctrl *RolePermissionController) GetRole(c *fiber.Ctx) error {
+	roleID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	role, err := ctrl.rolePermissionService.GetRoleByID(uint(roleID))
+	if err != nil {
+		return helper.Message404(err.Error())
+	}
+
+	return helper.Message200(c, role, "Role retrieved successfully")
+}
+
+// CreateRole creates a new role, optionally with a set of permission slugs
+func (ctrl *RolePermissionController) CreateRole(c *fiber.Ctx) error {
+	var data service.RoleDataDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	role, err := ctrl.rolePermissionService.CreateRole(data)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message201(c, role, "Role created successfully")
+}
+
+// UpdateRole updates a role's name, description or permissions
+func (ctrl *RolePermissionController) UpdateRole(c *fiber.Ctx) error {
+	roleID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	var data service.RoleDataDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	role, err := ctrl.rolePermissionService.UpdateRole(uint(roleID), data)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, role, "Role updated successfully")
+}
+
+// DeleteRole deletes a custom role
+func (ctrl *RolePermissionController) DeleteRole(c *fiber.Ctx) error {
+	roleID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	if err := ctrl.rolePermissionService.DeleteRole(uint(roleID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Role deleted successfully")
 }
 
-func Permission() {
-	fmt.Println("toto")
+// GetPermissions lists every permission
+func (ctrl *RolePermissionController) GetPermissions(c *fiber.Ctx) error {
+	permissions, err := ctrl.rolePermissionService.GetAllPermissions()
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, permissions, "Permissions retrieved successfully")
+}
+
+// CreatePermission creates a new permission
+func (ctrl *RolePermissionController) CreatePermission(c *fiber.Ctx) error {
+	var data service.PermissionDataDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	permission, err := ctrl.rolePermissionService.CreatePermission(data)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message201(c, permission, "Permission created successfully")
+}
+
+// UpdatePermission updates a permission
+func (ctrl *RolePermissionController) UpdatePermission(c *fiber.Ctx) error {
+	permissionID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid permission ID")
+	}
+
+	var data service.PermissionDataDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	permission, err := ctrl.rolePermissionService.UpdatePermission(uint(permissionID), data)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, permission, "Permission updated successfully")
+}
+
+// DeletePermission deletes a custom permission
+func (ctrl *RolePermissionController) DeletePermission(c *fiber.Ctx) error {
+	permissionID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid permission ID")
+	}
+
+	if err := ctrl.rolePermissionService.DeletePermission(uint(permissionID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Permission deleted successfully")
+}
+
+// GetUserRoles lists the roles assigned to a user
+func (ctrl *RolePermissionController) GetUserRoles(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("user_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid user ID")
+	}
+
+	roles, err := ctrl.rolePermissionService.GetUserRoles(uint(userID))
+	if err != nil {
+		return helper.Message404(err.Error())
+	}
+
+	return helper.Message200(c, roles, "User roles retrieved successfully")
+}
+
+// AssignRole assigns a role to a user
+func (ctrl *RolePermissionController) AssignRole(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("user_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid user ID")
+	}
+
+	roleID, err := strconv.ParseUint(c.FormValue("role_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	if err := ctrl.rolePermissionService.AssignRoleToUser(uint(userID), uint(roleID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Role assigned successfully")
+}
+
+// RemoveRole removes a role from a user
+func (ctrl *RolePermissionController) RemoveRole(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("user_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid user ID")
+	}
+
+	roleID, err := strconv.ParseUint(c.Params("role_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid role ID")
+	}
+
+	if err := ctrl.rolePermissionService.RemoveRoleFromUser(uint(userID), uint(roleID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Role removed successfully")
 }
@@ -2,12 +2,17 @@ package controller
 
 import (
 	"context"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/oauth2"
@@ -48,7 +53,14 @@ func getGoogleOAuthConfig() *oauth2.Config {
 	return googleOauthConfig
 }
 
-const oauthStateString = "random-string-for-security"
+// oauthStateTTL is how long the user has to finish signing in at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// socialLinkTTL is how long a provider account can be linked after its callback
+const socialLinkTTL = 15 * time.Minute
+
+// oauthLinkTicketTTL is how long the URL from StartGoogleLink can be opened
+const oauthLinkTicketTTL = time.Minute
 
 type SocialController struct {
 	socialAuthService *service.SocialAuthService
@@ -62,34 +74,86 @@ func NewSocialController(sas *service.SocialAuthService, as *service.AuthService
 	}
 }
 
+// StartGoogleLink returns the URL a logged-in user opens to link their Google account. The
+// ticket in it names the user, so the callback links the account without another token.
+func (c *SocialController) StartGoogleLink(ctx *fiber.Ctx) error {
+	userID := ctx.Locals("user_id").(uint)
+
+	ticket, err := helper.EncodeOAuthLinkTicket(&helper.OAuthLinkTicket{
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(oauthLinkTicketTTL).Unix(),
+	})
+	if err != nil {
+		return helper.Message500("Failed to start linking")
+	}
+
+	linkURL := fmt.Sprintf("%s/api/auth/google/login?mode=%s&ticket=%s", ctx.BaseURL(), helper.OAuthModeLink, url.QueryEscape(ticket))
+	return helper.Message200(ctx, fiber.Map{"url": linkURL}, "Link started successfully")
+}
+
+// GoogleLogin redirects to Google. A fresh state and PKCE verifier are kept in a signed cookie
+// for the callback. With ?mode=link and a ticket from StartGoogleLink the callback links the
+// Google account to the user of the ticket instead of signing in.
 func (c *SocialController) GoogleLogin(ctx *fiber.Ctx) error {
+	mode := helper.OAuthModeLogin
+	var linkUserID uint
+	if ctx.Query("mode") == helper.OAuthModeLink {
+		ticket, err := helper.DecodeOAuthLinkTicket(ctx.Query("ticket"))
+		if err != nil {
+			return ctx.Redirect(helper.BuildOAuthErrorURL("link_not_authorized"))
+		}
+		mode = helper.OAuthModeLink
+		linkUserID = ticket.UserID
+	}
+
+	state, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return ctx.Redirect(helper.BuildOAuthErrorURL("state_generation_failed"))
+	}
+
 	config := getGoogleOAuthConfig()
-	url := config.AuthCodeURL(oauthStateString)
-	log.Printf("Generated Google OAuth URL: %s", url)
-	log.Printf("Expected callback URL: %s", config.RedirectURL)
-	return ctx.Redirect(url)
+	oauthState := &helper.OAuthState{
+		State:     state,
+		Verifier:  oauth2.GenerateVerifier(),
+		Mode:      mode,
+		UserID:    linkUserID,
+		ExpiresAt: time.Now().Add(oauthStateTTL).Unix(),
+	}
+	cookieValue, err := helper.EncodeOAuthState(oauthState)
+	if err != nil {
+		return ctx.Redirect(helper.BuildOAuthErrorURL("state_generation_failed"))
+	}
+	setOAuthStateCookie(ctx, config, cookieValue, oauthStateTTL)
+
+	return ctx.Redirect(config.AuthCodeURL(state, oauth2.S256ChallengeOption(oauthState.Verifier)))
 }
 
 func (c *SocialController) GoogleCallback(ctx *fiber.Ctx) error {
-	log.Printf("GoogleCallback called with URL: %s", ctx.OriginalURL())
-	log.Printf("State received: %s", ctx.Query("state"))
-	log.Printf("Code received: %s", ctx.Query("code"))
+	config := getGoogleOAuthConfig()
 
-	if ctx.Query("state") != oauthStateString {
-		log.Printf("State mismatch! Expected: %s, Got: %s", oauthStateString, ctx.Query("state"))
+	// The cookie is single use, whatever the outcome
+	cookieValue := ctx.Cookies(helper.OAuthStateCookie)
+	setOAuthStateCookie(ctx, config, "", -time.Hour)
+
+	oauthState, err := helper.DecodeOAuthState(cookieValue)
+	if err != nil || !hmac.Equal([]byte(oauthState.State), []byte(ctx.Query("state"))) {
+		log.Printf("OAuth state mismatch or missing state cookie")
 		errorURL := helper.BuildOAuthErrorURL("invalid_state")
 		return ctx.Redirect(errorURL)
 	}
 
-	config := getGoogleOAuthConfig()
-	token, err := config.Exchange(context.Background(), ctx.Query("code"))
+	if errorType := ctx.Query("error"); errorType != "" {
+		return ctx.Redirect(helper.BuildOAuthErrorURL(errorType))
+	}
+
+	token, err := config.Exchange(context.Background(), ctx.Query("code"), oauth2.VerifierOption(oauthState.Verifier))
 	if err != nil {
 		log.Printf("Failed to exchange token: %v", err)
 		errorURL := helper.BuildOAuthErrorURL("token_exchange_failed")
 		return ctx.Redirect(errorURL)
 	}
 
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	response, err := config.Client(context.Background(), token).Get("https://www.googleapis.com/oauth2/v2/userinfo")
 	if err != nil {
 		log.Printf("Failed to get user info: %v", err)
 		errorURL := helper.BuildOAuthErrorURL("user_info_failed")
@@ -105,56 +169,155 @@ func (c *SocialController) GoogleCallback(ctx *fiber.Ctx) error {
 	}
 
 	var userInfo struct {
-		ID    string `json:"id"`
-		Email string `json:"email"`
-		Name  string `json:"name"`
+		ID            string `json:"id"`
+		Email         string `json:"email"`
+		VerifiedEmail bool   `json:"verified_email"`
+		Name          string `json:"name"`
 	}
-	if err := json.Unmarshal(contents, &userInfo); err != nil {
+	if err := json.Unmarshal(contents, &userInfo); err != nil || userInfo.ID == "" {
 		log.Printf("Failed to parse user info: %v", err)
 		errorURL := helper.BuildOAuthErrorURL("user_info_parse_failed")
 		return ctx.Redirect(errorURL)
 	}
 
-	user, err := c.socialAuthService.HandleProviderCallback("google", userInfo.ID, userInfo.Name, userInfo.Email)
+	// The state cookie binds a link flow to the browser and user that started it
+	if oauthState.Mode == helper.OAuthModeLink {
+		if oauthState.UserID == 0 {
+			return ctx.Redirect(helper.BuildOAuthErrorURL("link_not_authorized"))
+		}
+		if _, err := c.socialAuthService.LinkProvider(oauthState.UserID, "google", userInfo.ID, userInfo.Email); err != nil {
+			if errors.Is(err, service.ErrProviderLinkedElsewhere) || errors.Is(err, service.ErrProviderAlreadyLinked) {
+				return ctx.Redirect(helper.BuildOAuthErrorURL("already_linked"))
+			}
+			return ctx.Redirect(helper.BuildOAuthErrorURL("user_processing_failed"))
+		}
+		return ctx.Redirect(helper.BuildOAuthLinkedURL("google"))
+	}
+
+	user, err := c.socialAuthService.HandleProviderCallback("google", userInfo.ID, userInfo.Name, userInfo.Email, userInfo.VerifiedEmail)
+	if errors.Is(err, service.ErrSocialLinkRequired) {
+		return c.redirectToLink(ctx, userInfo.ID, userInfo.Email)
+	}
 	if err != nil {
 		log.Printf("Error in HandleProviderCallback: %v", err)
 		errorURL := helper.BuildOAuthErrorURL("user_processing_failed")
 		return ctx.Redirect(errorURL)
 	}
 
-	jwtToken, err := c.authService.GenerateTokenForUser(user.ID, user.Email)
+	// The tokens, or the mfa_pending token of two-factor users, are issued when the frontend
+	// exchanges the code, so they never appear in a URL
+	code, err := c.authService.TokenService.IssueOAuthLoginCode(user.ID)
 	if err != nil {
-		log.Printf("Token generation failed: %v", err)
+		log.Printf("Login code generation failed: %v", err)
 		errorURL := helper.BuildOAuthErrorURL("token_generation_failed")
 		return ctx.Redirect(errorURL)
 	}
 
-	// Redirect to frontend with success data
-	redirectURL := helper.BuildOAuthSuccessURL(jwtToken, user.ID, user.Name, user.Email)
-	log.Printf("Redirecting to frontend: %s", redirectURL)
-	return ctx.Redirect(redirectURL)
+	return ctx.Redirect(helper.BuildOAuthSuccessURL(code))
+}
+
+// ExchangeOAuthCode returns the tokens of a social login for the single-use code from the
+// success redirect, or the mfa_pending token when the user has two-factor authentication
+func (c *SocialController) ExchangeOAuthCode(ctx *fiber.Ctx) error {
+	code := ctx.FormValue("code")
+	if code == "" {
+		return helper.Message400("Code is required")
+	}
+
+	result, err := c.authService.ExchangeOAuthLoginCode(code, clientInfoFromCtx(ctx))
+	if err != nil {
+		return helper.Message401(err.Error())
+	}
+
+	return loginResponse(ctx, result)
+}
+
+// redirectToLink sends the frontend a link token for the provider account. The owner of the
+// account with that email links it with /api/auth/social/link after signing in, confirming with
+// their password.
+func (c *SocialController) redirectToLink(ctx *fiber.Ctx, providerID, email string) error {
+	linkToken, err := helper.EncodeSocialLinkToken(&helper.SocialLinkToken{
+		Provider:   "google",
+		ProviderID: providerID,
+		Email:      email,
+		ExpiresAt:  time.Now().Add(socialLinkTTL).Unix(),
+	})
+	if err != nil {
+		return ctx.Redirect(helper.BuildOAuthErrorURL("user_processing_failed"))
+	}
+	return ctx.Redirect(helper.BuildOAuthLinkURL(linkToken, "google", email))
+}
+
+// setOAuthStateCookie stores the signed OAuth state for the callback. SameSite=Lax lets the
+// cookie come along on the provider's top-level redirect back to us.
+func setOAuthStateCookie(ctx *fiber.Ctx, config *oauth2.Config, value string, maxAge time.Duration) {
+	ctx.Cookie(&fiber.Cookie{
+		Name:     helper.OAuthStateCookie,
+		Value:    value,
+		Path:     "/api/auth/google",
+		MaxAge:   int(maxAge.Seconds()),
+		Expires:  time.Now().Add(maxAge),
+		Secure:   strings.HasPrefix(config.RedirectURL, "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// ListProviders returns the social logins connected to the account
+func (c *SocialController) ListProviders(ctx *fiber.Ctx) error {
+	userID := ctx.Locals("user_id").(uint)
+
+	providers, err := c.socialAuthService.ListProviders(userID)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(ctx, providers, "Linked providers retrieved successfully")
+}
+
+// LinkProvider connects the provider account of a link token to the logged-in user, who confirms
+// with their password
+func (c *SocialController) LinkProvider(ctx *fiber.Ctx) error {
+	userID := ctx.Locals("user_id").(uint)
+
+	linkToken := ctx.FormValue("link_token")
+	if linkToken == "" {
+		return helper.Message400("Link token is required")
+	}
+
+	provider, err := c.socialAuthService.LinkWithToken(userID, linkToken, ctx.FormValue("password"))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(ctx, provider, "Provider linked successfully")
+}
+
+// UnlinkProvider disconnects a social login from the account
+func (c *SocialController) UnlinkProvider(ctx *fiber.Ctx) error {
+	userID := ctx.Locals("user_id").(uint)
+
+	if err := c.socialAuthService.UnlinkProvider(userID, ctx.Params("provider")); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(ctx, nil, "Provider unlinked successfully")
 }
 
 // OAuthSuccess handles successful OAuth redirects with query parameters
 func (c *SocialController) OAuthSuccess(ctx *fiber.Ctx) error {
-	token := ctx.Query("token")
-	userID := ctx.Query("user_id")
-	userName := ctx.Query("user_name")
-	userEmail := ctx.Query("user_email")
+	code := ctx.Query("code")
 
-	if token == "" {
+	if code == "" {
 		return ctx.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Missing token parameter",
+			"error": "Missing code parameter",
 		})
 	}
 
 	return ctx.JSON(fiber.Map{
-		"success":    true,
-		"message":    "OAuth authentication successful",
-		"token":      token,
-		"user_id":    userID,
-		"user_name":  userName,
-		"user_email": userEmail,
+		"success": true,
+		"message": "OAuth authentication successful, exchange the code with POST /api/auth/oauth/exchange",
+		"code":    code,
 	})
 }
 
@@ -1,8 +1,11 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"synergazing.com/synergazing/helper"
@@ -47,9 +50,9 @@ func (ctrl *AuthController) InitiateRegistration(c *fiber.Ctx) error {
 		return helper.Message400(fmt.Sprintf("Missing required fields: %s", strings.Join(missingFields, ", ")))
 	}
 
-	err := ctrl.AuthService.InitiateRegistration(name, email, password, phone)
+	err := ctrl.AuthService.InitiateRegistration(name, email, password, phone, c.IP())
 	if err != nil {
-		return helper.Message400(err.Error())
+		return otpErrorResponse(c, err)
 	}
 
 	return helper.Message200(c, nil, "OTP sent to your email. Please verify to complete registration.")
@@ -90,14 +93,16 @@ func (ctrl *AuthController) CompleteRegistration(c *fiber.Ctx) error {
 		return helper.Message400(err.Error())
 	}
 
-	token, err := ctrl.AuthService.GenerateTokenForUser(user.ID, user.Email)
+	tokens, err := ctrl.AuthService.IssueTokensForUser(user.ID, user.Email, clientInfoFromCtx(c))
 	if err != nil {
 		return helper.Message500("Token generation failed")
 	}
 
 	return helper.Message201(c, fiber.Map{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	}, "Registration completed successfully")
 }
 
@@ -131,14 +136,16 @@ func (ctrl *AuthController) Register(c *fiber.Ctx) error {
 		return helper.Message400(err.Error())
 	}
 
-	token, err := ctrl.AuthService.GenerateTokenForUser(user.ID, user.Email)
+	tokens, err := ctrl.AuthService.IssueTokensForUser(user.ID, user.Email, clientInfoFromCtx(c))
 	if err != nil {
 		return helper.Message500("Token generation failed")
 	}
 
 	return helper.Message201(c, fiber.Map{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 	}, "User registered successfully (direct registration)")
 }
 
@@ -150,15 +157,112 @@ func (ctrl *AuthController) Login(c *fiber.Ctx) error {
 		return helper.Message400("Email and password are required")
 	}
 
-	token, user, err := ctrl.AuthService.Login(email, password)
+	result, err := ctrl.AuthService.Login(email, password, clientInfoFromCtx(c))
+	if err != nil {
+		return loginErrorResponse(c, err)
+	}
+
+	return loginResponse(c, result)
+}
+
+// VerifyTwoFactorLogin finishes a login with the mfa_pending token and a code from the
+// authenticator app or a backup code
+func (ctrl *AuthController) VerifyTwoFactorLogin(c *fiber.Ctx) error {
+	mfaToken := c.FormValue("mfa_token")
+	code := c.FormValue("code")
+
+	if mfaToken == "" || code == "" {
+		return helper.Message400("MFA token and code are required")
+	}
+
+	result, err := ctrl.AuthService.VerifyTwoFactorLogin(mfaToken, code, clientInfoFromCtx(c))
+	if err != nil {
+		return loginErrorResponse(c, err)
+	}
+
+	return loginResponse(c, result)
+}
+
+// RequestTwoFactorResetCode emails a code to log in without the authenticator app
+func (ctrl *AuthController) RequestTwoFactorResetCode(c *fiber.Ctx) error {
+	mfaToken := c.FormValue("mfa_token")
+	if mfaToken == "" {
+		return helper.Message400("MFA token is required")
+	}
+
+	if err := ctrl.AuthService.TwoFactor.RequestLoginResetCode(mfaToken, c.IP()); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return helper.Message200(c, nil, "Verification code sent to your email")
+}
+
+// ResetTwoFactorLogin turns two-factor authentication off with the emailed code and logs the user in
+func (ctrl *AuthController) ResetTwoFactorLogin(c *fiber.Ctx) error {
+	mfaToken := c.FormValue("mfa_token")
+	otpCode := c.FormValue("otp_code")
+
+	if mfaToken == "" || otpCode == "" {
+		return helper.Message400("MFA token and OTP code are required")
+	}
+
+	result, err := ctrl.AuthService.ResetTwoFactorLogin(mfaToken, otpCode, clientInfoFromCtx(c))
+	if err != nil {
+		return loginErrorResponse(c, err)
+	}
+
+	return loginResponse(c, result)
+}
+
+// RefreshToken exchanges a refresh token for a new access/refresh token pair
+func (ctrl *AuthController) RefreshToken(c *fiber.Ctx) error {
+	refreshToken := c.FormValue("refresh_token")
+	if refreshToken == "" {
+		return helper.Message400("Refresh token is required")
+	}
+
+	tokens, err := ctrl.AuthService.RefreshTokens(refreshToken, clientInfoFromCtx(c))
 	if err != nil {
 		return helper.Message401(err.Error())
 	}
 
 	return helper.Message200(c, fiber.Map{
-		"user":  user,
-		"token": token,
-	}, "Login Successful")
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	}, "Token refreshed successfully")
+}
+
+// GetSessions lists the devices the authenticated user is logged in on
+func (ctrl *AuthController) GetSessions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	var currentSessionID uint
+	if claims, ok := c.Locals("token_claims").(*helper.Claims); ok {
+		currentSessionID = claims.SessionID
+	}
+
+	sessions, err := ctrl.AuthService.GetActiveSessions(userID, currentSessionID)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, sessions, "Active sessions retrieved successfully")
+}
+
+// RevokeSession logs the authenticated user out of a single device
+func (ctrl *AuthController) RevokeSession(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	sessionID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid session ID")
+	}
+
+	if err := ctrl.AuthService.RevokeSession(userID, uint(sessionID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Session revoked successfully")
 }
 
 func (ctrl *AuthController) Logout(c *fiber.Ctx) error {
@@ -166,9 +270,7 @@ func (ctrl *AuthController) Logout(c *fiber.Ctx) error {
 	if token == "" {
 		return helper.Message400("No token provided")
 	}
-	if len(token) > 7 && token[:7] == "Bearer" {
-		token = token[:7]
-	}
+	token = strings.TrimPrefix(token, "Bearer ")
 
 	err := ctrl.AuthService.Logout(token)
 	if err != nil {
@@ -180,6 +282,18 @@ func (ctrl *AuthController) Logout(c *fiber.Ctx) error {
 	})
 }
 
+// LogoutAllDevices revokes every token issued to the authenticated user
+func (ctrl *AuthController) LogoutAllDevices(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	claims, _ := c.Locals("token_claims").(*helper.Claims)
+
+	if err := ctrl.AuthService.LogoutAllDevices(userID, claims); err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Logged out of all devices")
+}
+
 func (ctrl *AuthController) ForgotPassword(c *fiber.Ctx) error {
 	email := c.FormValue("email")
 	if email == "" {
@@ -203,7 +317,7 @@ func (ctrl *AuthController) ResetPassword(c *fiber.Ctx) error {
 		return helper.Message400("All fields are required")
 	}
 
-	err := ctrl.AuthService.ResetPassword(token, password, passwordConfirm)
+	err := ctrl.AuthService.ResetPassword(token, password, passwordConfirm, clientInfoFromCtx(c))
 	if err != nil {
 		return helper.Message400(err.Error())
 	}
@@ -211,6 +325,33 @@ func (ctrl *AuthController) ResetPassword(c *fiber.Ctx) error {
 	return helper.Message200(c, nil, "Password has been reset successfully.")
 }
 
+// ChangePassword sets a new password for the authenticated user after checking the current one.
+// The current session stays logged in, all others are signed out.
+func (ctrl *AuthController) ChangePassword(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	claims, _ := c.Locals("token_claims").(*helper.Claims)
+
+	currentPassword := c.FormValue("current_password")
+	password := c.FormValue("password")
+	passwordConfirm := c.FormValue("passwordConfirm")
+
+	if currentPassword == "" || password == "" || passwordConfirm == "" {
+		return helper.Message400("All fields are required")
+	}
+
+	var sessionID uint
+	if claims != nil {
+		sessionID = claims.SessionID
+	}
+
+	err := ctrl.AuthService.ChangePassword(userID, sessionID, currentPassword, password, passwordConfirm, clientInfoFromCtx(c))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Password changed successfully. You have been logged out of all other devices.")
+}
+
 // ResendOTP resends OTP for the given email and purpose
 func (ctrl *AuthController) ResendOTP(c *fiber.Ctx) error {
 	email := c.FormValue("email")
@@ -225,9 +366,9 @@ func (ctrl *AuthController) ResendOTP(c *fiber.Ctx) error {
 		return helper.Message400("Invalid purpose. Must be 'registration' or 'password_reset'")
 	}
 
-	err := ctrl.AuthService.ResendOTP(email, purpose)
+	err := ctrl.AuthService.ResendOTP(email, purpose, c.IP())
 	if err != nil {
-		return helper.Message400(err.Error())
+		return otpErrorResponse(c, err)
 	}
 
 	return helper.Message200(c, nil, "OTP resent successfully")
@@ -306,9 +447,9 @@ func (ctrl *AuthController) RequestEmailVerification(c *fiber.Ctx) error {
 		return helper.Message400("Email is required")
 	}
 
-	err := ctrl.AuthService.ResendOTP(email, "registration")
+	err := ctrl.AuthService.ResendOTP(email, "registration", c.IP())
 	if err != nil {
-		return helper.Message400(err.Error())
+		return otpErrorResponse(c, err)
 	}
 
 	return helper.Message200(c, nil, "Verification email sent")
@@ -332,3 +473,52 @@ func (ctrl *AuthController) GetUserVerificationStatus(c *fiber.Ctx) error {
 		"is_email_verified": status,
 	}, "Email verification status retrieved")
 }
+
+// loginResponse returns the tokens of a finished login, or the mfa_pending token when a
+// second factor is needed
+func loginResponse(c *fiber.Ctx, result *service.LoginResult) error {
+	if result.MFARequired() {
+		return helper.Message200(c, fiber.Map{
+			"mfa_required": true,
+			"token_type":   "mfa_pending",
+			"mfa_token":    result.MFAToken,
+			"expires_in":   int64(time.Until(result.MFAExpiresAt).Seconds()),
+			"methods":      []string{"totp", "backup_code", "email"},
+		}, "Two-factor authentication required")
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"user":          result.User,
+		"token":         result.Tokens.AccessToken,
+		"refresh_token": result.Tokens.RefreshToken,
+		"expires_in":    result.Tokens.ExpiresIn,
+	}, "Login Successful")
+}
+
+// loginErrorResponse answers a failed login step, with 429 while the account is locked
+func loginErrorResponse(c *fiber.Ctx, err error) error {
+	var locked *service.AccountLockedError
+	if errors.As(err, &locked) {
+		return helper.Message429(c, "Too many failed login attempts, your account is temporarily locked. Please try again later or reset your password.", locked.RetryAfter())
+	}
+	return helper.Message401(err.Error())
+}
+
+// otpErrorResponse answers throttled code requests with 429 and the remaining wait, so the
+// frontend can show a countdown; other errors are a plain 400
+func otpErrorResponse(c *fiber.Ctx, err error) error {
+	var throttled *service.OTPThrottleError
+	if errors.As(err, &throttled) {
+		return helper.Message429(c, throttled.Message, throttled.RetryAfter)
+	}
+	return helper.Message400(err.Error())
+}
+
+// clientInfoFromCtx collects the device details stored with a new session
+func clientInfoFromCtx(c *fiber.Ctx) service.ClientInfo {
+	return service.ClientInfo{
+		DeviceName: c.FormValue("device_name"),
+		UserAgent:  c.Get("User-Agent"),
+		IPAddress:  c.IP(),
+	}
+}
@@ -1,28 +1,35 @@
 package controller
 
 import (
+	"errors"
 	"log"
+	"mime"
+	"os"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
 	"synergazing.com/synergazing/service"
 )
 
 type ChatController struct {
-	ChatService *service.ChatService
-	connections map[uint]*websocket.Conn // userID -> connection
-	mutex       sync.RWMutex
+	ChatService     *service.ChatService
+	TokenService    *service.TokenService
+	PresenceService *service.PresenceService
+	Hub             service.ChatHub
 }
 
 type WebSocketMessage struct {
-	Type    string      `json:"type"`
-	ChatID  uint        `json:"chat_id,omitempty"`
-	Content string      `json:"content,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	Type             string      `json:"type"`
+	ChatID           uint        `json:"chat_id,omitempty"`
+	Content          string      `json:"content,omitempty"`
+	ReplyToMessageID *uint       `json:"reply_to_message_id,omitempty"`
+	AttachmentIDs    []uint      `json:"attachment_ids,omitempty"`
+	Data             interface{} `json:"data,omitempty"`
 }
 
 type MessageResponse struct {
@@ -32,91 +39,183 @@ type MessageResponse struct {
 	Content   string `json:"content"`
 	IsRead    bool   `json:"is_read"`
 	CreatedAt string `json:"created_at"`
-	Sender    struct {
+	// Set once a recipient received / read the message, announced with message_receipt events
+	DeliveredAt      *time.Time                `json:"delivered_at"`
+	ReadAt           *time.Time                `json:"read_at"`
+	EditedAt         *time.Time                `json:"edited_at"`
+	DeletedAt        *time.Time                `json:"deleted_at"`
+	ReplyToMessageID *uint                     `json:"reply_to_message_id"`
+	ReplyTo          *MessageReplyPreview      `json:"reply_to,omitempty"`
+	Attachments      []model.MessageAttachment `json:"attachments"`
+	Sender           struct {
 		ID     uint   `json:"id"`
 		Name   string `json:"name"`
 		Avatar string `json:"avatar,omitempty"`
 	} `json:"sender"`
 }
 
-func NewChatController(chatService *service.ChatService) *ChatController {
+// MessageReplyPreview is the quoted message shown above a reply
+type MessageReplyPreview struct {
+	ID         uint       `json:"id"`
+	SenderID   uint       `json:"sender_id"`
+	SenderName string     `json:"sender_name"`
+	Content    string     `json:"content"`
+	DeletedAt  *time.Time `json:"deleted_at"`
+}
+
+func newMessageResponse(message *model.Message) MessageResponse {
+	response := MessageResponse{
+		ID:               message.ID,
+		ChatID:           message.ChatID,
+		SenderID:         message.SenderID,
+		Content:          message.Content,
+		IsRead:           message.IsRead,
+		CreatedAt:        message.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		DeliveredAt:      message.DeliveredAt,
+		ReadAt:           message.ReadAt,
+		EditedAt:         message.EditedAt,
+		DeletedAt:        message.DeletedAt,
+		ReplyToMessageID: message.ReplyToMessageID,
+		Attachments:      message.Attachments,
+	}
+	if response.Attachments == nil {
+		response.Attachments = []model.MessageAttachment{}
+	}
+
+	response.Sender.ID = message.Sender.ID
+	response.Sender.Name = message.Sender.Name
+	if message.Sender.Profile != nil {
+		response.Sender.Avatar = helper.GetUrlFile(message.Sender.Profile.ProfilePicture)
+	}
+
+	if message.ReplyTo != nil {
+		response.ReplyTo = &MessageReplyPreview{
+			ID:         message.ReplyTo.ID,
+			SenderID:   message.ReplyTo.SenderID,
+			SenderName: message.ReplyTo.Sender.Name,
+			Content:    message.ReplyTo.Content,
+			DeletedAt:  message.ReplyTo.DeletedAt,
+		}
+	}
+
+	return response
+}
+
+func NewChatController(chatService *service.ChatService, tokenService *service.TokenService, presenceService *service.PresenceService, hub service.ChatHub) *ChatController {
 	return &ChatController{
-		ChatService: chatService,
-		connections: make(map[uint]*websocket.Conn),
+		ChatService:     chatService,
+		TokenService:    tokenService,
+		PresenceService: presenceService,
+		Hub:             hub,
 	}
 }
 
-// WebSocket upgrade handler
+// ChatTokenSubprotocol is the Sec-WebSocket-Protocol value that marks the next protocol
+// entry as an access token, e.g. new WebSocket(url, ["access_token", jwt])
+const ChatTokenSubprotocol = "access_token"
+
+// chatDevModeEnabled allows connecting with a bare user_id query parameter. It needs both
+// CHAT_WS_DEV_MODE=true and APP_ENV=development so it can never be switched on in production by accident.
+func chatDevModeEnabled() bool {
+	return os.Getenv("CHAT_WS_DEV_MODE") == "true" && os.Getenv("APP_ENV") == "development"
+}
+
+// WebSocket upgrade handler, authenticates the connection before upgrading it
 func (ctrl *ChatController) WebSocketUpgrade(c *fiber.Ctx) error {
 	// Check if the request is a WebSocket upgrade
-	if websocket.IsWebSocketUpgrade(c) {
-		c.Locals("allowed", true)
-		return c.Next()
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+
+	userID, err := ctrl.authenticateWebSocket(c)
+	if err != nil {
+		log.Printf("Rejected WebSocket connection from %s: %v", c.IP(), err)
+		return helper.Message401(err.Error())
+	}
+
+	c.Locals("allowed", true)
+	c.Locals("user_id", userID)
+	return c.Next()
+}
+
+// authenticateWebSocket resolves the connecting user from a JWT sent in the
+// Sec-WebSocket-Protocol header or from a one-time ticket in the query string
+func (ctrl *ChatController) authenticateWebSocket(c *fiber.Ctx) (uint, error) {
+	if token := webSocketProtocolToken(c.Get("Sec-WebSocket-Protocol")); token != "" {
+		claims, err := ctrl.TokenService.ValidateToken(token)
+		if err != nil {
+			return 0, errors.New("invalid or expired token")
+		}
+		return claims.UserID, nil
+	}
+
+	if ticket := c.Query("ticket"); ticket != "" {
+		return ctrl.TokenService.RedeemWebSocketTicket(ticket)
+	}
+
+	if chatDevModeEnabled() {
+		if userID, err := strconv.ParseUint(c.Query("user_id"), 10, 32); err == nil && userID > 0 {
+			log.Printf("User %d connected via chat dev mode without authentication", userID)
+			return uint(userID), nil
+		}
 	}
-	return fiber.ErrUpgradeRequired
+
+	return 0, errors.New("authentication required")
+}
+
+// webSocketProtocolToken returns the token that follows ChatTokenSubprotocol in the header
+func webSocketProtocolToken(header string) string {
+	protocols := strings.Split(header, ",")
+	for i, protocol := range protocols {
+		if strings.TrimSpace(protocol) == ChatTokenSubprotocol && i+1 < len(protocols) {
+			return strings.TrimSpace(protocols[i+1])
+		}
+	}
+	return ""
 }
 
+// chatPingInterval is how often the server pings a chat connection. It is shorter than the
+// read deadline, so an idle but open connection stays alive and online.
+const chatPingInterval = 30 * time.Second
+
 // WebSocket connection handler
 func (ctrl *ChatController) HandleWebSocket(c *websocket.Conn) {
 	// Set connection timeouts
 	c.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	c.SetPongHandler(func(string) error {
-		c.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
-	})
-
-	// Get user ID and token from query params
-	userIDStr := c.Query("user_id")
-	token := c.Query("token")
 
-	if userIDStr == "" {
-		log.Println("No user_id provided in WebSocket connection")
+	// The user was authenticated by WebSocketUpgrade
+	currentUserID, ok := c.Locals("user_id").(uint)
+	if !ok || currentUserID == 0 {
+		log.Println("WebSocket connection without an authenticated user")
 		c.Close()
 		return
 	}
 
-	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	// Register connection; a user may be connected from several devices at once
+	client := ctrl.Hub.Register(currentUserID, c)
+
+	// Track presence across instances
+	connectionID, cameOnline, err := ctrl.PresenceService.Connect(currentUserID)
 	if err != nil {
-		log.Printf("Invalid user_id: %s", userIDStr)
-		c.Close()
-		return
+		log.Printf("Error recording presence for user %d: %v", currentUserID, err)
 	}
 
-	currentUserID := uint(userID)
+	// Remove connection on close
+	defer func() {
+		ctrl.Hub.Unregister(client)
+		c.Close()
 
-	// If token is provided, verify it
-	if token != "" {
-		claims, err := helper.VerifyJWTToken(token)
-		if err != nil {
-			log.Printf("Invalid JWT token for user %d: %v", currentUserID, err)
-			c.Close()
+		if connectionID == "" {
 			return
 		}
-
-		// Verify the token belongs to the user
-		if claims.UserID != currentUserID {
-			log.Printf("Token user ID mismatch: token=%d, provided=%d", claims.UserID, currentUserID)
-			c.Close()
-			return
+		wentOffline, lastSeen, err := ctrl.PresenceService.Disconnect(currentUserID, connectionID)
+		if err != nil {
+			log.Printf("Error recording disconnect for user %d: %v", currentUserID, err)
+		}
+		if wentOffline {
+			ctrl.broadcastPresence(model.UserPresence{UserID: currentUserID, Status: model.PresenceOffline, LastSeenAt: &lastSeen})
 		}
-
-		log.Printf("User %d authenticated via JWT token", currentUserID)
-	} else {
-		log.Printf("User %d connected without token (test mode)", currentUserID)
-	}
-
-	// Store connection
-	ctrl.mutex.Lock()
-	ctrl.connections[currentUserID] = c
-	ctrl.mutex.Unlock()
-
-	// Remove connection on close
-	defer func() {
-		ctrl.mutex.Lock()
-		delete(ctrl.connections, currentUserID)
-		ctrl.mutex.Unlock()
-		c.Close()
 	}()
 
 	log.Printf("User %d connected to WebSocket", currentUserID)
@@ -124,9 +223,57 @@ func (ctrl *ChatController) HandleWebSocket(c *websocket.Conn) {
 	// Send welcome message
 	welcomeMsg := WebSocketMessage{
 		Type: "connected",
-		Data: fiber.Map{"message": "Connected to chat server"},
+		Data: fiber.Map{"message": "Connected to chat server", "user_id": currentUserID},
 	}
-	ctrl.sendToUser(currentUserID, welcomeMsg)
+	client.Send(welcomeMsg)
+
+	if cameOnline {
+		ctrl.broadcastPresence(model.UserPresence{UserID: currentUserID, Status: model.PresenceOnline})
+	}
+
+	// Everything sent while the user was offline has now reached them
+	receipts, err := ctrl.ChatService.MarkAllMessagesDelivered(currentUserID)
+	if err != nil {
+		log.Printf("Error marking messages delivered for user %d: %v", currentUserID, err)
+	}
+	ctrl.sendReceipts(receipts)
+
+	// Keep the connection counted as online. Called from the read loop and the pong handler,
+	// which runs on the same goroutine while reading.
+	lastTouch := time.Now()
+	touchPresence := func() {
+		if connectionID != "" && time.Since(lastTouch) > service.PresenceTouchInterval {
+			if err := ctrl.PresenceService.Touch(connectionID); err != nil {
+				log.Printf("Error refreshing presence for user %d: %v", currentUserID, err)
+			}
+			lastTouch = time.Now()
+		}
+	}
+
+	c.SetPongHandler(func(string) error {
+		c.SetReadDeadline(time.Now().Add(60 * time.Second))
+		touchPresence()
+		return nil
+	})
+
+	// Ping the client so a connection without chat activity is still refreshed. WriteControl
+	// may be called concurrently with the hub's writes.
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go func() {
+		ticker := time.NewTicker(chatPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPing:
+				return
+			case <-ticker.C:
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}()
 
 	// Handle incoming messages
 	for {
@@ -139,6 +286,8 @@ func (ctrl *ChatController) HandleWebSocket(c *websocket.Conn) {
 		// Reset read deadline on any message
 		c.SetReadDeadline(time.Now().Add(60 * time.Second))
 
+		touchPresence()
+
 		switch msg.Type {
 		case "ping":
 			// Respond with pong
@@ -146,78 +295,121 @@ func (ctrl *ChatController) HandleWebSocket(c *websocket.Conn) {
 				Type: "pong",
 				Data: fiber.Map{"timestamp": time.Now().Unix()},
 			}
-			ctrl.sendToUser(currentUserID, pongMsg)
+			client.Send(pongMsg)
 		case "send_message":
-			ctrl.handleSendMessage(currentUserID, msg)
+			ctrl.handleSendMessage(client, msg)
 		case "join_chat":
-			ctrl.handleJoinChat(currentUserID, msg)
+			ctrl.handleJoinChat(client, msg)
 		case "mark_read":
-			ctrl.handleMarkRead(currentUserID, msg)
+			ctrl.handleMarkRead(client, msg)
+		case "typing_start", "typing_stop":
+			ctrl.handleTyping(client, msg)
 		default:
 			log.Printf("Unknown message type: %s", msg.Type)
 		}
 	}
 }
 
-func (ctrl *ChatController) handleSendMessage(userID uint, msg WebSocketMessage) {
-	if msg.ChatID == 0 || msg.Content == "" {
-		ctrl.sendError(userID, "Invalid message data")
+func (ctrl *ChatController) handleSendMessage(client service.ChatClient, msg WebSocketMessage) {
+	userID := client.UserID()
+	if msg.ChatID == 0 || (msg.Content == "" && len(msg.AttachmentIDs) == 0) {
+		ctrl.sendError(client, "Invalid message data")
 		return
 	}
 
 	// Send message via service
-	message, err := ctrl.ChatService.SendMessage(msg.ChatID, userID, msg.Content)
+	message, err := ctrl.ChatService.SendMessage(msg.ChatID, userID, msg.Content, msg.ReplyToMessageID, msg.AttachmentIDs)
 	if err != nil {
-		ctrl.sendError(userID, err.Error())
+		ctrl.sendError(client, err.Error())
 		return
 	}
 
-	// Create response
-	response := MessageResponse{
-		ID:        message.ID,
-		ChatID:    message.ChatID,
-		SenderID:  message.SenderID,
-		Content:   message.Content,
-		IsRead:    message.IsRead,
-		CreatedAt: message.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
-		Sender: struct {
-			ID     uint   `json:"id"`
-			Name   string `json:"name"`
-			Avatar string `json:"avatar,omitempty"`
-		}{
-			ID:   message.Sender.ID,
-			Name: message.Sender.Name,
-			Avatar: func() string {
-				if message.Sender.Profile != nil {
-					return helper.GetUrlFile(message.Sender.Profile.ProfilePicture)
-				}
-				return ""
-			}(),
-		},
-	}
+	response := newMessageResponse(message)
 
-	// Send to both users in the chat
+	// Send to every participant of the chat
 	ctrl.broadcastToChat(msg.ChatID, WebSocketMessage{
 		Type: "new_message",
 		Data: response,
 	})
+
+	// Recipients that are online received it right away
+	participantIDs, err := ctrl.ChatService.GetChatParticipantIDs(msg.ChatID)
+	if err != nil {
+		log.Printf("Error loading participants of chat %d: %v", msg.ChatID, err)
+		return
+	}
+	for _, participantID := range participantIDs {
+		if participantID == userID || !ctrl.PresenceService.IsOnline(participantID) {
+			continue
+		}
+		receipts, err := ctrl.ChatService.MarkMessagesDelivered(msg.ChatID, participantID)
+		if err != nil {
+			log.Printf("Error marking messages delivered in chat %d: %v", msg.ChatID, err)
+			return
+		}
+		ctrl.sendReceipts(receipts)
+		break
+	}
 }
 
-func (ctrl *ChatController) handleJoinChat(userID uint, msg WebSocketMessage) {
+// handleTyping relays typing_start/typing_stop to the other participants. Nothing is stored;
+// clients should treat typing_start as expired after a few seconds without a new one.
+func (ctrl *ChatController) handleTyping(client service.ChatClient, msg WebSocketMessage) {
+	userID := client.UserID()
 	if msg.ChatID == 0 {
-		ctrl.sendError(userID, "Invalid chat ID")
+		ctrl.sendError(client, "Invalid chat ID")
+		return
+	}
+
+	if !ctrl.ChatService.UserHasAccessToChat(msg.ChatID, userID) {
+		ctrl.sendError(client, "unauthorized access to chat")
+		return
+	}
+
+	// Typing in a blocked direct chat is dropped just like its messages
+	if err := ctrl.ChatService.CheckCanMessage(msg.ChatID, userID); err != nil {
+		return
+	}
+
+	participantIDs, err := ctrl.ChatService.GetChatParticipantIDs(msg.ChatID)
+	if err != nil {
+		log.Printf("Error loading participants of chat %d: %v", msg.ChatID, err)
+		return
+	}
+
+	var recipients []uint
+	for _, participantID := range participantIDs {
+		if participantID != userID {
+			recipients = append(recipients, participantID)
+		}
+	}
+
+	event := WebSocketMessage{
+		Type:   msg.Type,
+		ChatID: msg.ChatID,
+		Data:   fiber.Map{"chat_id": msg.ChatID, "user_id": userID},
+	}
+	if err := ctrl.Hub.SendToUsers(recipients, event); err != nil {
+		log.Printf("Error relaying typing event in chat %d: %v", msg.ChatID, err)
+	}
+}
+
+func (ctrl *ChatController) handleJoinChat(client service.ChatClient, msg WebSocketMessage) {
+	userID := client.UserID()
+	if msg.ChatID == 0 {
+		ctrl.sendError(client, "Invalid chat ID")
 		return
 	}
 
 	// Verify user has access to chat
 	chat, err := ctrl.ChatService.GetChatByID(msg.ChatID, userID)
 	if err != nil {
-		ctrl.sendError(userID, err.Error())
+		ctrl.sendError(client, err.Error())
 		return
 	}
 
 	// Send confirmation
-	ctrl.sendToUser(userID, WebSocketMessage{
+	client.Send(WebSocketMessage{
 		Type: "joined_chat",
 		Data: fiber.Map{
 			"chat_id": chat.ID,
@@ -226,72 +418,75 @@ func (ctrl *ChatController) handleJoinChat(userID uint, msg WebSocketMessage) {
 	})
 }
 
-func (ctrl *ChatController) handleMarkRead(userID uint, msg WebSocketMessage) {
+func (ctrl *ChatController) handleMarkRead(client service.ChatClient, msg WebSocketMessage) {
+	userID := client.UserID()
 	if msg.ChatID == 0 {
-		ctrl.sendError(userID, "Invalid chat ID")
+		ctrl.sendError(client, "Invalid chat ID")
 		return
 	}
 
-	err := ctrl.ChatService.MarkMessagesAsRead(msg.ChatID, userID)
+	receipts, err := ctrl.ChatService.MarkMessagesAsRead(msg.ChatID, userID)
 	if err != nil {
-		ctrl.sendError(userID, err.Error())
+		ctrl.sendError(client, err.Error())
 		return
 	}
 
-	// Notify that messages were marked as read
+	// Notify every connection of the user that messages were marked as read
 	ctrl.sendToUser(userID, WebSocketMessage{
 		Type: "messages_marked_read",
 		Data: fiber.Map{"chat_id": msg.ChatID},
 	})
+	ctrl.sendReceipts(receipts)
 }
 
 func (ctrl *ChatController) sendToUser(userID uint, msg WebSocketMessage) {
-	ctrl.mutex.RLock()
-	conn, exists := ctrl.connections[userID]
-	ctrl.mutex.RUnlock()
-
-	if exists && conn != nil {
-		// Set write deadline
-		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-
-		if err := conn.WriteJSON(msg); err != nil {
-			log.Printf("Error sending message to user %d: %v", userID, err)
-			// Remove failed connection
-			ctrl.mutex.Lock()
-			delete(ctrl.connections, userID)
-			ctrl.mutex.Unlock()
-
-			// Close the connection gracefully
-			conn.Close()
-		}
+	if err := ctrl.Hub.SendToUser(userID, msg); err != nil {
+		log.Printf("Error sending message to user %d: %v", userID, err)
 	}
 }
 
-func (ctrl *ChatController) sendError(userID uint, errorMsg string) {
-	ctrl.sendToUser(userID, WebSocketMessage{
+// sendReceipts pushes delivery and read receipts to the senders of the messages
+func (ctrl *ChatController) sendReceipts(receipts []service.MessageReceipt) {
+	for _, receipt := range receipts {
+		ctrl.sendToUser(receipt.SenderID, WebSocketMessage{
+			Type:   "message_receipt",
+			ChatID: receipt.ChatID,
+			Data:   receipt,
+		})
+	}
+}
+
+// broadcastPresence tells everyone who shares a chat with the user that their presence changed
+func (ctrl *ChatController) broadcastPresence(presence model.UserPresence) {
+	contactIDs, err := ctrl.ChatService.GetContactIDs(presence.UserID)
+	if err != nil {
+		log.Printf("Error loading contacts of user %d: %v", presence.UserID, err)
+		return
+	}
+
+	if err := ctrl.Hub.SendToUsers(contactIDs, WebSocketMessage{Type: "presence", Data: presence}); err != nil {
+		log.Printf("Error broadcasting presence of user %d: %v", presence.UserID, err)
+	}
+}
+
+// sendError replies to the connection that caused the error only
+func (ctrl *ChatController) sendError(client service.ChatClient, errorMsg string) {
+	client.Send(WebSocketMessage{
 		Type: "error",
 		Data: fiber.Map{"error": errorMsg},
 	})
 }
 
 func (ctrl *ChatController) broadcastToChat(chatID uint, msg WebSocketMessage) {
-	// Get chat to find both users
-	// We need to find which users are in this chat
-	// For now, we'll broadcast to all connected users and let them filter
-	// In a production app, you'd want to maintain a chat->users mapping
-
-	ctrl.mutex.RLock()
-	defer ctrl.mutex.RUnlock()
-
-	for userID, conn := range ctrl.connections {
-		if conn != nil {
-			// Check if user has access to this chat
-			if ctrl.ChatService.UserHasAccessToChat(chatID, userID) {
-				if err := conn.WriteJSON(msg); err != nil {
-					log.Printf("Error broadcasting to user %d: %v", userID, err)
-				}
-			}
-		}
+	participantIDs, err := ctrl.ChatService.GetChatParticipantIDs(chatID)
+	if err != nil {
+		log.Printf("Error loading participants of chat %d: %v", chatID, err)
+		return
+	}
+
+	// Fan out to every connection of every participant
+	if err := ctrl.Hub.SendToUsers(participantIDs, msg); err != nil {
+		log.Printf("Error broadcasting to chat %d: %v", chatID, err)
 	}
 }
 
@@ -308,6 +503,9 @@ func (ctrl *ChatController) GetOrCreateChat(c *fiber.Ctx) error {
 	}
 
 	chat, err := ctrl.ChatService.GetOrCreateChat(userID, uint(otherUserID))
+	if errors.Is(err, service.ErrChatBlocked) {
+		return helper.Message403(err.Error())
+	}
 	if err != nil {
 		return helper.Message400(err.Error())
 	}
@@ -315,6 +513,42 @@ func (ctrl *ChatController) GetOrCreateChat(c *fiber.Ctx) error {
 	return helper.Message200(c, chat, "Chat retrieved successfully")
 }
 
+// IssueWebSocketTicket returns a short-lived, single-use ticket for opening the chat WebSocket
+func (ctrl *ChatController) IssueWebSocketTicket(c *fiber.Ctx) error {
+	claims, ok := c.Locals("token_claims").(*helper.Claims)
+	if !ok {
+		return helper.Message401("Invalid token")
+	}
+
+	ticket, expiresAt, err := ctrl.TokenService.IssueWebSocketTicket(claims)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message201(c, fiber.Map{
+		"ticket":     ticket,
+		"expires_at": expiresAt,
+		"expires_in": int(service.WebSocketTicketTTL.Seconds()),
+	}, "WebSocket ticket issued successfully")
+}
+
+// GetProjectChat returns the team chat room of a project, joining it if needed
+func (ctrl *ChatController) GetProjectChat(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	projectID, err := strconv.ParseUint(c.Params("project_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid project ID")
+	}
+
+	chat, err := ctrl.ChatService.GetProjectChat(uint(projectID), userID)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, chat, "Project chat retrieved successfully")
+}
+
 // GetUserChats retrieves all chats for the authenticated user
 func (ctrl *ChatController) GetUserChats(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uint)
@@ -327,7 +561,8 @@ func (ctrl *ChatController) GetUserChats(c *fiber.Ctx) error {
 	return helper.Message200(c, chats, "Chats retrieved successfully")
 }
 
-// GetChatMessages retrieves messages for a specific chat
+// GetChatMessages retrieves a page of chat history, newest first. Pass before_id with the
+// oldest loaded message ID to load older messages, or after_id to catch up on newer ones.
 func (ctrl *ChatController) GetChatMessages(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uint)
 
@@ -337,24 +572,284 @@ func (ctrl *ChatController) GetChatMessages(c *fiber.Ctx) error {
 		return helper.Message400("Invalid chat ID")
 	}
 
-	// Parse pagination parameters
-	page := c.QueryInt("page", 1)
+	cursor := service.MessageCursor{Limit: chatHistoryLimit(c)}
+	if cursor.BeforeID, err = optionalIDQuery(c, "before_id"); err != nil {
+		return err
+	}
+	if cursor.AfterID, err = optionalIDQuery(c, "after_id"); err != nil {
+		return err
+	}
+	if cursor.BeforeID > 0 && cursor.AfterID > 0 {
+		return helper.Message400("Use either before_id or after_id, not both")
+	}
+
+	page, err := ctrl.ChatService.GetChatMessages(uint(chatID), userID, cursor)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	// Loading the history counts as receiving whatever had not reached the user yet
+	receipts, err := ctrl.ChatService.MarkMessagesDelivered(uint(chatID), userID)
+	if err != nil {
+		log.Printf("Error marking messages delivered in chat %d: %v", chatID, err)
+	}
+	ctrl.sendReceipts(receipts)
+
+	return helper.Message200(c, fiber.Map{
+		"messages":  page.Messages,
+		"limit":     cursor.Limit,
+		"has_older": page.HasOlder,
+		"has_newer": page.HasNewer,
+	}, "Messages retrieved successfully")
+}
+
+// GetMessageContext returns a message with the history around it, for jumping to a search
+// result or a replied message. Continue from there with before_id / after_id.
+func (ctrl *ChatController) GetMessageContext(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, messageID, err := chatMessageParams(c)
+	if err != nil {
+		return err
+	}
+
+	context, err := ctrl.ChatService.GetMessageContext(chatID, messageID, userID, chatHistoryLimit(c))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, context, "Message context retrieved successfully")
+}
+
+// SearchMessages searches the messages of all the user's chats, optionally within one chat
+func (ctrl *ChatController) SearchMessages(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		return helper.Message400("Search query is required")
+	}
+	if len(query) > 200 {
+		return helper.Message400("Search query is too long")
+	}
+
+	filter := service.MessageSearchFilter{Query: query, Limit: chatHistoryLimit(c)}
+	var err error
+	if filter.ChatID, err = optionalIDQuery(c, "chat_id"); err != nil {
+		return err
+	}
+	if filter.BeforeID, err = optionalIDQuery(c, "before_id"); err != nil {
+		return err
+	}
+
+	results, err := ctrl.ChatService.SearchMessages(userID, filter)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	response := fiber.Map{
+		"results": results,
+		"limit":   filter.Limit,
+	}
+	// A full page means there may be more; continue with before_id
+	if len(results) == filter.Limit {
+		response["next_before_id"] = results[len(results)-1].MessageID
+	}
+
+	return helper.Message200(c, response, "Search results retrieved successfully")
+}
+
+// chatHistoryLimit reads the limit query parameter, 50 by default and at most 100
+func chatHistoryLimit(c *fiber.Ctx) int {
 	limit := c.QueryInt("limit", 50)
+	if limit < 1 {
+		limit = 50
+	}
 	if limit > 100 {
 		limit = 100 // Max limit
 	}
-	offset := (page - 1) * limit
+	return limit
+}
+
+// optionalIDQuery parses an ID query parameter that may be left out
+func optionalIDQuery(c *fiber.Ctx, name string) (uint, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, helper.Message400("Invalid " + name)
+	}
+	return uint(id), nil
+}
+
+// EditMessage changes the content of one of the user's messages
+func (ctrl *ChatController) EditMessage(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, messageID, err := chatMessageParams(c)
+	if err != nil {
+		return err
+	}
 
-	messages, err := ctrl.ChatService.GetChatMessages(uint(chatID), userID, offset, limit)
+	message, err := ctrl.ChatService.EditMessage(chatID, messageID, userID, c.FormValue("content"))
 	if err != nil {
 		return helper.Message400(err.Error())
 	}
 
-	return helper.Message200(c, fiber.Map{
-		"messages": messages,
-		"page":     page,
-		"limit":    limit,
-	}, "Messages retrieved successfully")
+	response := newMessageResponse(message)
+	ctrl.broadcastToChat(chatID, WebSocketMessage{
+		Type:   "message_edited",
+		ChatID: chatID,
+		Data:   response,
+	})
+
+	return helper.Message200(c, response, "Message edited successfully")
+}
+
+// GetMessageRevisions lists the earlier versions of an edited message
+func (ctrl *ChatController) GetMessageRevisions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, messageID, err := chatMessageParams(c)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := ctrl.ChatService.GetMessageRevisions(chatID, messageID, userID)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, revisions, "Message revisions retrieved successfully")
+}
+
+// DeleteMessage deletes a message for the user only (scope=me, default) or for everyone (scope=everyone)
+func (ctrl *ChatController) DeleteMessage(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, messageID, err := chatMessageParams(c)
+	if err != nil {
+		return err
+	}
+
+	scope := c.Query("scope", service.DeleteForMe)
+	if err := ctrl.ChatService.DeleteMessage(chatID, messageID, userID, scope); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	event := WebSocketMessage{
+		Type:   "message_deleted",
+		ChatID: chatID,
+		Data: fiber.Map{
+			"chat_id":    chatID,
+			"message_id": messageID,
+			"scope":      scope,
+			"deleted_by": userID,
+		},
+	}
+	if scope == service.DeleteForEveryone {
+		ctrl.broadcastToChat(chatID, event)
+	} else {
+		// Only the user's other devices need to hide it
+		ctrl.sendToUser(userID, event)
+	}
+
+	return helper.Message200(c, nil, "Message deleted successfully")
+}
+
+// UploadAttachment stores a file for a chat; send its ID in attachment_ids of send_message to share it
+func (ctrl *ChatController) UploadAttachment(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, err := strconv.ParseUint(c.Params("chat_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid chat ID")
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return helper.Message400("File is required")
+	}
+
+	attachment, err := ctrl.ChatService.UploadAttachment(uint(chatID), userID, file)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message201(c, attachment, "Attachment uploaded successfully")
+}
+
+// DownloadAttachment serves an attachment to participants of its chat
+func (ctrl *ChatController) DownloadAttachment(c *fiber.Ctx) error {
+	return ctrl.serveAttachment(c, false)
+}
+
+// DownloadAttachmentThumbnail serves the generated thumbnail of an image attachment
+func (ctrl *ChatController) DownloadAttachmentThumbnail(c *fiber.Ctx) error {
+	return ctrl.serveAttachment(c, true)
+}
+
+func (ctrl *ChatController) serveAttachment(c *fiber.Ctx, thumbnail bool) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, err := strconv.ParseUint(c.Params("chat_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid chat ID")
+	}
+
+	attachmentID, err := strconv.ParseUint(c.Params("attachment_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid attachment ID")
+	}
+
+	attachment, err := ctrl.ChatService.GetAttachment(uint(chatID), uint(attachmentID), userID)
+	if err != nil {
+		return helper.Message404(err.Error())
+	}
+
+	path, contentType := attachment.StoragePath, attachment.MimeType
+	if thumbnail {
+		if attachment.ThumbnailPath == "" {
+			return helper.Message404("attachment has no thumbnail")
+		}
+		path, contentType = attachment.ThumbnailPath, "image/png"
+		if strings.HasSuffix(path, ".jpg") {
+			contentType = "image/jpeg"
+		}
+	}
+
+	if err := c.SendFile(path); err != nil {
+		return helper.Message404("attachment file not found")
+	}
+
+	// Images and PDFs can be shown in the browser, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") || contentType == "application/pdf" {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": attachment.FileName}))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+
+	return nil
+}
+
+// chatMessageParams parses the :chat_id and :message_id route parameters
+func chatMessageParams(c *fiber.Ctx) (uint, uint, error) {
+	chatID, err := strconv.ParseUint(c.Params("chat_id"), 10, 32)
+	if err != nil {
+		return 0, 0, helper.Message400("Invalid chat ID")
+	}
+
+	messageID, err := strconv.ParseUint(c.Params("message_id"), 10, 32)
+	if err != nil {
+		return 0, 0, helper.Message400("Invalid message ID")
+	}
+
+	return uint(chatID), uint(messageID), nil
 }
 
 // MarkChatAsRead marks all unread messages in a chat as read
@@ -367,14 +862,169 @@ func (ctrl *ChatController) MarkChatAsRead(c *fiber.Ctx) error {
 		return helper.Message400("Invalid chat ID")
 	}
 
-	err = ctrl.ChatService.MarkMessagesAsRead(uint(chatID), userID)
+	receipts, err := ctrl.ChatService.MarkMessagesAsRead(uint(chatID), userID)
 	if err != nil {
 		return helper.Message400(err.Error())
 	}
+	ctrl.sendReceipts(receipts)
 
 	return helper.Message200(c, nil, "Messages marked as read")
 }
 
+// BlockUser blocks a user from direct chats with the authenticated user
+func (ctrl *ChatController) BlockUser(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	blockedID, err := strconv.ParseUint(c.Params("user_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid user ID")
+	}
+
+	block, err := ctrl.ChatService.BlockUser(userID, uint(blockedID))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message201(c, block, "User blocked successfully")
+}
+
+// UnblockUser removes a block
+func (ctrl *ChatController) UnblockUser(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	blockedID, err := strconv.ParseUint(c.Params("user_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid user ID")
+	}
+
+	if err := ctrl.ChatService.UnblockUser(userID, uint(blockedID)); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "User unblocked successfully")
+}
+
+// GetBlockedUsers lists the users the authenticated user blocked
+func (ctrl *ChatController) GetBlockedUsers(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	blocks, err := ctrl.ChatService.GetBlockedUsers(userID)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, blocks, "Blocked users retrieved successfully")
+}
+
+// MuteChat mutes a chat for duration_minutes, or until it is unmuted when no duration is given
+func (ctrl *ChatController) MuteChat(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, err := strconv.ParseUint(c.Params("chat_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid chat ID")
+	}
+
+	var until *time.Time
+	if value := c.FormValue("duration_minutes"); value != "" {
+		minutes, err := strconv.Atoi(value)
+		if err != nil || minutes <= 0 || minutes > maxMuteMinutes {
+			return helper.Message400("duration_minutes must be between 1 and 525600")
+		}
+		end := time.Now().Add(time.Duration(minutes) * time.Minute)
+		until = &end
+	}
+
+	if err := ctrl.ChatService.MuteChat(uint(chatID), userID, until); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"chat_id":     chatID,
+		"muted":       true,
+		"muted_until": until,
+	}, "Chat muted successfully")
+}
+
+// maxMuteMinutes is one year; longer mutes should simply be indefinite
+const maxMuteMinutes = 365 * 24 * 60
+
+// UnmuteChat turns notifications for a chat back on
+func (ctrl *ChatController) UnmuteChat(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, err := strconv.ParseUint(c.Params("chat_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid chat ID")
+	}
+
+	if err := ctrl.ChatService.UnmuteChat(uint(chatID), userID); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{"chat_id": chatID, "muted": false}, "Chat unmuted successfully")
+}
+
+// ReportMessage reports someone else's message to the moderators
+func (ctrl *ChatController) ReportMessage(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	chatID, messageID, err := chatMessageParams(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := ctrl.ChatService.ReportMessage(chatID, messageID, userID, service.MessageReportInput{
+		Reason:  c.FormValue("reason"),
+		Details: c.FormValue("details"),
+	})
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message201(c, fiber.Map{
+		"id":         report.ID,
+		"status":     report.Status,
+		"created_at": report.CreatedAt,
+	}, "Message reported successfully")
+}
+
+// GetMessageReports lists message reports for moderators, filtered by status (open by default)
+func (ctrl *ChatController) GetMessageReports(c *fiber.Ctx) error {
+	status := c.Query("status", model.ReportStatusOpen)
+	if status == "all" {
+		status = ""
+	}
+
+	var reports []model.MessageReport
+	paginationData, err := helper.Paginate(ctrl.ChatService.MessageReportsQuery(status), c, &reports)
+	if err != nil {
+		return helper.Message500("Failed to retrieve reports")
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"reports":    reports,
+		"pagination": paginationData,
+	}, "Reports retrieved successfully")
+}
+
+// ResolveMessageReport closes a report as resolved or dismissed
+func (ctrl *ChatController) ResolveMessageReport(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	reportID, err := strconv.ParseUint(c.Params("report_id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid report ID")
+	}
+
+	report, err := ctrl.ChatService.ResolveReport(uint(reportID), userID, c.FormValue("status"), c.FormValue("note"))
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, report, "Report updated successfully")
+}
+
 // GetNotifications gets unread message notifications for the authenticated user
 func (ctrl *ChatController) GetNotifications(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(uint)
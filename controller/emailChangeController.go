@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
+)
+
+type EmailChangeController struct {
+	EmailChangeService *service.EmailChangeService
+}
+
+func NewEmailChangeController(s *service.EmailChangeService) *EmailChangeController {
+	return &EmailChangeController{
+		EmailChangeService: s,
+	}
+}
+
+// RequestEmailChange sends a confirmation code to the new address
+func (ctrl *EmailChangeController) RequestEmailChange(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	email := c.FormValue("email")
+	if email == "" {
+		return helper.Message400("Email is required")
+	}
+
+	change, err := ctrl.EmailChangeService.RequestChange(userID, email, c.FormValue("password"), c.IP())
+	if err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return helper.Message200(c, change, "Verification code sent to the new email address")
+}
+
+// GetPendingEmailChange returns the change waiting for its code, if any
+func (ctrl *EmailChangeController) GetPendingEmailChange(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	change, err := ctrl.EmailChangeService.GetPendingChange(userID)
+	if err != nil {
+		return helper.Message500("Could not retrieve email change")
+	}
+	if change == nil {
+		return helper.Message404("No pending email change")
+	}
+
+	return helper.Message200(c, change, "Pending email change retrieved successfully")
+}
+
+// ConfirmEmailChange switches the account to the new address after checking its code
+func (ctrl *EmailChangeController) ConfirmEmailChange(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	otpCode := c.FormValue("otp_code")
+	if otpCode == "" {
+		return helper.Message400("OTP code is required")
+	}
+
+	user, err := ctrl.EmailChangeService.ConfirmChange(userID, otpCode)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"id":                user.ID,
+		"email":             user.Email,
+		"is_email_verified": user.IsEmailVerified,
+	}, "Email changed successfully")
+}
+
+// CancelEmailChange drops the pending change
+func (ctrl *EmailChangeController) CancelEmailChange(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	if err := ctrl.EmailChangeService.CancelChange(userID); err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Email change cancelled")
+}
+
+// RevertEmailChange restores the previous address with the link emailed to it. It needs no
+// login, as the account may have been taken over.
+func (ctrl *EmailChangeController) RevertEmailChange(c *fiber.Ctx) error {
+	token := c.FormValue("token")
+	if token == "" {
+		return helper.Message400("Token is required")
+	}
+
+	if err := ctrl.EmailChangeService.RevertChange(token); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Your previous email address has been restored and all devices were signed out. If you did not make the change, please reset your password.")
+}
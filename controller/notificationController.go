@@ -1,19 +1,235 @@
 package controller
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
 	"synergazing.com/synergazing/service"
 )
 
 type NotificationController struct {
 	notificationService *service.NotificationService
+	tokenService        *service.TokenService
+	hub                 service.ChatHub
 }
 
-func NewNotificationController(ns *service.NotificationService) *NotificationController {
-	return &NotificationController{notificationService: ns}
+func NewNotificationController(ns *service.NotificationService, ts *service.TokenService, hub service.ChatHub) *NotificationController {
+	return &NotificationController{notificationService: ns, tokenService: ts, hub: hub}
+}
+
+const (
+	// notificationStreamHeartbeat keeps proxies from closing an idle stream
+	notificationStreamHeartbeat = 25 * time.Second
+	// notificationStreamReplayLimit caps how many missed notifications are replayed on resume.
+	// A client that missed more gets a resync event instead and reloads the list.
+	notificationStreamReplayLimit = 100
+	notificationStreamBuffer      = 32
+	// notificationResyncEventType tells the client the replay was skipped, so it reloads from
+	// GET /api/notifications instead of relying on the stream for what it missed
+	notificationResyncEventType = "resync"
+)
+
+// StreamNotifications is a Server-Sent Events stream of the user's new notifications. Browsers
+// cannot set headers on EventSource, so besides a bearer token a single-use ticket from
+// POST /api/chat/ws-ticket is accepted as ?ticket=. Each event carries the notification ID,
+// and a reconnect with Last-Event-ID replays the notifications created in the meantime.
+func (ctrl *NotificationController) StreamNotifications(c *fiber.Ctx) error {
+	userID, err := ctrl.authenticateStream(c)
+	if err != nil {
+		return helper.Message401(err.Error())
+	}
+
+	lastEventID, err := lastNotificationEventID(c)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	// Register before loading missed notifications so nothing created in between is lost
+	conn := newNotificationStreamConn()
+	client := ctrl.hub.Register(userID, conn)
+
+	var missed []model.Notification
+	resync := false
+	if lastEventID > 0 {
+		missed, err = ctrl.notificationService.GetNotificationsAfter(userID, lastEventID, notificationStreamReplayLimit+1)
+		if err != nil {
+			ctrl.hub.Unregister(client)
+			return helper.Message500(err.Error())
+		}
+		// Replaying only part would let live events move Last-Event-ID past the rest
+		if len(missed) > notificationStreamReplayLimit {
+			missed, resync = nil, true
+		}
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			ctrl.hub.Unregister(client)
+			conn.Close()
+		}()
+
+		fmt.Fprintf(w, "retry: 3000\n\n")
+		if resync {
+			fmt.Fprintf(w, "event: %s\ndata: {}\n\n", notificationResyncEventType)
+		}
+
+		replayed := make(map[uint]bool, len(missed))
+		for i := range missed {
+			data, err := json.Marshal(&missed[i])
+			if err != nil {
+				log.Printf("Error encoding notification %d: %v", missed[i].ID, err)
+				continue
+			}
+			writeNotificationEvent(w, missed[i].ID, data)
+			replayed[missed[i].ID] = true
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(notificationStreamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case event := <-conn.events:
+				// Created while the replay was loading, already sent
+				if event.id != 0 && replayed[event.id] {
+					continue
+				}
+				writeNotificationEvent(w, event.id, event.data)
+			case <-heartbeat.C:
+				fmt.Fprintf(w, ": ping\n\n")
+			case <-conn.done:
+				return
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+func (ctrl *NotificationController) authenticateStream(c *fiber.Ctx) (uint, error) {
+	if authHeader := c.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		claims, err := ctrl.tokenService.ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil {
+			return 0, errors.New("invalid or expired token")
+		}
+		return claims.UserID, nil
+	}
+
+	if ticket := c.Query("ticket"); ticket != "" {
+		return ctrl.tokenService.RedeemWebSocketTicket(ticket)
+	}
+
+	return 0, errors.New("authentication required")
+}
+
+// lastNotificationEventID reads the Last-Event-ID header an EventSource sends when it reconnects.
+// The last_event_id query parameter does the same for a fresh EventSource.
+func lastNotificationEventID(c *fiber.Ctx) (uint, error) {
+	value := c.Get("Last-Event-ID")
+	if value == "" {
+		value = c.Query("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid Last-Event-ID")
+	}
+	return uint(id), nil
+}
+
+func writeNotificationEvent(w *bufio.Writer, id uint, data []byte) {
+	// Notifications without an in-app copy have no ID and must not move Last-Event-ID
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", service.NotificationEventType, data)
+}
+
+type notificationStreamEvent struct {
+	id   uint
+	data []byte
+}
+
+// notificationStreamConn lets an SSE response register with the chat hub like a WebSocket.
+// The hub sends it every event for the user; only notifications are passed on to the stream.
+type notificationStreamConn struct {
+	events    chan notificationStreamEvent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newNotificationStreamConn() *notificationStreamConn {
+	return &notificationStreamConn{
+		events: make(chan notificationStreamEvent, notificationStreamBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *notificationStreamConn) WriteJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var event struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil || event.Type != service.NotificationEventType {
+		return nil
+	}
+
+	var notification struct {
+		ID uint `json:"id"`
+	}
+	if err := json.Unmarshal(event.Data, &notification); err != nil {
+		return err
+	}
+
+	select {
+	case s.events <- notificationStreamEvent{id: notification.ID, data: event.Data}:
+		return nil
+	case <-s.done:
+		return errors.New("notification stream closed")
+	default:
+		// The client is not reading; the hub drops the connection and it resumes with Last-Event-ID
+		return errors.New("notification stream is not keeping up")
+	}
+}
+
+func (s *notificationStreamConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (s *notificationStreamConn) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
 }
 
 // GetNotifications retrieves paginated notifications for the authenticated user
@@ -125,6 +341,75 @@ func (ctrl *NotificationController) DeleteNotification(c *fiber.Ctx) error {
 	return helper.Message200(c, nil, "Notification deleted successfully")
 }
 
+// GetPreferences returns the user's channel settings for every notification type and their quiet hours
+func (ctrl *NotificationController) GetPreferences(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	preferences, err := ctrl.notificationService.Preferences.GetPreferences(userID)
+	if err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	return helper.Message200(c, preferences, "Notification preferences retrieved successfully")
+}
+
+// UpdatePreferences changes the listed notification types and, when given, the quiet hours
+func (ctrl *NotificationController) UpdatePreferences(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	var data service.NotificationPreferencesDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	preferences, err := ctrl.notificationService.Preferences.UpdatePreferences(userID, data)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, preferences, "Notification preferences updated successfully")
+}
+
+// ConfirmUnsubscribeDigest shows the page behind the unsubscribe link in digest emails. It changes
+// nothing, since link scanners and mail prefetchers open every link; its button posts to
+// UnsubscribeDigest.
+func (ctrl *NotificationController) ConfirmUnsubscribeDigest(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if _, list, err := helper.VerifyUnsubscribeToken(token); err != nil || list != service.DigestUnsubscribeList {
+		return helper.Message400("Invalid unsubscribe link")
+	}
+
+	page, err := service.RenderPage("unsubscribe_digest", fiber.Map{
+		"ActionURL": c.Path() + "?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		log.Printf("Error rendering unsubscribe page: %v", err)
+		return helper.Message500("Failed to load unsubscribe page")
+	}
+
+	c.Type("html")
+	return c.SendString(page)
+}
+
+// UnsubscribeDigest turns digest emails off through the signed link in every digest, without login.
+// It is the one-click unsubscribe mail clients send for the List-Unsubscribe-Post header, and the
+// button of the confirmation page, which is redirected to the frontend.
+func (ctrl *NotificationController) UnsubscribeDigest(c *fiber.Ctx) error {
+	userID, list, err := helper.VerifyUnsubscribeToken(c.Query("token"))
+	if err != nil || list != service.DigestUnsubscribeList {
+		return helper.Message400("Invalid unsubscribe link")
+	}
+
+	if err := ctrl.notificationService.Preferences.UnsubscribeDigest(userID); err != nil {
+		return helper.Message500(err.Error())
+	}
+
+	if c.FormValue("List-Unsubscribe") != "One-Click" {
+		return c.Redirect(helper.GetFrontendURL()+"/settings/notifications?unsubscribed=digest", fiber.StatusSeeOther)
+	}
+	return helper.Message200(c, nil, "Unsubscribed from digest emails")
+}
+
 // TestDeadlineNotifications manually triggers deadline notifications (for testing)
 func (ctrl *NotificationController) TestDeadlineNotifications(c *fiber.Ctx) error {
 	err := ctrl.notificationService.CheckAndNotifyApproachingDeadlines()
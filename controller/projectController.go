@@ -191,6 +191,83 @@ func (ctrl *ProjectController) UpdateStage5(c *fiber.Ctx) error {
 	return helper.Message200(c, project, "Project successfully published!")
 }
 
+// UpdateProject applies a partial update to a published project. The body is JSON;
+// a new picture can be sent as the "picture" file of a multipart request.
+func (ctrl *ProjectController) UpdateProject(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	projectID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid project ID")
+	}
+
+	var data service.ProjectUpdateDTO
+	if err := c.BodyParser(&data); err != nil {
+		return helper.Message400("Invalid request body: " + err.Error())
+	}
+
+	// Checked before the picture is stored, so refused requests leave no files behind
+	if err := ctrl.projectService.CanEditProject(uint(projectID), userID); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	var uploadedPicture string
+	if file, _ := c.FormFile("picture"); file != nil {
+		filePath, uploadErr := helper.UploadFile(file, "post")
+		if uploadErr != nil {
+			return helper.Message400(uploadErr.Error())
+		}
+		uploadedPicture = filePath
+		data.PictureURL = &filePath
+	}
+
+	project, err := ctrl.projectService.UpdateProject(uint(projectID), userID, data)
+	if err != nil {
+		if uploadedPicture != "" {
+			helper.DeleteFile(uploadedPicture)
+		}
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, project, "Project updated successfully")
+}
+
+// UpdateProjectStatus moves a project to another lifecycle status
+func (ctrl *ProjectController) UpdateProjectStatus(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	projectID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid project ID")
+	}
+
+	status := strings.TrimSpace(c.FormValue("status"))
+	if status == "" {
+		return helper.Message400("Status is required")
+	}
+
+	project, err := ctrl.projectService.UpdateProjectStatus(uint(projectID), userID, status)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, project, "Project status updated successfully")
+}
+
+// GetProjectRevisions returns the change history of a project
+func (ctrl *ProjectController) GetProjectRevisions(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+	projectID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return helper.Message400("Invalid project ID")
+	}
+
+	revisions, err := ctrl.projectService.GetProjectRevisions(uint(projectID), userID)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, revisions, "Project revisions retrieved successfully")
+}
+
 // GetTimelineStatusOptions returns available timeline status options for frontend selection
 func (ctrl *ProjectController) GetTimelineStatusOptions(c *fiber.Ctx) error {
 	options := helper.GetTimelineStatusOptions()
@@ -245,13 +322,59 @@ func (ctrl *ProjectController) GetMyMemberProjects(c *fiber.Ctx) error {
 	return helper.Message200(c, projects, "Member projects retrieved successfully")
 }
 
+// GetAllProjects lists public projects with optional search, filters, sorting and pagination
 func (ctrl *ProjectController) GetAllProjects(c *fiber.Ctx) error {
-	projects, err := ctrl.projectService.GetAllProjects()
+	filter := service.ProjectSearchFilter{
+		Query:       strings.TrimSpace(c.Query("q")),
+		ProjectType: c.Query("project_type"),
+		Tags:        splitQueryList(c.Query("tags")),
+		Skills:      splitQueryList(c.Query("skills")),
+		Location:    strings.TrimSpace(c.Query("location")),
+		Status:      c.Query("status"),
+		Sort:        c.Query("sort", service.ProjectSortNewest),
+	}
+
+	switch filter.Sort {
+	case service.ProjectSortNewest, service.ProjectSortDeadline, service.ProjectSortRemainingSlots, service.ProjectSortRelevance:
+	default:
+		return helper.Message400("Invalid sort, use one of: newest, deadline, remaining_slots, relevance")
+	}
+
+	if filter.Status != "" && !model.IsValidProjectStatus(filter.Status) {
+		return helper.Message400("Invalid status")
+	}
+	if filter.Status == model.ProjectStatusDraft {
+		return helper.Message400("Draft projects are not public")
+	}
+
+	if from := c.Query("deadline_from"); from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return helper.Message400("Invalid deadline_from format, use YYYY-MM-DD")
+		}
+		filter.DeadlineFrom = &t
+	}
+
+	if to := c.Query("deadline_to"); to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return helper.Message400("Invalid deadline_to format, use YYYY-MM-DD")
+		}
+		// Include the whole day
+		t = t.Add(24*time.Hour - time.Nanosecond)
+		filter.DeadlineTo = &t
+	}
+
+	var projects []model.Project
+	paginationData, err := helper.Paginate(ctrl.projectService.SearchProjectsQuery(filter), c, &projects)
 	if err != nil {
-		return helper.Message400(err.Error())
+		return helper.Message500("Failed to retrieve projects")
 	}
 
-	return helper.Message200(c, projects, "All projects retrieved successfully")
+	return helper.Message200(c, fiber.Map{
+		"projects":   ctrl.projectService.TransformProjectList(projects),
+		"pagination": paginationData,
+	}, "All projects retrieved successfully")
 }
 
 func (ctrl *ProjectController) GetProjectByID(c *fiber.Ctx) error {
@@ -297,3 +420,14 @@ func (ctrl *ProjectController) DeleteProject(c *fiber.Ctx) error {
 
 	return helper.Message200(c, nil, "Project deleted successfully")
 }
+
+// splitQueryList parses a comma separated query value such as "go,react"
+func splitQueryList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
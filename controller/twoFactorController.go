@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
+)
+
+type TwoFactorController struct {
+	TwoFactorService *service.TwoFactorService
+}
+
+func NewTwoFactorController(s *service.TwoFactorService) *TwoFactorController {
+	return &TwoFactorController{
+		TwoFactorService: s,
+	}
+}
+
+// GetStatus returns whether two-factor authentication is on and how many backup codes are left
+func (ctrl *TwoFactorController) GetStatus(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	status, err := ctrl.TwoFactorService.GetStatus(userID)
+	if err != nil {
+		return helper.Message500("Could not retrieve two-factor status")
+	}
+
+	return helper.Message200(c, status, "Two-factor status retrieved successfully")
+}
+
+// Setup creates a secret and returns the provisioning URI to show as a QR code
+func (ctrl *TwoFactorController) Setup(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	setup, err := ctrl.TwoFactorService.BeginSetup(userID)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, setup, "Scan the QR code with your authenticator app, then confirm with a code")
+}
+
+// Enable turns two-factor authentication on with a first code from the app
+func (ctrl *TwoFactorController) Enable(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	code := c.FormValue("code")
+	if code == "" {
+		return helper.Message400("Code is required")
+	}
+
+	backupCodes, err := ctrl.TwoFactorService.EnableTwoFactor(userID, code)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"backup_codes": backupCodes,
+	}, "Two-factor authentication enabled. Store the backup codes somewhere safe, they are only shown once.")
+}
+
+// RegenerateBackupCodes replaces the backup codes, confirmed with a code from the app
+func (ctrl *TwoFactorController) RegenerateBackupCodes(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	code := c.FormValue("code")
+	if code == "" {
+		return helper.Message400("Code is required")
+	}
+
+	backupCodes, err := ctrl.TwoFactorService.RegenerateBackupCodes(userID, code)
+	if err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, fiber.Map{
+		"backup_codes": backupCodes,
+	}, "New backup codes generated, the old ones no longer work")
+}
+
+// RequestDisableCode emails a code to turn two-factor authentication off without the app
+func (ctrl *TwoFactorController) RequestDisableCode(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	if err := ctrl.TwoFactorService.RequestDisableCode(userID, c.IP()); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return helper.Message200(c, nil, "Verification code sent to your email")
+}
+
+// Disable turns two-factor authentication off with a code from the app, a backup code or an emailed code
+func (ctrl *TwoFactorController) Disable(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(uint)
+
+	code := c.FormValue("code")
+	otpCode := c.FormValue("otp_code")
+	if code == "" && otpCode == "" {
+		return helper.Message400("Code or OTP code is required")
+	}
+
+	if err := ctrl.TwoFactorService.DisableTwoFactor(userID, code, otpCode); err != nil {
+		return helper.Message400(err.Error())
+	}
+
+	return helper.Message200(c, nil, "Two-factor authentication disabled")
+}
@@ -1 +1,53 @@
 package helper
+
+import (
+	"math"
+	"strings"
+)
+
+// MatchedSkill is a required skill the collaborator has, with their proficiency (0-100)
+type MatchedSkill struct {
+	Name        string `json:"name"`
+	Proficiency int    `json:"proficiency"`
+}
+
+// SkillMatchResult is the score breakdown of a collaborator against a set of required skills
+type SkillMatchResult struct {
+	Score         float64        `json:"score"`
+	MatchedSkills []MatchedSkill `json:"matched_skills"`
+	MissingSkills []string       `json:"missing_skills"`
+}
+
+// FilterColabolator scores a collaborator against the required skills of a role.
+// userSkills maps skill names to proficiency. Every required skill is worth the same,
+// and a matched skill counts proportionally to its proficiency, so the score ranges
+// from 0 (no overlap) to 100 (every skill at full proficiency).
+func FilterColabolator(userSkills map[string]int, requiredSkills []string) SkillMatchResult {
+	result := SkillMatchResult{
+		MatchedSkills: []MatchedSkill{},
+		MissingSkills: []string{},
+	}
+	if len(requiredSkills) == 0 {
+		return result
+	}
+
+	normalized := make(map[string]int, len(userSkills))
+	for name, proficiency := range userSkills {
+		normalized[strings.ToLower(strings.TrimSpace(name))] = proficiency
+	}
+
+	var total float64
+	for _, skill := range requiredSkills {
+		proficiency, ok := normalized[strings.ToLower(strings.TrimSpace(skill))]
+		if !ok {
+			result.MissingSkills = append(result.MissingSkills, skill)
+			continue
+		}
+
+		result.MatchedSkills = append(result.MatchedSkills, MatchedSkill{Name: skill, Proficiency: proficiency})
+		total += float64(proficiency) / 100
+	}
+
+	result.Score = math.Round(total/float64(len(requiredSkills))*1000) / 10
+	return result
+}
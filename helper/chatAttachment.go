@@ -0,0 +1,252 @@
+package helper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ChatAttachmentDir is outside storage/, so attachments are never served by the public /storage route
+const ChatAttachmentDir = "storage_private/chat"
+
+const (
+	MaxChatImageSize    = 10 * 1024 * 1024
+	MaxChatDocumentSize = 25 * 1024 * 1024
+
+	chatThumbnailSize = 320
+	// Images with more pixels than this are rejected instead of being decoded for a thumbnail
+	maxThumbnailSourcePixels = 40_000_000
+)
+
+// chatAttachmentType is an accepted attachment format
+type chatAttachmentType struct {
+	MimeType string
+	Ext      string
+	IsImage  bool
+}
+
+var chatImageTypes = map[string]chatAttachmentType{
+	"image/jpeg": {MimeType: "image/jpeg", Ext: ".jpg", IsImage: true},
+	"image/png":  {MimeType: "image/png", Ext: ".png", IsImage: true},
+	"image/gif":  {MimeType: "image/gif", Ext: ".gif", IsImage: true},
+	"image/webp": {MimeType: "image/webp", Ext: ".webp", IsImage: true},
+}
+
+// Office files are recognised by their container (ZIP or OLE) plus the extension the client gave
+var chatZipDocumentTypes = map[string]chatAttachmentType{
+	".docx": {MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Ext: ".docx"},
+	".xlsx": {MimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Ext: ".xlsx"},
+	".pptx": {MimeType: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Ext: ".pptx"},
+}
+
+var chatOLEDocumentTypes = map[string]chatAttachmentType{
+	".doc": {MimeType: "application/msword", Ext: ".doc"},
+	".xls": {MimeType: "application/vnd.ms-excel", Ext: ".xls"},
+	".ppt": {MimeType: "application/vnd.ms-powerpoint", Ext: ".ppt"},
+}
+
+var chatTextTypes = map[string]chatAttachmentType{
+	".txt": {MimeType: "text/plain", Ext: ".txt"},
+	".csv": {MimeType: "text/csv", Ext: ".csv"},
+	".md":  {MimeType: "text/markdown", Ext: ".md"},
+}
+
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// StoredChatAttachment describes a saved attachment and its optional thumbnail
+type StoredChatAttachment struct {
+	FileName      string
+	Path          string
+	ThumbnailPath string
+	MimeType      string
+	Size          int64
+	IsImage       bool
+	Width         int
+	Height        int
+}
+
+// SaveChatAttachment checks the real content type of an upload, enforces the size limit for
+// that type and stores it under ChatAttachmentDir. Images also get a thumbnail.
+func SaveChatAttachment(file *multipart.FileHeader) (*StoredChatAttachment, error) {
+	if file.Size > MaxChatDocumentSize {
+		return nil, fmt.Errorf("file too large, maximum is %dMB", MaxChatDocumentSize/1024/1024)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %v", err)
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(io.LimitReader(src, MaxChatDocumentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload file: %v", err)
+	}
+	if len(data) > MaxChatDocumentSize {
+		return nil, fmt.Errorf("file too large, maximum is %dMB", MaxChatDocumentSize/1024/1024)
+	}
+
+	fileType, err := sniffChatAttachmentType(data, file.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if fileType.IsImage && len(data) > MaxChatImageSize {
+		return nil, fmt.Errorf("image too large, maximum is %dMB", MaxChatImageSize/1024/1024)
+	}
+
+	dir := filepath.Join(ChatAttachmentDir, time.Now().Format("2006/01"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// The stored name never uses client input, the extension follows the detected type
+	name := uuid.New().String()
+	stored := &StoredChatAttachment{
+		FileName: sanitizeAttachmentName(file.Filename, fileType.Ext),
+		Path:     filepath.Join(dir, name+fileType.Ext),
+		MimeType: fileType.MimeType,
+		Size:     int64(len(data)),
+		IsImage:  fileType.IsImage,
+	}
+
+	if err := os.WriteFile(stored.Path, data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save file: %v", err)
+	}
+
+	if fileType.IsImage {
+		thumbnailPath, width, height, err := createThumbnail(data, filepath.Join(dir, name+"_thumb"))
+		if err != nil {
+			DeleteFile(stored.Path)
+			return nil, err
+		}
+		stored.ThumbnailPath = thumbnailPath
+		stored.Width = width
+		stored.Height = height
+	}
+
+	return stored, nil
+}
+
+// sniffChatAttachmentType decides the type from the file content; the extension is only used
+// to tell apart formats that share a container
+func sniffChatAttachmentType(data []byte, fileName string) (chatAttachmentType, error) {
+	detected := http.DetectContentType(data)
+	mimeType := strings.TrimSpace(strings.Split(detected, ";")[0])
+	ext := strings.ToLower(filepath.Ext(fileName))
+
+	if fileType, ok := chatImageTypes[mimeType]; ok {
+		return fileType, nil
+	}
+
+	switch {
+	case mimeType == "application/pdf":
+		return chatAttachmentType{MimeType: "application/pdf", Ext: ".pdf"}, nil
+	case mimeType == "application/zip":
+		if fileType, ok := chatZipDocumentTypes[ext]; ok {
+			return fileType, nil
+		}
+	case bytes.HasPrefix(data, oleSignature):
+		if fileType, ok := chatOLEDocumentTypes[ext]; ok {
+			return fileType, nil
+		}
+	case mimeType == "text/plain":
+		if fileType, ok := chatTextTypes[ext]; ok {
+			return fileType, nil
+		}
+	}
+
+	return chatAttachmentType{}, fmt.Errorf("unsupported file type %s. Allowed are images (jpg, png, gif, webp), PDF, Office documents and text files", mimeType)
+}
+
+// createThumbnail scales an image to fit chatThumbnailSize and returns the thumbnail path and the original size
+func createThumbnail(data []byte, basePath string) (string, int, int, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid image: %v", err)
+	}
+	if config.Width*config.Height > maxThumbnailSourcePixels {
+		return "", 0, 0, fmt.Errorf("image dimensions too large")
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid image: %v", err)
+	}
+
+	width, height := config.Width, config.Height
+	thumbWidth, thumbHeight := width, height
+	if width > chatThumbnailSize || height > chatThumbnailSize {
+		if width >= height {
+			thumbWidth = chatThumbnailSize
+			thumbHeight = max(1, height*chatThumbnailSize/width)
+		} else {
+			thumbHeight = chatThumbnailSize
+			thumbWidth = max(1, width*chatThumbnailSize/height)
+		}
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	// Photos become JPEG, formats that may be transparent stay PNG
+	path := basePath + ".png"
+	if format == "jpeg" {
+		path = basePath + ".jpg"
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("failed to create thumbnail: %v", err)
+	}
+	defer out.Close()
+
+	if format == "jpeg" {
+		err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(out, thumb)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, 0, fmt.Errorf("failed to encode thumbnail: %v", err)
+	}
+
+	return path, width, height, nil
+}
+
+// sanitizeAttachmentName keeps the client's file name for display only
+func sanitizeAttachmentName(fileName, ext string) string {
+	name := strings.TrimSpace(filepath.Base(strings.ReplaceAll(fileName, "\\", "/")))
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || r == 127 || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == "/" {
+		name = "attachment" + ext
+	}
+
+	// Downloads must not suggest a different type than the one that was detected
+	nameExt := strings.ToLower(filepath.Ext(name))
+	if nameExt != ext && !(ext == ".jpg" && nameExt == ".jpeg") {
+		name += ext
+	}
+	if len(name) > 255 {
+		name = name[len(name)-255:]
+	}
+	return name
+}
@@ -1,6 +1,12 @@
 package helper
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
 
 func Message400(msg string) error {
 	return fiber.NewError(fiber.StatusBadRequest, msg)
@@ -21,3 +27,20 @@ func Message404(msg string) error {
 func Message500(msg string) error {
 	return fiber.NewError(fiber.StatusInternalServerError, msg)
 }
+
+// Message429 rejects a throttled request. Unlike the other errors it answers with JSON, so the
+// client can show a countdown from retry_after (seconds), which is also sent as Retry-After.
+func Message429(c *fiber.Ctx, msg string, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"success": false,
+		"message": msg,
+		"data": fiber.Map{
+			"retry_after": seconds,
+		},
+	})
+}
@@ -3,29 +3,67 @@ package helper
 import (
 	"errors"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
+// Claims of an access token. IssuedAtMicros is the issue time in microseconds, since "iat" only
+// has whole seconds and the "log out everywhere" cutoff has to tell apart tokens issued in the
+// same second.
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Email  string `json:"email"`
+	UserID         uint   `json:"user_id"`
+	Email          string `json:"email"`
+	SessionID      uint   `json:"sid,omitempty"`
+	IssuedAtMicros int64  `json:"iat_us,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateJWTToken(userID uint, email string) (string, error) {
+// IssuedAtTime returns when the token was issued, as precisely as the token tells
+func (c *Claims) IssuedAtTime() time.Time {
+	if c.IssuedAtMicros != 0 {
+		return time.UnixMicro(c.IssuedAtMicros)
+	}
+	if c.IssuedAt != nil {
+		return c.IssuedAt.Time
+	}
+	return time.Time{}
+}
+
+// AccessTokenTTL is the lifetime of access tokens, configurable with ACCESS_TOKEN_TTL_MINUTES
+func AccessTokenTTL() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("ACCESS_TOKEN_TTL_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return 15 * time.Minute
+}
+
+// RefreshTokenTTL is the lifetime of refresh tokens, configurable with REFRESH_TOKEN_TTL_DAYS
+func RefreshTokenTTL() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("REFRESH_TOKEN_TTL_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+func GenerateJWTToken(userID uint, email string, sessionID uint) (string, error) {
 	secret := os.Getenv("JWT_SECRET")
 	if secret == "" {
 		secret = "your-secret-key"
 	}
 
+	now := time.Now()
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:         userID,
+		Email:          email,
+		SessionID:      sessionID,
+		IssuedAtMicros: now.UnixMicro(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(168 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL())),
+			IssuedAt:  jwt.NewNumericDate(now),
 			Issuer:    "synergazing-api",
 		},
 	}
@@ -0,0 +1,116 @@
+package helper
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// PasswordMaxLength is the most bytes bcrypt can hash
+const PasswordMaxLength = 72
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var (
+	commonPasswords     map[string]struct{}
+	commonPasswordsOnce sync.Once
+)
+
+// PasswordPolicy describes what a new password has to look like
+type PasswordPolicy struct {
+	MinLength int
+	// MinCharacterClasses is how many of lowercase, uppercase, digits and symbols must be used
+	MinCharacterClasses int
+	RejectCommon        bool
+}
+
+// PasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH (default 8), PASSWORD_MIN_CHARACTER_CLASSES
+// (1-4, default 3) and PASSWORD_REJECT_COMMON (default true)
+func PasswordPolicyFromEnv() PasswordPolicy {
+	policy := PasswordPolicy{MinLength: 8, MinCharacterClasses: 3, RejectCommon: true}
+
+	if length, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && length > 0 {
+		policy.MinLength = min(length, PasswordMaxLength)
+	}
+	if classes, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CHARACTER_CLASSES")); err == nil && classes >= 1 && classes <= 4 {
+		policy.MinCharacterClasses = classes
+	}
+	if reject, err := strconv.ParseBool(os.Getenv("PASSWORD_REJECT_COMMON")); err == nil {
+		policy.RejectCommon = reject
+	}
+
+	return policy
+}
+
+// ValidatePassword checks a new password against the policy configured in the environment
+func ValidatePassword(password string) error {
+	return PasswordPolicyFromEnv().Validate(password)
+}
+
+// Validate returns an error describing the first rule the password breaks
+func (p PasswordPolicy) Validate(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > PasswordMaxLength {
+		return fmt.Errorf("Password must be at most %d bytes", PasswordMaxLength)
+	}
+
+	if classes := passwordCharacterClasses(password); classes < p.MinCharacterClasses {
+		return fmt.Errorf("Password must use at least %d of: lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses)
+	}
+
+	if p.RejectCommon && IsCommonPassword(password) {
+		return errors.New("Password is too common, please choose another one")
+	}
+
+	return nil
+}
+
+// IsCommonPassword reports whether the password is on the embedded list of common passwords
+func IsCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswords = make(map[string]struct{})
+		scanner := bufio.NewScanner(strings.NewReader(commonPasswordList))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[strings.ToLower(line)] = struct{}{}
+			}
+		}
+	})
+
+	_, found := commonPasswords[strings.ToLower(password)]
+	return found
+}
+
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, used := range []bool{lower, upper, digit, symbol} {
+		if used {
+			classes++
+		}
+	}
+	return classes
+}
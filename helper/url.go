@@ -34,15 +34,29 @@ func GetFrontendURL() string {
 	return "http://localhost:3000"
 }
 
-// BuildOAuthSuccessURL builds the OAuth success redirect URL with query parameters
-func BuildOAuthSuccessURL(token string, userID uint, userName, userEmail string) string {
+// BuildOAuthSuccessURL builds the OAuth success redirect URL. It carries a single-use code
+// instead of the tokens, which would end up in browser history, proxy logs and Referer headers;
+// the frontend exchanges it with POST /api/auth/oauth/exchange.
+func BuildOAuthSuccessURL(code string) string {
 	frontendURL := GetFrontendURL()
-	return fmt.Sprintf("%s/callback?success=true&token=%s&user_id=%d&user_name=%s&user_email=%s",
+	return fmt.Sprintf("%s/callback?success=true&code=%s", frontendURL, url.QueryEscape(code))
+}
+
+// BuildOAuthLinkURL builds the OAuth redirect URL for a provider account whose email belongs to
+// an existing account, carrying the link token for /api/auth/social/link
+func BuildOAuthLinkURL(linkToken, provider, email string) string {
+	frontendURL := GetFrontendURL()
+	return fmt.Sprintf("%s/callback?link_required=true&link_token=%s&provider=%s&email=%s",
 		frontendURL,
-		url.QueryEscape(token),
-		userID,
-		url.QueryEscape(userName),
-		url.QueryEscape(userEmail))
+		url.QueryEscape(linkToken),
+		url.QueryEscape(provider),
+		url.QueryEscape(email))
+}
+
+// BuildOAuthLinkedURL builds the OAuth redirect URL after a provider was linked in a link flow
+func BuildOAuthLinkedURL(provider string) string {
+	frontendURL := GetFrontendURL()
+	return fmt.Sprintf("%s/callback?linked=%s", frontendURL, url.QueryEscape(provider))
 }
 
 // BuildOAuthErrorURL builds the OAuth error redirect URL with error type
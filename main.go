@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -57,16 +58,67 @@ func main() {
 			log.Println("Cleaning up expired OTPs...")
 			migrations.CleanupExpiredOTPs(db)
 			return
+		case "seed-roles":
+			log.Println("Seeding default roles and permissions...")
+			if err := service.NewRolePermissionService(db).SeedDefaultRolesAndPermissions(); err != nil {
+				log.Fatalf("Failed to seed roles: %v", err)
+			}
+			return
+		case "assign-role":
+			if len(os.Args) < 4 {
+				log.Fatal("Please provide the user email and role name: e.g., `go run main.go assign-role admin@example.com admin`")
+			}
+			log.Printf("Assigning role %s to %s", os.Args[3], os.Args[2])
+			if err := migrations.AssignRoleByEmail(db, os.Args[2], os.Args[3]); err != nil {
+				log.Fatalf("Failed to assign role: %v", err)
+			}
+			return
 		}
 	}
 
 	log.Println("Running with auto migration...")
 	migrations.AutoMigrate(db)
 
+	if err := service.NewRolePermissionService(db).SeedDefaultRolesAndPermissions(); err != nil {
+		log.Fatalf("Failed to seed default roles: %v", err)
+	}
+
+	go startEmailOutboxRoutine()
 	go startOTPCleanupRoutine()
+	go startRevokedTokenCleanupRoutine()
 	go startNotificationRoutine()
+	go startNotificationDeliveryRoutine()
+	go startNotificationDigestRoutine()
+	go startRecruitmentClosingRoutine()
+	go startPresenceCleanupRoutine()
+	go startChatAttachmentCleanupRoutine()
+	go startRateLimitCleanupRoutine()
 
-	app := fiber.New()
+	fiberConfig := fiber.Config{
+		// Chat attachments can be up to 25MB, leave room for the multipart envelope
+		BodyLimit: 30 * 1024 * 1024,
+	}
+	// Behind a reverse proxy every request comes from the proxy, so the rate limits need the
+	// client address from the header the proxy sets. Only the listed proxies are believed.
+	// The header must be one the proxy overwrites: Fiber takes the leftmost X-Forwarded-For entry,
+	// which the client chooses, so every per-IP limit could be dodged with it.
+	if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+		proxyHeader := os.Getenv("PROXY_HEADER")
+		if proxyHeader == "" {
+			proxyHeader = "X-Real-IP"
+		}
+		if strings.EqualFold(proxyHeader, fiber.HeaderXForwardedFor) {
+			log.Fatalf("PROXY_HEADER must not be X-Forwarded-For, its first entry is set by the client; have the proxy overwrite X-Real-IP instead")
+		}
+		fiberConfig.EnableTrustedProxyCheck = true
+		for _, proxy := range strings.Split(trustedProxies, ",") {
+			fiberConfig.TrustedProxies = append(fiberConfig.TrustedProxies, strings.TrimSpace(proxy))
+		}
+		fiberConfig.ProxyHeader = proxyHeader
+		fiberConfig.EnableIPValidation = true
+	}
+
+	app := fiber.New(fiberConfig)
 
 	// Get allowed origins from environment variable
 	allowedOrigins := os.Getenv("FRONTEND_URL")
@@ -114,12 +166,15 @@ func main() {
 	})
 	routes.SetupAuthRoutes(app)
 	routes.SetupProjectRoutes(app)
+	// Before the profile and user routes, whose "/api" groups require a bearer token on every
+	// later /api route; the notification stream also accepts a ticket
+	routes.SetupNotificationRoutes(app)
 	routes.SetupProfileRoutes(app)
 	routes.SetupUserRoutes(app)
 	routes.SkillRoutes(app)
 	routes.SetupChatRoutes(app)
-	routes.SetupNotificationRoutes(app)
 	routes.SetupProjectMemberRoutes(app)
+	routes.SetupRolePermissionRoutes(app)
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello World - GORM Connected!")
@@ -135,6 +190,29 @@ func main() {
 
 }
 
+// startEmailOutboxRoutine sends queued emails. Emails queued by this process wake it right away,
+// the ticker picks up retries and emails queued by other instances.
+func startEmailOutboxRoutine() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	cleanupTicker := time.NewTicker(24 * time.Hour)
+	defer cleanupTicker.Stop()
+
+	outbox := service.DefaultEmailOutbox()
+	outbox.CleanupSentEmails()
+	outbox.ProcessOutbox()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-outbox.Wake():
+		case <-cleanupTicker.C:
+			outbox.CleanupSentEmails()
+		}
+		outbox.ProcessOutbox()
+	}
+}
+
 func startOTPCleanupRoutine() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
@@ -148,6 +226,24 @@ func startOTPCleanupRoutine() {
 	}
 }
 
+func startRevokedTokenCleanupRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	tokenService := service.NewTokenServiceDefault()
+	twoFactorService := service.NewTwoFactorService(service.NewOTPService())
+	tokenService.CleanupExpiredRevokedTokens()
+	tokenService.CleanupExpiredSessions()
+	twoFactorService.CleanupExpiredChallenges()
+	log.Println("Initial revoked token cleanup completed")
+
+	for range ticker.C {
+		tokenService.CleanupExpiredRevokedTokens()
+		tokenService.CleanupExpiredSessions()
+		twoFactorService.CleanupExpiredChallenges()
+	}
+}
+
 func startNotificationRoutine() {
 	ticker := time.NewTicker(24 * time.Hour) // Check daily
 	defer ticker.Stop()
@@ -170,3 +266,89 @@ func startNotificationRoutine() {
 		}
 	}
 }
+
+// startNotificationDeliveryRoutine sends push and email notifications held back by quiet hours
+func startNotificationDeliveryRoutine() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	notificationService := service.NewNotificationService(config.GetDB())
+	notificationService.DispatchDeferredDeliveries()
+
+	for range ticker.C {
+		notificationService.DispatchDeferredDeliveries()
+	}
+}
+
+// startNotificationDigestRoutine emails the daily and weekly digests; it runs hourly so each
+// digest goes out close to its period and after the user's quiet hours
+func startNotificationDigestRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	digestService := service.NewNotificationDigestService(config.GetDB())
+	digestService.SendDueDigests()
+
+	for range ticker.C {
+		digestService.SendDueDigests()
+	}
+}
+
+func startRecruitmentClosingRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	db := config.GetDB()
+	projectService := service.NewProjectService(db, service.NewSkillService(db), service.NewTagService(db), service.NewBenefitService(db), service.NewTimelineService(db))
+
+	closeRecruitment := func() {
+		closed, err := projectService.CloseExpiredRecruitment()
+		if err != nil {
+			log.Printf("Error closing expired recruitment: %v", err)
+		} else if closed > 0 {
+			log.Printf("Closed recruitment for %d projects past their registration deadline", closed)
+		}
+	}
+
+	closeRecruitment()
+	for range ticker.C {
+		closeRecruitment()
+	}
+}
+
+func startPresenceCleanupRoutine() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	presenceService := service.NewPresenceService(config.GetDB())
+	presenceService.CleanupStaleConnections()
+
+	for range ticker.C {
+		presenceService.CleanupStaleConnections()
+	}
+}
+
+// startRateLimitCleanupRoutine drops rate limit buckets that have been full for a while
+func startRateLimitCleanupRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	store := service.DefaultRateLimitStore()
+	for range ticker.C {
+		if err := store.Cleanup(24 * time.Hour); err != nil {
+			log.Printf("Error cleaning up rate limit buckets: %v", err)
+		}
+	}
+}
+
+func startChatAttachmentCleanupRoutine() {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	chatService := service.NewChatService()
+	chatService.CleanupOrphanedAttachments()
+
+	for range ticker.C {
+		chatService.CleanupOrphanedAttachments()
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
 )
 
 func AuthMiddleware() fiber.Handler  {
@@ -24,7 +24,7 @@ func AuthMiddleware() fiber.Handler  {
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
 
-		claims, err := helper.VerifyJWTToken(token)
+		claims, err := service.NewTokenServiceDefault().ValidateToken(token)
 		if err != nil {
 			return c.Status(401).JSON(fiber.Map{
 				"error": "Invalid or expired token",
@@ -32,6 +32,7 @@ func AuthMiddleware() fiber.Handler  {
 		}
 		c.Locals("user_id", claims.UserID)
 		c.Locals("user_email", claims.Email)
+		c.Locals("token_claims", claims)
 
 		return c.Next()
 	}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/service"
+)
+
+// RequirePermission only lets the request through when the authenticated user
+// holds the given permission slug. It must be used after AuthMiddleware.
+func RequirePermission(slug string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, ok := c.Locals("user_id").(uint)
+		if !ok {
+			return c.Status(401).JSON(fiber.Map{
+				"error": "Authentication required",
+			})
+		}
+
+		rolePermissionService := service.NewRolePermissionServiceDefault()
+		allowed, err := rolePermissionService.UserHasPermission(userID, slug)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to verify permissions",
+			})
+		}
+
+		if !allowed {
+			return c.Status(403).JSON(fiber.Map{
+				"error": "You do not have permission to perform this action",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/service"
+)
+
+// RateLimitConfig limits one endpoint. Requests are counted per client IP and, when Account
+// returns a key, per account as well, so spreading attempts over many addresses does not get
+// around the account limit.
+type RateLimitConfig struct {
+	// Name keeps the buckets of different endpoints apart
+	Name       string
+	PerIP      service.RateLimit
+	PerAccount service.RateLimit
+	// Account returns the account the request is about, or "" when there is none
+	Account func(c *fiber.Ctx) string
+	// Store defaults to service.DefaultRateLimitStore()
+	Store service.RateLimitStore
+}
+
+// RateLimit rejects requests over the configured limits with 429 and a Retry-After header.
+// Every response carries the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers of the closest limit. When the store cannot be reached the request
+// is let through, so an outage of the store does not lock everybody out.
+func RateLimit(config RateLimitConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		store := config.Store
+		if store == nil {
+			store = service.DefaultRateLimitStore()
+		}
+
+		var closest *service.RateLimitResult
+		var closestLimit service.RateLimit
+		check := func(key string, limit service.RateLimit) bool {
+			result, err := store.Take(key, limit)
+			if err != nil {
+				log.Printf("Rate limit store error for %s: %v", key, err)
+				return true
+			}
+			if closest == nil || !result.Allowed || result.Remaining < closest.Remaining {
+				closest = &result
+				closestLimit = limit
+			}
+			return result.Allowed
+		}
+
+		allowed := true
+		if config.PerIP.Requests > 0 {
+			allowed = check(fmt.Sprintf("%s:ip:%s", config.Name, c.IP()), config.PerIP)
+		}
+		if allowed && config.PerAccount.Requests > 0 && config.Account != nil {
+			if account := config.Account(c); account != "" {
+				allowed = check(fmt.Sprintf("%s:account:%s", config.Name, account), config.PerAccount)
+			}
+		}
+
+		if closest != nil {
+			c.Set("RateLimit-Limit", strconv.Itoa(closest.Limit))
+			c.Set("RateLimit-Remaining", strconv.Itoa(closest.Remaining))
+			c.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(closest.Reset)))
+			c.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", closestLimit.Requests, ceilSeconds(closestLimit.Period)))
+		}
+		if !allowed {
+			return helper.Message429(c, "Too many requests, please try again later", closest.RetryAfter)
+		}
+
+		return c.Next()
+	}
+}
+
+// AccountFromEmail keys the account limit by the email form value
+func AccountFromEmail(c *fiber.Ctx) string {
+	return strings.ToLower(strings.TrimSpace(c.FormValue("email")))
+}
+
+// AccountFromMFAToken keys the account limit by the user of the mfa_token form value, so the
+// codes guessed for one account are counted together over all its logins
+func AccountFromMFAToken(twoFactor *service.TwoFactorService) func(c *fiber.Ctx) string {
+	return func(c *fiber.Ctx) string {
+		userID, err := twoFactor.ChallengeUserID(c.FormValue("mfa_token"))
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("user:%d", userID)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
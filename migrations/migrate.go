@@ -11,36 +11,86 @@ import (
 )
 
 var modelMap = map[string]interface{}{
-	"users":                &model.Users{},
-	"profiles":             &model.Profiles{},
-	"role":                 &model.Role{},
-	"permission":           &model.Permission{},
-	"socialauth":           &model.SocialAuth{},
-	"skill":                &model.Skill{},
-	"userskill":            &model.UserSkill{},
-	"project":              &model.Project{},
-	"projectcondition":     &model.ProjectCondition{},
-	"tag":                  &model.Tag{},
-	"benefit":              &model.Benefit{},
-	"timeline":             &model.Timeline{},
-	"projecttag":           &model.ProjectTag{},
-	"projectbenefit":       &model.ProjectBenefit{},
-	"projecttimeline":      &model.ProjectTimeline{},
-	"projectrequiredskill": &model.ProjectRequiredSkill{},
-	"projectrole":          &model.ProjectRole{},
-	"projectroleskill":     &model.ProjectRoleSkill{},
-	"projectmember":        &model.ProjectMember{},
-	"projectmemberskill":   &model.ProjectMemberSkill{},
-	"chat":                 &model.Chat{},
-	"chats":                &model.Chat{},
-	"message":              &model.Message{},
-	"messages":             &model.Message{},
-	"otp":                  &model.OTP{},
-	"otps":                 &model.OTP{},
-	"notification":         &model.Notification{},
-	"notifications":        &model.Notification{},
-	"projectapplication":   &model.ProjectApplication{},
-	"projectapplications":  &model.ProjectApplication{},
+	"users":                   &model.Users{},
+	"profiles":                &model.Profiles{},
+	"role":                    &model.Role{},
+	"permission":              &model.Permission{},
+	"socialauth":              &model.SocialAuth{},
+	"skill":                   &model.Skill{},
+	"userskill":               &model.UserSkill{},
+	"project":                 &model.Project{},
+	"projectcondition":        &model.ProjectCondition{},
+	"tag":                     &model.Tag{},
+	"benefit":                 &model.Benefit{},
+	"timeline":                &model.Timeline{},
+	"projecttag":              &model.ProjectTag{},
+	"projectbenefit":          &model.ProjectBenefit{},
+	"projecttimeline":         &model.ProjectTimeline{},
+	"projectrequiredskill":    &model.ProjectRequiredSkill{},
+	"projectrole":             &model.ProjectRole{},
+	"projectroleskill":        &model.ProjectRoleSkill{},
+	"projectmember":           &model.ProjectMember{},
+	"projectmemberskill":      &model.ProjectMemberSkill{},
+	"chat":                    &model.Chat{},
+	"chats":                   &model.Chat{},
+	"message":                 &model.Message{},
+	"messages":                &model.Message{},
+	"otp":                     &model.OTP{},
+	"otps":                    &model.OTP{},
+	"otprequest":              &model.OTPRequest{},
+	"otprequests":             &model.OTPRequest{},
+	"notification":            &model.Notification{},
+	"notifications":           &model.Notification{},
+	"projectapplication":      &model.ProjectApplication{},
+	"projectapplications":     &model.ProjectApplication{},
+	"revokedtoken":            &model.RevokedToken{},
+	"revokedtokens":           &model.RevokedToken{},
+	"usersession":             &model.UserSession{},
+	"usersessions":            &model.UserSession{},
+	"refreshtoken":            &model.RefreshToken{},
+	"refreshtokens":           &model.RefreshToken{},
+	"projectrevision":         &model.ProjectRevision{},
+	"projectrevisions":        &model.ProjectRevision{},
+	"chatparticipant":         &model.ChatParticipant{},
+	"chatparticipants":        &model.ChatParticipant{},
+	"chathubevent":            &model.ChatHubEvent{},
+	"chathubevents":           &model.ChatHubEvent{},
+	"websocketticket":         &model.WebSocketTicket{},
+	"websockettickets":        &model.WebSocketTicket{},
+	"oauthlogincode":          &model.OAuthLoginCode{},
+	"oauthlogincodes":         &model.OAuthLoginCode{},
+	"chatconnection":          &model.ChatConnection{},
+	"chatconnections":         &model.ChatConnection{},
+	"messagerevision":         &model.MessageRevision{},
+	"messagerevisions":        &model.MessageRevision{},
+	"messagedeletion":         &model.MessageDeletion{},
+	"messagedeletions":        &model.MessageDeletion{},
+	"messageattachment":       &model.MessageAttachment{},
+	"messageattachments":      &model.MessageAttachment{},
+	"userblock":               &model.UserBlock{},
+	"userblocks":              &model.UserBlock{},
+	"messagereport":           &model.MessageReport{},
+	"messagereports":          &model.MessageReport{},
+	"notificationpreference":  &model.NotificationPreference{},
+	"notificationpreferences": &model.NotificationPreference{},
+	"notificationsettings":    &model.NotificationSettings{},
+	"notificationdelivery":    &model.NotificationDelivery{},
+	"notificationdeliveries":  &model.NotificationDelivery{},
+	"notificationdigest":      &model.NotificationDigest{},
+	"notificationdigests":     &model.NotificationDigest{},
+	"emailoutbox":             &model.EmailOutbox{},
+	"emailchange":             &model.EmailChange{},
+	"emailchanges":            &model.EmailChange{},
+	"usertwofactor":           &model.UserTwoFactor{},
+	"usertwofactors":          &model.UserTwoFactor{},
+	"twofactorbackupcode":     &model.TwoFactorBackupCode{},
+	"twofactorbackupcodes":    &model.TwoFactorBackupCode{},
+	"mfachallenge":            &model.MFAChallenge{},
+	"mfachallenges":           &model.MFAChallenge{},
+	"ratelimitbucket":         &model.RateLimitBucket{},
+	"ratelimitbuckets":        &model.RateLimitBucket{},
+	"accountlockout":          &model.AccountLockout{},
+	"accountlockouts":         &model.AccountLockout{},
 }
 
 func AutoMigrate(db *gorm.DB) {
@@ -51,27 +101,47 @@ func AutoMigrate(db *gorm.DB) {
 		log.Fatalf("Failed to create custom enums: %v", err)
 	}
 
+	if err := DropPlaintextOTPCodes(db); err != nil {
+		log.Fatalf("Failed to drop plaintext OTP codes: %v", err)
+	}
+
+	if err := DropOutdatedOTPPurposeCheck(db); err != nil {
+		log.Fatalf("Failed to update OTP purpose check: %v", err)
+	}
+
 	err := db.AutoMigrate(
-		&model.Users{}, &model.Role{}, &model.Permission{}, &model.Skill{}, &model.Tag{}, &model.Benefit{}, &model.Timeline{}, &model.OTP{},
+		&model.Users{}, &model.Role{}, &model.Permission{}, &model.Skill{}, &model.Tag{}, &model.Benefit{}, &model.Timeline{}, &model.OTP{}, &model.OTPRequest{}, &model.RevokedToken{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to migrate primary tables: %v", err)
 	}
 
 	err = db.AutoMigrate(
-		&model.Profiles{}, &model.SocialAuth{}, &model.UserSkill{}, &model.Project{}, &model.Chat{}, &model.Notification{},
+		&model.Profiles{}, &model.SocialAuth{}, &model.UserSkill{}, &model.Project{}, &model.Chat{}, &model.Notification{}, &model.UserSession{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to migrate dependent tables: %v", err)
 	}
 
 	err = db.AutoMigrate(
-		&model.ProjectCondition{}, &model.ProjectRequiredSkill{}, &model.ProjectTag{}, &model.ProjectBenefit{}, &model.ProjectTimeline{}, &model.ProjectRole{}, &model.ProjectRoleSkill{}, &model.ProjectMember{}, &model.ProjectMemberSkill{}, &model.Message{}, &model.ProjectApplication{},
+		&model.ProjectCondition{}, &model.ProjectRequiredSkill{}, &model.ProjectTag{}, &model.ProjectBenefit{}, &model.ProjectTimeline{}, &model.ProjectRole{}, &model.ProjectRoleSkill{}, &model.ProjectMember{}, &model.ProjectMemberSkill{}, &model.Message{}, &model.ProjectApplication{}, &model.RefreshToken{}, &model.ProjectRevision{}, &model.ChatParticipant{}, &model.ChatHubEvent{}, &model.WebSocketTicket{}, &model.ChatConnection{}, &model.MessageRevision{}, &model.MessageDeletion{}, &model.MessageAttachment{}, &model.UserBlock{}, &model.MessageReport{}, &model.NotificationPreference{}, &model.NotificationSettings{}, &model.NotificationDelivery{}, &model.NotificationDigest{}, &model.EmailOutbox{}, &model.EmailChange{}, &model.UserTwoFactor{}, &model.TwoFactorBackupCode{}, &model.MFAChallenge{}, &model.RateLimitBucket{}, &model.AccountLockout{}, &model.OAuthLoginCode{},
 	)
 	if err != nil {
 		log.Fatalf("Failed to migrate final tables: %v", err)
 	}
 
+	if err := CreateProjectSearchIndexes(db); err != nil {
+		log.Fatalf("Failed to create project search indexes: %v", err)
+	}
+
+	if err := CreateChatSearchIndexes(db); err != nil {
+		log.Fatalf("Failed to create chat search indexes: %v", err)
+	}
+
+	if err := BackfillChatParticipants(db); err != nil {
+		log.Fatalf("Failed to backfill chat participants: %v", err)
+	}
+
 	fmt.Println("Success run Auto-migrate")
 }
 
@@ -95,7 +165,7 @@ func MigrateFresh(db *gorm.DB) {
 	}
 
 	modelsToDrop := []interface{}{
-		&model.ProjectMemberSkill{}, &model.ProjectMember{}, &model.ProjectRoleSkill{}, &model.ProjectCondition{}, &model.ProjectRequiredSkill{}, &model.ProjectTag{}, &model.ProjectBenefit{}, &model.ProjectTimeline{}, &model.ProjectRole{}, &model.Message{}, &model.Notification{}, &model.ProjectApplication{},
+		&model.ProjectMemberSkill{}, &model.ProjectMember{}, &model.ProjectRoleSkill{}, &model.ProjectCondition{}, &model.ProjectRequiredSkill{}, &model.ProjectTag{}, &model.ProjectBenefit{}, &model.ProjectTimeline{}, &model.ProjectRole{}, &model.Message{}, &model.Notification{}, &model.ProjectApplication{}, &model.RefreshToken{}, &model.ProjectRevision{}, &model.ChatParticipant{}, &model.ChatHubEvent{}, &model.WebSocketTicket{}, &model.ChatConnection{}, &model.MessageRevision{}, &model.MessageDeletion{}, &model.MessageAttachment{}, &model.UserBlock{}, &model.MessageReport{}, &model.NotificationPreference{}, &model.NotificationSettings{}, &model.NotificationDelivery{}, &model.NotificationDigest{}, &model.EmailOutbox{}, &model.EmailChange{}, &model.UserTwoFactor{}, &model.TwoFactorBackupCode{}, &model.MFAChallenge{}, &model.RateLimitBucket{}, &model.AccountLockout{}, &model.OAuthLoginCode{},
 	}
 	if err := tx.Migrator().DropTable(modelsToDrop...); err != nil {
 		tx.Rollback()
@@ -103,13 +173,18 @@ func MigrateFresh(db *gorm.DB) {
 	}
 
 	modelsToDrop = []interface{}{
-		&model.Profiles{}, &model.SocialAuth{}, &model.UserSkill{}, &model.Project{}, &model.Chat{}, &model.OTP{},
+		&model.Profiles{}, &model.SocialAuth{}, &model.UserSkill{}, &model.Project{}, &model.Chat{}, &model.OTP{}, &model.OTPRequest{}, &model.RevokedToken{}, &model.UserSession{},
 	}
 	if err := tx.Migrator().DropTable(modelsToDrop...); err != nil {
 		tx.Rollback()
 		log.Fatalf("Failed to drop main dependent tables: %v", err)
 	}
 
+	if err := tx.Migrator().DropTable("user_roles", "role_permissions"); err != nil {
+		tx.Rollback()
+		log.Fatalf("Failed to drop role join tables: %v", err)
+	}
+
 	modelsToDrop = []interface{}{
 		&model.Users{}, &model.Role{}, &model.Permission{}, &model.Skill{}, &model.Tag{}, &model.Benefit{}, &model.Timeline{},
 	}
@@ -139,7 +214,7 @@ func CreateCustomEnums(db *gorm.DB) error {
 		return err
 	}
 
-	err = db.Exec("DO $$ BEGIN CREATE TYPE otp_purpose AS ENUM ('registration', 'password_reset', 'email_change'); EXCEPTION WHEN duplicate_object THEN null; END $$;").Error
+	err = db.Exec("DO $$ BEGIN CREATE TYPE otp_purpose AS ENUM ('registration', 'password_reset', 'email_change', 'two_factor'); EXCEPTION WHEN duplicate_object THEN null; END $$;").Error
 	if err != nil {
 		return err
 	}
@@ -159,12 +234,20 @@ func DropWorkerTypeColumn(db *gorm.DB) error {
 func MigrateOTP(db *gorm.DB) error {
 	fmt.Println("Running OTP migration...")
 
-	err := db.Exec("DO $$ BEGIN CREATE TYPE otp_purpose AS ENUM ('registration', 'password_reset', 'email_change'); EXCEPTION WHEN duplicate_object THEN null; END $$;").Error
+	err := db.Exec("DO $$ BEGIN CREATE TYPE otp_purpose AS ENUM ('registration', 'password_reset', 'email_change', 'two_factor'); EXCEPTION WHEN duplicate_object THEN null; END $$;").Error
 	if err != nil {
 		return fmt.Errorf("failed to create otp_purpose enum: %v", err)
 	}
 
-	err = db.AutoMigrate(&model.OTP{})
+	if err := DropPlaintextOTPCodes(db); err != nil {
+		return fmt.Errorf("failed to drop plaintext OTP codes: %v", err)
+	}
+
+	if err := DropOutdatedOTPPurposeCheck(db); err != nil {
+		return fmt.Errorf("failed to update OTP purpose check: %v", err)
+	}
+
+	err = db.AutoMigrate(&model.OTP{}, &model.OTPRequest{})
 	if err != nil {
 		return fmt.Errorf("failed to migrate OTP table: %v", err)
 	}
@@ -178,6 +261,38 @@ func MigrateOTP(db *gorm.DB) error {
 	return nil
 }
 
+// DropPlaintextOTPCodes removes the old plaintext code column now that only hashes are stored.
+// It runs before the OTP table is migrated, so the new hash column is added to an empty table.
+// Codes that were pending at that moment stop working; they expire within minutes anyway.
+func DropPlaintextOTPCodes(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&model.OTP{}) || !db.Migrator().HasColumn(&model.OTP{}, "code") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM otps").Error; err != nil {
+			return err
+		}
+		return tx.Exec("ALTER TABLE otps DROP COLUMN code").Error
+	})
+}
+
+// DropOutdatedOTPPurposeCheck drops the purpose check of the otps table when it predates the
+// two_factor purpose. AutoMigrate only creates missing checks, so it then adds the current one.
+func DropOutdatedOTPPurposeCheck(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&model.OTP{}) {
+		return nil
+	}
+
+	var definition string
+	if err := db.Raw("SELECT pg_get_constraintdef(oid) FROM pg_constraint WHERE conname = 'chk_otps_purpose'").Scan(&definition).Error; err != nil {
+		return err
+	}
+	if definition == "" || strings.Contains(definition, "'two_factor'") {
+		return nil
+	}
+	return db.Exec("ALTER TABLE otps DROP CONSTRAINT chk_otps_purpose").Error
+}
+
 func CleanupExpiredOTPs(db *gorm.DB) {
 	result := db.Where("expires_at < ?", time.Now()).Delete(&model.OTP{})
 	if result.Error != nil {
@@ -187,4 +302,107 @@ func CleanupExpiredOTPs(db *gorm.DB) {
 	} else {
 		log.Println("No expired OTP records found")
 	}
+
+	if err := db.Where("created_at < ?", time.Now().Add(-24*time.Hour)).Delete(&model.OTPRequest{}).Error; err != nil {
+		log.Printf("Error cleaning up OTP requests: %v", err)
+	}
+}
+
+func AssignRoleByEmail(db *gorm.DB, email, roleName string) error {
+	var user model.Users
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		return fmt.Errorf("user %s not found: %v", email, err)
+	}
+
+	var role model.Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return fmt.Errorf("role %s not found, run `go run main.go seed-roles` first: %v", roleName, err)
+	}
+
+	if err := db.Model(&user).Association("Role").Append(&role); err != nil {
+		return fmt.Errorf("failed to assign role: %v", err)
+	}
+
+	fmt.Printf("Role %s assigned to %s\n", roleName, email)
+	return nil
+}
+
+// CreateProjectSearchIndexes adds the indexes used by project search and filtering.
+// The full-text expression must stay in sync with projectSearchVector in ProjectService.
+func CreateProjectSearchIndexes(db *gorm.DB) error {
+	statements := []string{
+		"CREATE INDEX IF NOT EXISTS idx_projects_search ON projects USING GIN (to_tsvector('simple', coalesce(title, '') || ' ' || coalesce(description, '')));",
+		"CREATE INDEX IF NOT EXISTS idx_projects_status ON projects (status);",
+		"CREATE INDEX IF NOT EXISTS idx_projects_project_type ON projects (project_type);",
+		"CREATE INDEX IF NOT EXISTS idx_projects_registration_deadline ON projects (registration_deadline);",
+		"CREATE INDEX IF NOT EXISTS idx_projects_created_at ON projects (created_at);",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	// Trigram indexes speed up ILIKE on title and location, but pg_trgm may need
+	// elevated privileges to install, so search keeps working without them.
+	// Running it in a nested transaction keeps a failure from aborting MigrateFresh.
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm;").Error
+	})
+	if err != nil {
+		log.Printf("Skipping trigram indexes, pg_trgm unavailable: %v", err)
+		return nil
+	}
+
+	statements = []string{
+		"CREATE INDEX IF NOT EXISTS idx_projects_title_trgm ON projects USING GIN (title gin_trgm_ops);",
+		"CREATE INDEX IF NOT EXISTS idx_projects_location_trgm ON projects USING GIN (location gin_trgm_ops);",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CreateChatSearchIndexes adds the full-text index used by message search and the
+// (chat_id, id) index that keyset pagination of chat history walks.
+// The expression must match messageSearchVector in the chat service.
+func CreateChatSearchIndexes(db *gorm.DB) error {
+	statements := []string{
+		"CREATE INDEX IF NOT EXISTS idx_messages_content_search ON messages USING GIN (to_tsvector('simple', content));",
+		"CREATE INDEX IF NOT EXISTS idx_messages_chat_id_id ON messages (chat_id, id);",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillChatParticipants creates participant rows for direct chats created before group
+// chats existed. The read position is taken from the legacy messages.is_read flag.
+// It is safe to run repeatedly.
+func BackfillChatParticipants(db *gorm.DB) error {
+	statements := []string{
+		"ALTER TABLE chats ALTER COLUMN user1_id DROP NOT NULL;",
+		"ALTER TABLE chats ALTER COLUMN user2_id DROP NOT NULL;",
+		`INSERT INTO chat_participants (chat_id, user_id, role, last_read_message_id, joined_at, created_at, updated_at)
+		SELECT c.id, x.user_id, 'member',
+			(SELECT MAX(m.id) FROM messages m WHERE m.chat_id = c.id AND m.sender_id != x.user_id AND m.is_read = true),
+			c.created_at, NOW(), NOW()
+		FROM chats c
+		CROSS JOIN LATERAL (VALUES (c.user1_id), (c.user2_id)) AS x(user_id)
+		WHERE c.type = 'direct' AND x.user_id IS NOT NULL
+		ON CONFLICT (chat_id, user_id) DO NOTHING;`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
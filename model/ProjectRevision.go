@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// ProjectRevision records a single field change made to a project after it was published.
+// All changes saved by one edit share the same RevisionGroup.
+type ProjectRevision struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	ProjectID     uint      `json:"project_id" gorm:"not null;index"`
+	ChangedByID   uint      `json:"changed_by_id" gorm:"not null"`
+	RevisionGroup string    `json:"revision_group" gorm:"size:36;not null;index"`
+	Field         string    `json:"field" gorm:"size:100;not null"`
+	OldValue      string    `json:"old_value" gorm:"type:text"`
+	NewValue      string    `json:"new_value" gorm:"type:text"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Not serialized as is, responses carry only the public details of the user
+	ChangedBy *Users `json:"-" gorm:"foreignKey:ChangedByID"`
+}
+
+func (ProjectRevision) TableName() string {
+	return "project_revisions"
+}
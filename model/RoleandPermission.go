@@ -30,3 +30,19 @@ func (Role) TableName() string {
 func (Permission) TableName() string {
 	return "permissions"
 }
+
+// Default role names seeded on startup
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Permission slugs checked by middleware.RequirePermission
+const (
+	PermissionRoleManage         = "role.manage"
+	PermissionUserManage         = "user.manage"
+	PermissionProjectModerate    = "project.moderate"
+	PermissionChatModerate       = "chat.moderate"
+	PermissionNotificationManage = "notification.manage"
+)
@@ -0,0 +1,83 @@
+package model
+
+import "time"
+
+// UserSession is one logged-in device. All refresh tokens rotated from the same
+// login belong to the same session, which makes the session the token family
+// that gets revoked when a refresh token is reused.
+type UserSession struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"user_id" gorm:"not null;index"`
+	DeviceName    string     `json:"device_name" gorm:"size:255"`
+	UserAgent     string     `json:"user_agent" gorm:"type:text"`
+	IPAddress     string     `json:"ip_address" gorm:"size:64"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	ExpiresAt     time.Time  `json:"expires_at" gorm:"not null;index"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty" gorm:"size:50"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	User Users `json:"-" gorm:"foreignKey:UserID"`
+}
+
+func (UserSession) TableName() string {
+	return "user_sessions"
+}
+
+// RefreshToken is stored as a SHA-256 hash, the plaintext only ever leaves the server once
+type RefreshToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	SessionID uint       `json:"session_id" gorm:"not null;index"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null;size:64"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null;index"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	Session UserSession `json:"-" gorm:"foreignKey:SessionID"`
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+// Session revocation reasons
+const (
+	SessionRevokedLogout     = "logout"
+	SessionRevokedLogoutAll  = "logout_all"
+	SessionRevokedByUser     = "revoked_by_user"
+	SessionRevokedTokenReuse = "token_reuse"
+	SessionRevokedPassword   = "password_change"
+)
+
+// WebSocketTicket is a short-lived, single-use credential for opening a chat WebSocket
+// without putting a long-lived token in the URL. Only its SHA-256 hash is stored.
+type WebSocketTicket struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"not null;index"`
+	SessionID  uint       `json:"session_id" gorm:"index"`
+	TicketHash string     `json:"-" gorm:"uniqueIndex;not null;size:64"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null;index"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (WebSocketTicket) TableName() string {
+	return "websocket_tickets"
+}
+
+// OAuthLoginCode is a short-lived, single-use code handed to the frontend after a social login.
+// The frontend exchanges it for the tokens with a POST, so no token ever appears in a URL.
+type OAuthLoginCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"uniqueIndex;not null;size:64"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null;index"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (OAuthLoginCode) TableName() string {
+	return "oauth_login_codes"
+}
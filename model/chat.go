@@ -1,34 +1,233 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
 
+	"synergazing.com/synergazing/helper"
+)
+
+// Chat types
+const (
+	ChatTypeDirect  = "direct"
+	ChatTypeProject = "project"
+)
+
+// Chat participant roles
+const (
+	ChatParticipantRoleOwner  = "owner"
+	ChatParticipantRoleMember = "member"
+)
+
+// Chat is either a one-to-one conversation (User1/User2) or a group room shared by a
+// project team (ProjectID). Who can read and write is tracked in ChatParticipant for both.
 type Chat struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	User1ID   uint      `json:"user1_id" gorm:"not null"`
-	User2ID   uint      `json:"user2_id" gorm:"not null"`
-	User1     Users     `json:"user1" gorm:"foreignKey:User1ID"`
-	User2     Users     `json:"user2" gorm:"foreignKey:User2ID"`
-	Messages  []Message `json:"messages,omitempty" gorm:"foreignKey:ChatID"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           uint              `json:"id" gorm:"primaryKey"`
+	Type         string            `json:"type" gorm:"size:20;not null;default:'direct'"`
+	Name         string            `json:"name,omitempty" gorm:"size:255"`
+	ProjectID    *uint             `json:"project_id,omitempty" gorm:"uniqueIndex"`
+	User1ID      *uint             `json:"user1_id,omitempty"`
+	User2ID      *uint             `json:"user2_id,omitempty"`
+	User1        *Users            `json:"user1,omitempty" gorm:"foreignKey:User1ID"`
+	User2        *Users            `json:"user2,omitempty" gorm:"foreignKey:User2ID"`
+	Project      *Project          `json:"-" gorm:"foreignKey:ProjectID"`
+	Participants []ChatParticipant `json:"participants,omitempty" gorm:"foreignKey:ChatID"`
+	Messages     []Message         `json:"messages,omitempty" gorm:"foreignKey:ChatID"`
+	// Presence of the other participants, filled in for chat lists
+	Presence map[uint]UserPresence `json:"presence,omitempty" gorm:"-"`
+	// The requesting user's mute setting, filled in for chat lists
+	Muted      bool       `json:"muted" gorm:"-"`
+	MutedUntil *time.Time `json:"muted_until,omitempty" gorm:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 func (Chat) TableName() string {
 	return "chats"
 }
 
+// ChatParticipant is a user's membership of a chat together with their own read state.
+// LeftAt is set instead of deleting the row when someone leaves a project room.
+type ChatParticipant struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	ChatID            uint       `json:"chat_id" gorm:"not null;uniqueIndex:idx_chat_participant"`
+	UserID            uint       `json:"user_id" gorm:"not null;uniqueIndex:idx_chat_participant;index"`
+	Role              string     `json:"role" gorm:"size:20;not null;default:'member'"`
+	LastReadMessageID *uint      `json:"last_read_message_id"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+	JoinedAt          time.Time  `json:"joined_at"`
+	LeftAt            *time.Time `json:"left_at,omitempty"`
+	// A muted chat does not count towards unread notifications. MutedUntil empty means until unmuted.
+	// Private to the participant, so not serialized with the participant list.
+	Muted      bool       `json:"-" gorm:"not null;default:false"`
+	MutedUntil *time.Time `json:"-"`
+	User       Users      `json:"-" gorm:"foreignKey:UserID"`
+	Chat       *Chat      `json:"-" gorm:"foreignKey:ChatID"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (ChatParticipant) TableName() string {
+	return "chat_participants"
+}
+
 type Message struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	ChatID    uint      `json:"chat_id" gorm:"not null"`
-	SenderID  uint      `json:"sender_id" gorm:"not null"`
-	Content   string    `json:"content" gorm:"type:text;not null"`
-	IsRead    bool      `json:"is_read" gorm:"default:false"`
-	Chat      Chat      `json:"chat" gorm:"foreignKey:ChatID"`
-	Sender    Users     `json:"sender" gorm:"foreignKey:SenderID"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID               uint   `json:"id" gorm:"primaryKey"`
+	ChatID           uint   `json:"chat_id" gorm:"not null"`
+	SenderID         uint   `json:"sender_id" gorm:"not null"`
+	Content          string `json:"content" gorm:"type:text;not null"`
+	IsRead           bool   `json:"is_read" gorm:"default:false"`
+	ReplyToMessageID *uint  `json:"reply_to_message_id" gorm:"index"`
+	// First time the message reached / was read by a recipient
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	EditedAt    *time.Time `json:"edited_at"`
+	// Set when the sender deleted the message for everyone; the content is cleared.
+	// This is a plain timestamp, not gorm's soft delete, so deleted messages stay in the history.
+	DeletedAt   *time.Time          `json:"deleted_at"`
+	ReplyTo     *Message            `json:"reply_to,omitempty" gorm:"foreignKey:ReplyToMessageID"`
+	Attachments []MessageAttachment `json:"attachments,omitempty" gorm:"foreignKey:MessageID"`
+	Chat        Chat                `json:"chat" gorm:"foreignKey:ChatID"`
+	Sender      Users               `json:"-" gorm:"foreignKey:SenderID"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
 }
 
 func (Message) TableName() string {
 	return "messages"
 }
+
+// MessageAttachment is a file shared in a chat. It is uploaded first, while MessageID is
+// still empty, and linked when the message that carries it is sent. Files live outside the
+// public storage route and are only served to participants of the chat.
+type MessageAttachment struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	ChatID        uint      `json:"chat_id" gorm:"not null;index"`
+	MessageID     *uint     `json:"message_id" gorm:"index"`
+	UploaderID    uint      `json:"uploader_id" gorm:"not null;index"`
+	FileName      string    `json:"file_name" gorm:"size:255;not null"`
+	MimeType      string    `json:"mime_type" gorm:"size:100;not null"`
+	Size          int64     `json:"size"`
+	Width         int       `json:"width,omitempty"`
+	Height        int       `json:"height,omitempty"`
+	StoragePath   string    `json:"-" gorm:"type:text;not null"`
+	ThumbnailPath string    `json:"-" gorm:"type:text"`
+	CreatedAt     time.Time `json:"created_at"`
+	Chat          *Chat     `json:"-" gorm:"foreignKey:ChatID"`
+}
+
+func (MessageAttachment) TableName() string {
+	return "message_attachments"
+}
+
+func (a MessageAttachment) MarshalJSON() ([]byte, error) {
+	type Alias MessageAttachment
+	thumbnailURL := ""
+	if a.ThumbnailPath != "" {
+		thumbnailURL = helper.GetUrlFile(fmt.Sprintf("api/chat/%d/attachments/%d/thumbnail", a.ChatID, a.ID))
+	}
+	return json.Marshal(&struct {
+		URL          string `json:"url"`
+		ThumbnailURL string `json:"thumbnail_url,omitempty"`
+		*Alias
+	}{
+		URL:          helper.GetUrlFile(fmt.Sprintf("api/chat/%d/attachments/%d", a.ChatID, a.ID)),
+		ThumbnailURL: thumbnailURL,
+		Alias:        (*Alias)(&a),
+	})
+}
+
+// MessageRevision keeps the content a message had before an edit
+type MessageRevision struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	MessageID  uint      `json:"message_id" gorm:"not null;index"`
+	Content    string    `json:"content" gorm:"type:text;not null"`
+	EditedByID uint      `json:"edited_by_id" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+	Message    *Message  `json:"-" gorm:"foreignKey:MessageID"`
+}
+
+func (MessageRevision) TableName() string {
+	return "message_revisions"
+}
+
+// MessageDeletion hides a message from one user only ("delete for me")
+type MessageDeletion struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	MessageID uint      `json:"message_id" gorm:"not null;uniqueIndex:idx_message_deletion"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_message_deletion"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   *Message  `json:"-" gorm:"foreignKey:MessageID"`
+}
+
+func (MessageDeletion) TableName() string {
+	return "message_deletions"
+}
+
+// ChatHubEvent stores chat events too large for a Postgres NOTIFY payload
+type ChatHubEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Payload   string    `json:"payload" gorm:"type:text;not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+func (ChatHubEvent) TableName() string {
+	return "chat_hub_events"
+}
+
+// UserBlock stops BlockedID from starting a direct chat with or messaging BlockerID, and the other way round
+type UserBlock struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	BlockerID uint      `json:"blocker_id" gorm:"not null;uniqueIndex:idx_user_block"`
+	BlockedID uint      `json:"blocked_id" gorm:"not null;uniqueIndex:idx_user_block;index"`
+	Blocked   *Users    `json:"blocked,omitempty" gorm:"foreignKey:BlockedID"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (UserBlock) TableName() string {
+	return "user_blocks"
+}
+
+// Message report reasons
+const (
+	ReportReasonSpam          = "spam"
+	ReportReasonHarassment    = "harassment"
+	ReportReasonInappropriate = "inappropriate"
+	ReportReasonOther         = "other"
+)
+
+// Message report statuses
+const (
+	ReportStatusOpen      = "open"
+	ReportStatusResolved  = "resolved"
+	ReportStatusDismissed = "dismissed"
+)
+
+// MessageReport is a user's complaint about a chat message. The content is copied when the
+// report is made, so moderators see what was reported even if the message is later edited
+// or deleted. MessageID and ChatID are kept without a foreign key for the same reason.
+type MessageReport struct {
+	ID                 uint       `json:"id" gorm:"primaryKey"`
+	MessageID          uint       `json:"message_id" gorm:"not null;uniqueIndex:idx_message_report"`
+	ChatID             uint       `json:"chat_id" gorm:"not null"`
+	ReporterID         uint       `json:"reporter_id" gorm:"not null;uniqueIndex:idx_message_report"`
+	ReportedUserID     uint       `json:"reported_user_id" gorm:"not null;index"`
+	Reason             string     `json:"reason" gorm:"size:30;not null"`
+	Details            string     `json:"details" gorm:"type:text"`
+	ContentSnapshot    string     `json:"content_snapshot" gorm:"type:text"`
+	AttachmentSnapshot string     `json:"attachment_snapshot,omitempty" gorm:"type:text"`
+	MessageSentAt      time.Time  `json:"message_sent_at"`
+	Status             string     `json:"status" gorm:"size:20;not null;default:'open';index"`
+	ResolvedByID       *uint      `json:"resolved_by_id,omitempty"`
+	ResolutionNote     string     `json:"resolution_note,omitempty" gorm:"type:text"`
+	ResolvedAt         *time.Time `json:"resolved_at,omitempty"`
+	Reporter           *Users     `json:"reporter,omitempty" gorm:"foreignKey:ReporterID"`
+	ReportedUser       *Users     `json:"reported_user,omitempty" gorm:"foreignKey:ReportedUserID"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+func (MessageReport) TableName() string {
+	return "message_reports"
+}
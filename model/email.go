@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// Email outbox statuses
+const (
+	EmailStatusPending = "pending"
+	EmailStatusSent    = "sent"
+	EmailStatusFailed  = "failed"
+)
+
+// EmailOutbox is an email waiting to be sent, or the record of one that was sent or gave up.
+// Emails are rendered when they are queued, so a restart or a failing mail server does not
+// lose them. The bodies are cleared once sent because they can contain codes and links.
+type EmailOutbox struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	Recipient     string     `json:"recipient" gorm:"size:255;not null"`
+	Template      string     `json:"template" gorm:"size:50;not null"`
+	Locale        string     `json:"locale" gorm:"size:10;not null"`
+	Subject       string     `json:"subject" gorm:"size:255;not null"`
+	HTMLBody      string     `json:"-" gorm:"type:text"`
+	TextBody      string     `json:"-" gorm:"type:text"`
+	Headers       string     `json:"-" gorm:"type:text"` // JSON object of extra headers
+	Status        string     `json:"status" gorm:"size:20;not null;default:'pending';index:idx_email_outbox_due,priority:1"`
+	Attempts      int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"not null;index:idx_email_outbox_due,priority:2"`
+	LastError     string     `json:"last_error,omitempty" gorm:"type:text"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func (EmailOutbox) TableName() string {
+	return "email_outbox"
+}
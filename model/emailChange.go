@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// Email change statuses
+const (
+	EmailChangeStatusPending   = "pending"
+	EmailChangeStatusConfirmed = "confirmed"
+	EmailChangeStatusCancelled = "cancelled"
+	EmailChangeStatusReverted  = "reverted"
+)
+
+// EmailChange is a user's request to move their account to a new address. The address only
+// changes once the OTP sent to it is confirmed. The old address then gets a link that can
+// undo the change until RevertExpiresAt, in case someone else took over the account.
+type EmailChange struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	UserID   uint   `json:"user_id" gorm:"not null;index"`
+	OldEmail string `json:"old_email" gorm:"not null"`
+	NewEmail string `json:"new_email" gorm:"not null"`
+	// Verification state of the old address, restored on revert
+	OldEmailVerified bool       `json:"-" gorm:"not null;default:false"`
+	Status           string     `json:"status" gorm:"size:20;not null;default:'pending';index"`
+	ExpiresAt        time.Time  `json:"expires_at" gorm:"not null"`
+	ConfirmedAt      *time.Time `json:"confirmed_at,omitempty"`
+	RevertTokenHash  string     `json:"-" gorm:"size:64;index"`
+	RevertExpiresAt  *time.Time `json:"revert_expires_at,omitempty"`
+	RevertedAt       *time.Time `json:"reverted_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+func (EmailChange) TableName() string {
+	return "email_changes"
+}
@@ -11,6 +11,7 @@ type Notification struct {
 	Message   string    `json:"message" gorm:"type:text;not null"`
 	IsRead    bool      `json:"is_read" gorm:"default:false"`
 	Data      string    `json:"data,omitempty" gorm:"type:text"`
+	Push      bool      `json:"-" gorm:"not null;default:false"` // also pushed live; resumed streams replay only these
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
@@ -36,3 +37,86 @@ const (
 	NotificationTypeRoleAssigned        = "role_assigned"
 	NotificationTypeInvitationReceived  = "invitation_received"
 )
+
+// Notification channels
+const (
+	NotificationChannelInApp = "in_app"
+	NotificationChannelEmail = "email"
+	NotificationChannelPush  = "push"
+)
+
+// NotificationPreference is a user's channel choice for one notification type.
+// Types without a row use the defaults of the notification service.
+type NotificationPreference struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	UserID    uint      `json:"-" gorm:"not null;uniqueIndex:idx_notification_preference"`
+	Type      string    `json:"type" gorm:"size:50;not null;uniqueIndex:idx_notification_preference"`
+	InApp     bool      `json:"in_app" gorm:"not null"`
+	Email     bool      `json:"email" gorm:"not null"`
+	Push      bool      `json:"push" gorm:"not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (NotificationPreference) TableName() string {
+	return "notification_preferences"
+}
+
+// NotificationSettings holds a user's settings that apply to every notification type.
+// During quiet hours email and push delivery of non-urgent notifications waits until the
+// quiet hours end; the in-app notification is still stored right away.
+type NotificationSettings struct {
+	UserID            uint      `json:"-" gorm:"primaryKey;autoIncrement:false"`
+	QuietHoursEnabled bool      `json:"enabled" gorm:"not null"`
+	QuietHoursStart   string    `json:"start" gorm:"size:5"` // HH:MM in Timezone
+	QuietHoursEnd     string    `json:"end" gorm:"size:5"`
+	Timezone          string    `json:"timezone" gorm:"size:64"`
+	DigestFrequency   string    `json:"digest" gorm:"size:10;not null;default:'off'"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func (NotificationSettings) TableName() string {
+	return "notification_settings"
+}
+
+// NotificationDelivery is an email or push delivery held back by quiet hours. Payload is the
+// notification as JSON, so the delivery works even when the in-app copy is disabled or deleted.
+type NotificationDelivery struct {
+	ID             uint       `json:"id" gorm:"primaryKey"`
+	UserID         uint       `json:"user_id" gorm:"not null;index"`
+	NotificationID *uint      `json:"notification_id"`
+	Channel        string     `json:"channel" gorm:"size:20;not null"`
+	Payload        string     `json:"payload" gorm:"type:text;not null"`
+	DeliverAfter   time.Time  `json:"deliver_after" gorm:"not null;index"`
+	SentAt         *time.Time `json:"sent_at" gorm:"index"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (NotificationDelivery) TableName() string {
+	return "notification_deliveries"
+}
+
+// Digest frequencies
+const (
+	DigestFrequencyOff    = "off"
+	DigestFrequencyDaily  = "daily"
+	DigestFrequencyWeekly = "weekly"
+)
+
+// NotificationDigest records one digest run for a user. The next digest only includes
+// notifications and chat messages newer than LastNotificationID and LastMessageID, so nothing
+// is sent twice. Runs with nothing new are recorded too, with Emailed false, to keep the cadence.
+type NotificationDigest struct {
+	ID                 uint      `json:"id" gorm:"primaryKey"`
+	UserID             uint      `json:"user_id" gorm:"not null;index"`
+	Frequency          string    `json:"frequency" gorm:"size:10;not null"`
+	NotificationCount  int       `json:"notification_count"`
+	MessageCount       int       `json:"message_count"`
+	LastNotificationID uint      `json:"last_notification_id"`
+	LastMessageID      uint      `json:"last_message_id"`
+	Emailed            bool      `json:"emailed" gorm:"not null;default:false"`
+	CreatedAt          time.Time `json:"created_at" gorm:"index"`
+}
+
+func (NotificationDigest) TableName() string {
+	return "notification_digests"
+}
@@ -2,11 +2,14 @@ package model
 
 import "time"
 
+// OTP is an emailed one-time code. Only a keyed hash of the code is stored, and the code
+// stops working after too many wrong guesses (Attempts).
 type OTP struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	Email     string    `json:"email" gorm:"not null;index"`
-	Code      string    `json:"code" gorm:"not null"`
-	Purpose   string    `json:"purpose" gorm:"not null;default:'registration';check:purpose IN ('registration','password_reset','email_change')"`
+	CodeHash  string    `json:"-" gorm:"size:64;not null"`
+	Purpose   string    `json:"purpose" gorm:"not null;default:'registration';check:purpose IN ('registration','password_reset','email_change','two_factor')"`
+	Attempts  int       `json:"attempts" gorm:"not null;default:0"`
 	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
 	IsUsed    bool      `json:"is_used" gorm:"default:false"`
 	CreatedAt time.Time `json:"created_at"`
@@ -16,3 +19,17 @@ type OTP struct {
 func (OTP) TableName() string {
 	return "otps"
 }
+
+// OTPRequest records every code that was sent, for the resend cooldown and the daily caps.
+// Rows outlive the OTP itself and are removed after a day.
+type OTPRequest struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Email     string    `json:"email" gorm:"not null;index"`
+	Purpose   string    `json:"purpose" gorm:"size:30;not null"`
+	IPAddress string    `json:"ip_address" gorm:"size:64;index"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+func (OTPRequest) TableName() string {
+	return "otp_requests"
+}
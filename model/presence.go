@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// Presence statuses
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+// ChatConnection is an open chat WebSocket connection. Its row is touched while the client
+// is active, so connections left behind by a crashed instance stop counting once they go stale.
+type ChatConnection struct {
+	ID           string    `json:"id" gorm:"primaryKey;size:36"`
+	UserID       uint      `json:"user_id" gorm:"not null;index"`
+	LastActiveAt time.Time `json:"last_active_at" gorm:"not null;index"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (ChatConnection) TableName() string {
+	return "chat_connections"
+}
+
+// UserPresence is what other users see of someone's connection state
+type UserPresence struct {
+	UserID     uint       `json:"user_id"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
@@ -43,6 +43,49 @@ type Project struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// Project lifecycle statuses
+const (
+	ProjectStatusDraft             = "draft"
+	ProjectStatusPublished         = "published"
+	ProjectStatusRecruitmentClosed = "recruitment_closed"
+	ProjectStatusInProgress        = "in_progress"
+	ProjectStatusCompleted         = "completed"
+	ProjectStatusArchived          = "archived"
+	ProjectStatusCancelled         = "cancelled"
+)
+
+// projectStatusTransitions lists the statuses a project may move to from each status
+var projectStatusTransitions = map[string][]string{
+	ProjectStatusDraft:             {ProjectStatusPublished, ProjectStatusCancelled},
+	ProjectStatusPublished:         {ProjectStatusRecruitmentClosed, ProjectStatusInProgress, ProjectStatusCancelled},
+	ProjectStatusRecruitmentClosed: {ProjectStatusPublished, ProjectStatusInProgress, ProjectStatusCancelled},
+	ProjectStatusInProgress:        {ProjectStatusCompleted, ProjectStatusCancelled},
+	ProjectStatusCompleted:         {ProjectStatusArchived},
+	ProjectStatusCancelled:         {ProjectStatusArchived},
+	ProjectStatusArchived:          {},
+}
+
+// IsValidProjectStatus reports whether status is a known lifecycle status
+func IsValidProjectStatus(status string) bool {
+	_, ok := projectStatusTransitions[status]
+	return ok
+}
+
+// CanTransitionProjectStatus reports whether a project may move from one status to another
+func CanTransitionProjectStatus(from, to string) bool {
+	for _, next := range projectStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextProjectStatuses returns the statuses reachable from the given status
+func NextProjectStatuses(status string) []string {
+	return append([]string{}, projectStatusTransitions[status]...)
+}
+
 func (Project) TableName() string {
 	return "projects"
 }
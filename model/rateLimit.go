@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// RateLimitBucket is a token bucket of the Postgres rate limit store. Tokens are refilled
+// lazily from UpdatedAt whenever the bucket is used.
+type RateLimitBucket struct {
+	Key       string    `gorm:"primaryKey;size:255"`
+	Tokens    float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null;index"`
+}
+
+func (RateLimitBucket) TableName() string {
+	return "rate_limit_buckets"
+}
+
+// AccountLockout counts failed logins of an account. After too many in a row the account is
+// locked until LockedUntil, for longer with every lockout in LockoutCount.
+type AccountLockout struct {
+	UserID         uint       `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	FailedAttempts int        `json:"failed_attempts" gorm:"not null;default:0"`
+	LastFailedAt   *time.Time `json:"last_failed_at,omitempty"`
+	LockoutCount   int        `json:"lockout_count" gorm:"not null;default:0"`
+	LockedAt       *time.Time `json:"locked_at,omitempty"`
+	LockedUntil    *time.Time `json:"locked_until,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (AccountLockout) TableName() string {
+	return "account_lockouts"
+}
@@ -0,0 +1,51 @@
+package model
+
+import "time"
+
+// UserTwoFactor is a user's TOTP authenticator. The secret is stored encrypted and only
+// protects logins once Enabled is set, after the user confirmed a first code from their app.
+type UserTwoFactor struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	UserID          uint       `json:"user_id" gorm:"not null;uniqueIndex"`
+	SecretEncrypted string     `json:"-" gorm:"type:text;not null"`
+	Enabled         bool       `json:"enabled" gorm:"not null;default:false"`
+	EnabledAt       *time.Time `json:"enabled_at,omitempty"`
+	// Time step of the last accepted code, so a code cannot be used twice
+	LastUsedStep int64     `json:"-" gorm:"not null;default:0"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (UserTwoFactor) TableName() string {
+	return "user_two_factors"
+}
+
+// TwoFactorBackupCode is a single-use code for logging in without the authenticator app.
+// Only a keyed hash is stored; the codes are shown to the user once.
+type TwoFactorBackupCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"size:64;not null;index"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (TwoFactorBackupCode) TableName() string {
+	return "two_factor_backup_codes"
+}
+
+// MFAChallenge is the "mfa_pending" state between a correct password and the second factor.
+// Its token is short-lived, cannot be used as an access token, and only its hash is stored.
+type MFAChallenge struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"not null;index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;not null;size:64"`
+	Attempts  int        `json:"attempts" gorm:"not null;default:0"`
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null;index"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (MFAChallenge) TableName() string {
+	return "mfa_challenges"
+}
@@ -17,8 +17,15 @@ type Users struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
-	PasswordResetToken string
-	PasswordResetAt    time.Time
+	PasswordResetToken string    `json:"-"`
+	PasswordResetAt    time.Time `json:"-"`
+
+	// Tokens issued before this moment are rejected ("log out of all devices")
+	TokensInvalidBefore *time.Time `json:"-"`
+
+	// When the user's last chat connection closed. Only exposed through the presence service,
+	// which hides it from blocked users.
+	LastSeenAt *time.Time `json:"-"`
 }
 
 func (Users) TableName() string {
@@ -1,9 +1,12 @@
 package routes
 
 import (
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 	"synergazing.com/synergazing/config"
 	"synergazing.com/synergazing/controller"
+	"synergazing.com/synergazing/middleware"
 	"synergazing.com/synergazing/service"
 )
 
@@ -15,27 +18,86 @@ func SetupAuthRoutes(app *fiber.App) {
 
 	authController := controller.NewAuthController(authService, otpService)
 	socialController := controller.NewSocialController(socialAuthService, authService)
+	emailChangeController := controller.NewEmailChangeController(service.NewEmailChangeService(otpService))
+	twoFactorController := controller.NewTwoFactorController(authService.TwoFactor)
+
+	// Limits of the endpoints open to guessing and email flooding. Each is counted per IP and
+	// per email address.
+	loginLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name:       "login",
+		PerIP:      service.RateLimit{Requests: 20, Period: 5 * time.Minute},
+		PerAccount: service.RateLimit{Requests: 10, Period: 5 * time.Minute},
+		Account:    middleware.AccountFromEmail,
+	})
+	// The mfa_pending token caps the attempts per login, this caps them per account over all logins
+	twoFactorLoginLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name:       "login-2fa",
+		PerIP:      service.RateLimit{Requests: 20, Period: 5 * time.Minute},
+		PerAccount: service.RateLimit{Requests: 10, Period: 5 * time.Minute},
+		Account:    middleware.AccountFromMFAToken(authService.TwoFactor),
+	})
+	forgotPasswordLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name:       "forgot-password",
+		PerIP:      service.RateLimit{Requests: 10, Period: time.Hour},
+		PerAccount: service.RateLimit{Requests: 3, Period: time.Hour},
+		Account:    middleware.AccountFromEmail,
+	})
+	registerLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name:       "register-initiate",
+		PerIP:      service.RateLimit{Requests: 10, Period: time.Hour},
+		PerAccount: service.RateLimit{Requests: 5, Period: time.Hour},
+		Account:    middleware.AccountFromEmail,
+	})
+	otpVerifyLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name:       "otp-verify",
+		PerIP:      service.RateLimit{Requests: 30, Period: 10 * time.Minute},
+		PerAccount: service.RateLimit{Requests: 10, Period: 10 * time.Minute},
+		Account:    middleware.AccountFromEmail,
+	})
 
 	auth := app.Group("/api/auth")
 
-	auth.Post("/register/initiate", authController.InitiateRegistration)
+	auth.Post("/register/initiate", registerLimit, authController.InitiateRegistration)
 	auth.Post("/register/complete", authController.CompleteRegistration)
 	auth.Post("/otp/resend", authController.ResendOTP)
-	auth.Post("/otp/verify", authController.VerifyOTP)
+	auth.Post("/otp/verify", otpVerifyLimit, authController.VerifyOTP)
 
 	auth.Get("/register/info", authController.GetRegistrationInfo)
 	auth.Post("/register", authController.Register)
-	auth.Post("/login", authController.Login)
+	auth.Post("/login", loginLimit, authController.Login)
+	// Second step of the login for users with two-factor authentication, using the mfa_pending token
+	auth.Post("/login/2fa", twoFactorLoginLimit, authController.VerifyTwoFactorLogin)
+	auth.Post("/login/2fa/email-code", twoFactorLoginLimit, authController.RequestTwoFactorResetCode)
+	auth.Post("/login/2fa/reset", twoFactorLoginLimit, authController.ResetTwoFactorLogin)
 	auth.Post("/logout", authController.Logout)
+	auth.Post("/logout-all", middleware.AuthMiddleware(), authController.LogoutAllDevices)
+	auth.Post("/refresh", authController.RefreshToken)
+
+	// Active sessions (one per logged-in device)
+	auth.Get("/sessions", middleware.AuthMiddleware(), authController.GetSessions)
+	auth.Delete("/sessions/:id", middleware.AuthMiddleware(), authController.RevokeSession)
 
-	auth.Post("/forgot-password", authController.ForgotPassword)
+	auth.Post("/forgot-password", forgotPasswordLimit, authController.ForgotPassword)
 	auth.Post("/reset-password", authController.ResetPassword)
+	auth.Put("/password", middleware.AuthMiddleware(), authController.ChangePassword)
+
+	// Two-factor authentication (TOTP)
+	twoFactor := auth.Group("/2fa", middleware.AuthMiddleware())
+	twoFactor.Get("/", twoFactorController.GetStatus)
+	twoFactor.Post("/setup", twoFactorController.Setup)
+	twoFactor.Post("/enable", twoFactorController.Enable)
+	twoFactor.Post("/backup-codes", twoFactorController.RegenerateBackupCodes)
+	twoFactor.Post("/disable/email-code", twoFactorController.RequestDisableCode)
+	twoFactor.Post("/disable", twoFactorController.Disable)
 
 	// Email verification endpoints
 	auth.Post("/verify-email", authController.VerifyEmail)
 	auth.Post("/request-email-verification", authController.RequestEmailVerification)
 	auth.Get("/verification-status", authController.GetUserVerificationStatus)
 
+	// Undoes an email change from the link sent to the previous address
+	auth.Post("/email-change/revert", emailChangeController.RevertEmailChange)
+
 	// OAuth redirect endpoints
 	auth.Get("/success", socialController.OAuthSuccess)
 	auth.Get("/error", socialController.OAuthError)
@@ -43,4 +105,13 @@ func SetupAuthRoutes(app *fiber.App) {
 	google := auth.Group("/google")
 	google.Get("/login", socialController.GoogleLogin)
 	google.Get("/callback", socialController.GoogleCallback)
+	google.Post("/link", middleware.AuthMiddleware(), socialController.StartGoogleLink)
+	// Trades the single-use code of the success redirect for the tokens
+	auth.Post("/oauth/exchange", socialController.ExchangeOAuthCode)
+
+	// Social logins connected to the account
+	social := auth.Group("/social", middleware.AuthMiddleware())
+	social.Get("/", socialController.ListProviders)
+	social.Post("/link", socialController.LinkProvider)
+	social.Delete("/:provider", socialController.UnlinkProvider)
 }
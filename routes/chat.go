@@ -5,28 +5,69 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"synergazing.com/synergazing/controller"
 	"synergazing.com/synergazing/middleware"
+	"synergazing.com/synergazing/model"
 	"synergazing.com/synergazing/service"
 )
 
 func SetupChatRoutes(app *fiber.App) {
 	chatService := service.NewChatService()
-	chatController := controller.NewChatController(chatService)
+	tokenService := service.NewTokenServiceDefault()
+	chatHub := service.DefaultChatHub()
+	presenceService := service.NewPresenceService(chatService.DB)
+	chatController := controller.NewChatController(chatService, tokenService, presenceService, chatHub)
 
-	// WebSocket route (no auth middleware for WebSocket upgrade)
+	// WebSocket route, authenticated during the upgrade with a token subprotocol or a ticket
 	app.Use("/ws/chat", chatController.WebSocketUpgrade)
-	app.Get("/ws/chat", websocket.New(chatController.HandleWebSocket))
+	app.Get("/ws/chat", websocket.New(chatController.HandleWebSocket, websocket.Config{
+		Subprotocols: []string{controller.ChatTokenSubprotocol},
+	}))
 
 	// REST API routes (protected)
 	api := app.Group("/api/chat", middleware.AuthMiddleware())
 
+	// Issue a one-time ticket for the WebSocket handshake
+	api.Post("/ws-ticket", chatController.IssueWebSocketTicket)
+
 	// Get or create chat with another user
 	api.Get("/with/:user_id", chatController.GetOrCreateChat)
 
+	// Get (and join) the group chat room of a project
+	api.Get("/project/:project_id", chatController.GetProjectChat)
+
 	// Get all chats for current user
 	api.Get("/", chatController.GetUserChats)
 
+	// Block users from direct chats
+	api.Get("/blocks", chatController.GetBlockedUsers)
+	api.Post("/blocks/:user_id", chatController.BlockUser)
+	api.Delete("/blocks/:user_id", chatController.UnblockUser)
+
+	// Review reported messages
+	reports := api.Group("/reports", middleware.RequirePermission(model.PermissionChatModerate))
+	reports.Get("/", chatController.GetMessageReports)
+	reports.Put("/:report_id", chatController.ResolveMessageReport)
+
+	// Full-text search across the user's chats
+	api.Get("/search", chatController.SearchMessages)
+
 	// Get messages for a specific chat
 	api.Get("/:chat_id/messages", chatController.GetChatMessages)
+	api.Get("/:chat_id/messages/:message_id/context", chatController.GetMessageContext)
+
+	// Edit, delete and inspect the history of a single message
+	api.Patch("/:chat_id/messages/:message_id", chatController.EditMessage)
+	api.Delete("/:chat_id/messages/:message_id", chatController.DeleteMessage)
+	api.Get("/:chat_id/messages/:message_id/revisions", chatController.GetMessageRevisions)
+	api.Post("/:chat_id/messages/:message_id/report", chatController.ReportMessage)
+
+	// Upload and download chat attachments, only for participants of the chat
+	api.Post("/:chat_id/attachments", chatController.UploadAttachment)
+	api.Get("/:chat_id/attachments/:attachment_id", chatController.DownloadAttachment)
+	api.Get("/:chat_id/attachments/:attachment_id/thumbnail", chatController.DownloadAttachmentThumbnail)
+
+	// Mute a chat so it does not count towards unread notifications
+	api.Put("/:chat_id/mute", chatController.MuteChat)
+	api.Delete("/:chat_id/mute", chatController.UnmuteChat)
 
 	// Mark chat messages as read
 	api.Put("/:chat_id/read", chatController.MarkChatAsRead)
@@ -5,13 +5,23 @@ import (
 	"synergazing.com/synergazing/config"
 	"synergazing.com/synergazing/controller"
 	"synergazing.com/synergazing/middleware"
+	"synergazing.com/synergazing/model"
 	"synergazing.com/synergazing/service"
 )
 
 func SetupNotificationRoutes(app *fiber.App) {
 	db := config.GetDB()
 	notificationService := service.NewNotificationService(db)
-	notificationController := controller.NewNotificationController(notificationService)
+	tokenService := service.NewTokenServiceDefault()
+	notificationController := controller.NewNotificationController(notificationService, tokenService, service.DefaultChatHub())
+
+	// Server-Sent Events stream, registered before the group because it also accepts a ticket
+	app.Get("/api/notifications/stream", notificationController.StreamNotifications)
+
+	// Unsubscribe links in digest emails are signed and work without login. GET only shows a
+	// confirmation page, the unsubscribe itself is a POST.
+	app.Get("/api/notifications/digest/unsubscribe", notificationController.ConfirmUnsubscribeDigest)
+	app.Post("/api/notifications/digest/unsubscribe", notificationController.UnsubscribeDigest)
 
 	notifications := app.Group("/api/notifications", middleware.AuthMiddleware())
 
@@ -21,11 +31,15 @@ func SetupNotificationRoutes(app *fiber.App) {
 
 	notifications.Get("/count", notificationController.GetUnreadCount)
 
+	notifications.Get("/preferences", notificationController.GetPreferences)
+
+	notifications.Put("/preferences", notificationController.UpdatePreferences)
+
 	notifications.Put("/:id/read", notificationController.MarkAsRead)
 
 	notifications.Put("/read-all", notificationController.MarkAllAsRead)
 
 	notifications.Delete("/:id", notificationController.DeleteNotification)
 
-	notifications.Post("/test-deadlines", notificationController.TestDeadlineNotifications)
+	notifications.Post("/test-deadlines", middleware.RequirePermission(model.PermissionNotificationManage), notificationController.TestDeadlineNotifications)
 }
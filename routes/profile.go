@@ -10,6 +10,7 @@ import (
 func SetupProfileRoutes(app *fiber.App) {
 	profileService := service.NewProfileService()
 	profileController := controller.NewProfileController(profileService)
+	emailChangeController := controller.NewEmailChangeController(service.NewEmailChangeService(service.NewOTPService()))
 
 	profile := app.Group("/api", middleware.AuthMiddleware())
 
@@ -22,4 +23,10 @@ func SetupProfileRoutes(app *fiber.App) {
 	profile.Delete("/profile/picture", profileController.DeleteProfilePicture)
 	profile.Delete("/profile/cv", profileController.DeleteCVFile)
 	profile.Put("/profile/collaboration-status", profileController.UpdateCollaborationStatus)
+
+	// Changing the email address, confirmed with a code sent to the new address
+	profile.Get("/profile/email-change", emailChangeController.GetPendingEmailChange)
+	profile.Post("/profile/email-change", emailChangeController.RequestEmailChange)
+	profile.Post("/profile/email-change/confirm", emailChangeController.ConfirmEmailChange)
+	profile.Delete("/profile/email-change", emailChangeController.CancelEmailChange)
 }
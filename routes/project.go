@@ -16,6 +16,7 @@ func SetupProjectRoutes(app *fiber.App) {
 	timelineService := service.NewTimelineService(db)
 	ProjectService := service.NewProjectService(db, skillService, tagService, benefitService, timelineService)
 	projectController := controller.NewProjectController(ProjectService)
+	matchmakingController := controller.NewMatchmakingController(service.NewMatchmakingService(db))
 
 	// Register specific public routes FIRST to avoid conflicts with protected /:id route
 	app.Get("/api/projects/all", projectController.GetAllProjects)
@@ -34,7 +35,12 @@ func SetupProjectRoutes(app *fiber.App) {
 	project.Get("/", projectController.GetUserProjects)
 	project.Get("/created", projectController.GetMyCreatedProjects)
 	project.Get("/member", projectController.GetMyMemberProjects)
+	project.Get("/recommended", matchmakingController.GetRecommendedProjects)
 	project.Get("/:id", projectController.GetUserProject)
 	project.Get("/:id/capacity", projectController.GetProjectTeamCapacity)
+	project.Get("/:id/revisions", projectController.GetProjectRevisions)
+	project.Get("/:id/roles/:role_id/candidates", matchmakingController.GetRoleCandidates)
+	project.Put("/:id/status", projectController.UpdateProjectStatus)
+	project.Patch("/:id", projectController.UpdateProject)
 	project.Delete("/:id", projectController.DeleteProject)
 }
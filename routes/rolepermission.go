@@ -1 +1,39 @@
 package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/controller"
+	"synergazing.com/synergazing/middleware"
+	"synergazing.com/synergazing/model"
+	"synergazing.com/synergazing/service"
+)
+
+func SetupRolePermissionRoutes(app *fiber.App) {
+	db := config.GetDB()
+	rolePermissionService := service.NewRolePermissionService(db)
+	rolePermissionController := controller.NewRolePermissionController(rolePermissionService)
+
+	rbac := app.Group("/api/rbac", middleware.AuthMiddleware())
+
+	// Current user's roles and effective permissions
+	rbac.Get("/me", rolePermissionController.GetMyPermissions)
+
+	// Admin-only management endpoints
+	admin := rbac.Group("", middleware.RequirePermission(model.PermissionRoleManage))
+
+	admin.Get("/roles", rolePermissionController.GetRoles)
+	admin.Post("/roles", rolePermissionController.CreateRole)
+	admin.Get("/roles/:id", rolePermissionController.GetRole)
+	admin.Put("/roles/:id", rolePermissionController.UpdateRole)
+	admin.Delete("/roles/:id", rolePermissionController.DeleteRole)
+
+	admin.Get("/permissions", rolePermissionController.GetPermissions)
+	admin.Post("/permissions", rolePermissionController.CreatePermission)
+	admin.Put("/permissions/:id", rolePermissionController.UpdatePermission)
+	admin.Delete("/permissions/:id", rolePermissionController.DeletePermission)
+
+	admin.Get("/users/:user_id/roles", rolePermissionController.GetUserRoles)
+	admin.Post("/users/:user_id/roles", rolePermissionController.AssignRole)
+	admin.Delete("/users/:user_id/roles/:role_id", rolePermissionController.RemoveRole)
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"errors"
+	"sort"
+
+	"gorm.io/gorm"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+type MatchmakingService struct {
+	DB *gorm.DB
+}
+
+// RoleMatch is the score of a user against a single open project role
+type RoleMatch struct {
+	RoleID         uint   `json:"role_id"`
+	RoleName       string `json:"role_name"`
+	SlotsAvailable int    `json:"slots_available"`
+	helper.SkillMatchResult
+}
+
+// ProjectRecommendation is a project ranked by the best matching open role
+type ProjectRecommendation struct {
+	ProjectID            uint        `json:"project_id"`
+	Title                string      `json:"title"`
+	ProjectType          string      `json:"project_type"`
+	PictureURL           string      `json:"picture_url"`
+	Location             string      `json:"location"`
+	RegistrationDeadline string      `json:"registration_deadline"`
+	Score                float64     `json:"score"`
+	BestRole             RoleMatch   `json:"best_role"`
+	Roles                []RoleMatch `json:"roles"`
+}
+
+// CandidateMatch is a ready user ranked against a project role
+type CandidateMatch struct {
+	User ReadyUserResponse `json:"user"`
+	helper.SkillMatchResult
+}
+
+func NewMatchmakingService(db *gorm.DB) *MatchmakingService {
+	return &MatchmakingService{DB: db}
+}
+
+// GetRecommendedProjects ranks public projects with open roles by how well the user's skills match them
+func (s *MatchmakingService) GetRecommendedProjects(userID uint, limit int) ([]ProjectRecommendation, error) {
+	var userSkills []*model.UserSkill
+	if err := s.DB.Preload("Skill").Where("user_id = ?", userID).Find(&userSkills).Error; err != nil {
+		return nil, errors.New("failed to load user skills")
+	}
+	if len(userSkills) == 0 {
+		return []ProjectRecommendation{}, nil
+	}
+	skillMap := userSkillMap(userSkills)
+
+	var projects []model.Project
+	err := s.DB.Preload("RequiredSkills.Skill").
+		Preload("Roles", "slots_available > 0").
+		Preload("Roles.RequiredSkills.Skill").
+		Where("status = ? AND creator_id != ?", model.ProjectStatusPublished, userID).
+		Where("id NOT IN (?)", s.DB.Model(&model.ProjectMember{}).Select("project_id").Where("user_id = ?", userID)).
+		Find(&projects).Error
+	if err != nil {
+		return nil, errors.New("failed to load projects")
+	}
+
+	recommendations := []ProjectRecommendation{}
+	for _, project := range projects {
+		var roleMatches []RoleMatch
+		for _, role := range project.Roles {
+			match := helper.FilterColabolator(skillMap, roleRequiredSkillNames(&project, role))
+			if match.Score == 0 {
+				continue
+			}
+			roleMatches = append(roleMatches, RoleMatch{
+				RoleID:           role.ID,
+				RoleName:         role.Name,
+				SlotsAvailable:   role.SlotsAvailable,
+				SkillMatchResult: match,
+			})
+		}
+		if len(roleMatches) == 0 {
+			continue
+		}
+
+		sort.SliceStable(roleMatches, func(i, j int) bool {
+			return roleMatches[i].Score > roleMatches[j].Score
+		})
+
+		recommendation := ProjectRecommendation{
+			ProjectID:   project.ID,
+			Title:       project.Title,
+			ProjectType: project.ProjectType,
+			PictureURL:  helper.GetUrlFile(project.PictureURL),
+			Location:    project.Location,
+			Score:       roleMatches[0].Score,
+			BestRole:    roleMatches[0],
+			Roles:       roleMatches,
+		}
+		if !project.RegistrationDeadline.IsZero() {
+			recommendation.RegistrationDeadline = project.RegistrationDeadline.Format("2006-01-02T15:04:05Z07:00")
+		}
+		recommendations = append(recommendations, recommendation)
+	}
+
+	sort.SliceStable(recommendations, func(i, j int) bool {
+		return recommendations[i].Score > recommendations[j].Score
+	})
+
+	if limit > 0 && len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+
+	return recommendations, nil
+}
+
+// GetRoleCandidates ranks ready users against a role of a project owned by creatorID
+func (s *MatchmakingService) GetRoleCandidates(projectID, roleID, creatorID uint, limit int) ([]CandidateMatch, error) {
+	var project model.Project
+	if err := s.DB.Preload("RequiredSkills.Skill").First(&project, projectID).Error; err != nil {
+		return nil, errors.New("project not found")
+	}
+	if project.CreatorID != creatorID {
+		return nil, errors.New("only the project creator can view candidates")
+	}
+
+	var role model.ProjectRole
+	if err := s.DB.Preload("RequiredSkills.Skill").
+		Where("id = ? AND project_id = ?", roleID, projectID).
+		First(&role).Error; err != nil {
+		return nil, errors.New("role not found in this project")
+	}
+
+	requiredSkills := roleRequiredSkillNames(&project, &role)
+	if len(requiredSkills) == 0 {
+		return nil, errors.New("this role has no required skills to match against")
+	}
+
+	var memberIDs []uint
+	if err := s.DB.Model(&model.ProjectMember{}).Where("project_id = ?", projectID).Pluck("user_id", &memberIDs).Error; err != nil {
+		return nil, errors.New("failed to load project members")
+	}
+	excluded := map[uint]bool{project.CreatorID: true}
+	for _, id := range memberIDs {
+		excluded[id] = true
+	}
+
+	readyUsers, err := GetReadyUsers()
+	if err != nil {
+		return nil, errors.New("failed to load ready users")
+	}
+
+	candidates := []CandidateMatch{}
+	for _, user := range readyUsers {
+		if excluded[user.ID] {
+			continue
+		}
+
+		match := helper.FilterColabolator(userSkillMap(user.Skills), requiredSkills)
+		if match.Score == 0 {
+			continue
+		}
+		candidates = append(candidates, CandidateMatch{User: user, SkillMatchResult: match})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	if limit > 0 && len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return candidates, nil
+}
+
+// roleRequiredSkillNames returns the skills of a role, falling back to the project's
+// required skills when the creator did not list any for the role itself
+func roleRequiredSkillNames(project *model.Project, role *model.ProjectRole) []string {
+	var names []string
+	for _, roleSkill := range role.RequiredSkills {
+		names = append(names, roleSkill.Skill.Name)
+	}
+	if len(names) > 0 {
+		return names
+	}
+
+	for _, projectSkill := range project.RequiredSkills {
+		names = append(names, projectSkill.Skill.Name)
+	}
+	return names
+}
+
+func userSkillMap(userSkills []*model.UserSkill) map[string]int {
+	skills := make(map[string]int, len(userSkills))
+	for _, userSkill := range userSkills {
+		skills[userSkill.Skill.Name] = userSkill.Proficiency
+	}
+	return skills
+}
@@ -1 +1,522 @@
-package service
\ No newline at end of file
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/model"
+)
+
+type RolePermissionService struct {
+	DB *gorm.DB
+}
+
+func NewRolePermissionService(db *gorm.DB) *RolePermissionService {
+	return &RolePermissionService{DB: db}
+}
+
+func NewRolePermissionServiceDefault() *RolePermissionService {
+	return &RolePermissionService{DB: config.GetDB()}
+}
+
+// RoleDataDTO carries the writable fields of a role
+type RoleDataDTO struct {
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	PermissionSlugs []string `json:"permissions"`
+}
+
+// PermissionDataDTO carries the writable fields of a permission
+type PermissionDataDTO struct {
+	Name  string `json:"name"`
+	Slug  string `json:"slug"`
+	Group string `json:"group"`
+}
+
+type defaultPermission struct {
+	Name  string
+	Slug  string
+	Group string
+}
+
+var defaultPermissions = []defaultPermission{
+	{Name: "Manage roles and permissions", Slug: model.PermissionRoleManage, Group: "rbac"},
+	{Name: "Manage users", Slug: model.PermissionUserManage, Group: "user"},
+	{Name: "Moderate projects", Slug: model.PermissionProjectModerate, Group: "project"},
+	{Name: "Moderate chat", Slug: model.PermissionChatModerate, Group: "chat"},
+	{Name: "Manage notifications", Slug: model.PermissionNotificationManage, Group: "notification"},
+}
+
+var defaultRoles = []struct {
+	Name        string
+	Description string
+	Permissions []string
+}{
+	{
+		Name:        model.RoleAdmin,
+		Description: "Full access to every administrative feature",
+		Permissions: nil, // admin always receives every permission
+	},
+	{
+		Name:        model.RoleModerator,
+		Description: "Can moderate projects and chat",
+		Permissions: []string{model.PermissionProjectModerate, model.PermissionChatModerate},
+	},
+	{
+		Name:        model.RoleMember,
+		Description: "Regular platform member",
+		Permissions: []string{},
+	},
+}
+
+// SeedDefaultRolesAndPermissions creates the default permissions and roles if they are missing.
+// It is safe to run on every startup.
+func (s *RolePermissionService) SeedDefaultRolesAndPermissions() error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var allPermissions []*model.Permission
+		for _, p := range defaultPermissions {
+			permission := model.Permission{Slug: p.Slug}
+			if err := tx.Where(model.Permission{Slug: p.Slug}).
+				Attrs(model.Permission{Name: p.Name, Group: p.Group}).
+				FirstOrCreate(&permission).Error; err != nil {
+				return fmt.Errorf("failed to seed permission %s: %v", p.Slug, err)
+			}
+		}
+
+		if err := tx.Find(&allPermissions).Error; err != nil {
+			return fmt.Errorf("failed to load permissions: %v", err)
+		}
+
+		for _, r := range defaultRoles {
+			var role model.Role
+			created := false
+			if err := tx.Where("name = ?", r.Name).First(&role).Error; err != nil {
+				if !errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("failed to find role %s: %v", r.Name, err)
+				}
+				role = model.Role{Name: r.Name, Description: r.Description}
+				if err := tx.Create(&role).Error; err != nil {
+					return fmt.Errorf("failed to seed role %s: %v", r.Name, err)
+				}
+				created = true
+			}
+
+			// Admin is kept in sync with every permission, other roles are only
+			// populated when they are first created so admins can customise them.
+			if r.Name == model.RoleAdmin {
+				if err := tx.Model(&role).Association("Permissions").Replace(allPermissions); err != nil {
+					return fmt.Errorf("failed to sync admin permissions: %v", err)
+				}
+			} else if created && len(r.Permissions) > 0 {
+				var permissions []*model.Permission
+				if err := tx.Where("slug IN ?", r.Permissions).Find(&permissions).Error; err != nil {
+					return fmt.Errorf("failed to load permissions for role %s: %v", r.Name, err)
+				}
+				if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+					return fmt.Errorf("failed to assign permissions to role %s: %v", r.Name, err)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Role management
+
+func (s *RolePermissionService) GetAllRoles() ([]model.Role, error) {
+	var roles []model.Role
+	if err := s.DB.Preload("Permissions").Order("name ASC").Find(&roles).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve roles: %v", err)
+	}
+	return roles, nil
+}
+
+func (s *RolePermissionService) GetRoleByID(roleID uint) (*model.Role, error) {
+	var role model.Role
+	if err := s.DB.Preload("Permissions").First(&role, roleID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("role not found")
+		}
+		return nil, fmt.Errorf("failed to retrieve role: %v", err)
+	}
+	return &role, nil
+}
+
+func (s *RolePermissionService) CreateRole(data RoleDataDTO) (*model.Role, error) {
+	name := strings.TrimSpace(data.Name)
+	if name == "" {
+		return nil, errors.New("role name is required")
+	}
+
+	var existing model.Role
+	if err := s.DB.Where("LOWER(name) = LOWER(?)", name).First(&existing).Error; err == nil {
+		return nil, errors.New("role already exists")
+	}
+
+	tx := s.DB.Begin()
+
+	role := model.Role{
+		Name:        name,
+		Description: data.Description,
+	}
+	if err := tx.Create(&role).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to create role: %v", err)
+	}
+
+	if len(data.PermissionSlugs) > 0 {
+		permissions, err := s.findPermissionsBySlug(tx, data.PermissionSlugs)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to assign permissions: %v", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return s.GetRoleByID(role.ID)
+}
+
+func (s *RolePermissionService) UpdateRole(roleID uint, data RoleDataDTO) (*model.Role, error) {
+	var role model.Role
+	if err := s.DB.First(&role, roleID).Error; err != nil {
+		return nil, errors.New("role not found")
+	}
+
+	name := strings.TrimSpace(data.Name)
+	if name != "" && name != role.Name {
+		if isDefaultRole(role.Name) {
+			return nil, errors.New("default roles cannot be renamed")
+		}
+		var existing model.Role
+		if err := s.DB.Where("LOWER(name) = LOWER(?) AND id != ?", name, roleID).First(&existing).Error; err == nil {
+			return nil, errors.New("role already exists")
+		}
+		role.Name = name
+	}
+	if data.Description != "" {
+		role.Description = data.Description
+	}
+
+	tx := s.DB.Begin()
+
+	if err := tx.Save(&role).Error; err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to update role: %v", err)
+	}
+
+	if data.PermissionSlugs != nil {
+		if role.Name == model.RoleAdmin {
+			tx.Rollback()
+			return nil, errors.New("admin permissions are managed automatically")
+		}
+		permissions, err := s.findPermissionsBySlug(tx, data.PermissionSlugs)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to assign permissions: %v", err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return s.GetRoleByID(role.ID)
+}
+
+func (s *RolePermissionService) DeleteRole(roleID uint) error {
+	var role model.Role
+	if err := s.DB.First(&role, roleID).Error; err != nil {
+		return errors.New("role not found")
+	}
+
+	if isDefaultRole(role.Name) {
+		return errors.New("default roles cannot be deleted")
+	}
+
+	tx := s.DB.Begin()
+
+	if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to detach permissions: %v", err)
+	}
+	if err := tx.Model(&role).Association("Users").Clear(); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to detach users: %v", err)
+	}
+	if err := tx.Delete(&role).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete role: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// Permission management
+
+func (s *RolePermissionService) GetAllPermissions() ([]model.Permission, error) {
+	var permissions []model.Permission
+	if err := s.DB.Order(`"group" ASC, slug ASC`).Find(&permissions).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve permissions: %v", err)
+	}
+	return permissions, nil
+}
+
+func (s *RolePermissionService) CreatePermission(data PermissionDataDTO) (*model.Permission, error) {
+	name := strings.TrimSpace(data.Name)
+	slug := strings.ToLower(strings.TrimSpace(data.Slug))
+	if name == "" || slug == "" {
+		return nil, errors.New("permission name and slug are required")
+	}
+
+	var existing model.Permission
+	if err := s.DB.Where("slug = ? OR name = ?", slug, name).First(&existing).Error; err == nil {
+		return nil, errors.New("permission already exists")
+	}
+
+	permission := model.Permission{
+		Name:  name,
+		Slug:  slug,
+		Group: data.Group,
+	}
+	if err := s.DB.Create(&permission).Error; err != nil {
+		return nil, fmt.Errorf("failed to create permission: %v", err)
+	}
+
+	// Keep the admin role in possession of every permission
+	var admin model.Role
+	if err := s.DB.Where("name = ?", model.RoleAdmin).First(&admin).Error; err == nil {
+		if err := s.DB.Model(&admin).Association("Permissions").Append(&permission); err != nil {
+			log.Printf("Failed to grant permission %s to admin role: %v", slug, err)
+		}
+	}
+
+	return &permission, nil
+}
+
+func (s *RolePermissionService) UpdatePermission(permissionID uint, data PermissionDataDTO) (*model.Permission, error) {
+	var permission model.Permission
+	if err := s.DB.First(&permission, permissionID).Error; err != nil {
+		return nil, errors.New("permission not found")
+	}
+
+	if name := strings.TrimSpace(data.Name); name != "" {
+		permission.Name = name
+	}
+	if slug := strings.ToLower(strings.TrimSpace(data.Slug)); slug != "" && slug != permission.Slug {
+		if isDefaultPermission(permission.Slug) {
+			return nil, errors.New("default permission slugs cannot be changed")
+		}
+		permission.Slug = slug
+	}
+	if data.Group != "" {
+		permission.Group = data.Group
+	}
+
+	if err := s.DB.Save(&permission).Error; err != nil {
+		return nil, fmt.Errorf("failed to update permission: %v", err)
+	}
+	return &permission, nil
+}
+
+func (s *RolePermissionService) DeletePermission(permissionID uint) error {
+	var permission model.Permission
+	if err := s.DB.First(&permission, permissionID).Error; err != nil {
+		return errors.New("permission not found")
+	}
+
+	if isDefaultPermission(permission.Slug) {
+		return errors.New("default permissions cannot be deleted")
+	}
+
+	tx := s.DB.Begin()
+
+	if err := tx.Exec("DELETE FROM role_permissions WHERE permission_id = ?", permission.ID).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to detach permission from roles: %v", err)
+	}
+	if err := tx.Delete(&permission).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete permission: %v", err)
+	}
+
+	return tx.Commit().Error
+}
+
+// User role assignment
+
+func (s *RolePermissionService) GetUserRoles(userID uint) ([]*model.Role, error) {
+	var user model.Users
+	if err := s.DB.Preload("Role.Permissions").First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	return user.Role, nil
+}
+
+func (s *RolePermissionService) AssignRoleToUser(userID, roleID uint) error {
+	var user model.Users
+	if err := s.DB.First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+
+	var role model.Role
+	if err := s.DB.First(&role, roleID).Error; err != nil {
+		return errors.New("role not found")
+	}
+
+	if err := s.DB.Model(&user).Association("Role").Append(&role); err != nil {
+		return fmt.Errorf("failed to assign role: %v", err)
+	}
+	return nil
+}
+
+func (s *RolePermissionService) AssignRoleToUserByName(userID uint, roleName string) error {
+	var role model.Role
+	if err := s.DB.Where("name = ?", roleName).First(&role).Error; err != nil {
+		return fmt.Errorf("role %s not found", roleName)
+	}
+	return s.AssignRoleToUser(userID, role.ID)
+}
+
+// AssignDefaultRole gives a newly created user the member role
+func (s *RolePermissionService) AssignDefaultRole(userID uint) {
+	if err := s.AssignRoleToUserByName(userID, model.RoleMember); err != nil {
+		log.Printf("Failed to assign default role to user %d: %v", userID, err)
+	}
+}
+
+func (s *RolePermissionService) RemoveRoleFromUser(userID, roleID uint) error {
+	var user model.Users
+	if err := s.DB.First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+
+	var role model.Role
+	if err := s.DB.First(&role, roleID).Error; err != nil {
+		return errors.New("role not found")
+	}
+
+	if role.Name != model.RoleAdmin {
+		if err := s.DB.Model(&user).Association("Role").Delete(&role); err != nil {
+			return fmt.Errorf("failed to remove role: %v", err)
+		}
+		return nil
+	}
+
+	// The admin role row is locked so two admins removed at the same time cannot both pass the
+	// check. Users who are not admins can be "removed" from it even when there is one admin left.
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&role, role.ID).Error; err != nil {
+			return errors.New("role not found")
+		}
+
+		var held, adminCount int64
+		if err := tx.Table("user_roles").Where("role_id = ? AND users_id = ?", role.ID, user.ID).Count(&held).Error; err != nil {
+			return fmt.Errorf("failed to count admins: %v", err)
+		}
+		if err := tx.Table("user_roles").Where("role_id = ?", role.ID).Count(&adminCount).Error; err != nil {
+			return fmt.Errorf("failed to count admins: %v", err)
+		}
+		if held > 0 && adminCount <= 1 {
+			return errors.New("cannot remove the last admin")
+		}
+
+		if err := tx.Model(&user).Association("Role").Delete(&role); err != nil {
+			return fmt.Errorf("failed to remove role: %v", err)
+		}
+		return nil
+	})
+}
+
+// GetUserPermissions returns the slugs of every permission granted to the user through their roles
+func (s *RolePermissionService) GetUserPermissions(userID uint) ([]string, error) {
+	var slugs []string
+	err := s.DB.Table("permissions").
+		Distinct("permissions.slug").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.users_id = ?", userID).
+		Order("permissions.slug ASC").
+		Pluck("permissions.slug", &slugs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve user permissions: %v", err)
+	}
+	return slugs, nil
+}
+
+// UserHasPermission checks whether any of the user's roles grants the given permission slug
+func (s *RolePermissionService) UserHasPermission(userID uint, slug string) (bool, error) {
+	var count int64
+	err := s.DB.Table("permissions").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN user_roles ON user_roles.role_id = role_permissions.role_id").
+		Where("user_roles.users_id = ? AND permissions.slug = ?", userID, slug).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check permission: %v", err)
+	}
+	return count > 0, nil
+}
+
+func (s *RolePermissionService) findPermissionsBySlug(tx *gorm.DB, slugs []string) ([]*model.Permission, error) {
+	if len(slugs) == 0 {
+		return []*model.Permission{}, nil
+	}
+
+	var permissions []*model.Permission
+	if err := tx.Where("slug IN ?", slugs).Find(&permissions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load permissions: %v", err)
+	}
+
+	if len(permissions) != len(slugs) {
+		found := make(map[string]bool)
+		for _, p := range permissions {
+			found[p.Slug] = true
+		}
+		var missing []string
+		for _, slug := range slugs {
+			if !found[slug] {
+				missing = append(missing, slug)
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("unknown permissions: %s", strings.Join(missing, ", "))
+		}
+	}
+
+	return permissions, nil
+}
+
+func isDefaultRole(name string) bool {
+	for _, r := range defaultRoles {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isDefaultPermission(slug string) bool {
+	for _, p := range defaultPermissions {
+		if p.Slug == slug {
+			return true
+		}
+	}
+	return false
+}
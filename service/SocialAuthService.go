@@ -1,15 +1,45 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/helper"
 	"synergazing.com/synergazing/model"
 )
 
+// ErrSocialLinkRequired is returned by HandleProviderCallback when the provider's email belongs
+// to an existing account. The user has to sign in to that account and link the provider, so
+// whoever controls a provider account with the same email cannot take the account over.
+var ErrSocialLinkRequired = errors.New("an account with this email already exists, sign in and link the provider from your account")
+
+// Errors of linking and unlinking that are shown to the user as they are
+var (
+	ErrProviderLinkedElsewhere = errors.New("this provider account is already linked to another user")
+	ErrProviderAlreadyLinked   = errors.New("another account of this provider is already linked, unlink it first")
+	errProviderNotLinked       = errors.New("provider is not linked to your account")
+	errLastSignInMethod        = errors.New("set a password with forgot password before unlinking your only sign-in method")
+)
+
+// LinkedProvider is a social login connected to an account
+type LinkedProvider struct {
+	Provider string    `json:"provider"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// LinkedProviders lists the social logins of an account. HasPassword tells whether the account
+// can still sign in when the last provider is unlinked.
+type LinkedProviders struct {
+	HasPassword bool             `json:"has_password"`
+	Providers   []LinkedProvider `json:"providers"`
+}
+
 type SocialAuthService struct {
 	db *gorm.DB
 }
@@ -20,7 +50,10 @@ func NewSocialAuthService(db *gorm.DB) *SocialAuthService {
 	}
 }
 
-func (s *SocialAuthService) HandleProviderCallback(provider, providerID, name, email string) (*model.Users, error) {
+// HandleProviderCallback signs in the user of a provider account, creating the user on first
+// sign-in. Existing accounts with the same email are only joined automatically when they have no
+// password and the provider verified the email; otherwise ErrSocialLinkRequired is returned.
+func (s *SocialAuthService) HandleProviderCallback(provider, providerID, name, email string, emailVerified bool) (*model.Users, error) {
 	log.Printf("🔄 HandleProviderCallback: provider=%s, providerID=%s, name=%s, email=%s", provider, providerID, name, email)
 
 	var socialAuth model.SocialAuth
@@ -36,9 +69,14 @@ func (s *SocialAuthService) HandleProviderCallback(provider, providerID, name, e
 
 	// Check if user already exists by email
 	var user model.Users
-	if err := s.db.Where("email = ?", email).First(&user).Error; err == nil {
+	if err := s.db.Where("LOWER(email) = LOWER(?)", email).First(&user).Error; err == nil {
 		log.Printf("✅ Found existing user by email=%s, user_id=%d", email, user.ID)
 
+		if user.Password != "" || !emailVerified {
+			log.Printf("🔗 User_id=%d has to link %s explicitly", user.ID, provider)
+			return nil, ErrSocialLinkRequired
+		}
+
 		// Update existing user to be email verified for OAuth login
 		user.IsEmailVerified = true
 		if err := s.db.Save(&user).Error; err != nil {
@@ -75,7 +113,7 @@ func (s *SocialAuthService) HandleProviderCallback(provider, providerID, name, e
 		Name:            name,
 		Email:           email,
 		Phone:           phoneNumber, // Use random Indonesian phone number
-		IsEmailVerified: true,        // OAuth users are automatically email verified
+		IsEmailVerified: emailVerified,
 	}
 
 	if err := tx.Create(&newUser).Error; err != nil {
@@ -102,6 +140,164 @@ func (s *SocialAuthService) HandleProviderCallback(provider, providerID, name, e
 		return nil, err
 	}
 
+	NewRolePermissionService(s.db).AssignDefaultRole(newUser.ID)
+
 	log.Printf("✅ Successfully created new user and social auth, user_id=%d", newUser.ID)
 	return &newUser, nil
 }
+
+// LinkWithToken connects the provider account of a link token from a social login to a
+// logged-in user. The token travels through URLs and is not tied to the user, so the user has to
+// confirm with their password; otherwise anyone could get their own provider account linked by
+// sending the link to a logged-in victim.
+func (s *SocialAuthService) LinkWithToken(userID uint, linkToken, password string) (*LinkedProvider, error) {
+	token, err := helper.DecodeSocialLinkToken(linkToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var user model.Users
+	if err := s.db.Select("id", "password").First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	if user.Password == "" {
+		return nil, errors.New("your account has no password, link the provider from your account settings instead")
+	}
+	if password == "" {
+		return nil, errors.New("current password is required")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, errors.New("current password is incorrect")
+	}
+
+	return s.LinkProvider(userID, token.Provider, token.ProviderID, token.Email)
+}
+
+// LinkProvider connects a provider account to a user. A user has at most one account per
+// provider. The user is emailed about the new sign-in method.
+func (s *SocialAuthService) LinkProvider(userID uint, provider, providerID, providerEmail string) (*LinkedProvider, error) {
+	var socialAuth model.SocialAuth
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user model.Users
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var existing model.SocialAuth
+		err := tx.Where("provider = ? AND provider_id = ?", provider, providerID).First(&existing).Error
+		if err == nil {
+			if existing.UserID != userID {
+				return ErrProviderLinkedElsewhere
+			}
+			socialAuth = existing
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&model.SocialAuth{}).Where("user_id = ? AND provider = ?", userID, provider).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrProviderAlreadyLinked
+		}
+
+		socialAuth = model.SocialAuth{UserID: userID, Provider: provider, ProviderID: providerID}
+		if err := tx.Create(&socialAuth).Error; err != nil {
+			return err
+		}
+
+		return DefaultEmailOutbox().EnqueueTx(tx, OutgoingEmail{
+			To:       user.Email,
+			Template: "social_account_linked",
+			Data: map[string]interface{}{
+				"Name":          user.Name,
+				"Provider":      providerDisplayName(provider),
+				"ProviderEmail": providerEmail,
+				"LinkedAt":      time.Now().UTC().Format("2 January 2006, 15:04 UTC"),
+				"ResetURL":      helper.GetFrontendURL() + "/forgot-password",
+			},
+		})
+	})
+	if err != nil {
+		if errors.Is(err, ErrProviderLinkedElsewhere) || errors.Is(err, ErrProviderAlreadyLinked) {
+			return nil, err
+		}
+		log.Printf("Error linking %s to user %d: %v", provider, userID, err)
+		return nil, errors.New("failed to link provider")
+	}
+	DefaultEmailOutbox().notify()
+
+	return &LinkedProvider{Provider: socialAuth.Provider, LinkedAt: socialAuth.CreatedAt}, nil
+}
+
+// ListProviders returns the social logins of a user
+func (s *SocialAuthService) ListProviders(userID uint) (*LinkedProviders, error) {
+	var user model.Users
+	if err := s.db.Select("id", "password").First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var socialAuths []model.SocialAuth
+	if err := s.db.Where("user_id = ?", userID).Order("created_at ASC").Find(&socialAuths).Error; err != nil {
+		log.Printf("Database error listing providers of user %d: %v", userID, err)
+		return nil, errors.New("failed to retrieve linked providers")
+	}
+
+	result := &LinkedProviders{HasPassword: user.Password != "", Providers: []LinkedProvider{}}
+	for _, socialAuth := range socialAuths {
+		result.Providers = append(result.Providers, LinkedProvider{Provider: socialAuth.Provider, LinkedAt: socialAuth.CreatedAt})
+	}
+	return result, nil
+}
+
+// UnlinkProvider disconnects a provider from a user. The last provider of an account without a
+// password cannot be unlinked, the account would have no way to sign in.
+func (s *SocialAuthService) UnlinkProvider(userID uint, provider string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var user model.Users
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var socialAuths []model.SocialAuth
+		if err := tx.Where("user_id = ?", userID).Find(&socialAuths).Error; err != nil {
+			return err
+		}
+
+		var linked []uint
+		for _, socialAuth := range socialAuths {
+			if socialAuth.Provider == provider {
+				linked = append(linked, socialAuth.ID)
+			}
+		}
+		if len(linked) == 0 {
+			return errProviderNotLinked
+		}
+		if user.Password == "" && len(linked) == len(socialAuths) {
+			return errLastSignInMethod
+		}
+
+		return tx.Delete(&model.SocialAuth{}, linked).Error
+	})
+	if err != nil {
+		if errors.Is(err, errProviderNotLinked) || errors.Is(err, errLastSignInMethod) {
+			return err
+		}
+		log.Printf("Error unlinking %s from user %d: %v", provider, userID, err)
+		return errors.New("failed to unlink provider")
+	}
+	return nil
+}
+
+// providerDisplayName is the name of a provider as shown in emails
+func providerDisplayName(provider string) string {
+	switch provider {
+	case "google":
+		return "Google"
+	default:
+		return provider
+	}
+}
@@ -37,6 +37,26 @@ type UserProfileResponse struct {
 	Skills         []*model.UserSkill `json:"skills"`
 }
 
+// UserSummary is the public part of a user, for lists that show who someone is: no email,
+// phone or account details
+type UserSummary struct {
+	ID             uint   `json:"id"`
+	Name           string `json:"name"`
+	ProfilePicture string `json:"profile_picture"`
+}
+
+// NewUserSummary builds the summary of a user loaded with its Profile, or nil without a user
+func NewUserSummary(user *model.Users) *UserSummary {
+	if user == nil || user.ID == 0 {
+		return nil
+	}
+	summary := &UserSummary{ID: user.ID, Name: user.Name}
+	if user.Profile != nil {
+		summary.ProfilePicture = helper.GetUrlFile(user.Profile.ProfilePicture)
+	}
+	return summary
+}
+
 func GetAllUser() ([]model.Users, error) {
 	var user []model.Users
 	result := config.DB.Find(&user)
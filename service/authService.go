@@ -15,17 +15,38 @@ import (
 )
 
 type AuthService struct {
-	OTPService *OTPService
+	OTPService   *OTPService
+	TokenService *TokenService
+	TwoFactor    *TwoFactorService
+	Lockout      *LoginLockoutService
 }
 
 func NewAuthService(otpService *OTPService) *AuthService {
 	return &AuthService{
-		OTPService: otpService,
+		OTPService:   otpService,
+		TokenService: NewTokenServiceDefault(),
+		TwoFactor:    NewTwoFactorService(otpService),
+		Lockout:      NewLoginLockoutService(),
 	}
 }
 
+// LoginResult is the outcome of a correct password: either the tokens of a new session, or an
+// mfa_pending token when the user has two-factor authentication on
+type LoginResult struct {
+	Tokens *TokenPair
+	User   *model.Users
+
+	MFAToken     string
+	MFAExpiresAt time.Time
+}
+
+// MFARequired reports whether the login still needs the second factor
+func (r *LoginResult) MFARequired() bool {
+	return r.MFAToken != ""
+}
+
 // InitiateRegistration validates user data and sends OTP for email verification
-func (s *AuthService) InitiateRegistration(name, email, password, phone string) error {
+func (s *AuthService) InitiateRegistration(name, email, password, phone, ipAddress string) error {
 	if name == "" {
 		return errors.New("Name is required")
 	}
@@ -35,8 +56,8 @@ func (s *AuthService) InitiateRegistration(name, email, password, phone string)
 	if password == "" {
 		return errors.New("Password is required")
 	}
-	if len(password) < 8 {
-		return errors.New("Password must be at least 8 characters")
+	if err := helper.ValidatePassword(password); err != nil {
+		return err
 	}
 	if phone == "" {
 		return errors.New("Phone number is required")
@@ -51,11 +72,16 @@ func (s *AuthService) InitiateRegistration(name, email, password, phone string)
 	}
 
 	// Send OTP for email verification
-	return s.OTPService.SendOTP(email, "registration")
+	return s.OTPService.SendOTP(email, "registration", ipAddress)
 }
 
 // CompleteRegistration creates user account after OTP verification
 func (s *AuthService) CompleteRegistration(name, email, password, phone, otpCode string) (*model.Users, error) {
+	// Checked before the code, so a rejected password does not use it up
+	if err := helper.ValidatePassword(password); err != nil {
+		return nil, err
+	}
+
 	// Verify OTP first
 	if err := s.OTPService.VerifyOTP(email, otpCode, "registration"); err != nil {
 		return nil, err
@@ -87,6 +113,8 @@ func (s *AuthService) CompleteRegistration(name, email, password, phone, otpCode
 		return nil, fmt.Errorf("Failed to create user: %v", err)
 	}
 
+	NewRolePermissionService(db).AssignDefaultRole(user.ID)
+
 	user.Password = ""
 	return &user, nil
 }
@@ -102,8 +130,8 @@ func (s *AuthService) Register(name, email, password string, phone string) (*mod
 	if password == "" {
 		return nil, errors.New("Password is required")
 	}
-	if len(password) < 8 {
-		return nil, errors.New("Password must be at least 8 characters")
+	if err := helper.ValidatePassword(password); err != nil {
+		return nil, err
 	}
 	if phone == "" {
 		return nil, errors.New("Phone number is required")
@@ -133,38 +161,188 @@ func (s *AuthService) Register(name, email, password string, phone string) (*mod
 		log.Printf("Database error creating user: %v", err)
 		return nil, fmt.Errorf("Failed to create user: %v", err)
 	}
+
+	NewRolePermissionService(db).AssignDefaultRole(user.ID)
 	user.Password = ""
 	return &user, nil
 }
 
-func (s *AuthService) Login(email, password string) (string, *model.Users, error) {
+// Login checks the password. Users with two-factor authentication get an mfa_pending token to
+// finish the login with VerifyTwoFactorLogin instead of a session.
+func (s *AuthService) Login(email, password string, client ClientInfo) (*LoginResult, error) {
 	db := config.GetDB()
 
 	var user model.Users
 	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
-		return "", nil, errors.New("Invalid Credential Email")
+		return nil, errors.New("Invalid Credential Email")
+	}
+
+	// A locked account is refused even with the right password, otherwise guessing could go on
+	if err := s.Lockout.CheckLocked(user.ID); err != nil {
+		return nil, err
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "", nil, errors.New("Invalid Credential Password")
+		if err := s.Lockout.RecordFailure(&user, client); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("Invalid Credential Password")
 	}
+	user.Password = ""
 
-	token, err := helper.GenerateJWTToken(user.ID, user.Email)
+	// The lockout is only reset once the second factor is passed as well, so wrong codes keep counting
+	challenge, err := s.StartTwoFactorLogin(&user)
 	if err != nil {
-		return "", nil, errors.New("failed to generate token")
+		return nil, err
 	}
+	if challenge != nil {
+		return challenge, nil
+	}
+	s.Lockout.Reset(user.ID)
+
+	tokens, err := s.TokenService.IssueTokenPair(user.ID, user.Email, client)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	return &LoginResult{Tokens: tokens, User: &user}, nil
+}
+
+// StartTwoFactorLogin returns an mfa_pending login result if the user has two-factor
+// authentication on, or nil when the user can be logged in right away
+func (s *AuthService) StartTwoFactorLogin(user *model.Users) (*LoginResult, error) {
+	enabled, err := s.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		log.Printf("Database error checking two-factor authentication: %v", err)
+		return nil, errors.New("failed to log in")
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	token, expiresAt, err := s.TwoFactor.CreateChallenge(user.ID)
+	if err != nil {
+		log.Printf("Error creating two-factor challenge: %v", err)
+		return nil, errors.New("failed to log in")
+	}
+	return &LoginResult{User: user, MFAToken: token, MFAExpiresAt: expiresAt}, nil
+}
 
+// VerifyTwoFactorLogin finishes a login with the mfa_pending token and a code from the
+// authenticator app or a backup code. Wrong codes count towards the account lockout like wrong
+// passwords, since whoever gets here already knows the password.
+func (s *AuthService) VerifyTwoFactorLogin(mfaToken, code string, client ClientInfo) (*LoginResult, error) {
+	userID, err := s.TwoFactor.ChallengeUserID(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Lockout.CheckLocked(userID); err != nil {
+		return nil, err
+	}
+
+	user, err := s.TwoFactor.VerifyLogin(mfaToken, code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		var owner model.Users
+		if dbErr := config.GetDB().Select("id", "name", "email").First(&owner, userID).Error; dbErr == nil {
+			if lockErr := s.Lockout.RecordFailure(&owner, client); lockErr != nil {
+				return nil, lockErr
+			}
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lockout.Reset(user.ID)
+	return s.issueLoginResult(user, client)
+}
+
+// ResetTwoFactorLogin turns two-factor authentication off with an emailed code and finishes the login
+func (s *AuthService) ResetTwoFactorLogin(mfaToken, emailCode string, client ClientInfo) (*LoginResult, error) {
+	userID, err := s.TwoFactor.ChallengeUserID(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Lockout.CheckLocked(userID); err != nil {
+		return nil, err
+	}
+
+	user, err := s.TwoFactor.ResetWithEmailCode(mfaToken, emailCode)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lockout.Reset(user.ID)
+	return s.issueLoginResult(user, client)
+}
+
+// ExchangeOAuthLoginCode issues the tokens of a social login for the code the frontend was
+// redirected with. Signing in with a provider does not skip the second factor: two-factor users
+// get an mfa_pending token instead.
+func (s *AuthService) ExchangeOAuthLoginCode(code string, client ClientInfo) (*LoginResult, error) {
+	userID, err := s.TokenService.RedeemOAuthLoginCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	var user model.Users
+	if err := config.GetDB().First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
 	user.Password = ""
-	return token, &user, nil
+
+	challenge, err := s.StartTwoFactorLogin(&user)
+	if err != nil {
+		return nil, err
+	}
+	if challenge != nil {
+		return challenge, nil
+	}
+
+	return s.issueLoginResult(&user, client)
+}
+
+func (s *AuthService) issueLoginResult(user *model.Users, client ClientInfo) (*LoginResult, error) {
+	tokens, err := s.TokenService.IssueTokenPair(user.ID, user.Email, client)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+	return &LoginResult{Tokens: tokens, User: user}, nil
 }
 
+// Logout revokes the given token so it can no longer be used
 func (s *AuthService) Logout(token string) error {
+	claims, err := helper.VerifyJWTToken(token)
+	if err != nil {
+		return errors.New("invalid or expired token")
+	}
+
+	if err := s.TokenService.RevokeToken(claims); err != nil {
+		return err
+	}
+
+	return s.TokenService.RevokeSessionForLogout(claims)
+}
+
+// LogoutAllDevices invalidates every token issued to the user, including the current one
+func (s *AuthService) LogoutAllDevices(userID uint, currentClaims *helper.Claims) error {
+	if err := s.TokenService.RevokeAllUserTokens(userID); err != nil {
+		return err
+	}
+
+	if currentClaims != nil {
+		if err := s.TokenService.RevokeToken(currentClaims); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // ResendOTP resends OTP for the given email and purpose
-func (s *AuthService) ResendOTP(email, purpose string) error {
-	return s.OTPService.SendOTP(email, purpose)
+func (s *AuthService) ResendOTP(email, purpose, ipAddress string) error {
+	return s.OTPService.SendOTP(email, purpose, ipAddress)
 }
 
 // VerifyEmailWithOTP verifies email using OTP code
@@ -187,12 +365,28 @@ func (s *AuthService) VerifyEmailWithOTP(email, otpCode string) error {
 	return nil
 }
 
-func (s *AuthService) GenerateTokenForUser(userID uint, email string) (string, error) {
-	token, err := helper.GenerateJWTToken(userID, email)
+// IssueTokensForUser starts a new session and returns its access and refresh tokens
+func (s *AuthService) IssueTokensForUser(userID uint, email string, client ClientInfo) (*TokenPair, error) {
+	tokens, err := s.TokenService.IssueTokenPair(userID, email, client)
 	if err != nil {
-		return "", errors.New("failed to generate token")
+		return nil, errors.New("failed to generate token")
 	}
-	return token, nil
+	return tokens, nil
+}
+
+// RefreshTokens exchanges a refresh token for a new access/refresh token pair
+func (s *AuthService) RefreshTokens(refreshToken string, client ClientInfo) (*TokenPair, error) {
+	return s.TokenService.RefreshTokens(refreshToken, client)
+}
+
+// GetActiveSessions lists the devices the user is logged in on
+func (s *AuthService) GetActiveSessions(userID, currentSessionID uint) ([]SessionResponse, error) {
+	return s.TokenService.GetActiveSessions(userID, currentSessionID)
+}
+
+// RevokeSession logs the user out of a single device
+func (s *AuthService) RevokeSession(userID, sessionID uint) error {
+	return s.TokenService.RevokeUserSession(userID, sessionID)
 }
 
 func (s *AuthService) ForgotPassword(email string) error {
@@ -217,17 +411,30 @@ func (s *AuthService) ForgotPassword(email string) error {
 		return errors.New("failed to save reset token")
 	}
 
-	go helper.SendPasswordResetEmail(user.Email, token)
+	err := DefaultEmailOutbox().Enqueue(OutgoingEmail{
+		To:       user.Email,
+		Template: "password_reset",
+		Data: map[string]interface{}{
+			"ResetURL":       fmt.Sprintf("%s/reset-password?token=%s", helper.GetFrontendURL(), token),
+			"ExpiresMinutes": 5,
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing password reset email: %v", err)
+		return errors.New("failed to send password reset email")
+	}
 
 	return nil
 }
 
-func (s *AuthService) ResetPassword(token, password, passwordConfirm string) error {
+// ResetPassword sets a new password with a token from ForgotPassword. Every session is signed
+// out, since the password was probably reset because someone else knows it.
+func (s *AuthService) ResetPassword(token, password, passwordConfirm string, client ClientInfo) error {
 	if password != passwordConfirm {
 		return errors.New("passwords do not match")
 	}
-	if len(password) < 8 {
-		return errors.New("password must be at least 8 characters")
+	if err := helper.ValidatePassword(password); err != nil {
+		return err
 	}
 
 	db := config.GetDB()
@@ -251,9 +458,83 @@ func (s *AuthService) ResetPassword(token, password, passwordConfirm string) err
 		return errors.New("failed to update password")
 	}
 
+	if err := s.TokenService.RevokeAllUserTokens(user.ID); err != nil {
+		log.Printf("Error signing out user %d after password reset: %v", user.ID, err)
+	}
+	// Whoever can reset the password owns the email, so a lockout does not protect anything any more
+	s.Lockout.Reset(user.ID)
+	s.sendPasswordChangedAlert(&user, client)
+
+	return nil
+}
+
+// ChangePassword replaces the password of a logged-in user, who has to enter the current one.
+// Every other session is signed out and the user gets an email about the change.
+func (s *AuthService) ChangePassword(userID, currentSessionID uint, currentPassword, password, passwordConfirm string, client ClientInfo) error {
+	if password != passwordConfirm {
+		return errors.New("passwords do not match")
+	}
+
+	db := config.GetDB()
+	var user model.Users
+	if err := db.First(&user, userID).Error; err != nil {
+		return errors.New("User not found")
+	}
+
+	// Accounts created through social login set their first password with forgot password
+	if user.Password == "" {
+		return errors.New("your account has no password yet, use forgot password to set one")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		return errors.New("current password is incorrect")
+	}
+	if currentPassword == password {
+		return errors.New("new password must be different from the current password")
+	}
+	if err := helper.ValidatePassword(password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.New("failed to hash password")
+	}
+
+	if err := db.Model(&user).Updates(map[string]interface{}{
+		"password":             string(hashedPassword),
+		"password_reset_token": "",
+	}).Error; err != nil {
+		log.Printf("Database error changing password: %v", err)
+		return errors.New("failed to update password")
+	}
+
+	if err := s.TokenService.RevokeOtherSessions(user.ID, currentSessionID, model.SessionRevokedPassword); err != nil {
+		log.Printf("Error signing out other sessions of user %d: %v", user.ID, err)
+	}
+	s.sendPasswordChangedAlert(&user, client)
+
 	return nil
 }
 
+// sendPasswordChangedAlert tells the user their password changed, with a way to get the account
+// back if it was not them. The password is already changed, so a failure is only logged.
+func (s *AuthService) sendPasswordChangedAlert(user *model.Users, client ClientInfo) {
+	err := DefaultEmailOutbox().Enqueue(OutgoingEmail{
+		To:       user.Email,
+		Template: "password_changed",
+		Data: map[string]interface{}{
+			"Name":      user.Name,
+			"ChangedAt": time.Now().UTC().Format("2 January 2006, 15:04 UTC"),
+			"IPAddress": client.IPAddress,
+			"Device":    client.UserAgent,
+			"ResetURL":  helper.GetFrontendURL() + "/forgot-password",
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing password change alert for user %d: %v", user.ID, err)
+	}
+}
+
 // GetEmailVerificationStatus returns the email verification status of a user
 func (s *AuthService) GetEmailVerificationStatus(email string) (bool, error) {
 	db := config.GetDB()
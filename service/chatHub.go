@@ -0,0 +1,427 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/model"
+)
+
+// ChatConn is a client connection the hub delivers events to. *websocket.Conn satisfies it.
+type ChatConn interface {
+	WriteJSON(v interface{}) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// ChatClient is a registered connection. Send queues an event for this connection only and
+// is safe to call concurrently with hub deliveries.
+type ChatClient interface {
+	UserID() uint
+	Send(payload interface{}) error
+}
+
+// ChatHub keeps every open connection of every user and fans events out to them.
+// Implementations decide whether events reach connections held by other instances.
+type ChatHub interface {
+	// Register adds a connection for a user; a user may have any number of connections
+	Register(userID uint, conn ChatConn) ChatClient
+	// Unregister removes a connection previously returned by Register
+	Unregister(client ChatClient)
+	// SendToUser delivers payload to every connection of a user
+	SendToUser(userID uint, payload interface{}) error
+	// SendToUsers delivers payload to every connection of each user
+	SendToUsers(userIDs []uint, payload interface{}) error
+	// Close stops background work and closes every connection
+	Close() error
+}
+
+const (
+	chatWriteTimeout = 10 * time.Second
+	// chatClientSendBuffer events can wait for a slow connection before it is dropped
+	chatClientSendBuffer = 64
+)
+
+// chatClient queues events and writes them from its own goroutine, so a slow connection never
+// holds up the hub or the caller. A connection whose queue is full or whose write fails is
+// unregistered and closed; the client reconnects and catches up through the REST endpoints.
+type chatClient struct {
+	userID    uint
+	conn      ChatConn
+	queue     chan interface{}
+	done      chan struct{}
+	stopOnce  sync.Once
+	onDropped func(*chatClient)
+}
+
+func (c *chatClient) UserID() uint {
+	return c.userID
+}
+
+func (c *chatClient) Send(payload interface{}) error {
+	select {
+	case <-c.done:
+		return errors.New("connection closed")
+	default:
+	}
+
+	select {
+	case c.queue <- payload:
+		return nil
+	default:
+		c.drop()
+		return errors.New("connection is not keeping up")
+	}
+}
+
+func (c *chatClient) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case payload := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(chatWriteTimeout))
+			if err := c.conn.WriteJSON(payload); err != nil {
+				log.Printf("Error sending message to user %d: %v", c.userID, err)
+				c.drop()
+				return
+			}
+		}
+	}
+}
+
+// stop ends the writer goroutine; events still queued are discarded
+func (c *chatClient) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// drop unregisters and closes a connection the hub gave up on
+func (c *chatClient) drop() {
+	c.onDropped(c)
+	c.stop()
+	c.conn.Close()
+}
+
+// localConnections holds the connections of this process and is shared by the hub implementations
+type localConnections struct {
+	clients map[uint]map[*chatClient]struct{} // userID -> connections
+	mutex   sync.RWMutex
+}
+
+func newLocalConnections() *localConnections {
+	return &localConnections{clients: make(map[uint]map[*chatClient]struct{})}
+}
+
+func (l *localConnections) register(userID uint, conn ChatConn) ChatClient {
+	client := &chatClient{
+		userID:    userID,
+		conn:      conn,
+		queue:     make(chan interface{}, chatClientSendBuffer),
+		done:      make(chan struct{}),
+		onDropped: func(c *chatClient) { l.unregister(c) },
+	}
+	go client.writeLoop()
+
+	l.mutex.Lock()
+	if l.clients[userID] == nil {
+		l.clients[userID] = make(map[*chatClient]struct{})
+	}
+	l.clients[userID][client] = struct{}{}
+	l.mutex.Unlock()
+
+	return client
+}
+
+func (l *localConnections) unregister(client ChatClient) {
+	c, ok := client.(*chatClient)
+	if !ok {
+		return
+	}
+
+	l.mutex.Lock()
+	if conns, exists := l.clients[c.userID]; exists {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(l.clients, c.userID)
+		}
+	}
+	l.mutex.Unlock()
+
+	c.stop()
+}
+
+// deliver queues payload for every local connection of the given users. It never waits on a
+// connection; connections that cannot keep up are dropped.
+func (l *localConnections) deliver(userIDs []uint, payload interface{}) {
+	var targets []*chatClient
+	l.mutex.RLock()
+	for _, userID := range userIDs {
+		for client := range l.clients[userID] {
+			targets = append(targets, client)
+		}
+	}
+	l.mutex.RUnlock()
+
+	for _, client := range targets {
+		if err := client.Send(payload); err != nil {
+			log.Printf("Error sending message to user %d: %v", client.userID, err)
+		}
+	}
+}
+
+func (l *localConnections) closeAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for userID, conns := range l.clients {
+		for client := range conns {
+			client.stop()
+			client.conn.Close()
+		}
+		delete(l.clients, userID)
+	}
+}
+
+// InMemoryChatHub delivers events to connections of this process only.
+// Use it when a single instance serves every WebSocket connection.
+type InMemoryChatHub struct {
+	local *localConnections
+}
+
+func NewInMemoryChatHub() *InMemoryChatHub {
+	return &InMemoryChatHub{local: newLocalConnections()}
+}
+
+func (h *InMemoryChatHub) Register(userID uint, conn ChatConn) ChatClient {
+	return h.local.register(userID, conn)
+}
+
+func (h *InMemoryChatHub) Unregister(client ChatClient) {
+	h.local.unregister(client)
+}
+
+func (h *InMemoryChatHub) SendToUser(userID uint, payload interface{}) error {
+	h.local.deliver([]uint{userID}, payload)
+	return nil
+}
+
+func (h *InMemoryChatHub) SendToUsers(userIDs []uint, payload interface{}) error {
+	h.local.deliver(userIDs, payload)
+	return nil
+}
+
+func (h *InMemoryChatHub) Close() error {
+	h.local.closeAll()
+	return nil
+}
+
+const (
+	chatHubChannel = "chat_hub"
+
+	// NOTIFY payloads are limited to 8000 bytes; bigger events are stored in chat_hub_events
+	// and only their ID is sent
+	chatHubMaxNotifyPayload = 7500
+	chatHubEventRetention   = time.Hour
+)
+
+// chatHubEnvelope is what travels through NOTIFY
+type chatHubEnvelope struct {
+	UserIDs []uint          `json:"user_ids,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	EventID uint            `json:"event_id,omitempty"`
+}
+
+// PostgresChatHub fans events out through Postgres LISTEN/NOTIFY so every instance
+// delivers them to its own connections. Publishing instances receive their own
+// notifications too, so delivery always goes through the database.
+type PostgresChatHub struct {
+	DB     *gorm.DB
+	local  *localConnections
+	dsn    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPostgresChatHub starts listening on the chat hub channel with a dedicated connection
+func NewPostgresChatHub(db *gorm.DB, dsn string) *PostgresChatHub {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &PostgresChatHub{
+		DB:     db,
+		local:  newLocalConnections(),
+		dsn:    dsn,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go h.listen(ctx)
+	go h.cleanupEvents(ctx)
+
+	return h
+}
+
+func (h *PostgresChatHub) Register(userID uint, conn ChatConn) ChatClient {
+	return h.local.register(userID, conn)
+}
+
+func (h *PostgresChatHub) Unregister(client ChatClient) {
+	h.local.unregister(client)
+}
+
+func (h *PostgresChatHub) SendToUser(userID uint, payload interface{}) error {
+	return h.SendToUsers([]uint{userID}, payload)
+}
+
+func (h *PostgresChatHub) SendToUsers(userIDs []uint, payload interface{}) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode chat event: %v", err)
+	}
+
+	envelope := chatHubEnvelope{UserIDs: userIDs, Payload: payloadJSON}
+	message, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encode chat event: %v", err)
+	}
+
+	if len(message) > chatHubMaxNotifyPayload {
+		event := model.ChatHubEvent{Payload: string(message)}
+		if err := h.DB.Create(&event).Error; err != nil {
+			return fmt.Errorf("failed to store chat event: %v", err)
+		}
+		message, _ = json.Marshal(chatHubEnvelope{EventID: event.ID})
+	}
+
+	if err := h.DB.Exec("SELECT pg_notify(?, ?)", chatHubChannel, string(message)).Error; err != nil {
+		return fmt.Errorf("failed to publish chat event: %v", err)
+	}
+	return nil
+}
+
+func (h *PostgresChatHub) Close() error {
+	h.cancel()
+	<-h.done
+	h.local.closeAll()
+	return nil
+}
+
+// listen keeps a LISTEN connection open, reconnecting with backoff when it drops
+func (h *PostgresChatHub) listen(ctx context.Context) {
+	defer close(h.done)
+
+	backoff := time.Second
+	for {
+		err := h.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Chat hub listener stopped, reconnecting in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (h *PostgresChatHub) listenOnce(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, h.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+chatHubChannel); err != nil {
+		return err
+	}
+	log.Println("Chat hub listening for events")
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		h.handleNotification(notification.Payload)
+	}
+}
+
+func (h *PostgresChatHub) handleNotification(message string) {
+	var envelope chatHubEnvelope
+	if err := json.Unmarshal([]byte(message), &envelope); err != nil {
+		log.Printf("Invalid chat hub event: %v", err)
+		return
+	}
+
+	if envelope.EventID != 0 {
+		var event model.ChatHubEvent
+		if err := h.DB.First(&event, envelope.EventID).Error; err != nil {
+			log.Printf("Chat hub event %d not found: %v", envelope.EventID, err)
+			return
+		}
+		if err := json.Unmarshal([]byte(event.Payload), &envelope); err != nil {
+			log.Printf("Invalid stored chat hub event %d: %v", event.ID, err)
+			return
+		}
+	}
+
+	h.local.deliver(envelope.UserIDs, envelope.Payload)
+}
+
+// cleanupEvents removes stored events once every instance has had time to read them
+func (h *PostgresChatHub) cleanupEvents(ctx context.Context) {
+	ticker := time.NewTicker(chatHubEventRetention)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.DB.Where("created_at < ?", time.Now().Add(-chatHubEventRetention)).Delete(&model.ChatHubEvent{}).Error; err != nil {
+				log.Printf("Error cleaning up chat hub events: %v", err)
+			}
+		}
+	}
+}
+
+// NewChatHubFromEnv picks the hub implementation from CHAT_HUB: "postgres" for
+// LISTEN/NOTIFY across instances, anything else for the in-memory hub
+func NewChatHubFromEnv() ChatHub {
+	if os.Getenv("CHAT_HUB") == "postgres" {
+		log.Println("Using Postgres LISTEN/NOTIFY chat hub")
+		return NewPostgresChatHub(config.GetDB(), config.GetDSN())
+	}
+	return NewInMemoryChatHub()
+}
+
+var (
+	defaultChatHub     ChatHub
+	defaultChatHubOnce sync.Once
+)
+
+// DefaultChatHub returns the hub shared by the whole process, created from the environment
+// on first use. Chat events and notifications are delivered through the same hub.
+func DefaultChatHub() ChatHub {
+	defaultChatHubOnce.Do(func() {
+		defaultChatHub = NewChatHubFromEnv()
+	})
+	return defaultChatHub
+}
@@ -1,11 +1,21 @@
 package service
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"log"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
 	"synergazing.com/synergazing/model"
 )
 
@@ -25,6 +35,10 @@ func (s *ChatService) GetOrCreateChat(user1ID, user2ID uint) (*model.Chat, error
 		return nil, errors.New("cannot create chat with yourself")
 	}
 
+	if s.IsBlockedBetween(user1ID, user2ID) {
+		return nil, ErrChatBlocked
+	}
+
 	// Ensure consistent ordering (smaller ID first)
 	if user1ID > user2ID {
 		user1ID, user2ID = user2ID, user1ID
@@ -34,8 +48,8 @@ func (s *ChatService) GetOrCreateChat(user1ID, user2ID uint) (*model.Chat, error
 
 	// Try to find existing chat
 	err := s.DB.Preload("User1").Preload("User2").
-		Where("(user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?)",
-			user1ID, user2ID, user2ID, user1ID).
+		Where("type = ? AND ((user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?))",
+			model.ChatTypeDirect, user1ID, user2ID, user2ID, user1ID).
 		First(&chat).Error
 
 	if err == nil {
@@ -48,11 +62,23 @@ func (s *ChatService) GetOrCreateChat(user1ID, user2ID uint) (*model.Chat, error
 
 	// Create new chat
 	newChat := model.Chat{
-		User1ID: user1ID,
-		User2ID: user2ID,
+		Type:    model.ChatTypeDirect,
+		User1ID: &user1ID,
+		User2ID: &user2ID,
 	}
 
-	if err := s.DB.Create(&newChat).Error; err != nil {
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newChat).Error; err != nil {
+			return err
+		}
+		for _, userID := range []uint{user1ID, user2ID} {
+			if err := s.addParticipant(tx, newChat.ID, userID, model.ChatParticipantRoleMember); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("error creating chat: %v", err)
 	}
 
@@ -64,86 +90,929 @@ func (s *ChatService) GetOrCreateChat(user1ID, user2ID uint) (*model.Chat, error
 	return &newChat, nil
 }
 
-// GetChatMessages retrieves messages for a specific chat with pagination
-func (s *ChatService) GetChatMessages(chatID uint, userID uint, offset, limit int) ([]model.Message, error) {
+// GetOrCreateProjectChat returns the group room of a project, creating it with the creator
+// and every accepted member as participants the first time it is needed
+func (s *ChatService) GetOrCreateProjectChat(projectID uint) (*model.Chat, error) {
+	var chat model.Chat
+	err := s.DB.Where("project_id = ?", projectID).First(&chat).Error
+	if err == nil {
+		return &chat, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, fmt.Errorf("error finding project chat: %v", err)
+	}
+
+	var project model.Project
+	if err := s.DB.Preload("Members", "status = ?", "accepted").First(&project, projectID).Error; err != nil {
+		return nil, errors.New("project not found")
+	}
+
+	chat = model.Chat{
+		Type:      model.ChatTypeProject,
+		Name:      project.Title,
+		ProjectID: &project.ID,
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&chat).Error; err != nil {
+			return err
+		}
+		if err := s.addParticipant(tx, chat.ID, project.CreatorID, model.ChatParticipantRoleOwner); err != nil {
+			return err
+		}
+		for _, member := range project.Members {
+			if member.UserID == project.CreatorID {
+				continue
+			}
+			if err := s.addParticipant(tx, chat.ID, member.UserID, model.ChatParticipantRoleMember); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Another request may have created the room concurrently
+		if findErr := s.DB.Where("project_id = ?", projectID).First(&chat).Error; findErr == nil {
+			return &chat, nil
+		}
+		return nil, fmt.Errorf("error creating project chat: %v", err)
+	}
+
+	return &chat, nil
+}
+
+// GetProjectChat returns the project room for the project creator or an accepted member
+func (s *ChatService) GetProjectChat(projectID, userID uint) (*ChatResponse, error) {
+	var project model.Project
+	if err := s.DB.First(&project, projectID).Error; err != nil {
+		return nil, errors.New("project not found")
+	}
+
+	if project.CreatorID != userID {
+		var count int64
+		s.DB.Model(&model.ProjectMember{}).
+			Where("project_id = ? AND user_id = ? AND status = ?", projectID, userID, "accepted").
+			Count(&count)
+		if count == 0 {
+			return nil, errors.New("only project members can join the project chat")
+		}
+	}
+
+	if err := s.JoinProjectChat(projectID, userID); err != nil {
+		return nil, err
+	}
+
+	chat, err := s.GetOrCreateProjectChat(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.GetChatByID(chat.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return newChatResponse(room), nil
+}
+
+// JoinProjectChat adds a user to the project room, rejoining if they left before
+func (s *ChatService) JoinProjectChat(projectID, userID uint) error {
+	chat, err := s.GetOrCreateProjectChat(projectID)
+	if err != nil {
+		return err
+	}
+
+	role := model.ChatParticipantRoleMember
+	var project model.Project
+	if err := s.DB.Select("creator_id").First(&project, projectID).Error; err == nil && project.CreatorID == userID {
+		role = model.ChatParticipantRoleOwner
+	}
+
+	if err := s.addParticipant(s.DB, chat.ID, userID, role); err != nil {
+		return fmt.Errorf("error joining project chat: %v", err)
+	}
+	return nil
+}
+
+// LeaveProjectChat removes a user from the project room, keeping their message history
+func (s *ChatService) LeaveProjectChat(projectID, userID uint) error {
+	now := time.Now()
+	err := s.DB.Model(&model.ChatParticipant{}).
+		Where("user_id = ? AND left_at IS NULL AND chat_id IN (SELECT id FROM chats WHERE project_id = ?)", userID, projectID).
+		Update("left_at", &now).Error
+	if err != nil {
+		return fmt.Errorf("error leaving project chat: %v", err)
+	}
+	return nil
+}
+
+// addParticipant adds a user to a chat, or reactivates their membership if they left.
+// New participants start with everything already sent marked as read.
+func (s *ChatService) addParticipant(tx *gorm.DB, chatID, userID uint, role string) error {
+	var lastMessageID *uint
+	tx.Model(&model.Message{}).Where("chat_id = ?", chatID).Select("MAX(id)").Scan(&lastMessageID)
+
+	var participant model.ChatParticipant
+	err := tx.Where("chat_id = ? AND user_id = ?", chatID, userID).First(&participant).Error
+	if err == nil {
+		if participant.LeftAt == nil {
+			return nil
+		}
+		return tx.Model(&participant).Updates(map[string]interface{}{
+			"left_at":              nil,
+			"joined_at":            time.Now(),
+			"role":                 role,
+			"last_read_message_id": lastMessageID,
+		}).Error
+	}
+	if err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	participant = model.ChatParticipant{
+		ChatID:            chatID,
+		UserID:            userID,
+		Role:              role,
+		LastReadMessageID: lastMessageID,
+		JoinedAt:          time.Now(),
+	}
+	return tx.Create(&participant).Error
+}
+
+// GetChatParticipantIDs returns the IDs of the users currently in a chat
+func (s *ChatService) GetChatParticipantIDs(chatID uint) ([]uint, error) {
+	var userIDs []uint
+	err := s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id = ? AND left_at IS NULL", chatID).
+		Pluck("user_id", &userIDs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving chat participants: %v", err)
+	}
+	return userIDs, nil
+}
+
+// MessageCursor selects a page of chat history by message ID. With neither ID set the newest
+// messages are returned; BeforeID pages towards older messages and AfterID towards newer ones.
+type MessageCursor struct {
+	BeforeID uint
+	AfterID  uint
+	Limit    int
+}
+
+// MessagePage is a slice of chat history, newest message first
+type MessagePage struct {
+	Messages []ChatMessageResponse `json:"messages"`
+	HasOlder bool                  `json:"has_older"`
+	HasNewer bool                  `json:"has_newer"`
+}
+
+// ChatMessageResponse is a message with only the public details of its sender and of the
+// sender of the message it replies to
+type ChatMessageResponse struct {
+	model.Message
+	Sender  *UserSummary         `json:"sender"`
+	ReplyTo *ChatMessageResponse `json:"reply_to,omitempty"`
+}
+
+func newChatMessageResponse(message *model.Message) *ChatMessageResponse {
+	response := &ChatMessageResponse{
+		Message: *message,
+		Sender:  NewUserSummary(&message.Sender),
+	}
+	if message.ReplyTo != nil {
+		response.ReplyTo = newChatMessageResponse(message.ReplyTo)
+	}
+	return response
+}
+
+func newChatMessageResponses(messages []model.Message) []ChatMessageResponse {
+	responses := make([]ChatMessageResponse, len(messages))
+	for i := range messages {
+		responses[i] = *newChatMessageResponse(&messages[i])
+	}
+	return responses
+}
+
+// ChatResponse is a chat whose participants carry only the public details of their users,
+// so members of a room do not see each other's email address or phone number
+type ChatResponse struct {
+	model.Chat
+	Participants []ChatParticipantResponse `json:"participants,omitempty"`
+}
+
+// ChatParticipantResponse is a participant with only the public details of the user
+type ChatParticipantResponse struct {
+	model.ChatParticipant
+	User *UserSummary `json:"user"`
+}
+
+func newChatResponse(chat *model.Chat) *ChatResponse {
+	response := &ChatResponse{Chat: *chat}
+	if len(chat.Participants) > 0 {
+		response.Participants = make([]ChatParticipantResponse, len(chat.Participants))
+		for i := range chat.Participants {
+			response.Participants[i] = ChatParticipantResponse{
+				ChatParticipant: chat.Participants[i],
+				User:            NewUserSummary(&chat.Participants[i].User),
+			}
+		}
+	}
+	return response
+}
+
+// visibleMessages selects the messages of a chat the user has not deleted for themselves
+func (s *ChatService) visibleMessages(chatID, userID uint) *gorm.DB {
+	return s.DB.Model(&model.Message{}).
+		Where("messages.chat_id = ?", chatID).
+		Where("messages.id NOT IN (?)", s.DB.Model(&model.MessageDeletion{}).Select("message_id").Where("user_id = ?", userID))
+}
+
+func (s *ChatService) withMessageDetails(query *gorm.DB) *gorm.DB {
+	return query.Preload("Sender").Preload("Sender.Profile").Preload("ReplyTo").Preload("ReplyTo.Sender").Preload("ReplyTo.Sender.Profile").Preload("Attachments")
+}
+
+// GetChatMessages retrieves a page of chat history using keyset pagination on the message ID,
+// so messages arriving in the meantime do not shift the pages
+func (s *ChatService) GetChatMessages(chatID uint, userID uint, cursor MessageCursor) (*MessagePage, error) {
 	// First verify user has access to this chat
 	if !s.UserHasAccessToChat(chatID, userID) {
 		return nil, errors.New("unauthorized access to chat")
 	}
 
 	var messages []model.Message
-	err := s.DB.Preload("Sender").Preload("Sender.Profile").
-		Where("chat_id = ?", chatID).
-		Order("created_at DESC").
-		Offset(offset).
-		Limit(limit).
-		Find(&messages).Error
+	query := s.withMessageDetails(s.visibleMessages(chatID, userID)).Limit(cursor.Limit)
+	if cursor.AfterID > 0 {
+		query = query.Where("messages.id > ?", cursor.AfterID).Order("messages.id ASC")
+	} else {
+		if cursor.BeforeID > 0 {
+			query = query.Where("messages.id < ?", cursor.BeforeID)
+		}
+		query = query.Order("messages.id DESC")
+	}
 
-	if err != nil {
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving messages: %v", err)
+	}
+
+	if cursor.AfterID > 0 {
+		reverseMessages(messages)
+	}
+
+	page := &MessagePage{Messages: newChatMessageResponses(messages)}
+	if len(messages) > 0 {
+		page.HasNewer = s.hasVisibleMessages(chatID, userID, "messages.id > ?", messages[0].ID)
+		page.HasOlder = s.hasVisibleMessages(chatID, userID, "messages.id < ?", messages[len(messages)-1].ID)
+	} else if cursor.AfterID > 0 {
+		page.HasOlder = s.hasVisibleMessages(chatID, userID, "messages.id <= ?", cursor.AfterID)
+	} else if cursor.BeforeID > 0 {
+		page.HasNewer = s.hasVisibleMessages(chatID, userID, "messages.id >= ?", cursor.BeforeID)
+	}
+
+	return page, nil
+}
+
+// MessageContext is the history around one message, newest first
+type MessageContext struct {
+	TargetID uint                  `json:"target_id"`
+	Messages []ChatMessageResponse `json:"messages"`
+	HasOlder bool                  `json:"has_older"`
+	HasNewer bool                  `json:"has_newer"`
+}
+
+// GetMessageContext returns a message together with up to limit/2 messages on each side of it,
+// used to jump to a search result or a replied message
+func (s *ChatService) GetMessageContext(chatID, messageID, userID uint, limit int) (*MessageContext, error) {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return nil, errors.New("unauthorized access to chat")
+	}
+
+	var count int64
+	s.visibleMessages(chatID, userID).Where("messages.id = ?", messageID).Count(&count)
+	if count == 0 {
+		return nil, errors.New("message not found")
+	}
+
+	side := max(limit/2, 1)
+
+	var older []model.Message
+	if err := s.withMessageDetails(s.visibleMessages(chatID, userID)).
+		Where("messages.id <= ?", messageID).
+		Order("messages.id DESC").Limit(side + 1).
+		Find(&older).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving messages: %v", err)
+	}
+
+	var newer []model.Message
+	if err := s.withMessageDetails(s.visibleMessages(chatID, userID)).
+		Where("messages.id > ?", messageID).
+		Order("messages.id ASC").Limit(side).
+		Find(&newer).Error; err != nil {
 		return nil, fmt.Errorf("error retrieving messages: %v", err)
 	}
+	reverseMessages(newer)
+
+	context := &MessageContext{
+		TargetID: messageID,
+		Messages: newChatMessageResponses(append(newer, older...)),
+	}
+	if len(newer) > 0 {
+		context.HasNewer = s.hasVisibleMessages(chatID, userID, "messages.id > ?", newer[0].ID)
+	}
+	context.HasOlder = s.hasVisibleMessages(chatID, userID, "messages.id < ?", older[len(older)-1].ID)
+
+	return context, nil
+}
+
+func (s *ChatService) hasVisibleMessages(chatID, userID uint, condition string, id uint) bool {
+	var count int64
+	s.visibleMessages(chatID, userID).Where(condition, id).Limit(1).Count(&count)
+	return count > 0
+}
+
+func reverseMessages(messages []model.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
 
-	return messages, nil
+// messageSearchVector must match the expression of idx_messages_content_search in migrations
+const messageSearchVector = "to_tsvector('simple', messages.content)"
+
+// Snippet highlight markers. Control characters cannot clash with the markup, so the
+// snippet can be HTML-escaped before the markers are turned into <mark> tags.
+const (
+	searchHighlightStart  = "\x02"
+	searchHighlightStop   = "\x03"
+	searchHeadlineOptions = `StartSel="` + searchHighlightStart + `", StopSel="` + searchHighlightStop + `", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`
+)
+
+// MessageSearchFilter narrows a message search
+type MessageSearchFilter struct {
+	Query    string
+	ChatID   uint
+	BeforeID uint
+	Limit    int
 }
 
-// SendMessage creates a new message in a chat
-func (s *ChatService) SendMessage(chatID uint, senderID uint, content string) (*model.Message, error) {
+// MessageSearchResult is a matching message with a highlighted snippet. Snippet is HTML-escaped
+// and marks the matched terms with <mark></mark>.
+type MessageSearchResult struct {
+	MessageID  uint      `json:"message_id"`
+	ChatID     uint      `json:"chat_id"`
+	ChatType   string    `json:"chat_type"`
+	ChatName   string    `json:"chat_name,omitempty"`
+	SenderID   uint      `json:"sender_id"`
+	SenderName string    `json:"sender_name"`
+	Snippet    string    `json:"snippet"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SearchMessages runs a full-text search across every chat the user is in, newest match
+// first. Paging continues with BeforeID set to the last message ID of the previous page.
+func (s *ChatService) SearchMessages(userID uint, filter MessageSearchFilter) ([]MessageSearchResult, error) {
+	if strings.TrimSpace(filter.Query) == "" {
+		return nil, errors.New("search query is required")
+	}
+
+	query := s.DB.Table("messages").
+		Select(`messages.id AS message_id, messages.chat_id, chats.type AS chat_type, chats.name AS chat_name,
+			messages.sender_id, users.name AS sender_name, messages.created_at,
+			ts_headline('simple', messages.content, websearch_to_tsquery('simple', ?), ?) AS snippet`,
+			filter.Query, searchHeadlineOptions).
+		Joins("JOIN chats ON chats.id = messages.chat_id").
+		Joins("JOIN users ON users.id = messages.sender_id").
+		Where(messageSearchVector+" @@ websearch_to_tsquery('simple', ?)", filter.Query).
+		Where("messages.chat_id IN (?)", s.activeChatIDs(userID)).
+		Where("messages.deleted_at IS NULL").
+		Where("messages.id NOT IN (?)", s.DB.Model(&model.MessageDeletion{}).Select("message_id").Where("user_id = ?", userID))
+
+	if filter.ChatID > 0 {
+		query = query.Where("messages.chat_id = ?", filter.ChatID)
+	}
+	if filter.BeforeID > 0 {
+		query = query.Where("messages.id < ?", filter.BeforeID)
+	}
+
+	results := []MessageSearchResult{}
+	if err := query.Order("messages.id DESC").Limit(filter.Limit).Scan(&results).Error; err != nil {
+		return nil, fmt.Errorf("error searching messages: %v", err)
+	}
+
+	for i := range results {
+		results[i].Snippet = highlightSnippet(results[i].Snippet)
+	}
+	// Direct chats have no name, show the other person instead
+	if err := s.nameDirectChats(userID, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// highlightSnippet escapes a ts_headline fragment and turns the markers into <mark> tags
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, searchHighlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, searchHighlightStop, "</mark>")
+}
+
+// nameDirectChats fills ChatName of direct chat results with the other participant's name
+func (s *ChatService) nameDirectChats(userID uint, results []MessageSearchResult) error {
+	var chatIDs []uint
+	for _, result := range results {
+		if result.ChatType == model.ChatTypeDirect {
+			chatIDs = append(chatIDs, result.ChatID)
+		}
+	}
+	if len(chatIDs) == 0 {
+		return nil
+	}
+
+	var rows []struct {
+		ChatID uint
+		Name   string
+	}
+	if err := s.DB.Table("chat_participants").
+		Select("chat_participants.chat_id, users.name").
+		Joins("JOIN users ON users.id = chat_participants.user_id").
+		Where("chat_participants.chat_id IN ? AND chat_participants.user_id != ?", chatIDs, userID).
+		Scan(&rows).Error; err != nil {
+		return fmt.Errorf("error loading chat names: %v", err)
+	}
+
+	names := make(map[uint]string, len(rows))
+	for _, row := range rows {
+		names[row.ChatID] = row.Name
+	}
+	for i := range results {
+		if results[i].ChatType == model.ChatTypeDirect {
+			results[i].ChatName = names[results[i].ChatID]
+		}
+	}
+	return nil
+}
+
+// SendMessage creates a new message in a chat, optionally as a reply to another message of the
+// same chat and carrying attachments the sender uploaded to this chat beforehand
+func (s *ChatService) SendMessage(chatID uint, senderID uint, content string, replyToMessageID *uint, attachmentIDs []uint) (*model.Message, error) {
 	// Verify user has access to this chat
 	if !s.UserHasAccessToChat(chatID, senderID) {
 		return nil, errors.New("unauthorized access to chat")
 	}
 
-	if content == "" {
+	if err := s.CheckCanMessage(chatID, senderID); err != nil {
+		return nil, err
+	}
+
+	attachmentIDs = uniqueIDs(attachmentIDs)
+	if content == "" && len(attachmentIDs) == 0 {
 		return nil, errors.New("message content cannot be empty")
 	}
+	if len(attachmentIDs) > MaxAttachmentsPerMessage {
+		return nil, fmt.Errorf("a message can carry at most %d attachments", MaxAttachmentsPerMessage)
+	}
+
+	if replyToMessageID != nil {
+		var count int64
+		s.DB.Model(&model.Message{}).Where("id = ? AND chat_id = ?", *replyToMessageID, chatID).Count(&count)
+		if count == 0 {
+			return nil, errors.New("replied message not found in this chat")
+		}
+	}
 
 	message := model.Message{
-		ChatID:   chatID,
-		SenderID: senderID,
-		Content:  content,
-		IsRead:   false,
+		ChatID:           chatID,
+		SenderID:         senderID,
+		Content:          content,
+		IsRead:           false,
+		ReplyToMessageID: replyToMessageID,
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return fmt.Errorf("error creating message: %v", err)
+		}
+
+		if len(attachmentIDs) > 0 {
+			result := tx.Model(&model.MessageAttachment{}).
+				Where("id IN ? AND chat_id = ? AND uploader_id = ? AND message_id IS NULL", attachmentIDs, chatID, senderID).
+				Update("message_id", message.ID)
+			if result.Error != nil {
+				return fmt.Errorf("error attaching files: %v", result.Error)
+			}
+			if int(result.RowsAffected) != len(attachmentIDs) {
+				return errors.New("attachments must be your own unsent uploads to this chat")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep chats with recent activity at the top of the chat list
+	s.DB.Model(&model.Chat{}).Where("id = ?", chatID).Update("updated_at", time.Now())
+
+	return s.loadMessage(message.ID)
+}
+
+// MaxAttachmentsPerMessage limits how many uploads one message can carry
+const MaxAttachmentsPerMessage = 10
+
+// UploadAttachment stores a file for a chat. It stays private to the uploader until a message links it.
+func (s *ChatService) UploadAttachment(chatID, userID uint, file *multipart.FileHeader) (*model.MessageAttachment, error) {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return nil, errors.New("unauthorized access to chat")
+	}
+
+	stored, err := helper.SaveChatAttachment(file)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := s.DB.Create(&message).Error; err != nil {
-		return nil, fmt.Errorf("error creating message: %v", err)
+	attachment := model.MessageAttachment{
+		ChatID:        chatID,
+		UploaderID:    userID,
+		FileName:      stored.FileName,
+		MimeType:      stored.MimeType,
+		Size:          stored.Size,
+		Width:         stored.Width,
+		Height:        stored.Height,
+		StoragePath:   stored.Path,
+		ThumbnailPath: stored.ThumbnailPath,
+	}
+	if err := s.DB.Create(&attachment).Error; err != nil {
+		removeAttachmentFiles([]model.MessageAttachment{attachment})
+		return nil, fmt.Errorf("error saving attachment: %v", err)
 	}
 
-	// Preload sender information
-	if err := s.DB.Preload("Sender").Preload("Sender.Profile").First(&message, message.ID).Error; err != nil {
-		return nil, fmt.Errorf("error loading message sender: %v", err)
+	return &attachment, nil
+}
+
+// GetAttachment returns an attachment if the user may download it: they must be a current
+// participant of the chat, and unsent uploads are only visible to their uploader
+func (s *ChatService) GetAttachment(chatID, attachmentID, userID uint) (*model.MessageAttachment, error) {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return nil, errors.New("unauthorized access to chat")
 	}
 
+	var attachment model.MessageAttachment
+	if err := s.DB.Where("id = ? AND chat_id = ?", attachmentID, chatID).First(&attachment).Error; err != nil {
+		return nil, errors.New("attachment not found")
+	}
+
+	if attachment.MessageID == nil && attachment.UploaderID != userID {
+		return nil, errors.New("attachment not found")
+	}
+
+	return &attachment, nil
+}
+
+// CleanupOrphanedAttachments removes uploads that were never sent with a message
+func (s *ChatService) CleanupOrphanedAttachments() {
+	var attachments []model.MessageAttachment
+	if err := s.DB.Where("message_id IS NULL AND created_at < ?", time.Now().Add(-24*time.Hour)).Find(&attachments).Error; err != nil {
+		log.Printf("Error loading orphaned chat attachments: %v", err)
+		return
+	}
+	if len(attachments) == 0 {
+		return
+	}
+
+	if err := s.DB.Delete(&attachments).Error; err != nil {
+		log.Printf("Error cleaning up orphaned chat attachments: %v", err)
+		return
+	}
+	removeAttachmentFiles(attachments)
+	log.Printf("Cleaned up %d orphaned chat attachments", len(attachments))
+}
+
+// removeAttachmentFiles deletes the stored files of attachments whose rows are gone
+func removeAttachmentFiles(attachments []model.MessageAttachment) {
+	for _, attachment := range attachments {
+		if err := helper.DeleteFile(attachment.StoragePath); err != nil {
+			log.Printf("Error deleting attachment file %s: %v", attachment.StoragePath, err)
+		}
+		if err := helper.DeleteFile(attachment.ThumbnailPath); err != nil {
+			log.Printf("Error deleting attachment thumbnail %s: %v", attachment.ThumbnailPath, err)
+		}
+	}
+}
+
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	var unique []uint
+	for _, id := range ids {
+		if id != 0 && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// loadMessage loads a message with what clients need to render it
+func (s *ChatService) loadMessage(messageID uint) (*model.Message, error) {
+	var message model.Message
+	if err := s.DB.Preload("Sender").Preload("Sender.Profile").Preload("ReplyTo").Preload("ReplyTo.Sender").Preload("Attachments").
+		First(&message, messageID).Error; err != nil {
+		return nil, fmt.Errorf("error loading message: %v", err)
+	}
 	return &message, nil
 }
 
-// MarkMessagesAsRead marks messages as read for a specific user
-func (s *ChatService) MarkMessagesAsRead(chatID uint, userID uint) error {
+// findChatMessage loads a message of a chat the user currently has access to
+func (s *ChatService) findChatMessage(chatID, messageID, userID uint) (*model.Message, error) {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return nil, errors.New("unauthorized access to chat")
+	}
+
+	var message model.Message
+	if err := s.DB.Where("id = ? AND chat_id = ?", messageID, chatID).First(&message).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New("message not found")
+		}
+		return nil, fmt.Errorf("error retrieving message: %v", err)
+	}
+	return &message, nil
+}
+
+// EditMessage changes the content of the user's own message and keeps the previous content as a revision
+func (s *ChatService) EditMessage(chatID, messageID, userID uint, content string) (*model.Message, error) {
+	message, err := s.findChatMessage(chatID, messageID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.SenderID != userID {
+		return nil, errors.New("you can only edit your own messages")
+	}
+	if message.DeletedAt != nil {
+		return nil, errors.New("deleted messages cannot be edited")
+	}
+	if content == "" {
+		return nil, errors.New("message content cannot be empty")
+	}
+	if content == message.Content {
+		return nil, errors.New("message content is unchanged")
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		revision := model.MessageRevision{
+			MessageID:  message.ID,
+			Content:    message.Content,
+			EditedByID: userID,
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return fmt.Errorf("error saving message revision: %v", err)
+		}
+
+		if err := tx.Model(message).Updates(map[string]interface{}{
+			"content":   content,
+			"edited_at": time.Now(),
+		}).Error; err != nil {
+			return fmt.Errorf("error editing message: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.loadMessage(message.ID)
+}
+
+// GetMessageRevisions lists the earlier versions of a message, newest first
+func (s *ChatService) GetMessageRevisions(chatID, messageID, userID uint) ([]model.MessageRevision, error) {
+	if _, err := s.findChatMessage(chatID, messageID, userID); err != nil {
+		return nil, err
+	}
+
+	var revisions []model.MessageRevision
+	if err := s.DB.Where("message_id = ?", messageID).Order("created_at DESC").Find(&revisions).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving message revisions: %v", err)
+	}
+	return revisions, nil
+}
+
+// Message deletion scopes
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// MessageDeleteWindow is how long after sending a message its sender can still delete it
+// for everyone. It defaults to one hour and can be changed with CHAT_DELETE_WINDOW_MINUTES.
+func MessageDeleteWindow() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("CHAT_DELETE_WINDOW_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return time.Hour
+}
+
+// DeleteMessage hides a message for the user ("me") or, for the sender within
+// MessageDeleteWindow, retracts it for every participant ("everyone")
+func (s *ChatService) DeleteMessage(chatID, messageID, userID uint, scope string) error {
+	message, err := s.findChatMessage(chatID, messageID, userID)
+	if err != nil {
+		return err
+	}
+
+	switch scope {
+	case DeleteForMe:
+		deletion := model.MessageDeletion{MessageID: message.ID, UserID: userID}
+		if err := s.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&deletion).Error; err != nil {
+			return fmt.Errorf("error deleting message: %v", err)
+		}
+		return nil
+
+	case DeleteForEveryone:
+		if message.SenderID != userID {
+			return errors.New("you can only delete your own messages for everyone")
+		}
+		if message.DeletedAt != nil {
+			return errors.New("message is already deleted")
+		}
+		if time.Since(message.CreatedAt) > MessageDeleteWindow() {
+			return fmt.Errorf("messages can only be deleted for everyone within %s of sending", MessageDeleteWindow())
+		}
+
+		var attachments []model.MessageAttachment
+		if err := s.DB.Where("message_id = ?", message.ID).Find(&attachments).Error; err != nil {
+			return fmt.Errorf("error loading message attachments: %v", err)
+		}
+
+		// Earlier versions and attachments would reveal the retracted content, so they go too
+		err := s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("message_id = ?", message.ID).Delete(&model.MessageRevision{}).Error; err != nil {
+				return fmt.Errorf("error deleting message revisions: %v", err)
+			}
+			if err := tx.Where("message_id = ?", message.ID).Delete(&model.MessageAttachment{}).Error; err != nil {
+				return fmt.Errorf("error deleting message attachments: %v", err)
+			}
+			if err := tx.Model(message).Updates(map[string]interface{}{
+				"content":    "",
+				"deleted_at": time.Now(),
+			}).Error; err != nil {
+				return fmt.Errorf("error deleting message: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		removeAttachmentFiles(attachments)
+		return nil
+
+	default:
+		return errors.New("scope must be 'me' or 'everyone'")
+	}
+}
+
+// Receipt statuses
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// MessageReceipt tells a sender that some of their messages reached or were read by a recipient
+type MessageReceipt struct {
+	ChatID     uint      `json:"chat_id"`
+	SenderID   uint      `json:"-"`
+	MessageIDs []uint    `json:"message_ids"`
+	Status     string    `json:"status"`
+	UserID     uint      `json:"user_id"`
+	At         time.Time `json:"at"`
+}
+
+// MarkMessagesAsRead moves the user's read position to the latest message of the chat and
+// returns read receipts for the senders of messages nobody had read yet
+func (s *ChatService) MarkMessagesAsRead(chatID uint, userID uint) ([]MessageReceipt, error) {
 	// Verify user has access to this chat
 	if !s.UserHasAccessToChat(chatID, userID) {
-		return errors.New("unauthorized access to chat")
+		return nil, errors.New("unauthorized access to chat")
+	}
+
+	var lastMessageID *uint
+	if err := s.DB.Model(&model.Message{}).Where("chat_id = ?", chatID).Select("MAX(id)").Scan(&lastMessageID).Error; err != nil {
+		return nil, fmt.Errorf("error marking messages as read: %v", err)
+	}
+	if lastMessageID == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	err := s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id = ? AND user_id = ?", chatID, userID).
+		Updates(map[string]interface{}{
+			"last_read_message_id": *lastMessageID,
+			"last_read_at":         &now,
+		}).Error
+	if err != nil {
+		return nil, fmt.Errorf("error marking messages as read: %v", err)
 	}
 
-	// Mark messages as read (messages not sent by the current user)
-	err := s.DB.Model(&model.Message{}).
+	// Direct chats also keep the per-message flag, which only makes sense with one recipient
+	err = s.DB.Model(&model.Message{}).
 		Where("chat_id = ? AND sender_id != ? AND is_read = false", chatID, userID).
+		Where("chat_id IN (SELECT id FROM chats WHERE type = ?)", model.ChatTypeDirect).
 		Update("is_read", true).Error
 
 	if err != nil {
-		return fmt.Errorf("error marking messages as read: %v", err)
+		return nil, fmt.Errorf("error marking messages as read: %v", err)
 	}
 
-	return nil
+	unread := s.DB.Model(&model.Message{}).
+		Where("chat_id = ? AND sender_id != ? AND read_at IS NULL AND id <= ?", chatID, userID, *lastMessageID)
+	return s.stampMessages(unread, userID, ReceiptRead)
+}
+
+// MarkMessagesDelivered stamps messages of a chat that had not reached anyone yet as delivered to userID
+func (s *ChatService) MarkMessagesDelivered(chatID uint, userID uint) ([]MessageReceipt, error) {
+	pending := s.DB.Model(&model.Message{}).
+		Where("chat_id = ? AND sender_id != ? AND delivered_at IS NULL", chatID, userID)
+	return s.stampMessages(pending, userID, ReceiptDelivered)
+}
+
+// MarkAllMessagesDelivered stamps every undelivered message in the user's chats, used when they connect
+func (s *ChatService) MarkAllMessagesDelivered(userID uint) ([]MessageReceipt, error) {
+	pending := s.DB.Model(&model.Message{}).
+		Where("chat_id IN (?) AND sender_id != ? AND delivered_at IS NULL", s.activeChatIDs(userID), userID)
+	return s.stampMessages(pending, userID, ReceiptDelivered)
+}
+
+// stampMessages sets delivered_at (and read_at for read receipts) on the messages selected by
+// query and groups them into one receipt per chat and sender. Message timestamps record the
+// first recipient, so in project rooms later recipients do not produce receipts again.
+func (s *ChatService) stampMessages(query *gorm.DB, userID uint, status string) ([]MessageReceipt, error) {
+	var messages []model.Message
+	if err := query.Select("id", "chat_id", "sender_id").Order("id").Find(&messages).Error; err != nil {
+		return nil, fmt.Errorf("error loading messages for receipts: %v", err)
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"delivered_at": gorm.Expr("COALESCE(delivered_at, ?)", now)}
+	if status == ReceiptRead {
+		updates["read_at"] = gorm.Expr("COALESCE(read_at, ?)", now)
+	}
+	if err := s.DB.Model(&model.Message{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+		return nil, fmt.Errorf("error updating message receipts: %v", err)
+	}
+
+	var receipts []MessageReceipt
+	index := make(map[[2]uint]int)
+	for _, message := range messages {
+		key := [2]uint{message.ChatID, message.SenderID}
+		i, exists := index[key]
+		if !exists {
+			receipts = append(receipts, MessageReceipt{
+				ChatID:   message.ChatID,
+				SenderID: message.SenderID,
+				Status:   status,
+				UserID:   userID,
+				At:       now,
+			})
+			i = len(receipts) - 1
+			index[key] = i
+		}
+		receipts[i].MessageIDs = append(receipts[i].MessageIDs, message.ID)
+	}
+
+	return receipts, nil
 }
 
-// GetUserChats retrieves all chats for a user
-func (s *ChatService) GetUserChats(userID uint) ([]model.Chat, error) {
+// GetContactIDs returns the users who share at least one chat with userID
+func (s *ChatService) GetContactIDs(userID uint) ([]uint, error) {
+	var userIDs []uint
+	err := s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id IN (?) AND user_id != ? AND left_at IS NULL", s.activeChatIDs(userID), userID).
+		Where("user_id NOT IN (?) AND user_id NOT IN (?)", s.blockedByUser(userID), s.blockersOfUser(userID)).
+		Distinct().Pluck("user_id", &userIDs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving contacts: %v", err)
+	}
+	return userIDs, nil
+}
+
+// GetUserChats retrieves all direct and project chats the user participates in
+func (s *ChatService) GetUserChats(userID uint) ([]ChatResponse, error) {
 	var chats []model.Chat
 
 	err := s.DB.Preload("User1").Preload("User2").Preload("User1.Profile").Preload("User2.Profile").
+		Preload("Participants", "left_at IS NULL").
+		Preload("Participants.User.Profile").
 		Preload("Messages", func(db *gorm.DB) *gorm.DB {
 			return db.Order("created_at DESC").Limit(1) // Get last message
 		}).
-		Where("user1_id = ? OR user2_id = ?", userID, userID).
+		Where("id IN (?)", s.activeChatIDs(userID)).
 		Order("updated_at DESC").
 		Find(&chats).Error
 
@@ -151,19 +1020,65 @@ func (s *ChatService) GetUserChats(userID uint) ([]model.Chat, error) {
 		return nil, fmt.Errorf("error retrieving user chats: %v", err)
 	}
 
-	return chats, nil
+	// Attach the presence of everyone the user is chatting with, except blocked users
+	blocked, err := s.blockedRelations(userID)
+	if err != nil {
+		return nil, err
+	}
+	var counterpartIDs []uint
+	seen := make(map[uint]bool)
+	for _, chat := range chats {
+		for _, participant := range chat.Participants {
+			if participant.UserID != userID && !seen[participant.UserID] && !blocked[participant.UserID] {
+				seen[participant.UserID] = true
+				counterpartIDs = append(counterpartIDs, participant.UserID)
+			}
+		}
+	}
+
+	presence, err := NewPresenceService(s.DB).GetPresence(counterpartIDs)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range chats {
+		chats[i].Presence = make(map[uint]model.UserPresence)
+		for _, participant := range chats[i].Participants {
+			if participant.UserID == userID {
+				chats[i].Muted = participantMuted(participant, now)
+				if chats[i].Muted {
+					chats[i].MutedUntil = participant.MutedUntil
+				}
+				continue
+			}
+			if p, ok := presence[participant.UserID]; ok {
+				chats[i].Presence[participant.UserID] = p
+			}
+		}
+	}
+
+	responses := make([]ChatResponse, len(chats))
+	for i := range chats {
+		responses[i] = *newChatResponse(&chats[i])
+	}
+	return responses, nil
 }
 
-// UserHasAccessToChat checks if a user has access to a specific chat
+// UserHasAccessToChat checks if a user is a current participant of a specific chat
 func (s *ChatService) UserHasAccessToChat(chatID uint, userID uint) bool {
 	var count int64
-	s.DB.Model(&model.Chat{}).
-		Where("id = ? AND (user1_id = ? OR user2_id = ?)", chatID, userID, userID).
+	s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id = ? AND user_id = ? AND left_at IS NULL", chatID, userID).
 		Count(&count)
 
 	return count > 0
 }
 
+// activeChatIDs is a subquery selecting the chats a user currently participates in
+func (s *ChatService) activeChatIDs(userID uint) *gorm.DB {
+	return s.DB.Model(&model.ChatParticipant{}).Select("chat_id").Where("user_id = ? AND left_at IS NULL", userID)
+}
+
 // GetChatByID retrieves a chat by ID if user has access
 func (s *ChatService) GetChatByID(chatID uint, userID uint) (*model.Chat, error) {
 	if !s.UserHasAccessToChat(chatID, userID) {
@@ -171,7 +1086,10 @@ func (s *ChatService) GetChatByID(chatID uint, userID uint) (*model.Chat, error)
 	}
 
 	var chat model.Chat
-	err := s.DB.Preload("User1").Preload("User2").Preload("User1.Profile").Preload("User2.Profile").First(&chat, chatID).Error
+	err := s.DB.Preload("User1").Preload("User2").Preload("User1.Profile").Preload("User2.Profile").
+		Preload("Participants", "left_at IS NULL").
+		Preload("Participants.User.Profile").
+		First(&chat, chatID).Error
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, errors.New("chat not found")
@@ -182,34 +1100,32 @@ func (s *ChatService) GetChatByID(chatID uint, userID uint) (*model.Chat, error)
 	return &chat, nil
 }
 
-// GetUnreadNotifications gets unread message notifications for a user
+// GetUnreadNotifications gets unread message notifications for a user, one entry per chat
 func (s *ChatService) GetUnreadNotifications(userID uint) ([]map[string]interface{}, error) {
 	var notifications []map[string]interface{}
 
-	// Get all chats where user is a participant and has unread messages
+	// Get all chats where user is a participant and has messages after their read position
 	rows, err := s.DB.Raw(`
 		SELECT 
 			c.id as chat_id,
+			c.type as chat_type,
+			COALESCE(c.name, '') as chat_name,
 			CASE 
 				WHEN c.user1_id = ? THEN c.user2_id 
 				ELSE c.user1_id 
 			END as other_user_id,
-			CASE 
-				WHEN c.user1_id = ? THEN u2.name 
-				ELSE u1.name 
-			END as other_user_name,
+			COALESCE(u.name, '') as other_user_name,
 			COUNT(m.id) as unread_count,
 			MAX(m.created_at) as last_message_time,
 			(SELECT content FROM messages WHERE chat_id = c.id ORDER BY created_at DESC LIMIT 1) as last_message_content
-		FROM chats c
-		LEFT JOIN users u1 ON c.user1_id = u1.id
-		LEFT JOIN users u2 ON c.user2_id = u2.id
-		LEFT JOIN messages m ON c.id = m.chat_id AND m.sender_id != ? AND m.is_read = false
-		WHERE (c.user1_id = ? OR c.user2_id = ?)
-		AND EXISTS (SELECT 1 FROM messages WHERE chat_id = c.id AND sender_id != ? AND is_read = false)
-		GROUP BY c.id, other_user_id, other_user_name
+		FROM chat_participants p
+		JOIN chats c ON c.id = p.chat_id
+		JOIN messages m ON m.chat_id = c.id AND m.sender_id != ? AND m.id > COALESCE(p.last_read_message_id, 0)
+		LEFT JOIN users u ON c.type = ? AND u.id = CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
+		WHERE p.user_id = ? AND p.left_at IS NULL AND `+notMutedCondition+`
+		GROUP BY c.id, c.type, c.name, other_user_id, u.name
 		ORDER BY last_message_time DESC
-	`, userID, userID, userID, userID, userID, userID).Rows()
+	`, userID, userID, model.ChatTypeDirect, userID, userID, time.Now()).Rows()
 
 	if err != nil {
 		return nil, fmt.Errorf("error getting unread notifications: %v", err)
@@ -217,18 +1133,21 @@ func (s *ChatService) GetUnreadNotifications(userID uint) ([]map[string]interfac
 	defer rows.Close()
 
 	for rows.Next() {
-		var chatID, otherUserID uint
-		var otherUserName, lastMessageContent string
+		var chatID uint
+		var otherUserID *uint
+		var chatType, chatName, otherUserName, lastMessageContent string
 		var unreadCount int
 		var lastMessageTime interface{}
 
-		err := rows.Scan(&chatID, &otherUserID, &otherUserName, &unreadCount, &lastMessageTime, &lastMessageContent)
+		err := rows.Scan(&chatID, &chatType, &chatName, &otherUserID, &otherUserName, &unreadCount, &lastMessageTime, &lastMessageContent)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning notification row: %v", err)
 		}
 
 		notification := map[string]interface{}{
 			"chat_id":              chatID,
+			"chat_type":            chatType,
+			"chat_name":            chatName,
 			"other_user_id":        otherUserID,
 			"other_user_name":      otherUserName,
 			"unread_count":         unreadCount,
@@ -242,15 +1161,22 @@ func (s *ChatService) GetUnreadNotifications(userID uint) ([]map[string]interfac
 	return notifications, nil
 }
 
+// notMutedCondition filters the participant row p to chats that are not muted at the given time
+const notMutedCondition = "(p.muted = false OR p.muted_until <= ?)"
+
+// unreadMessages selects the messages in the user's unmuted chats that arrived after their read position
+func (s *ChatService) unreadMessages(userID uint) *gorm.DB {
+	return s.DB.Model(&model.Message{}).
+		Joins("JOIN chat_participants p ON p.chat_id = messages.chat_id AND p.user_id = ? AND p.left_at IS NULL", userID).
+		Where("messages.sender_id != ? AND messages.id > COALESCE(p.last_read_message_id, 0)", userID).
+		Where(notMutedCondition, time.Now())
+}
+
 // GetTotalUnreadCount gets the total number of unread messages for a user
 func (s *ChatService) GetTotalUnreadCount(userID uint) (int, error) {
 	var count int64
 
-	err := s.DB.Model(&model.Message{}).
-		Joins("JOIN chats ON messages.chat_id = chats.id").
-		Where("(chats.user1_id = ? OR chats.user2_id = ?) AND messages.sender_id != ? AND messages.is_read = false",
-			userID, userID, userID).
-		Count(&count).Error
+	err := s.unreadMessages(userID).Count(&count).Error
 
 	if err != nil {
 		return 0, fmt.Errorf("error getting total unread count: %v", err)
@@ -264,10 +1190,7 @@ func (s *ChatService) GetUnreadUsersCount(userID uint) (int, error) {
 	var count int64
 
 	// Count distinct sender IDs from unread messages in chats where the user is a participant
-	err := s.DB.Model(&model.Message{}).
-		Joins("JOIN chats ON messages.chat_id = chats.id").
-		Where("(chats.user1_id = ? OR chats.user2_id = ?) AND messages.sender_id != ? AND messages.is_read = false",
-			userID, userID, userID).
+	err := s.unreadMessages(userID).
 		Distinct("messages.sender_id").
 		Count(&count).Error
 
@@ -282,11 +1205,7 @@ func (s *ChatService) GetUnreadUsersCount(userID uint) (int, error) {
 func (s *ChatService) GetUnreadMessagesCount(userID uint) (int, error) {
 	var count int64
 
-	err := s.DB.Model(&model.Message{}).
-		Joins("JOIN chats ON messages.chat_id = chats.id").
-		Where("(chats.user1_id = ? OR chats.user2_id = ?) AND messages.sender_id != ? AND messages.is_read = false",
-			userID, userID, userID).
-		Count(&count).Error
+	err := s.unreadMessages(userID).Count(&count).Error
 
 	if err != nil {
 		return 0, fmt.Errorf("error getting unread messages count: %v", err)
@@ -306,14 +1225,14 @@ func (s *ChatService) GetUnreadMessagesCountByUser(userID uint) ([]map[string]in
 			u.name as sender_name,
 			COUNT(m.id) as unread_count
 		FROM messages m
-		JOIN chats c ON m.chat_id = c.id
+		JOIN chat_participants p ON p.chat_id = m.chat_id AND p.user_id = ? AND p.left_at IS NULL
 		JOIN users u ON m.sender_id = u.id
-		WHERE (c.user1_id = ? OR c.user2_id = ?) 
-		  AND m.sender_id != ? 
-		  AND m.is_read = false
+		WHERE m.sender_id != ? 
+		  AND m.id > COALESCE(p.last_read_message_id, 0)
+		  AND `+notMutedCondition+`
 		GROUP BY m.sender_id, u.name
 		ORDER BY unread_count DESC
-	`, userID, userID, userID).Rows()
+	`, userID, userID, time.Now()).Rows()
 
 	if err != nil {
 		return nil, fmt.Errorf("error getting unread messages count by user: %v", err)
@@ -341,3 +1260,301 @@ func (s *ChatService) GetUnreadMessagesCountByUser(userID uint) ([]map[string]in
 
 	return results, nil
 }
+
+// ErrChatBlocked is returned to both sides of a block, so it does not reveal who blocked whom
+var ErrChatBlocked = errors.New("you cannot message this user")
+
+// IsBlockedBetween reports whether either user has blocked the other
+func (s *ChatService) IsBlockedBetween(userA, userB uint) bool {
+	var count int64
+	s.DB.Model(&model.UserBlock{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", userA, userB, userB, userA).
+		Count(&count)
+	return count > 0
+}
+
+// CheckCanMessage returns ErrChatBlocked when the chat is a direct chat with someone the user
+// blocked or was blocked by. Project rooms are shared by a whole team and are not affected.
+func (s *ChatService) CheckCanMessage(chatID, userID uint) error {
+	var chat model.Chat
+	if err := s.DB.Select("id", "type", "user1_id", "user2_id").First(&chat, chatID).Error; err != nil {
+		return errors.New("chat not found")
+	}
+	if chat.Type != model.ChatTypeDirect || chat.User1ID == nil || chat.User2ID == nil {
+		return nil
+	}
+
+	otherID := *chat.User1ID
+	if otherID == userID {
+		otherID = *chat.User2ID
+	}
+	if s.IsBlockedBetween(userID, otherID) {
+		return ErrChatBlocked
+	}
+	return nil
+}
+
+// blockedByUser is a subquery selecting the users the given user blocked
+func (s *ChatService) blockedByUser(userID uint) *gorm.DB {
+	return s.DB.Model(&model.UserBlock{}).Select("blocked_id").Where("blocker_id = ?", userID)
+}
+
+// blockersOfUser is a subquery selecting the users who blocked the given user
+func (s *ChatService) blockersOfUser(userID uint) *gorm.DB {
+	return s.DB.Model(&model.UserBlock{}).Select("blocker_id").Where("blocked_id = ?", userID)
+}
+
+// blockedRelations returns every user the given user blocked or was blocked by
+func (s *ChatService) blockedRelations(userID uint) (map[uint]bool, error) {
+	var blocks []model.UserBlock
+	if err := s.DB.Where("blocker_id = ? OR blocked_id = ?", userID, userID).Find(&blocks).Error; err != nil {
+		return nil, fmt.Errorf("error loading blocked users: %v", err)
+	}
+
+	related := make(map[uint]bool, len(blocks))
+	for _, block := range blocks {
+		if block.BlockerID == userID {
+			related[block.BlockedID] = true
+		} else {
+			related[block.BlockerID] = true
+		}
+	}
+	return related, nil
+}
+
+// BlockedUserResponse is a block with only the public details of the blocked user
+type BlockedUserResponse struct {
+	ID        uint         `json:"id"`
+	BlockedID uint         `json:"blocked_id"`
+	Blocked   *UserSummary `json:"blocked,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+func newBlockedUserResponse(block *model.UserBlock) BlockedUserResponse {
+	return BlockedUserResponse{
+		ID:        block.ID,
+		BlockedID: block.BlockedID,
+		Blocked:   NewUserSummary(block.Blocked),
+		CreatedAt: block.CreatedAt,
+	}
+}
+
+// BlockUser stops blockedID from messaging the user in direct chats. Blocking twice is not an error.
+func (s *ChatService) BlockUser(blockerID, blockedID uint) (*BlockedUserResponse, error) {
+	if blockerID == blockedID {
+		return nil, errors.New("cannot block yourself")
+	}
+
+	var count int64
+	s.DB.Model(&model.Users{}).Where("id = ?", blockedID).Count(&count)
+	if count == 0 {
+		return nil, errors.New("user not found")
+	}
+
+	block := model.UserBlock{BlockerID: blockerID, BlockedID: blockedID}
+	if err := s.DB.Where(block).FirstOrCreate(&block).Error; err != nil {
+		return nil, fmt.Errorf("error blocking user: %v", err)
+	}
+
+	if err := s.DB.Preload("Blocked.Profile").First(&block, block.ID).Error; err != nil {
+		return nil, fmt.Errorf("error loading block: %v", err)
+	}
+	response := newBlockedUserResponse(&block)
+	return &response, nil
+}
+
+// UnblockUser removes a block
+func (s *ChatService) UnblockUser(blockerID, blockedID uint) error {
+	result := s.DB.Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Delete(&model.UserBlock{})
+	if result.Error != nil {
+		return fmt.Errorf("error unblocking user: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user is not blocked")
+	}
+	return nil
+}
+
+// GetBlockedUsers lists the users the given user blocked, most recent first
+func (s *ChatService) GetBlockedUsers(blockerID uint) ([]BlockedUserResponse, error) {
+	var blocks []model.UserBlock
+	if err := s.DB.Preload("Blocked.Profile").
+		Where("blocker_id = ?", blockerID).
+		Order("created_at DESC").
+		Find(&blocks).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving blocked users: %v", err)
+	}
+
+	response := make([]BlockedUserResponse, len(blocks))
+	for i := range blocks {
+		response[i] = newBlockedUserResponse(&blocks[i])
+	}
+	return response, nil
+}
+
+// MuteChat stops a chat from counting towards the user's unread notifications until the given
+// time, or until it is unmuted when until is nil
+func (s *ChatService) MuteChat(chatID, userID uint, until *time.Time) error {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return errors.New("unauthorized access to chat")
+	}
+	if until != nil && !until.After(time.Now()) {
+		return errors.New("mute end must be in the future")
+	}
+
+	return s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id = ? AND user_id = ? AND left_at IS NULL", chatID, userID).
+		Updates(map[string]interface{}{"muted": true, "muted_until": until}).Error
+}
+
+// UnmuteChat turns notifications for a chat back on
+func (s *ChatService) UnmuteChat(chatID, userID uint) error {
+	if !s.UserHasAccessToChat(chatID, userID) {
+		return errors.New("unauthorized access to chat")
+	}
+
+	return s.DB.Model(&model.ChatParticipant{}).
+		Where("chat_id = ? AND user_id = ? AND left_at IS NULL", chatID, userID).
+		Updates(map[string]interface{}{"muted": false, "muted_until": nil}).Error
+}
+
+// IsChatMuted reports whether the user currently has the chat muted
+func (s *ChatService) IsChatMuted(chatID, userID uint) bool {
+	var participant model.ChatParticipant
+	if err := s.DB.Select("muted", "muted_until").
+		Where("chat_id = ? AND user_id = ? AND left_at IS NULL", chatID, userID).
+		First(&participant).Error; err != nil {
+		return false
+	}
+	return participantMuted(participant, time.Now())
+}
+
+func participantMuted(participant model.ChatParticipant, now time.Time) bool {
+	return participant.Muted && (participant.MutedUntil == nil || participant.MutedUntil.After(now))
+}
+
+// MessageReportInput is what a user submits when reporting a message
+type MessageReportInput struct {
+	Reason  string
+	Details string
+}
+
+var reportReasons = map[string]bool{
+	model.ReportReasonSpam:          true,
+	model.ReportReasonHarassment:    true,
+	model.ReportReasonInappropriate: true,
+	model.ReportReasonOther:         true,
+}
+
+// reportedAttachment is the part of an attachment kept in a report snapshot
+type reportedAttachment struct {
+	ID       uint   `json:"id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
+
+// ReportMessage records a report about someone else's message with a copy of its current content
+func (s *ChatService) ReportMessage(chatID, messageID, reporterID uint, input MessageReportInput) (*model.MessageReport, error) {
+	if !reportReasons[input.Reason] {
+		return nil, errors.New("invalid reason, must be one of spam, harassment, inappropriate or other")
+	}
+	if input.Reason == model.ReportReasonOther && strings.TrimSpace(input.Details) == "" {
+		return nil, errors.New("details are required for reason other")
+	}
+	if len(input.Details) > 2000 {
+		return nil, errors.New("details must be at most 2000 characters")
+	}
+
+	message, err := s.findChatMessage(chatID, messageID, reporterID)
+	if err != nil {
+		return nil, err
+	}
+	if message.SenderID == reporterID {
+		return nil, errors.New("cannot report your own message")
+	}
+	if message.DeletedAt != nil {
+		return nil, errors.New("message was deleted")
+	}
+	if err := s.DB.Where("message_id = ?", message.ID).Find(&message.Attachments).Error; err != nil {
+		return nil, fmt.Errorf("error retrieving attachments: %v", err)
+	}
+
+	var count int64
+	s.DB.Model(&model.MessageReport{}).Where("message_id = ? AND reporter_id = ?", messageID, reporterID).Count(&count)
+	if count > 0 {
+		return nil, errors.New("you already reported this message")
+	}
+
+	report := model.MessageReport{
+		MessageID:       message.ID,
+		ChatID:          chatID,
+		ReporterID:      reporterID,
+		ReportedUserID:  message.SenderID,
+		Reason:          input.Reason,
+		Details:         strings.TrimSpace(input.Details),
+		ContentSnapshot: message.Content,
+		MessageSentAt:   message.CreatedAt,
+		Status:          model.ReportStatusOpen,
+	}
+
+	if len(message.Attachments) > 0 {
+		attachments := make([]reportedAttachment, 0, len(message.Attachments))
+		for _, attachment := range message.Attachments {
+			attachments = append(attachments, reportedAttachment{
+				ID:       attachment.ID,
+				FileName: attachment.FileName,
+				MimeType: attachment.MimeType,
+				Size:     attachment.Size,
+			})
+		}
+		snapshot, err := json.Marshal(attachments)
+		if err != nil {
+			return nil, fmt.Errorf("error saving attachments: %v", err)
+		}
+		report.AttachmentSnapshot = string(snapshot)
+	}
+
+	if err := s.DB.Create(&report).Error; err != nil {
+		return nil, fmt.Errorf("error saving report: %v", err)
+	}
+	return &report, nil
+}
+
+// MessageReportsQuery selects reports for moderators, oldest open report first
+func (s *ChatService) MessageReportsQuery(status string) *gorm.DB {
+	query := s.DB.Model(&model.MessageReport{}).Preload("Reporter").Preload("ReportedUser")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	return query.Order("created_at ASC").Session(&gorm.Session{})
+}
+
+// ResolveReport closes a report as resolved or dismissed
+func (s *ChatService) ResolveReport(reportID, moderatorID uint, status, note string) (*model.MessageReport, error) {
+	if status != model.ReportStatusResolved && status != model.ReportStatusDismissed {
+		return nil, errors.New("status must be resolved or dismissed")
+	}
+
+	var report model.MessageReport
+	if err := s.DB.First(&report, reportID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New("report not found")
+		}
+		return nil, fmt.Errorf("error retrieving report: %v", err)
+	}
+
+	now := time.Now()
+	report.Status = status
+	report.ResolutionNote = strings.TrimSpace(note)
+	report.ResolvedByID = &moderatorID
+	report.ResolvedAt = &now
+	if err := s.DB.Save(&report).Error; err != nil {
+		return nil, fmt.Errorf("error updating report: %v", err)
+	}
+
+	if err := s.DB.Preload("Reporter").Preload("ReportedUser").First(&report, report.ID).Error; err != nil {
+		return nil, fmt.Errorf("error loading report: %v", err)
+	}
+	return &report, nil
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+const (
+	// emailChangeExpiry is how long a requested change waits for its code to be confirmed.
+	// New codes can be requested within this time by requesting the change again.
+	emailChangeExpiry = 30 * time.Minute
+	// emailChangeRevertDays is how long the old address can undo a confirmed change
+	emailChangeRevertDays = 7
+)
+
+// Errors of the email change that are shown to the user as they are
+var (
+	errEmailTaken          = errors.New("email already exists")
+	errEmailChangeNotFound = errors.New("user not found")
+	errEmailChangeStale    = errors.New("email change is no longer pending")
+	errRevertLinkInvalid   = errors.New("invalid or expired revert link")
+	errPreviousEmailTaken  = errors.New("the previous email address is now used by another account, please contact support")
+)
+
+// EmailChangeService moves an account to a new email address in two steps: the change is
+// requested, then confirmed with the OTP sent to the new address. The old address is told
+// about the change and gets a link to revert it.
+type EmailChangeService struct {
+	DB           *gorm.DB
+	OTPService   *OTPService
+	TokenService *TokenService
+	Outbox       *EmailOutboxService
+}
+
+func NewEmailChangeService(otpService *OTPService) *EmailChangeService {
+	return &EmailChangeService{
+		DB:           config.GetDB(),
+		OTPService:   otpService,
+		TokenService: NewTokenServiceDefault(),
+		Outbox:       DefaultEmailOutbox(),
+	}
+}
+
+// RequestChange starts a change to newEmail and sends the confirmation code to it. Accounts
+// with a password have to enter it. An earlier pending change is replaced.
+func (s *EmailChangeService) RequestChange(userID uint, newEmail, password, ipAddress string) (*model.EmailChange, error) {
+	newEmail = strings.TrimSpace(newEmail)
+	if address, err := mail.ParseAddress(newEmail); err != nil || address.Address != newEmail {
+		return nil, errors.New("invalid email address")
+	}
+
+	var user model.Users
+	if err := s.DB.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	// Accounts created through social login have no password to check
+	if user.Password != "" {
+		if password == "" {
+			return nil, errors.New("current password is required")
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+			return nil, errors.New("current password is incorrect")
+		}
+	}
+
+	if strings.EqualFold(newEmail, user.Email) {
+		return nil, errors.New("new email is the same as the current email")
+	}
+	if err := s.checkEmailAvailable(s.DB, newEmail, userID); err != nil {
+		return nil, err
+	}
+
+	change := model.EmailChange{
+		UserID:           userID,
+		OldEmail:         user.Email,
+		NewEmail:         newEmail,
+		OldEmailVerified: user.IsEmailVerified,
+		Status:           model.EmailChangeStatusPending,
+		ExpiresAt:        time.Now().Add(emailChangeExpiry),
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := s.cancelPending(tx, userID); err != nil {
+			return err
+		}
+		return tx.Create(&change).Error
+	})
+	if err != nil {
+		log.Printf("Database error creating email change: %v", err)
+		return nil, errors.New("failed to request email change")
+	}
+
+	// Sent after the change is stored, so the code can never confirm a change that does not exist.
+	// When the code cannot be sent the change stays pending and can be requested again.
+	if err := s.OTPService.SendOTP(newEmail, "email_change", ipAddress); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// GetPendingChange returns the user's pending change, or nil if there is none
+func (s *EmailChangeService) GetPendingChange(userID uint) (*model.EmailChange, error) {
+	var change model.EmailChange
+	err := s.DB.Where("user_id = ? AND status = ? AND expires_at > ?", userID, model.EmailChangeStatusPending, time.Now()).
+		Order("id DESC").First(&change).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+// ConfirmChange checks the code sent to the new address and switches the account over. The new
+// address is verified by the code, so the account stays verified. The old address is emailed a
+// link that reverts the change.
+func (s *EmailChangeService) ConfirmChange(userID uint, otpCode string) (*model.Users, error) {
+	change, err := s.GetPendingChange(userID)
+	if err != nil {
+		log.Printf("Database error finding email change: %v", err)
+		return nil, errors.New("failed to confirm email change")
+	}
+	if change == nil {
+		return nil, errors.New("no pending email change, please request a new one")
+	}
+
+	if err := s.OTPService.VerifyOTP(change.NewEmail, otpCode, "email_change"); err != nil {
+		return nil, err
+	}
+
+	revertToken, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return nil, errors.New("failed to confirm email change")
+	}
+
+	var user model.Users
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, userID).Error; err != nil {
+			return errEmailChangeNotFound
+		}
+		// The address could have been taken since the change was requested
+		if err := s.checkEmailAvailable(tx, change.NewEmail, userID); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		revertExpiresAt := now.AddDate(0, 0, emailChangeRevertDays)
+		result := tx.Model(&model.EmailChange{}).
+			Where("id = ? AND status = ?", change.ID, model.EmailChangeStatusPending).
+			Updates(map[string]interface{}{
+				"status":            model.EmailChangeStatusConfirmed,
+				"confirmed_at":      now,
+				"revert_token_hash": helper.HashToken(revertToken),
+				"revert_expires_at": revertExpiresAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errEmailChangeStale
+		}
+
+		user.Email = change.NewEmail
+		user.IsEmailVerified = true
+		// A reset link sent to the old address must not work any more
+		user.PasswordResetToken = ""
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+
+		return s.Outbox.EnqueueTx(tx, OutgoingEmail{
+			To:       change.OldEmail,
+			Template: "email_changed",
+			Data: map[string]interface{}{
+				"Name":       user.Name,
+				"NewEmail":   change.NewEmail,
+				"RevertURL":  fmt.Sprintf("%s/email-change/revert?token=%s", helper.GetFrontendURL(), url.QueryEscape(revertToken)),
+				"RevertDays": emailChangeRevertDays,
+			},
+		})
+	})
+	if err != nil {
+		log.Printf("Error confirming email change %d: %v", change.ID, err)
+		return nil, errEmailChangeFailed(err, "failed to confirm email change")
+	}
+	s.Outbox.notify()
+
+	user.Password = ""
+	return &user, nil
+}
+
+// CancelChange drops the user's pending change
+func (s *EmailChangeService) CancelChange(userID uint) error {
+	if err := s.cancelPending(s.DB, userID); err != nil {
+		log.Printf("Database error cancelling email change: %v", err)
+		return errors.New("failed to cancel email change")
+	}
+	return nil
+}
+
+// RevertChange undoes a confirmed change with the token emailed to the old address. The old
+// address and its verification state are restored, later changes by the same user are undone
+// with it, and every session is signed out, since whoever made the change may still be logged in.
+func (s *EmailChangeService) RevertChange(token string) error {
+	if token == "" {
+		return errRevertLinkInvalid
+	}
+
+	var change model.EmailChange
+	err := s.DB.Where("revert_token_hash = ? AND status = ? AND revert_expires_at > ?",
+		helper.HashToken(token), model.EmailChangeStatusConfirmed, time.Now()).First(&change).Error
+	if err != nil {
+		return errRevertLinkInvalid
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		var user model.Users
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, change.UserID).Error; err != nil {
+			return errEmailChangeNotFound
+		}
+		if err := s.checkEmailAvailable(tx, change.OldEmail, user.ID); err != nil {
+			return errPreviousEmailTaken
+		}
+
+		now := time.Now()
+		result := tx.Model(&model.EmailChange{}).
+			Where("user_id = ? AND id >= ? AND status = ?", user.ID, change.ID, model.EmailChangeStatusConfirmed).
+			Updates(map[string]interface{}{"status": model.EmailChangeStatusReverted, "reverted_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRevertLinkInvalid
+		}
+		if err := s.cancelPending(tx, user.ID); err != nil {
+			return err
+		}
+
+		user.Email = change.OldEmail
+		user.IsEmailVerified = change.OldEmailVerified
+		user.PasswordResetToken = ""
+		return tx.Save(&user).Error
+	})
+	if err != nil {
+		log.Printf("Error reverting email change %d: %v", change.ID, err)
+		return errEmailChangeFailed(err, "failed to revert email change")
+	}
+
+	if err := s.TokenService.RevokeAllUserTokens(change.UserID); err != nil {
+		log.Printf("Error signing out user %d after email change revert: %v", change.UserID, err)
+	}
+
+	return nil
+}
+
+func (s *EmailChangeService) cancelPending(tx *gorm.DB, userID uint) error {
+	return tx.Model(&model.EmailChange{}).
+		Where("user_id = ? AND status = ?", userID, model.EmailChangeStatusPending).
+		Update("status", model.EmailChangeStatusCancelled).Error
+}
+
+// checkEmailAvailable fails when another account uses the address
+func (s *EmailChangeService) checkEmailAvailable(tx *gorm.DB, email string, userID uint) error {
+	var count int64
+	if err := tx.Model(&model.Users{}).Where("LOWER(email) = LOWER(?) AND id != ?", email, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errEmailTaken
+	}
+	return nil
+}
+
+// errEmailChangeFailed keeps the errors meant for the user and hides database errors
+func errEmailChangeFailed(err error, fallback string) error {
+	for _, known := range []error{errEmailTaken, errEmailChangeNotFound, errEmailChangeStale, errRevertLinkInvalid, errPreviousEmailTaken} {
+		if errors.Is(err, known) {
+			return known
+		}
+	}
+	return errors.New(fallback)
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/model"
+)
+
+const (
+	// EmailMaxAttempts is how often an email is tried before it is marked failed
+	EmailMaxAttempts = 8
+	emailBatchSize   = 50
+	// Retries wait emailRetryBaseDelay, doubling per attempt up to emailRetryMaxDelay
+	emailRetryBaseDelay = 30 * time.Second
+	emailRetryMaxDelay  = 1 * time.Hour
+	// Sent emails are kept this long for reference
+	emailRetention = 30 * 24 * time.Hour
+	// emailClaimTimeout is how long a claimed email is left to the instance sending it. If that
+	// instance dies before recording the outcome, the email is tried again after this time.
+	emailClaimTimeout = 5 * time.Minute
+)
+
+// OutgoingEmail is an email to queue: a template of the templates package and its data
+type OutgoingEmail struct {
+	To       string
+	Locale   string
+	Template string
+	Data     interface{}
+	Headers  map[string]string
+}
+
+// EmailOutboxService queues rendered emails in the email_outbox table and sends them with a
+// Mailer. Failed sends are retried with exponential backoff and stay visible in the table.
+type EmailOutboxService struct {
+	DB     *gorm.DB
+	Mailer Mailer
+	wake   chan struct{}
+}
+
+func NewEmailOutboxService(db *gorm.DB, mailer Mailer) *EmailOutboxService {
+	return &EmailOutboxService{DB: db, Mailer: mailer, wake: make(chan struct{}, 1)}
+}
+
+var (
+	defaultEmailOutbox     *EmailOutboxService
+	defaultEmailOutboxOnce sync.Once
+)
+
+// DefaultEmailOutbox returns the outbox shared by the whole process. Emails queued through it
+// wake the outbox routine, so they go out right away instead of on the next tick.
+func DefaultEmailOutbox() *EmailOutboxService {
+	defaultEmailOutboxOnce.Do(func() {
+		defaultEmailOutbox = NewEmailOutboxService(config.GetDB(), DefaultMailer())
+	})
+	return defaultEmailOutbox
+}
+
+// Enqueue renders an email and stores it in the outbox
+func (s *EmailOutboxService) Enqueue(email OutgoingEmail) error {
+	if err := s.EnqueueTx(s.DB, email); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// EnqueueTx stores an email within the caller's transaction, so it is only sent if the
+// transaction commits. It is picked up by the next run of the outbox routine.
+func (s *EmailOutboxService) EnqueueTx(tx *gorm.DB, email OutgoingEmail) error {
+	if email.Locale == "" {
+		email.Locale = EmailLocale()
+	}
+
+	message, err := RenderEmail(email.To, email.Locale, email.Template, email.Data)
+	if err != nil {
+		return err
+	}
+
+	var headers string
+	if len(email.Headers) > 0 {
+		encoded, err := json.Marshal(email.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to encode email headers: %v", err)
+		}
+		headers = string(encoded)
+	}
+
+	outbox := model.EmailOutbox{
+		Recipient:     email.To,
+		Template:      email.Template,
+		Locale:        email.Locale,
+		Subject:       message.Subject,
+		HTMLBody:      message.HTMLBody,
+		TextBody:      message.TextBody,
+		Headers:       headers,
+		Status:        model.EmailStatusPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(&outbox).Error; err != nil {
+		return fmt.Errorf("failed to queue email: %v", err)
+	}
+	return nil
+}
+
+// Wake is signalled when an email was queued by this process
+func (s *EmailOutboxService) Wake() <-chan struct{} {
+	return s.wake
+}
+
+func (s *EmailOutboxService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessOutbox sends every due email. Rows are claimed with SKIP LOCKED so several instances
+// can work on the outbox at the same time.
+func (s *EmailOutboxService) ProcessOutbox() {
+	for {
+		processed, err := s.processBatch()
+		if err != nil {
+			log.Printf("Error processing email outbox: %v", err)
+			return
+		}
+		if processed < emailBatchSize {
+			return
+		}
+	}
+}
+
+// processBatch claims a batch of due emails, then sends them outside any transaction, so a slow
+// mail server holds no locks and a failed update cannot roll back the record of a sent email.
+// Each outcome is stored on its own.
+func (s *EmailOutboxService) processBatch() (int, error) {
+	emails, err := s.claimBatch()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range emails {
+		// The attempt condition skips the update if the claim ran out and another run took the email
+		result := s.DB.Model(&model.EmailOutbox{}).
+			Where("id = ? AND attempts = ?", emails[i].ID, emails[i].Attempts).
+			Updates(s.send(&emails[i]))
+		if result.Error != nil {
+			log.Printf("Error recording the outcome of email %d: %v", emails[i].ID, result.Error)
+		}
+	}
+
+	return len(emails), nil
+}
+
+// claimBatch takes up to emailBatchSize due emails: their attempt is counted and they are held
+// back for emailClaimTimeout, which keeps other runs away from them once the claim is committed
+func (s *EmailOutboxService) claimBatch() ([]model.EmailOutbox, error) {
+	var emails []model.EmailOutbox
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", model.EmailStatusPending, now).
+			Order("next_attempt_at ASC, id ASC").
+			Limit(emailBatchSize).
+			Find(&emails).Error; err != nil {
+			return err
+		}
+		if len(emails) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, len(emails))
+		for i := range emails {
+			ids[i] = emails[i].ID
+			emails[i].Attempts++
+		}
+		return tx.Model(&model.EmailOutbox{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"next_attempt_at": now.Add(emailClaimTimeout),
+		}).Error
+	})
+
+	return emails, err
+}
+
+// send delivers one claimed email and returns the columns to update. The attempt was already
+// counted by the claim.
+func (s *EmailOutboxService) send(email *model.EmailOutbox) map[string]interface{} {
+	message := EmailMessage{
+		To:       email.Recipient,
+		Subject:  email.Subject,
+		HTMLBody: email.HTMLBody,
+		TextBody: email.TextBody,
+	}
+	if email.Headers != "" {
+		if err := json.Unmarshal([]byte(email.Headers), &message.Headers); err != nil {
+			log.Printf("Error decoding headers of email %d: %v", email.ID, err)
+		}
+	}
+
+	attempts := email.Attempts
+	err := s.Mailer.Send(message)
+	if err == nil {
+		log.Printf("Email %s sent successfully to %s", email.Template, email.Recipient)
+		return map[string]interface{}{
+			"status":     model.EmailStatusSent,
+			"sent_at":    time.Now(),
+			"last_error": "",
+			"html_body":  "",
+			"text_body":  "",
+		}
+	}
+
+	if attempts >= EmailMaxAttempts {
+		log.Printf("Giving up on email %d (%s) to %s after %d attempts: %v", email.ID, email.Template, email.Recipient, attempts, err)
+		// The bodies can hold codes and reset links, they are not kept once the email is given up
+		return map[string]interface{}{
+			"status":     model.EmailStatusFailed,
+			"last_error": err.Error(),
+			"html_body":  "",
+			"text_body":  "",
+		}
+	}
+
+	delay := emailRetryDelay(attempts)
+	log.Printf("Could not send email %d (%s) to %s, retrying in %s: %v", email.ID, email.Template, email.Recipient, delay, err)
+	return map[string]interface{}{
+		"next_attempt_at": time.Now().Add(delay),
+		"last_error":      err.Error(),
+	}
+}
+
+// emailRetryDelay is the wait after the given number of failed attempts
+func emailRetryDelay(attempts int) time.Duration {
+	delay := emailRetryBaseDelay
+	for i := 1; i < attempts && delay < emailRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, emailRetryMaxDelay)
+}
+
+// CleanupSentEmails removes sent emails older than the retention period. Failed emails are
+// kept until someone looked into them, without their bodies.
+func (s *EmailOutboxService) CleanupSentEmails() {
+	if err := s.DB.Model(&model.EmailOutbox{}).
+		Where("status = ? AND (html_body <> '' OR text_body <> '')", model.EmailStatusFailed).
+		Updates(map[string]interface{}{"html_body": "", "text_body": ""}).Error; err != nil {
+		log.Printf("Error clearing bodies of failed emails: %v", err)
+	}
+
+	result := s.DB.Where("status = ? AND sent_at < ?", model.EmailStatusSent, time.Now().Add(-emailRetention)).Delete(&model.EmailOutbox{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up sent emails: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d sent emails", result.RowsAffected)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+
+	"synergazing.com/synergazing/templates"
+)
+
+// DefaultEmailLocale is used when EMAIL_LOCALE is not set, and for templates missing in a locale
+const DefaultEmailLocale = "en"
+
+var emailLocalePattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]{2})?$`)
+
+// EmailLocale returns the locale emails are written in, configured with EMAIL_LOCALE
+func EmailLocale() string {
+	if locale := strings.ToLower(os.Getenv("EMAIL_LOCALE")); emailLocalePattern.MatchString(locale) {
+		return locale
+	}
+	return DefaultEmailLocale
+}
+
+// emailButton is the argument of the "button" layout template
+type emailButton struct {
+	URL   string
+	Label string
+}
+
+var emailTemplateFuncs = map[string]interface{}{
+	"button": func(url, label string) emailButton {
+		return emailButton{URL: url, Label: label}
+	},
+}
+
+// emailTemplate is one email of one locale: the HTML body and the subject plus plain text body
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var emailTemplates sync.Map // "locale/name" -> *emailTemplate
+
+// RenderEmail renders the named email template for the locale, falling back to DefaultEmailLocale
+// when the locale has no such template
+func RenderEmail(to, locale, name string, data interface{}) (*EmailMessage, error) {
+	tmpl, err := loadEmailTemplate(locale, name)
+	if err != nil && locale != DefaultEmailLocale {
+		tmpl, err = loadEmailTemplate(DefaultEmailLocale, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render subject of email %s: %v", name, err)
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, fmt.Errorf("failed to render text of email %s: %v", name, err)
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return nil, fmt.Errorf("failed to render HTML of email %s: %v", name, err)
+	}
+
+	return &EmailMessage{
+		To:       to,
+		Subject:  strings.Join(strings.Fields(subject.String()), " "),
+		HTMLBody: html.String(),
+		TextBody: strings.TrimSpace(text.String()),
+	}, nil
+}
+
+func loadEmailTemplate(locale, name string) (*emailTemplate, error) {
+	key := locale + "/" + name
+	if cached, ok := emailTemplates.Load(key); ok {
+		return cached.(*emailTemplate), nil
+	}
+
+	if !emailLocalePattern.MatchString(locale) {
+		return nil, fmt.Errorf("invalid email locale %q", locale)
+	}
+
+	dir := "email/" + locale + "/"
+	html, err := htmltemplate.New(name).Funcs(emailTemplateFuncs).ParseFS(templates.Email, dir+"layout.html", dir+name+".html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email template %s: %v", key, err)
+	}
+	text, err := texttemplate.New(name).ParseFS(templates.Email, dir+"layout.txt", dir+name+".txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email template %s: %v", key, err)
+	}
+
+	tmpl := &emailTemplate{html: html, text: text}
+	emailTemplates.Store(key, tmpl)
+	return tmpl, nil
+}
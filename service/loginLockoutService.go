@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+const (
+	// loginLockoutThreshold is how many wrong passwords in a row lock the account
+	loginLockoutThreshold = 5
+	// loginLockoutBase is the first lockout; every further lockout doubles it up to loginLockoutMax
+	loginLockoutBase = 5 * time.Minute
+	loginLockoutMax  = 24 * time.Hour
+	// loginLockoutForget is how long without a failed login before failures and lockouts are forgotten
+	loginLockoutForget = 24 * time.Hour
+)
+
+// AccountLockedError is returned while an account is locked after too many failed logins
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return "too many failed login attempts, your account is temporarily locked"
+}
+
+// RetryAfter is how long until the account can log in again
+func (e *AccountLockedError) RetryAfter() time.Duration {
+	return time.Until(e.Until)
+}
+
+// LoginLockoutService locks accounts progressively after repeated wrong passwords and emails the
+// owner when it happens. It protects an account against guessing spread over many addresses,
+// which the per-IP rate limits cannot catch.
+type LoginLockoutService struct {
+	DB     *gorm.DB
+	Outbox *EmailOutboxService
+}
+
+func NewLoginLockoutService() *LoginLockoutService {
+	return &LoginLockoutService{
+		DB:     config.GetDB(),
+		Outbox: DefaultEmailOutbox(),
+	}
+}
+
+// CheckLocked returns an *AccountLockedError while the user is locked out
+func (s *LoginLockoutService) CheckLocked(userID uint) error {
+	var lockout model.AccountLockout
+	err := s.DB.Where("user_id = ? AND locked_until > ?", userID, time.Now()).First(&lockout).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		// Let the login go on, the password is still checked
+		log.Printf("Database error checking lockout of user %d: %v", userID, err)
+		return nil
+	}
+	return &AccountLockedError{Until: *lockout.LockedUntil}
+}
+
+// RecordFailure counts a wrong password. When the threshold is reached the account is locked
+// and the user is emailed, and an *AccountLockedError is returned.
+func (s *LoginLockoutService) RecordFailure(user *model.Users, client ClientInfo) error {
+	var lockedUntil *time.Time
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		lockout := model.AccountLockout{UserID: user.ID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&lockout).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lockout, "user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+
+		if lockout.LastFailedAt != nil && now.Sub(*lockout.LastFailedAt) > loginLockoutForget {
+			lockout.FailedAttempts = 0
+			lockout.LockoutCount = 0
+		}
+		lockout.FailedAttempts++
+		lockout.LastFailedAt = &now
+
+		attempts := lockout.FailedAttempts
+		if attempts >= loginLockoutThreshold {
+			until := now.Add(loginLockoutDuration(lockout.LockoutCount))
+			lockout.LockoutCount++
+			lockout.FailedAttempts = 0
+			lockout.LockedAt = &now
+			lockout.LockedUntil = &until
+			lockedUntil = &until
+		}
+
+		if err := tx.Save(&lockout).Error; err != nil {
+			return err
+		}
+		if lockedUntil == nil {
+			return nil
+		}
+
+		return s.Outbox.EnqueueTx(tx, OutgoingEmail{
+			To:       user.Email,
+			Template: "account_locked",
+			Data: map[string]interface{}{
+				"Name":        user.Name,
+				"Attempts":    attempts,
+				"LockedUntil": lockedUntil.UTC().Format("2 January 2006, 15:04 UTC"),
+				"IPAddress":   client.IPAddress,
+				"ResetURL":    fmt.Sprintf("%s/forgot-password", helper.GetFrontendURL()),
+			},
+		})
+	})
+	if err != nil {
+		log.Printf("Error recording failed login of user %d: %v", user.ID, err)
+		return nil
+	}
+	if lockedUntil == nil {
+		return nil
+	}
+
+	s.Outbox.notify()
+	log.Printf("Locked user %d until %s after repeated failed logins", user.ID, lockedUntil.Format(time.RFC3339))
+	return &AccountLockedError{Until: *lockedUntil}
+}
+
+// Reset forgets the failed logins and lockouts of the user, after a correct password or a
+// password reset
+func (s *LoginLockoutService) Reset(userID uint) {
+	if err := s.DB.Where("user_id = ?", userID).Delete(&model.AccountLockout{}).Error; err != nil {
+		log.Printf("Database error resetting lockout of user %d: %v", userID, err)
+	}
+}
+
+// loginLockoutDuration is the length of the lockout after the given number of earlier ones
+func loginLockoutDuration(previousLockouts int) time.Duration {
+	duration := loginLockoutBase
+	for i := 0; i < previousLockouts && duration < loginLockoutMax; i++ {
+		duration *= 2
+	}
+	if duration > loginLockoutMax {
+		duration = loginLockoutMax
+	}
+	return duration
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// EmailMessage is a rendered email ready to be handed to a Mailer
+type EmailMessage struct {
+	To       string
+	Subject  string
+	HTMLBody string
+	TextBody string
+	Headers  map[string]string
+}
+
+// Mailer delivers a rendered email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(message EmailMessage) error
+}
+
+// SMTPMailer sends through an SMTP server configured once at startup
+type SMTPMailer struct {
+	From   string
+	dialer *gomail.Dialer
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{From: from, dialer: gomail.NewDialer(host, port, username, password)}
+}
+
+// NewSMTPMailerFromEnv reads EMAIL_HOST, EMAIL_PORT, EMAIL_USERNAME, EMAIL_PASSWORD and the
+// optional EMAIL_FROM, which defaults to the username
+func NewSMTPMailerFromEnv() (*SMTPMailer, error) {
+	port, err := strconv.Atoi(os.Getenv("EMAIL_PORT"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse EMAIL_PORT: %v", err)
+	}
+
+	username := os.Getenv("EMAIL_USERNAME")
+	from := os.Getenv("EMAIL_FROM")
+	if from == "" {
+		from = username
+	}
+
+	return NewSMTPMailer(os.Getenv("EMAIL_HOST"), port, username, os.Getenv("EMAIL_PASSWORD"), from), nil
+}
+
+func (m *SMTPMailer) Send(message EmailMessage) error {
+	msg := gomail.NewMessage()
+
+	msg.SetHeader("From", fmt.Sprintf("Synergazing <%s>", m.From))
+	msg.SetHeader("To", message.To)
+	msg.SetHeader("Subject", message.Subject)
+	for name, value := range message.Headers {
+		msg.SetHeader(name, value)
+	}
+
+	msg.SetBody("text/html", message.HTMLBody)
+	msg.AddAlternative("text/plain", message.TextBody)
+
+	return m.dialer.DialAndSend(msg)
+}
+
+// FileMailer writes every email to Dir as a text file, or to the log when Dir is empty.
+// Meant for development, where no SMTP server is available.
+type FileMailer struct {
+	Dir string
+}
+
+func NewFileMailer(dir string) *FileMailer {
+	return &FileMailer{Dir: dir}
+}
+
+func (m *FileMailer) Send(message EmailMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "To: %s\nSubject: %s\n", message.To, message.Subject)
+	for name, value := range message.Headers {
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+	fmt.Fprintf(&b, "\n%s\n\n--- HTML ---\n%s\n", message.TextBody, message.HTMLBody)
+
+	if m.Dir == "" {
+		log.Printf("Email (console mailer):\n%s", b.String())
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %v", err)
+	}
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102T150405.000000000"), sanitizeMailFileName(message.To))
+	if err := os.WriteFile(filepath.Join(m.Dir, name), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write email: %v", err)
+	}
+	return nil
+}
+
+func sanitizeMailFileName(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '@' {
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+// MemoryMailer keeps sent emails in memory, for tests and local tooling
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []EmailMessage
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(message EmailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// Messages returns a copy of the emails sent so far
+func (m *MemoryMailer) Messages() []EmailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]EmailMessage(nil), m.messages...)
+}
+
+// Reset forgets the emails sent so far
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
+
+// NewMailerFromEnv picks the mailer from MAILER: "file" writes to MAILER_DIR (storage_private/mail
+// by default), "console" logs emails, "memory" keeps them in memory and anything else uses SMTP
+func NewMailerFromEnv() Mailer {
+	switch os.Getenv("MAILER") {
+	case "file":
+		dir := os.Getenv("MAILER_DIR")
+		if dir == "" {
+			dir = "storage_private/mail"
+		}
+		log.Printf("Using file mailer, emails are written to %s", dir)
+		return NewFileMailer(dir)
+	case "console":
+		log.Println("Using console mailer, emails are written to the log")
+		return NewFileMailer("")
+	case "memory":
+		log.Println("Using in-memory mailer, emails are not delivered")
+		return NewMemoryMailer()
+	}
+
+	mailer, err := NewSMTPMailerFromEnv()
+	if err != nil {
+		// Queued emails stay in the outbox and fail visibly instead of being dropped
+		log.Printf("Error configuring SMTP mailer: %v", err)
+		return failingMailer{err: err}
+	}
+	return mailer
+}
+
+// failingMailer stands in for a mailer that could not be configured
+type failingMailer struct {
+	err error
+}
+
+func (m failingMailer) Send(EmailMessage) error {
+	return m.err
+}
+
+var (
+	defaultMailer     Mailer
+	defaultMailerOnce sync.Once
+)
+
+// DefaultMailer returns the mailer shared by the whole process, created from the environment on first use
+func DefaultMailer() Mailer {
+	defaultMailerOnce.Do(func() {
+		defaultMailer = NewMailerFromEnv()
+	})
+	return defaultMailer
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+// DigestUnsubscribeList is the list name carried by digest unsubscribe tokens
+const DigestUnsubscribeList = "digest"
+
+const (
+	// digestNotificationLimit caps how many notifications are listed in one email
+	digestNotificationLimit = 10
+	digestBatchSize         = 100
+	// digestSlack lets an hourly job that runs a little early still pick up a due digest
+	digestSlack = 10 * time.Minute
+)
+
+// digestDueCondition matches settings rows whose user got no digest within their period.
+// The two parameters are the cut-off times for weekly and daily digests.
+const digestDueCondition = `NOT EXISTS (
+	SELECT 1 FROM notification_digests d
+	WHERE d.user_id = notification_settings.user_id
+	  AND d.created_at > CASE notification_settings.digest_frequency WHEN 'weekly' THEN ? ELSE ? END)`
+
+// NotificationDigestService emails users who opted in a daily or weekly summary of their
+// unread notifications and chat messages
+type NotificationDigestService struct {
+	DB     *gorm.DB
+	Chat   *ChatService
+	Outbox *EmailOutboxService
+}
+
+func NewNotificationDigestService(db *gorm.DB) *NotificationDigestService {
+	return &NotificationDigestService{DB: db, Chat: &ChatService{DB: db}, Outbox: DefaultEmailOutbox()}
+}
+
+// digestEmailData is the data of the digest email template
+type digestEmailData struct {
+	Name      string
+	Frequency string
+	// Notifications holds the newest unread notifications, NotificationCount counts all of them
+	Notifications      []model.Notification
+	NotificationCount  int
+	MoreNotifications  int
+	ChatSenders        []digestChatSender
+	UnreadMessageCount int
+	NotificationsURL   string
+	ChatURL            string
+	UnsubscribeURL     string
+}
+
+// digestChatSender is a chat partner with unread messages
+type digestChatSender struct {
+	Name        string
+	UnreadCount int
+}
+
+// SendDueDigests sends the digests of every user whose daily or weekly period has passed
+func (s *NotificationDigestService) SendDueDigests() {
+	now := time.Now()
+	var lastUserID uint
+	emailed := 0
+
+	for {
+		var userIDs []uint
+		if err := s.DB.Model(&model.NotificationSettings{}).
+			Where("user_id > ? AND digest_frequency IN ?", lastUserID, []string{model.DigestFrequencyDaily, model.DigestFrequencyWeekly}).
+			Where(digestDueCondition, digestCutoff(model.DigestFrequencyWeekly, now), digestCutoff(model.DigestFrequencyDaily, now)).
+			Order("user_id ASC").
+			Limit(digestBatchSize).
+			Pluck("user_id", &userIDs).Error; err != nil {
+			log.Printf("Error finding due digests: %v", err)
+			return
+		}
+
+		for _, userID := range userIDs {
+			sent, err := s.sendDigest(userID, now)
+			if err != nil {
+				log.Printf("Error sending digest to user %d: %v", userID, err)
+			} else if sent {
+				emailed++
+			}
+		}
+
+		if len(userIDs) < digestBatchSize {
+			break
+		}
+		lastUserID = userIDs[len(userIDs)-1]
+	}
+
+	if emailed > 0 {
+		log.Printf("Queued %d notification digests", emailed)
+		s.Outbox.notify()
+	}
+}
+
+// sendDigest queues one user's digest if it is still due and records it. The settings row is
+// locked so two instances never send the same digest. Only notifications and chat messages
+// newer than the previous digest count as news; without news no email is sent, but the run is
+// recorded so the next digest follows the normal cadence. Returns whether an email was queued.
+func (s *NotificationDigestService) sendDigest(userID uint, now time.Time) (bool, error) {
+	emailed := false
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var settings model.NotificationSettings
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("user_id = ? AND digest_frequency IN ?", userID, []string{model.DigestFrequencyDaily, model.DigestFrequencyWeekly}).
+			Where(digestDueCondition, digestCutoff(model.DigestFrequencyWeekly, now), digestCutoff(model.DigestFrequencyDaily, now)).
+			First(&settings).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Sent by another instance or unsubscribed in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Wait for the quiet hours to end
+		if !quietHoursEnd(&settings, now).IsZero() {
+			return nil
+		}
+
+		var previous model.NotificationDigest
+		if err := tx.Where("user_id = ?", userID).Order("id DESC").Limit(1).Find(&previous).Error; err != nil {
+			return err
+		}
+
+		digest := model.NotificationDigest{
+			UserID:             userID,
+			Frequency:          settings.DigestFrequency,
+			LastNotificationID: previous.LastNotificationID,
+			LastMessageID:      previous.LastMessageID,
+		}
+
+		newNotifications := tx.Model(&model.Notification{}).
+			Where("user_id = ? AND is_read = ? AND id > ?", userID, false, previous.LastNotificationID)
+
+		var notificationCount int64
+		if err := newNotifications.Session(&gorm.Session{}).Count(&notificationCount).Error; err != nil {
+			return err
+		}
+		var notifications []model.Notification
+		if err := newNotifications.Session(&gorm.Session{}).Order("id DESC").Limit(digestNotificationLimit).Find(&notifications).Error; err != nil {
+			return err
+		}
+
+		var newMessages struct {
+			Count int64
+			MaxID uint
+		}
+		if err := s.Chat.unreadMessages(userID).
+			Where("messages.id > ?", previous.LastMessageID).
+			Select("COUNT(*) AS count, COALESCE(MAX(messages.id), 0) AS max_id").
+			Scan(&newMessages).Error; err != nil {
+			return err
+		}
+
+		if notificationCount > 0 || newMessages.Count > 0 {
+			data := digestEmailData{
+				Frequency:         settings.DigestFrequency,
+				Notifications:     notifications,
+				NotificationCount: int(notificationCount),
+				MoreNotifications: int(notificationCount) - len(notifications),
+				NotificationsURL:  helper.GetFrontendURL() + "/notifications",
+				ChatURL:           helper.GetFrontendURL() + "/chat",
+				UnsubscribeURL:    DigestUnsubscribeURL(userID),
+			}
+
+			// The chat section shows everything still unread, as long as something new arrived
+			if newMessages.Count > 0 {
+				unreadByUser, err := s.Chat.GetUnreadMessagesCountByUser(userID)
+				if err != nil {
+					return err
+				}
+				for _, sender := range unreadByUser {
+					count, _ := sender["unread_count"].(int)
+					name, _ := sender["user_name"].(string)
+					data.ChatSenders = append(data.ChatSenders, digestChatSender{Name: name, UnreadCount: count})
+					data.UnreadMessageCount += count
+				}
+			}
+
+			var user model.Users
+			if err := tx.Select("id", "name", "email").First(&user, userID).Error; err != nil {
+				return fmt.Errorf("failed to find user: %v", err)
+			}
+			data.Name = user.Name
+
+			// Queued in the same transaction, so the digest is recorded if and only if the email is queued
+			if err := s.Outbox.EnqueueTx(tx, OutgoingEmail{
+				To:       user.Email,
+				Template: "digest",
+				Data:     data,
+				Headers: map[string]string{
+					"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+					"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+				},
+			}); err != nil {
+				return err
+			}
+
+			digest.Emailed = true
+			digest.NotificationCount = int(notificationCount)
+			digest.MessageCount = int(newMessages.Count)
+			if len(notifications) > 0 {
+				digest.LastNotificationID = notifications[0].ID
+			}
+			if newMessages.MaxID > digest.LastMessageID {
+				digest.LastMessageID = newMessages.MaxID
+			}
+		}
+
+		if err := tx.Create(&digest).Error; err != nil {
+			return err
+		}
+		emailed = digest.Emailed
+		return nil
+	})
+
+	return emailed, err
+}
+
+// DigestUnsubscribeURL returns the signed one-click unsubscribe link of a user's digest
+func DigestUnsubscribeURL(userID uint) string {
+	token := helper.SignUnsubscribeToken(userID, DigestUnsubscribeList)
+	return helper.GetUrlFile("api/notifications/digest/unsubscribe?token=" + url.QueryEscape(token))
+}
+
+// digestCutoff is the time the previous digest must be older than for a new one to be due
+func digestCutoff(frequency string, now time.Time) time.Time {
+	period := 24 * time.Hour
+	if frequency == model.DigestFrequencyWeekly {
+		period = 7 * 24 * time.Hour
+	}
+	return now.Add(-period + digestSlack)
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	_ "time/tzdata" // quiet hours accept any IANA time zone, also on hosts without zoneinfo
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/model"
+)
+
+// NotificationTypeInfo describes a notification type users can configure
+type NotificationTypeInfo struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	// Urgent notifications are delivered during quiet hours as well
+	Urgent bool `json:"urgent"`
+}
+
+// NotificationTypes lists every notification type with its settings label
+var NotificationTypes = []NotificationTypeInfo{
+	{Type: model.NotificationTypeDeadlineApproaching, Label: "Registration deadline approaching", Urgent: true},
+	{Type: model.NotificationTypeUserRegistered, Label: "New application to your project"},
+	{Type: model.NotificationTypeUserAccepted, Label: "Your application was accepted"},
+	{Type: model.NotificationTypeUserRejected, Label: "Your application was not selected"},
+	{Type: model.NotificationTypeInvitationReceived, Label: "Project invitation"},
+	{Type: model.NotificationTypeRoleAssigned, Label: "Role assigned"},
+	{Type: model.NotificationTypeProjectStatusChange, Label: "Project status changed"},
+	{Type: model.NotificationTypeProjectUpdated, Label: "Project updated"},
+	{Type: model.NotificationTypeProjectCompleted, Label: "Project completed"},
+	{Type: model.NotificationTypeTeamMemberLeft, Label: "Team member left"},
+}
+
+// DefaultQuietHoursTimezone is used until a user picks a time zone
+const DefaultQuietHoursTimezone = "Asia/Jakarta"
+
+// NotificationChannels is the routing decision for one notification
+type NotificationChannels struct {
+	InApp bool `json:"in_app"`
+	Email bool `json:"email"`
+	Push  bool `json:"push"`
+}
+
+// Any reports whether at least one channel is enabled
+func (c NotificationChannels) Any() bool {
+	return c.InApp || c.Email || c.Push
+}
+
+// defaultNotificationChannels applies to types the user never configured.
+// Email is opt-in; before preferences existed no notification emails were sent.
+var defaultNotificationChannels = NotificationChannels{InApp: true, Email: false, Push: true}
+
+// NotificationTypePreference is the effective setting of one type
+type NotificationTypePreference struct {
+	NotificationTypeInfo
+	NotificationChannels
+}
+
+// QuietHoursDTO is the quiet hours part of the preferences
+type QuietHoursDTO struct {
+	Enabled  bool   `json:"enabled"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+// NotificationPreferencesDTO is read by GET and accepted by PUT /api/notifications/preferences.
+// On update only the listed types change, and quiet hours and digest only when given.
+type NotificationPreferencesDTO struct {
+	Types      []NotificationTypePreference `json:"types"`
+	QuietHours *QuietHoursDTO               `json:"quiet_hours"`
+	// Digest is the email digest frequency: off, daily or weekly
+	Digest *string `json:"digest"`
+}
+
+type NotificationPreferenceService struct {
+	DB *gorm.DB
+}
+
+func NewNotificationPreferenceService(db *gorm.DB) *NotificationPreferenceService {
+	return &NotificationPreferenceService{DB: db}
+}
+
+// GetPreferences returns the effective settings of every type plus the quiet hours
+func (s *NotificationPreferenceService) GetPreferences(userID uint) (*NotificationPreferencesDTO, error) {
+	var stored []model.NotificationPreference
+	if err := s.DB.Where("user_id = ?", userID).Find(&stored).Error; err != nil {
+		return nil, fmt.Errorf("failed to get notification preferences: %v", err)
+	}
+	byType := make(map[string]model.NotificationPreference, len(stored))
+	for _, preference := range stored {
+		byType[preference.Type] = preference
+	}
+
+	result := &NotificationPreferencesDTO{Types: make([]NotificationTypePreference, 0, len(NotificationTypes))}
+	for _, info := range NotificationTypes {
+		channels := defaultNotificationChannels
+		if preference, ok := byType[info.Type]; ok {
+			channels = NotificationChannels{InApp: preference.InApp, Email: preference.Email, Push: preference.Push}
+		}
+		result.Types = append(result.Types, NotificationTypePreference{NotificationTypeInfo: info, NotificationChannels: channels})
+	}
+
+	settings, err := s.getSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	result.QuietHours = &QuietHoursDTO{
+		Enabled:  settings.QuietHoursEnabled,
+		Start:    settings.QuietHoursStart,
+		End:      settings.QuietHoursEnd,
+		Timezone: settings.Timezone,
+	}
+	result.Digest = &settings.DigestFrequency
+
+	return result, nil
+}
+
+// UpdatePreferences stores the given type settings, quiet hours and digest frequency and returns the result
+func (s *NotificationPreferenceService) UpdatePreferences(userID uint, data NotificationPreferencesDTO) (*NotificationPreferencesDTO, error) {
+	preferences := make([]model.NotificationPreference, 0, len(data.Types))
+	for _, preference := range data.Types {
+		if notificationTypeInfo(preference.Type) == nil {
+			return nil, fmt.Errorf("unknown notification type %q", preference.Type)
+		}
+		preferences = append(preferences, model.NotificationPreference{
+			UserID: userID,
+			Type:   preference.Type,
+			InApp:  preference.InApp,
+			Email:  preference.Email,
+			Push:   preference.Push,
+		})
+	}
+
+	settings, err := s.getSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	if data.QuietHours != nil {
+		if err := applyQuietHours(settings, *data.QuietHours); err != nil {
+			return nil, err
+		}
+	}
+	if data.Digest != nil {
+		if !isDigestFrequency(*data.Digest) {
+			return nil, fmt.Errorf("digest must be %s, %s or %s", model.DigestFrequencyOff, model.DigestFrequencyDaily, model.DigestFrequencyWeekly)
+		}
+		settings.DigestFrequency = *data.Digest
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if len(preferences) > 0 {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "user_id"}, {Name: "type"}},
+				DoUpdates: clause.AssignmentColumns([]string{"in_app", "email", "push", "updated_at"}),
+			}).Create(&preferences).Error; err != nil {
+				return err
+			}
+		}
+		if data.QuietHours != nil || data.Digest != nil {
+			if err := tx.Save(settings).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update notification preferences: %v", err)
+	}
+
+	return s.GetPreferences(userID)
+}
+
+// ChannelsFor returns the channels a notification of the given type goes to
+func (s *NotificationPreferenceService) ChannelsFor(userID uint, notificationType string) (NotificationChannels, error) {
+	var preference model.NotificationPreference
+	err := s.DB.Where("user_id = ? AND type = ?", userID, notificationType).First(&preference).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return defaultNotificationChannels, nil
+	}
+	if err != nil {
+		return NotificationChannels{}, fmt.Errorf("failed to get notification preference: %v", err)
+	}
+	return NotificationChannels{InApp: preference.InApp, Email: preference.Email, Push: preference.Push}, nil
+}
+
+// DeferUntil returns when a notification of the given type may interrupt the user: the end of
+// the current quiet hours, or the zero time if it can be delivered now
+func (s *NotificationPreferenceService) DeferUntil(userID uint, notificationType string, now time.Time) (time.Time, error) {
+	if info := notificationTypeInfo(notificationType); info != nil && info.Urgent {
+		return time.Time{}, nil
+	}
+
+	settings, err := s.getSettings(userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return quietHoursEnd(settings, now), nil
+}
+
+// UnsubscribeDigest turns the email digest off, used by the unsubscribe link in digest emails
+func (s *NotificationPreferenceService) UnsubscribeDigest(userID uint) error {
+	settings := model.NotificationSettings{UserID: userID, Timezone: DefaultQuietHoursTimezone, DigestFrequency: model.DigestFrequencyOff}
+	err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"digest_frequency", "updated_at"}),
+	}).Create(&settings).Error
+	if err != nil {
+		return fmt.Errorf("failed to unsubscribe from digest: %v", err)
+	}
+	return nil
+}
+
+func (s *NotificationPreferenceService) getSettings(userID uint) (*model.NotificationSettings, error) {
+	settings := model.NotificationSettings{UserID: userID, Timezone: DefaultQuietHoursTimezone, DigestFrequency: model.DigestFrequencyOff}
+	err := s.DB.Where("user_id = ?", userID).First(&settings).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to get notification settings: %v", err)
+	}
+	return &settings, nil
+}
+
+func notificationTypeInfo(notificationType string) *NotificationTypeInfo {
+	for i := range NotificationTypes {
+		if NotificationTypes[i].Type == notificationType {
+			return &NotificationTypes[i]
+		}
+	}
+	return nil
+}
+
+// applyQuietHours validates the quiet hours sent by the client and copies them into settings
+func applyQuietHours(settings *model.NotificationSettings, quietHours QuietHoursDTO) error {
+	if quietHours.Timezone == "" {
+		quietHours.Timezone = DefaultQuietHoursTimezone
+	}
+	if _, err := time.LoadLocation(quietHours.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", quietHours.Timezone)
+	}
+
+	if quietHours.Enabled {
+		start, startErr := parseClock(quietHours.Start)
+		end, endErr := parseClock(quietHours.End)
+		if startErr != nil || endErr != nil {
+			return errors.New("quiet hours start and end must be given as HH:MM")
+		}
+		if start == end {
+			return errors.New("quiet hours start and end must differ")
+		}
+	}
+
+	settings.QuietHoursEnabled = quietHours.Enabled
+	settings.QuietHoursStart = quietHours.Start
+	settings.QuietHoursEnd = quietHours.End
+	settings.Timezone = quietHours.Timezone
+	return nil
+}
+
+func isDigestFrequency(frequency string) bool {
+	return frequency == model.DigestFrequencyOff || frequency == model.DigestFrequencyDaily || frequency == model.DigestFrequencyWeekly
+}
+
+// quietHoursEnd returns the end of the quiet hours now falls in, or the zero time outside them.
+// Quiet hours may wrap midnight, e.g. 22:00 to 07:00.
+func quietHoursEnd(settings *model.NotificationSettings, now time.Time) time.Time {
+	if !settings.QuietHoursEnabled {
+		return time.Time{}
+	}
+	start, err := parseClock(settings.QuietHoursStart)
+	if err != nil {
+		return time.Time{}
+	}
+	end, err := parseClock(settings.QuietHoursEnd)
+	if err != nil || start == end {
+		return time.Time{}
+	}
+	location, err := time.LoadLocation(settings.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	endToday := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, location)
+
+	if start < end {
+		if minute >= start && minute < end {
+			return endToday
+		}
+		return time.Time{}
+	}
+
+	// Wrapping midnight
+	if minute >= start {
+		return endToday.AddDate(0, 0, 1)
+	}
+	if minute < end {
+		return endToday
+	}
+	return time.Time{}
+}
+
+// parseClock turns "HH:MM" into minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
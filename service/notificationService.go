@@ -3,21 +3,41 @@ package service
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/helper"
 	"synergazing.com/synergazing/model"
 )
 
 type NotificationService struct {
 	DB *gorm.DB
+	// Hub pushes new notifications to the user's open chat WebSockets and notification streams
+	Hub         ChatHub
+	Preferences *NotificationPreferenceService
+	Outbox      *EmailOutboxService
 }
 
 func NewNotificationService(db *gorm.DB) *NotificationService {
-	return &NotificationService{DB: db}
+	return &NotificationService{DB: db, Hub: DefaultChatHub(), Preferences: NewNotificationPreferenceService(db), Outbox: DefaultEmailOutbox()}
 }
 
-// CreateNotification creates a new notification
+// NotificationEventType is the realtime event type of a new notification
+const NotificationEventType = "notification"
+
+// NotificationEvent is pushed for every new notification, in the same shape as chat WebSocket messages
+type NotificationEvent struct {
+	Type string              `json:"type"`
+	Data *model.Notification `json:"data"`
+}
+
+// CreateNotification routes a notification to the channels the user enabled for its type:
+// the in-app list, a realtime push and email. During the user's quiet hours push and email
+// of non-urgent types are deferred. The returned notification has no ID when the in-app
+// copy is disabled.
 func (s *NotificationService) CreateNotification(userID uint, projectID *uint, notificationType, title, message string, data map[string]interface{}) (*model.Notification, error) {
 	var dataJSON string
 	if data != nil {
@@ -38,13 +58,177 @@ func (s *NotificationService) CreateNotification(userID uint, projectID *uint, n
 		Data:      dataJSON,
 	}
 
-	if err := s.DB.Create(notification).Error; err != nil {
-		return nil, fmt.Errorf("failed to create notification: %v", err)
+	channels, err := s.Preferences.ChannelsFor(userID, notificationType)
+	if err != nil {
+		return nil, err
+	}
+	notification.Push = channels.Push
+
+	if channels.InApp {
+		if err := s.DB.Create(notification).Error; err != nil {
+			return nil, fmt.Errorf("failed to create notification: %v", err)
+		}
+	}
+
+	if !channels.Push && !channels.Email {
+		return notification, nil
+	}
+
+	now := time.Now()
+	deferUntil, err := s.Preferences.DeferUntil(userID, notificationType, now)
+	if err != nil {
+		log.Printf("Error checking quiet hours of user %d, delivering now: %v", userID, err)
+	}
+
+	if channels.Push {
+		if deferUntil.IsZero() {
+			s.publish(notification)
+		} else {
+			s.deferDelivery(notification, model.NotificationChannelPush, deferUntil)
+		}
+	}
+	if channels.Email {
+		if deferUntil.IsZero() {
+			if err := s.sendEmail(notification); err != nil {
+				log.Printf("Error emailing notification to user %d: %v", userID, err)
+			}
+		} else {
+			s.deferDelivery(notification, model.NotificationChannelEmail, deferUntil)
+		}
 	}
 
 	return notification, nil
 }
 
+// publish delivers a notification to the user's connected clients. Delivery is best effort;
+// clients that were offline catch up through the REST endpoints or by resuming the stream.
+func (s *NotificationService) publish(notification *model.Notification) {
+	if s.Hub == nil {
+		return
+	}
+	event := NotificationEvent{Type: NotificationEventType, Data: notification}
+	if err := s.Hub.SendToUser(notification.UserID, event); err != nil {
+		log.Printf("Error publishing notification %d to user %d: %v", notification.ID, notification.UserID, err)
+	}
+}
+
+// sendEmail queues a notification email to its user
+func (s *NotificationService) sendEmail(notification *model.Notification) error {
+	if err := s.queueEmail(s.DB, notification); err != nil {
+		return err
+	}
+	s.Outbox.notify()
+	return nil
+}
+
+// queueEmail stores a notification email within the caller's transaction
+func (s *NotificationService) queueEmail(tx *gorm.DB, notification *model.Notification) error {
+	var user model.Users
+	if err := tx.Select("id", "name", "email").First(&user, notification.UserID).Error; err != nil {
+		return fmt.Errorf("failed to find user: %v", err)
+	}
+	return s.Outbox.EnqueueTx(tx, OutgoingEmail{
+		To:       user.Email,
+		Template: "notification",
+		Data: map[string]interface{}{
+			"Name":             user.Name,
+			"Title":            notification.Title,
+			"Message":          notification.Message,
+			"NotificationsURL": helper.GetFrontendURL() + "/notifications",
+		},
+	})
+}
+
+// deferDelivery stores a push or email delivery until the user's quiet hours end
+func (s *NotificationService) deferDelivery(notification *model.Notification, channel string, deliverAfter time.Time) {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error encoding notification for user %d: %v", notification.UserID, err)
+		return
+	}
+
+	delivery := model.NotificationDelivery{
+		UserID:       notification.UserID,
+		Channel:      channel,
+		Payload:      string(payload),
+		DeliverAfter: deliverAfter,
+	}
+	if notification.ID != 0 {
+		delivery.NotificationID = &notification.ID
+	}
+	if err := s.DB.Create(&delivery).Error; err != nil {
+		log.Printf("Error deferring %s notification for user %d: %v", channel, notification.UserID, err)
+	}
+}
+
+// DispatchDeferredDeliveries sends the push and email deliveries whose quiet hours have ended.
+// Rows are locked with SKIP LOCKED so several instances can run it at the same time. Emails are
+// queued in the same transaction and pushes are published once it commits, so a rolled back
+// batch is neither sent nor marked as sent.
+func (s *NotificationService) DispatchDeferredDeliveries() {
+	var pushes []model.Notification
+	emailed := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		pushes, emailed = nil, false
+		var deliveries []model.NotificationDelivery
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL AND deliver_after <= ?", time.Now()).
+			Order("id ASC").
+			Limit(100).
+			Find(&deliveries).Error; err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			var notification model.Notification
+			if err := json.Unmarshal([]byte(delivery.Payload), &notification); err != nil {
+				log.Printf("Error decoding deferred notification %d: %v", delivery.ID, err)
+			} else if delivery.Channel == model.NotificationChannelPush {
+				pushes = append(pushes, notification)
+			} else if err := s.queueEmail(tx, &notification); err != nil {
+				log.Printf("Error emailing deferred notification %d: %v", delivery.ID, err)
+			} else {
+				emailed = true
+			}
+
+			if err := tx.Model(&delivery).Update("sent_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(deliveries) > 0 {
+			log.Printf("Dispatched %d deferred notification deliveries", len(deliveries))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error dispatching deferred notifications: %v", err)
+		return
+	}
+
+	for i := range pushes {
+		s.publish(&pushes[i])
+	}
+	if emailed {
+		s.Outbox.notify()
+	}
+}
+
+// GetNotificationsAfter returns the user's pushed notifications created after the given one,
+// oldest first, so a reconnecting stream can replay what it missed. Pushes held back by quiet
+// hours are left to DispatchDeferredDeliveries.
+func (s *NotificationService) GetNotificationsAfter(userID, afterID uint, limit int) ([]model.Notification, error) {
+	var notifications []model.Notification
+	if err := s.DB.Where("user_id = ? AND id > ? AND push = ?", userID, afterID, true).
+		Where("NOT EXISTS (SELECT 1 FROM notification_deliveries WHERE notification_deliveries.notification_id = notifications.id AND notification_deliveries.channel = ? AND notification_deliveries.sent_at IS NULL)", model.NotificationChannelPush).
+		Order("id ASC").
+		Limit(limit).
+		Find(&notifications).Error; err != nil {
+		return nil, fmt.Errorf("failed to get missed notifications: %v", err)
+	}
+	return notifications, nil
+}
+
 // GetUserNotifications retrieves notifications for a specific user
 func (s *NotificationService) GetUserNotifications(userID uint, limit, offset int) ([]model.Notification, error) {
 	var notifications []model.Notification
@@ -261,8 +445,9 @@ func (s *NotificationService) NotifyRoleAssigned(projectID, userID uint, roleTit
 	return err
 }
 
-// NotifyProjectStatusChange notifies relevant users about project status changes
-func (s *NotificationService) NotifyProjectStatusChange(projectID uint, newStatus string) error {
+// NotifyProjectStatusChange notifies project members, and the creator when someone else made
+// the change, that the project moved from oldStatus to newStatus. actorID is 0 for system changes.
+func (s *NotificationService) NotifyProjectStatusChange(projectID uint, oldStatus, newStatus string, actorID uint) error {
 	var project model.Project
 	if err := s.DB.Preload("Members.User").First(&project, projectID).Error; err != nil {
 		return fmt.Errorf("failed to find project: %v", err)
@@ -275,11 +460,20 @@ func (s *NotificationService) NotifyProjectStatusChange(projectID uint, newStatu
 		"project_id":    project.ID,
 		"project_title": project.Title,
 		"new_status":    newStatus,
-		"old_status":    project.Status,
+		"old_status":    oldStatus,
+	}
+
+	if actorID != project.CreatorID {
+		if _, err := s.CreateNotification(project.CreatorID, &projectID, model.NotificationTypeProjectStatusChange, title, message, data); err != nil {
+			return fmt.Errorf("failed to notify project creator: %v", err)
+		}
 	}
 
 	// Notify all project members
 	for _, member := range project.Members {
+		if member.UserID == actorID || member.UserID == project.CreatorID {
+			continue
+		}
 		if _, err := s.CreateNotification(member.UserID, &projectID, model.NotificationTypeProjectStatusChange, title, message, data); err != nil {
 			return fmt.Errorf("failed to notify project member: %v", err)
 		}
@@ -288,6 +482,63 @@ func (s *NotificationService) NotifyProjectStatusChange(projectID uint, newStatu
 	return nil
 }
 
+// NotifyProjectCompleted notifies project members that the project has been completed
+func (s *NotificationService) NotifyProjectCompleted(projectID uint) error {
+	var project model.Project
+	if err := s.DB.Preload("Members").First(&project, projectID).Error; err != nil {
+		return fmt.Errorf("failed to find project: %v", err)
+	}
+
+	title := "Project Completed"
+	message := fmt.Sprintf("Project '%s' has been completed. Thank you for your contribution!", project.Title)
+
+	data := map[string]interface{}{
+		"project_id":    project.ID,
+		"project_title": project.Title,
+		"status":        model.ProjectStatusCompleted,
+	}
+
+	for _, member := range project.Members {
+		if member.UserID == project.CreatorID {
+			continue
+		}
+		if _, err := s.CreateNotification(member.UserID, &projectID, model.NotificationTypeProjectCompleted, title, message, data); err != nil {
+			return fmt.Errorf("failed to notify project member: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// NotifyProjectUpdated notifies project members, except the editor, that a published project was edited
+func (s *NotificationService) NotifyProjectUpdated(projectID, editorID uint, changedFields []string) error {
+	var project model.Project
+	if err := s.DB.Preload("Members").First(&project, projectID).Error; err != nil {
+		return fmt.Errorf("failed to find project: %v", err)
+	}
+
+	title := "Project Updated"
+	message := fmt.Sprintf("Project '%s' has been updated: %s", project.Title, strings.Join(changedFields, ", "))
+
+	data := map[string]interface{}{
+		"project_id":     project.ID,
+		"project_title":  project.Title,
+		"changed_fields": changedFields,
+		"updated_by":     editorID,
+	}
+
+	for _, member := range project.Members {
+		if member.UserID == editorID {
+			continue
+		}
+		if _, err := s.CreateNotification(member.UserID, &projectID, model.NotificationTypeProjectUpdated, title, message, data); err != nil {
+			return fmt.Errorf("failed to notify project member: %v", err)
+		}
+	}
+
+	return nil
+}
+
 // NotifyInvitationReceived notifies user when they receive a project invitation
 func (s *NotificationService) NotifyInvitationReceived(projectID, userID uint, roleTitle string) error {
 	var project model.Project
@@ -324,8 +575,8 @@ func (s *NotificationService) CheckAndNotifyApproachingDeadlines() error {
 		endOfDay := startOfDay.Add(24 * time.Hour)
 
 		var projects []model.Project
-		if err := s.DB.Where("registration_deadline >= ? AND registration_deadline < ? AND status != ?",
-			startOfDay, endOfDay, "completed").Find(&projects).Error; err != nil {
+		if err := s.DB.Where("registration_deadline >= ? AND registration_deadline < ? AND status = ?",
+			startOfDay, endOfDay, model.ProjectStatusPublished).Find(&projects).Error; err != nil {
 			return fmt.Errorf("failed to find projects with approaching deadlines: %v", err)
 		}
 
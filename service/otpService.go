@@ -1,20 +1,43 @@
 package service
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"log"
 	"math/big"
-	"os"
-	"strconv"
 	"time"
 
-	"gopkg.in/gomail.v2"
+	"gorm.io/gorm"
 	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
 	"synergazing.com/synergazing/model"
 )
 
+const (
+	// otpExpiryMinutes is how long an emailed code can be used
+	otpExpiryMinutes = 3
+	// otpMaxAttempts wrong guesses invalidate a code
+	otpMaxAttempts = 5
+	// otpResendCooldown is the wait between two codes for the same email and purpose
+	otpResendCooldown = 60 * time.Second
+	// At most this many codes are sent per email address and per IP address within 24 hours
+	otpDailyLimitPerEmail = 10
+	otpDailyLimitPerIP    = 30
+)
+
+// OTPThrottleError is returned when codes are requested too often. RetryAfter is how long
+// the client has to wait before it may ask again.
+type OTPThrottleError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *OTPThrottleError) Error() string {
+	return e.Message
+}
+
 type OTPService struct{}
 
 func NewOTPService() *OTPService {
@@ -33,7 +56,9 @@ func (s *OTPService) GenerateOTP() (string, error) {
 	return fmt.Sprintf("%06d", n.Add(n, min).Int64()), nil
 }
 
-func (s *OTPService) SendOTP(email, purpose string) error {
+// SendOTP emails a new code, replacing any unused code for the same email and purpose.
+// Requests within the resend cooldown or over the daily caps fail with an *OTPThrottleError.
+func (s *OTPService) SendOTP(email, purpose, ipAddress string) error {
 	db := config.GetDB()
 
 	code, err := s.GenerateOTP()
@@ -41,32 +66,110 @@ func (s *OTPService) SendOTP(email, purpose string) error {
 		return errors.New("failed to generate OTP")
 	}
 
-	db.Where("email = ? AND purpose = ? AND is_used = ?", email, purpose, false).Delete(&model.OTP{})
-
-	otp := model.OTP{
-		Email:     email,
-		Code:      code,
-		Purpose:   purpose,
-		ExpiresAt: time.Now().Add(time.Minute * 3),
-		IsUsed:    false,
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Serializes requests for the same address so parallel requests cannot skip the checks
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "otp:"+email).Error; err != nil {
+			return err
+		}
+
+		if err := s.checkThrottle(tx, email, purpose, ipAddress); err != nil {
+			return err
+		}
+
+		if err := tx.Where("email = ? AND purpose = ? AND is_used = ?", email, purpose, false).Delete(&model.OTP{}).Error; err != nil {
+			return err
+		}
+
+		otp := model.OTP{
+			Email:     email,
+			CodeHash:  helper.HashOTP(email, purpose, code),
+			Purpose:   purpose,
+			ExpiresAt: time.Now().Add(time.Minute * otpExpiryMinutes),
+			IsUsed:    false,
+		}
+		if err := tx.Create(&otp).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&model.OTPRequest{Email: email, Purpose: purpose, IPAddress: ipAddress}).Error
+	})
+	var throttled *OTPThrottleError
+	if errors.As(err, &throttled) {
+		return err
 	}
-
-	if err := db.Create(&otp).Error; err != nil {
+	if err != nil {
 		log.Printf("Database error creating OTP: %v", err)
 		return errors.New("failed to create OTP")
 	}
 
-	go s.sendOTPEmail(email, code, purpose)
+	if err := s.sendOTPEmail(email, code, purpose); err != nil {
+		log.Printf("Error queueing OTP email: %v", err)
+		return errors.New("failed to send OTP email")
+	}
+
+	return nil
+}
+
+// checkThrottle enforces the resend cooldown and the daily caps per email and per IP address
+func (s *OTPService) checkThrottle(tx *gorm.DB, email, purpose, ipAddress string) error {
+	now := time.Now()
+
+	var last model.OTPRequest
+	if err := tx.Where("email = ? AND purpose = ?", email, purpose).Order("created_at DESC").Limit(1).Find(&last).Error; err != nil {
+		return err
+	}
+	if last.ID != 0 {
+		if wait := last.CreatedAt.Add(otpResendCooldown).Sub(now); wait > 0 {
+			return &OTPThrottleError{
+				Message:    fmt.Sprintf("Please wait %d seconds before requesting a new code", int(wait.Seconds())+1),
+				RetryAfter: wait,
+			}
+		}
+	}
+
+	if wait, err := dailyOTPLimitWait(tx.Where("email = ?", email), otpDailyLimitPerEmail, now); err != nil {
+		return err
+	} else if wait > 0 {
+		return &OTPThrottleError{Message: "Too many codes requested for this email today, please try again later", RetryAfter: wait}
+	}
+
+	if ipAddress != "" {
+		if wait, err := dailyOTPLimitWait(tx.Where("ip_address = ?", ipAddress), otpDailyLimitPerIP, now); err != nil {
+			return err
+		} else if wait > 0 {
+			return &OTPThrottleError{Message: "Too many codes requested from this network today, please try again later", RetryAfter: wait}
+		}
+	}
 
 	return nil
 }
 
+// dailyOTPLimitWait returns how long until the requests matched by scope drop below limit
+// within the last 24 hours, or zero if another request is allowed now
+func dailyOTPLimitWait(scope *gorm.DB, limit int, now time.Time) (time.Duration, error) {
+	var requests []model.OTPRequest
+	if err := scope.Model(&model.OTPRequest{}).
+		Where("created_at > ?", now.Add(-24*time.Hour)).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&requests).Error; err != nil {
+		return 0, err
+	}
+	if len(requests) < limit {
+		return 0, nil
+	}
+	// Allowed again once the oldest of the last limit requests is a day old
+	return requests[len(requests)-1].CreatedAt.Add(24 * time.Hour).Sub(now), nil
+}
+
+// VerifyOTP checks a code. Every wrong guess counts, and after otpMaxAttempts the code is
+// invalid even if the right one is entered later.
 func (s *OTPService) VerifyOTP(email, code, purpose string) error {
 	db := config.GetDB()
 
 	var otp model.OTP
-	if err := db.Where("email = ? AND code = ? AND purpose = ? AND is_used = ?",
-		email, code, purpose, false).First(&otp).Error; err != nil {
+	if err := db.Where("email = ? AND purpose = ? AND is_used = ?", email, purpose, false).
+		Order("id DESC").First(&otp).Error; err != nil {
 		return errors.New("invalid OTP code")
 	}
 
@@ -74,11 +177,34 @@ func (s *OTPService) VerifyOTP(email, code, purpose string) error {
 		return errors.New("OTP has expired")
 	}
 
-	otp.IsUsed = true
-	if err := db.Save(&otp).Error; err != nil {
-		log.Printf("Database error marking OTP as used: %v", err)
+	// Count the attempt before comparing, so parallel guesses cannot go over the limit
+	result := db.Model(&model.OTP{}).
+		Where("id = ? AND is_used = ? AND attempts < ?", otp.ID, false, otpMaxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		log.Printf("Database error counting OTP attempt: %v", result.Error)
+		return errors.New("failed to verify OTP")
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("too many failed attempts, please request a new code")
+	}
+
+	if !hmac.Equal([]byte(otp.CodeHash), []byte(helper.HashOTP(email, purpose, code))) {
+		remaining := otpMaxAttempts - otp.Attempts - 1
+		if remaining <= 0 {
+			return errors.New("invalid OTP code. Too many failed attempts, please request a new code")
+		}
+		return fmt.Errorf("invalid OTP code, %d attempt(s) left", remaining)
+	}
+
+	result = db.Model(&model.OTP{}).Where("id = ? AND is_used = ?", otp.ID, false).Update("is_used", true)
+	if result.Error != nil {
+		log.Printf("Database error marking OTP as used: %v", result.Error)
 		return errors.New("failed to verify OTP")
 	}
+	if result.RowsAffected == 0 {
+		return errors.New("invalid OTP code")
+	}
 
 	return nil
 }
@@ -92,114 +218,33 @@ func (s *OTPService) CleanupExpiredOTPs() {
 	} else if result.RowsAffected > 0 {
 		log.Printf("Cleaned up %d expired OTP records", result.RowsAffected)
 	}
-}
 
-func (s *OTPService) sendOTPEmail(email, code, purpose string) {
-	emailHost := os.Getenv("EMAIL_HOST")
-	emailPortStr := os.Getenv("EMAIL_PORT")
-	emailUser := os.Getenv("EMAIL_USERNAME")
-	emailPass := os.Getenv("EMAIL_PASSWORD")
-
-	emailPort, err := strconv.Atoi(emailPortStr)
-	if err != nil {
-		log.Printf("Error: Could not parse EMAIL_PORT from .env file: %v", err)
-		return
+	// Requests only matter for the daily caps
+	if err := db.Where("created_at < ?", time.Now().Add(-24*time.Hour)).Delete(&model.OTPRequest{}).Error; err != nil {
+		log.Printf("Error cleaning up OTP requests: %v", err)
 	}
+}
 
-	m := gomail.NewMessage()
-
-	m.SetHeader("From", fmt.Sprintf("Synergazing <%s>", emailUser))
-	m.SetHeader("To", email)
-
-	var subject, htmlBody, plainBody string
-
+// sendOTPEmail queues the code in the email outbox, using the template of the purpose if there is one
+func (s *OTPService) sendOTPEmail(email, code, purpose string) error {
+	template := "otp"
 	switch purpose {
 	case "registration":
-		subject = "Email Verification - Complete Your Registration"
-		htmlBody = fmt.Sprintf(`
-		<div style="font-family: Arial, sans-serif; line-height: 1.6; max-width: 600px; margin: 0 auto;">
-			<h2 style="color: #333;">Welcome to Synergazing!</h2>
-			<p>Hi there,</p>
-			<p>Thank you for registering with Synergazing. To complete your registration, please verify your email address using the verification code below:</p>
-			<div style="background-color: #f8f9fa; padding: 20px; text-align: center; margin: 20px 0; border-radius: 8px;">
-				<h1 style="color: #007bff; font-size: 32px; letter-spacing: 8px; margin: 0;">%s</h1>
-			</div>
-			<p>This verification code will expire in <strong>3 minutes</strong>.</p>
-			<p>If you did not create an account with Synergazing, please ignore this email.</p>
-			<br>
-			<p>Best regards,</p>
-			<p>The Synergazing Team</p>
-		</div>
-		`, code)
-
-		plainBody = fmt.Sprintf(
-			"Welcome to Synergazing!\n\n"+
-				"Thank you for registering with Synergazing. To complete your registration, please verify your email address using the verification code below:\n\n"+
-				"Verification Code: %s\n\n"+
-				"This verification code will expire in 3 minutes.\n\n"+
-				"If you did not create an account with Synergazing, please ignore this email.\n\n"+
-				"Best regards,\nThe Synergazing Team", code)
-
+		template = "otp_registration"
 	case "password_reset":
-		subject = "Password Reset Verification Code"
-		htmlBody = fmt.Sprintf(`
-		<div style="font-family: Arial, sans-serif; line-height: 1.6; max-width: 600px; margin: 0 auto;">
-			<h2 style="color: #333;">Password Reset Request</h2>
-			<p>Hi,</p>
-			<p>We received a request to reset your password. Please use the verification code below to proceed:</p>
-			<div style="background-color: #f8f9fa; padding: 20px; text-align: center; margin: 20px 0; border-radius: 8px;">
-				<h1 style="color: #dc3545; font-size: 32px; letter-spacing: 8px; margin: 0;">%s</h1>
-			</div>
-			<p>This verification code will expire in <strong>3 minutes</strong>.</p>
-			<p>If you did not request a password reset, please ignore this email and your password will remain unchanged.</p>
-			<br>
-			<p>Best regards,</p>
-			<p>The Synergazing Team</p>
-		</div>
-		`, code)
-
-		plainBody = fmt.Sprintf(
-			"Password Reset Request\n\n"+
-				"We received a request to reset your password. Please use the verification code below to proceed:\n\n"+
-				"Verification Code: %s\n\n"+
-				"This verification code will expire in 3 minutes.\n\n"+
-				"If you did not request a password reset, please ignore this email and your password will remain unchanged.\n\n"+
-				"Best regards,\nThe Synergazing Team", code)
-
-	default:
-		subject = "Verification Code"
-		htmlBody = fmt.Sprintf(`
-		<div style="font-family: Arial, sans-serif; line-height: 1.6; max-width: 600px; margin: 0 auto;">
-			<h2 style="color: #333;">Verification Required</h2>
-			<p>Hi,</p>
-			<p>Please use the verification code below:</p>
-			<div style="background-color: #f8f9fa; padding: 20px; text-align: center; margin: 20px 0; border-radius: 8px;">
-				<h1 style="color: #007bff; font-size: 32px; letter-spacing: 8px; margin: 0;">%s</h1>
-			</div>
-			<p>This verification code will expire in <strong>3 minutes</strong>.</p>
-			<br>
-			<p>Best regards,</p>
-			<p>The Synergazing Team</p>
-		</div>
-		`, code)
-
-		plainBody = fmt.Sprintf(
-			"Verification Required\n\n"+
-				"Please use the verification code below:\n\n"+
-				"Verification Code: %s\n\n"+
-				"This verification code will expire in 3 minutes.\n\n"+
-				"Best regards,\nThe Synergazing Team", code)
-	}
-
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", htmlBody)
-	m.AddAlternative("text/plain", plainBody)
-
-	d := gomail.NewDialer(emailHost, emailPort, emailUser, emailPass)
-
-	if err := d.DialAndSend(m); err != nil {
-		log.Printf("Could not send OTP email to %s: %v", email, err)
-	} else {
-		log.Printf("OTP email sent successfully to %s for purpose: %s", email, purpose)
+		template = "otp_password_reset"
+	case "email_change":
+		template = "otp_email_change"
+	case "two_factor":
+		template = "otp_two_factor"
 	}
+
+	return DefaultEmailOutbox().Enqueue(OutgoingEmail{
+		To:       email,
+		Template: template,
+		Data: map[string]interface{}{
+			"Code":           code,
+			"ExpiresMinutes": otpExpiryMinutes,
+		},
+	})
 }
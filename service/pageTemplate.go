@@ -0,0 +1,46 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"sync"
+
+	"synergazing.com/synergazing/templates"
+)
+
+var pageTemplates sync.Map // "locale/name" -> *htmltemplate.Template
+
+// RenderPage renders the named page template in the email locale, falling back to
+// DefaultEmailLocale when the locale has no such page
+func RenderPage(name string, data interface{}) (string, error) {
+	locale := EmailLocale()
+	tmpl, err := loadPageTemplate(locale, name)
+	if err != nil && locale != DefaultEmailLocale {
+		tmpl, err = loadPageTemplate(DefaultEmailLocale, name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		return "", fmt.Errorf("failed to render page %s: %v", name, err)
+	}
+	return page.String(), nil
+}
+
+func loadPageTemplate(locale, name string) (*htmltemplate.Template, error) {
+	key := locale + "/" + name
+	if cached, ok := pageTemplates.Load(key); ok {
+		return cached.(*htmltemplate.Template), nil
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates.Page, "page/"+locale+"/"+name+".html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load page template %s: %v", key, err)
+	}
+
+	pageTemplates.Store(key, tmpl)
+	return tmpl, nil
+}
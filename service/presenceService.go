@@ -0,0 +1,136 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"synergazing.com/synergazing/model"
+)
+
+const (
+	// PresenceStaleAfter is how long a connection counts as online without activity.
+	// Clients must send something at least every 60 seconds or the server drops them.
+	PresenceStaleAfter = 90 * time.Second
+	// PresenceTouchInterval limits how often an active connection is refreshed in the database
+	PresenceTouchInterval = 30 * time.Second
+)
+
+// PresenceService tracks which users have an open chat connection. Connections are
+// stored in the database so presence is shared by every instance behind the chat hub.
+type PresenceService struct {
+	DB *gorm.DB
+}
+
+func NewPresenceService(db *gorm.DB) *PresenceService {
+	return &PresenceService{DB: db}
+}
+
+// Connect records a new connection and reports whether the user just came online
+func (s *PresenceService) Connect(userID uint) (string, bool, error) {
+	wasOnline := s.IsOnline(userID)
+
+	connection := model.ChatConnection{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		LastActiveAt: time.Now(),
+	}
+	if err := s.DB.Create(&connection).Error; err != nil {
+		return "", false, fmt.Errorf("failed to record connection: %v", err)
+	}
+
+	return connection.ID, !wasOnline, nil
+}
+
+// Touch marks a connection as still active
+func (s *PresenceService) Touch(connectionID string) error {
+	return s.DB.Model(&model.ChatConnection{}).Where("id = ?", connectionID).Update("last_active_at", time.Now()).Error
+}
+
+// Disconnect removes a connection and reports whether it was the user's last one
+func (s *PresenceService) Disconnect(userID uint, connectionID string) (bool, time.Time, error) {
+	now := time.Now()
+	if err := s.DB.Where("id = ?", connectionID).Delete(&model.ChatConnection{}).Error; err != nil {
+		return false, now, fmt.Errorf("failed to remove connection: %v", err)
+	}
+
+	if s.IsOnline(userID) {
+		return false, now, nil
+	}
+
+	if err := s.DB.Model(&model.Users{}).Where("id = ?", userID).Update("last_seen_at", now).Error; err != nil {
+		return true, now, fmt.Errorf("failed to update last seen: %v", err)
+	}
+	return true, now, nil
+}
+
+// IsOnline reports whether the user has at least one active connection
+func (s *PresenceService) IsOnline(userID uint) bool {
+	var count int64
+	s.DB.Model(&model.ChatConnection{}).
+		Where("user_id = ? AND last_active_at > ?", userID, time.Now().Add(-PresenceStaleAfter)).
+		Count(&count)
+	return count > 0
+}
+
+// GetPresence returns the presence of each of the given users
+func (s *PresenceService) GetPresence(userIDs []uint) (map[uint]model.UserPresence, error) {
+	presence := make(map[uint]model.UserPresence, len(userIDs))
+	if len(userIDs) == 0 {
+		return presence, nil
+	}
+
+	var onlineIDs []uint
+	if err := s.DB.Model(&model.ChatConnection{}).
+		Where("user_id IN ? AND last_active_at > ?", userIDs, time.Now().Add(-PresenceStaleAfter)).
+		Distinct().Pluck("user_id", &onlineIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load presence: %v", err)
+	}
+	online := make(map[uint]bool, len(onlineIDs))
+	for _, id := range onlineIDs {
+		online[id] = true
+	}
+
+	var users []model.Users
+	if err := s.DB.Select("id", "last_seen_at").Where("id IN ?", userIDs).Find(&users).Error; err != nil {
+		return nil, fmt.Errorf("failed to load presence: %v", err)
+	}
+
+	for _, user := range users {
+		status := model.PresenceOffline
+		if online[user.ID] {
+			status = model.PresenceOnline
+		}
+		presence[user.ID] = model.UserPresence{
+			UserID:     user.ID,
+			Status:     status,
+			LastSeenAt: user.LastSeenAt,
+		}
+	}
+
+	return presence, nil
+}
+
+// CleanupStaleConnections removes connections that stopped reporting activity, e.g. because
+// the instance holding them crashed, and records their last activity as the user's last seen time
+func (s *PresenceService) CleanupStaleConnections() {
+	cutoff := time.Now().Add(-PresenceStaleAfter)
+
+	err := s.DB.Exec(`UPDATE users SET last_seen_at = stale.last_active_at
+		FROM (SELECT user_id, MAX(last_active_at) AS last_active_at FROM chat_connections
+			WHERE last_active_at < ? GROUP BY user_id) AS stale
+		WHERE users.id = stale.user_id AND (users.last_seen_at IS NULL OR users.last_seen_at < stale.last_active_at)`, cutoff).Error
+	if err != nil {
+		log.Printf("Error updating last seen from stale connections: %v", err)
+		return
+	}
+
+	result := s.DB.Where("last_active_at < ?", cutoff).Delete(&model.ChatConnection{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up stale chat connections: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d stale chat connections", result.RowsAffected)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"mime/multipart"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	"synergazing.com/synergazing/config"
 	"synergazing.com/synergazing/helper"
@@ -15,7 +14,6 @@ type UpdateProfileDTO struct {
 	Name           *string
 	Email          *string
 	Phone          *string
-	Password       *string
 	AboutMe        *string
 	Location       *string
 	Interests      *string
@@ -102,21 +100,10 @@ func (s *ProfileService) UpdateUserProfile(userId uint, data *UpdateProfileDTO)
 	if data.Phone != nil {
 		user.Phone = *data.Phone
 	}
-	if data.Email != nil {
-		var existingUser model.Users
-		if err := tx.Where("email = ? AND id != ?", *data.Email, userId).First(&existingUser).Error; err == nil {
-			tx.Rollback()
-			return nil, nil, fmt.Errorf("email already exists")
-		}
-		user.Email = *data.Email
-	}
-	if data.Password != nil {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*data.Password), bcrypt.DefaultCost)
-		if err != nil {
-			tx.Rollback()
-			return nil, nil, fmt.Errorf("failed to hash password")
-		}
-		user.Password = string(hashedPassword)
+	// The address is only changed once the new one is confirmed, see EmailChangeService
+	if data.Email != nil && *data.Email != user.Email {
+		tx.Rollback()
+		return nil, nil, fmt.Errorf("email cannot be changed here, use /api/profile/email-change to verify the new address")
 	}
 
 	if data.AboutMe != nil {
@@ -12,12 +12,14 @@ import (
 type ProjectMemberService struct {
 	DB                  *gorm.DB
 	NotificationService *NotificationService
+	ChatService         *ChatService
 }
 
 func NewProjectMemberService(db *gorm.DB, notificationService *NotificationService) *ProjectMemberService {
 	return &ProjectMemberService{
 		DB:                  db,
 		NotificationService: notificationService,
+		ChatService:         &ChatService{DB: db},
 	}
 }
 
@@ -37,7 +39,7 @@ func (s *ProjectMemberService) ApplyToProject(userID, projectID uint, applicatio
 		return nil, errors.New("project not found")
 	}
 
-	if project.Status != "published" {
+	if project.Status != model.ProjectStatusPublished {
 		return nil, errors.New("project is not accepting applications")
 	}
 
@@ -248,7 +250,17 @@ func (s *ProjectMemberService) ReviewApplication(applicationID, reviewerID uint,
 		}
 	}
 
-	return tx.Commit().Error
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if reviewData.Action == "accept" {
+		if err := s.ChatService.JoinProjectChat(application.ProjectID, application.UserID); err != nil {
+			fmt.Printf("Failed to add member to project chat: %v\n", err)
+		}
+	}
+
+	return nil
 }
 
 // WithdrawApplication allows a user to withdraw their application
@@ -292,6 +304,10 @@ func (s *ProjectMemberService) RemoveMember(projectID, memberUserID, creatorID u
 		return fmt.Errorf("failed to remove member: %v", err)
 	}
 
+	if err := s.ChatService.LeaveProjectChat(projectID, memberUserID); err != nil {
+		fmt.Printf("Failed to remove member from project chat: %v\n", err)
+	}
+
 	return nil
 }
 
@@ -384,6 +400,12 @@ func (s *ProjectMemberService) RespondToInvitation(projectID, userID uint, respo
 		return fmt.Errorf("failed to update invitation status: %v", err)
 	}
 
+	if newStatus == "accepted" {
+		if err := s.ChatService.JoinProjectChat(projectID, userID); err != nil {
+			fmt.Printf("Failed to add member to project chat: %v\n", err)
+		}
+	}
+
 	return nil
 }
 
@@ -1,21 +1,27 @@
 package service
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 	"synergazing.com/synergazing/helper"
 	"synergazing.com/synergazing/model"
 )
 
 type ProjectService struct {
-	DB              *gorm.DB
-	skillService    *SkillService
-	tagService      *TagService
-	benefitService  *BenefitService
-	timelineService *TimelineService
+	DB                  *gorm.DB
+	skillService        *SkillService
+	tagService          *TagService
+	benefitService      *BenefitService
+	timelineService     *TimelineService
+	notificationService *NotificationService
+	chatService         *ChatService
 }
 
 type RoleDTO struct {
@@ -100,6 +106,9 @@ func NewProjectService(db *gorm.DB, skillService *SkillService, tagService *TagS
 		tagService:      tagService,
 		benefitService:  benefitService,
 		timelineService: timelineService,
+
+		notificationService: NewNotificationService(db),
+		chatService:         &ChatService{DB: db},
 	}
 }
 
@@ -257,12 +266,18 @@ func (s *ProjectService) CreateProjectStage1(userID uint, title, projectType, de
 		ProjectType:     projectType,
 		Description:     description,
 		PictureURL:      pictureURL,
-		Status:          "draft",
+		Status:          model.ProjectStatusDraft,
 		CompletionStage: 1,
 	}
 	if err := s.DB.Create(&project).Error; err != nil {
 		return nil, err
 	}
+
+	// Every project gets a team chat room, starting with its creator
+	if _, err := s.chatService.GetOrCreateProjectChat(project.ID); err != nil {
+		log.Printf("Failed to create chat room for project %d: %v", project.ID, err)
+	}
+
 	return &project, nil
 }
 
@@ -539,7 +554,9 @@ func (s *ProjectService) UpdateStage5(projectID, userID uint, benefitNames []str
 	}
 
 	project.CompletionStage = 5
-	project.Status = "published"
+	if project.Status == model.ProjectStatusDraft {
+		project.Status = model.ProjectStatusPublished
+	}
 
 	if len(benefitNames) > 0 {
 		benefits, err := s.benefitService.findOrCreate(tx, benefitNames)
@@ -977,10 +994,39 @@ func (s *ProjectService) GetUserProject(userID, projectID uint) (interface{}, er
 	return s.transformProjectToResponseWithSingleProfile(projectResult), nil
 }
 
-func (s *ProjectService) GetAllProjects() ([]interface{}, error) {
-	var projects []model.Project
+// ProjectSearchFilter holds the query parameters accepted by /api/projects/all
+type ProjectSearchFilter struct {
+	Query        string
+	ProjectType  string
+	Tags         []string
+	Skills       []string
+	Location     string
+	Status       string
+	DeadlineFrom *time.Time
+	DeadlineTo   *time.Time
+	Sort         string
+}
 
-	err := s.DB.Preload("Creator").
+const (
+	ProjectSortNewest         = "newest"
+	ProjectSortDeadline       = "deadline"
+	ProjectSortRemainingSlots = "remaining_slots"
+	ProjectSortRelevance      = "relevance"
+)
+
+// projectSearchVector must match the expression of idx_projects_search in migrations
+const projectSearchVector = "to_tsvector('simple', coalesce(projects.title, '') || ' ' || coalesce(projects.description, ''))"
+
+// projectRemainingSlots mirrors calculateTeamCapacity in SQL so it can be used for sorting
+const projectRemainingSlots = `(projects.total_team
+	- (SELECT COUNT(*) FROM project_members pm WHERE pm.project_id = projects.id)
+	- (SELECT COALESCE(SUM(pr.slots_available), 0) FROM project_roles pr WHERE pr.project_id = projects.id))`
+
+// SearchProjectsQuery builds the filtered and sorted query for public projects.
+// The returned query is meant to be passed to helper.Paginate.
+func (s *ProjectService) SearchProjectsQuery(filter ProjectSearchFilter) *gorm.DB {
+	query := s.DB.Model(&model.Project{}).
+		Preload("Creator").
 		Preload("RequiredSkills.Skill").
 		Preload("Conditions").
 		Preload("Roles.RequiredSkills.Skill").
@@ -990,14 +1036,69 @@ func (s *ProjectService) GetAllProjects() ([]interface{}, error) {
 		Preload("Tags.Tag").
 		Preload("Benefits.Benefit").
 		Preload("Timeline.Timeline").
-		Where("status != ?", "draft").
-		Find(&projects).Error
+		Where("projects.status != ?", model.ProjectStatusDraft)
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve all projects: %w", err)
+	if filter.Query != "" {
+		query = query.Where(
+			projectSearchVector+" @@ plainto_tsquery('simple', ?) OR projects.title ILIKE ? ESCAPE '\\'",
+			filter.Query, "%"+escapeLike(filter.Query)+"%",
+		)
 	}
 
-	// Fetch profiles for all creators
+	if filter.ProjectType != "" {
+		query = query.Where("projects.project_type = ?", filter.ProjectType)
+	}
+
+	if filter.Status != "" {
+		query = query.Where("projects.status = ?", filter.Status)
+	}
+
+	if filter.Location != "" {
+		query = query.Where("projects.location ILIKE ? ESCAPE '\\'", "%"+escapeLike(filter.Location)+"%")
+	}
+
+	if filter.DeadlineFrom != nil {
+		query = query.Where("projects.registration_deadline >= ?", *filter.DeadlineFrom)
+	}
+
+	if filter.DeadlineTo != nil {
+		query = query.Where("projects.registration_deadline <= ?", *filter.DeadlineTo)
+	}
+
+	if len(filter.Tags) > 0 {
+		query = query.Where(`projects.id IN (
+			SELECT pt.project_id FROM project_tags pt
+			JOIN tags t ON t.id = pt.tag_id
+			WHERE LOWER(t.name) IN ?)`, lowerAll(filter.Tags))
+	}
+
+	if len(filter.Skills) > 0 {
+		query = query.Where(`projects.id IN (
+			SELECT prs.project_id FROM project_required_skills prs
+			JOIN skill sk ON sk.id = prs.skill_id
+			WHERE LOWER(sk.name) IN ?)`, lowerAll(filter.Skills))
+	}
+
+	switch filter.Sort {
+	case ProjectSortDeadline:
+		query = query.Order("projects.registration_deadline ASC").Order("projects.id DESC")
+	case ProjectSortRemainingSlots:
+		query = query.Order(projectRemainingSlots + " DESC").Order("projects.id DESC")
+	case ProjectSortRelevance:
+		if filter.Query != "" {
+			query = query.Order(gorm.Expr("ts_rank("+projectSearchVector+", plainto_tsquery('simple', ?)) DESC", filter.Query))
+		}
+		query = query.Order("projects.created_at DESC")
+	default:
+		query = query.Order("projects.created_at DESC")
+	}
+
+	// A fresh session lets helper.Paginate run Count and Find on the same query
+	return query.Session(&gorm.Session{})
+}
+
+// TransformProjectList converts projects into API responses, loading every creator profile in one query
+func (s *ProjectService) TransformProjectList(projects []model.Project) []interface{} {
 	var creatorIDs []uint
 	for _, project := range projects {
 		creatorIDs = append(creatorIDs, project.CreatorID)
@@ -1014,21 +1115,36 @@ func (s *ProjectService) GetAllProjects() ([]interface{}, error) {
 		profileMap[profile.UserID] = profile
 	}
 
-	var responses []interface{}
-	for _, project := range projects {
-		profile, exists := profileMap[project.CreatorID]
-		response := s.transformProjectToResponseWithProfile(&project, profile, exists)
-		responses = append(responses, response)
+	responses := make([]interface{}, 0, len(projects))
+	for i := range projects {
+		profile, exists := profileMap[projects[i].CreatorID]
+		responses = append(responses, s.transformProjectToResponseWithProfile(&projects[i], profile, exists))
 	}
 
-	return responses, nil
+	return responses
+}
+
+// likeEscaper escapes the LIKE wildcards, for patterns used with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike makes user input match literally inside a LIKE pattern
+func escapeLike(value string) string {
+	return likeEscaper.Replace(value)
+}
+
+func lowerAll(values []string) []string {
+	lowered := make([]string, len(values))
+	for i, v := range values {
+		lowered[i] = strings.ToLower(strings.TrimSpace(v))
+	}
+	return lowered
 }
 
 // GetProjectByID retrieves a single project by ID without authentication (public access)
 func (s *ProjectService) GetProjectByID(projectID uint) (interface{}, error) {
 	var project model.Project
 
-	err := s.DB.Where("id = ? AND status != ?", projectID, "draft").First(&project).Error
+	err := s.DB.Where("id = ? AND status != ?", projectID, model.ProjectStatusDraft).First(&project).Error
 	if err != nil {
 		return nil, fmt.Errorf("project not found")
 	}
@@ -1041,6 +1157,670 @@ func (s *ProjectService) GetProjectByID(projectID uint) (interface{}, error) {
 	return s.transformProjectToResponseWithSingleProfile(projectResult), nil
 }
 
+// ProjectUpdateDTO is a partial update of a published project. Nil fields are left unchanged.
+type ProjectUpdateDTO struct {
+	Title                *string         `json:"title"`
+	ProjectType          *string         `json:"project_type"`
+	Description          *string         `json:"description"`
+	PictureURL           *string         `json:"-"`
+	Duration             *string         `json:"duration"`
+	TotalTeam            *int            `json:"total_team"`
+	StartDate            *time.Time      `json:"start_date"`
+	EndDate              *time.Time      `json:"end_date"`
+	Location             *string         `json:"location"`
+	Budget               *string         `json:"budget"`
+	RegistrationDeadline *time.Time      `json:"registration_deadline"`
+	TimeCommitment       *string         `json:"time_commitment"`
+	RequiredSkills       *[]string       `json:"required_skills"`
+	Conditions           *[]string       `json:"conditions"`
+	Tags                 *[]string       `json:"tags"`
+	Benefits             *[]string       `json:"benefits"`
+	Timeline             *[]TimelineDTO  `json:"timeline"`
+	Roles                []RoleUpdateDTO `json:"roles"`
+}
+
+// RoleUpdateDTO updates the role with ID, creates a new role when ID is nil, or removes it when Delete is set
+type RoleUpdateDTO struct {
+	ID             *uint     `json:"id"`
+	Name           *string   `json:"name"`
+	SlotsAvailable *int      `json:"slots_available"`
+	Description    *string   `json:"description"`
+	SkillNames     *[]string `json:"skill_names"`
+	Delete         bool      `json:"delete"`
+}
+
+// projectChangeSet collects the revisions produced by a single project edit
+type projectChangeSet struct {
+	revisions []model.ProjectRevision
+	fields    []string
+}
+
+func (cs *projectChangeSet) add(field string, oldValue, newValue interface{}) {
+	cs.revisions = append(cs.revisions, model.ProjectRevision{
+		Field:    field,
+		OldValue: revisionValue(oldValue),
+		NewValue: revisionValue(newValue),
+	})
+	for _, f := range cs.fields {
+		if f == field {
+			return
+		}
+	}
+	cs.fields = append(cs.fields, field)
+}
+
+func revisionValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(time.RFC3339)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+func sameStringSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, v := range a {
+		counts[strings.ToLower(v)]++
+	}
+	for _, v := range b {
+		counts[strings.ToLower(v)]--
+		if counts[strings.ToLower(v)] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CanEditProject fails when the user may not edit the project. Callers check it before storing
+// uploads, so refused requests leave no files behind.
+func (s *ProjectService) CanEditProject(projectID, userID uint) error {
+	var project model.Project
+	if err := s.DB.Select("id", "creator_id", "completion_stage", "status").First(&project, projectID).Error; err != nil {
+		return errors.New("project not found")
+	}
+	return checkProjectEditable(&project, userID)
+}
+
+func checkProjectEditable(project *model.Project, userID uint) error {
+	if project.CreatorID != userID {
+		return errors.New("you are not authorized to edit this project")
+	}
+	if project.CompletionStage < 5 {
+		return errors.New("finish all project stages before editing the project")
+	}
+	if project.Status == model.ProjectStatusArchived || project.Status == model.ProjectStatusCancelled {
+		return fmt.Errorf("%s projects can no longer be edited", project.Status)
+	}
+	return nil
+}
+
+// UpdateProject applies a partial update to a published project, records every changed
+// field as a ProjectRevision and notifies the project members
+func (s *ProjectService) UpdateProject(projectID, userID uint, data ProjectUpdateDTO) (interface{}, error) {
+	current, err := s.loadProjectWithRelationships(projectID)
+	if err != nil {
+		return nil, errors.New("project not found")
+	}
+	if err := checkProjectEditable(current, userID); err != nil {
+		return nil, err
+	}
+
+	changes := &projectChangeSet{}
+	updates := map[string]interface{}{}
+
+	stringFields := []struct {
+		field    string
+		oldValue string
+		newValue *string
+	}{
+		{"title", current.Title, data.Title},
+		{"project_type", current.ProjectType, data.ProjectType},
+		{"description", current.Description, data.Description},
+		{"picture_url", current.PictureURL, data.PictureURL},
+		{"duration", current.Duration, data.Duration},
+		{"location", current.Location, data.Location},
+		{"budget", current.Budget, data.Budget},
+		{"time_commitment", current.TimeCommitment, data.TimeCommitment},
+	}
+	for _, f := range stringFields {
+		if f.newValue == nil || *f.newValue == f.oldValue {
+			continue
+		}
+		if (f.field == "title" || f.field == "project_type" || f.field == "description") && strings.TrimSpace(*f.newValue) == "" {
+			return nil, fmt.Errorf("%s cannot be empty", f.field)
+		}
+		updates[f.field] = *f.newValue
+		changes.add(f.field, f.oldValue, *f.newValue)
+	}
+
+	timeFields := []struct {
+		field    string
+		oldValue time.Time
+		newValue *time.Time
+	}{
+		{"start_date", current.StartDate, data.StartDate},
+		{"end_date", current.EndDate, data.EndDate},
+		{"registration_deadline", current.RegistrationDeadline, data.RegistrationDeadline},
+	}
+	for _, f := range timeFields {
+		if f.newValue == nil || f.newValue.Equal(f.oldValue) {
+			continue
+		}
+		updates[f.field] = *f.newValue
+		changes.add(f.field, f.oldValue, *f.newValue)
+	}
+
+	totalTeam := current.TotalTeam
+	if data.TotalTeam != nil && *data.TotalTeam != current.TotalTeam {
+		if *data.TotalTeam <= 0 {
+			return nil, errors.New("total_team must be greater than zero")
+		}
+		totalTeam = *data.TotalTeam
+		updates["total_team"] = totalTeam
+		changes.add("total_team", current.TotalTeam, totalTeam)
+	}
+
+	tx := s.DB.Begin()
+
+	if len(updates) > 0 {
+		if err := tx.Model(&model.Project{}).Where("id = ?", projectID).Updates(updates).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if data.RequiredSkills != nil {
+		var oldSkills []string
+		for _, skill := range current.RequiredSkills {
+			oldSkills = append(oldSkills, skill.Skill.Name)
+		}
+		if !sameStringSet(oldSkills, *data.RequiredSkills) {
+			if len(*data.RequiredSkills) == 0 {
+				tx.Rollback()
+				return nil, errors.New("at least one required skill is needed")
+			}
+			if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectRequiredSkill{}).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			for _, skillName := range *data.RequiredSkills {
+				skill, err := s.skillService.FindOrCreateWithTx(tx, skillName)
+				if err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				if err := tx.Create(&model.ProjectRequiredSkill{ProjectID: projectID, SkillID: skill.ID}).Error; err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			changes.add("required_skills", oldSkills, *data.RequiredSkills)
+		}
+	}
+
+	if data.Conditions != nil {
+		var oldConditions []string
+		for _, condition := range current.Conditions {
+			oldConditions = append(oldConditions, condition.Description)
+		}
+		if !sameStringSet(oldConditions, *data.Conditions) {
+			if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectCondition{}).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			for _, desc := range *data.Conditions {
+				if err := tx.Create(&model.ProjectCondition{ProjectID: projectID, Description: desc}).Error; err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			changes.add("conditions", oldConditions, *data.Conditions)
+		}
+	}
+
+	if data.Tags != nil {
+		var oldTags []string
+		for _, tag := range current.Tags {
+			oldTags = append(oldTags, tag.Tag.Name)
+		}
+		if !sameStringSet(oldTags, *data.Tags) {
+			tags, err := s.tagService.findOrCreate(tx, *data.Tags)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectTag{}).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			for _, tag := range tags {
+				if err := tx.Create(&model.ProjectTag{ProjectID: projectID, TagID: tag.ID}).Error; err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			changes.add("tags", oldTags, *data.Tags)
+		}
+	}
+
+	if data.Benefits != nil {
+		var oldBenefits []string
+		for _, benefit := range current.Benefits {
+			oldBenefits = append(oldBenefits, benefit.Benefit.Name)
+		}
+		if !sameStringSet(oldBenefits, *data.Benefits) {
+			if len(*data.Benefits) == 0 {
+				tx.Rollback()
+				return nil, errors.New("at least one benefit is required")
+			}
+			benefits, err := s.benefitService.findOrCreate(tx, *data.Benefits)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectBenefit{}).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			for _, benefit := range benefits {
+				if err := tx.Create(&model.ProjectBenefit{ProjectID: projectID, BenefitID: benefit.ID}).Error; err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
+			changes.add("benefits", oldBenefits, *data.Benefits)
+		}
+	}
+
+	if data.Timeline != nil {
+		oldTimeline := make([]TimelineDTO, 0, len(current.Timeline))
+		for _, timeline := range current.Timeline {
+			oldTimeline = append(oldTimeline, TimelineDTO{Name: timeline.Timeline.Name, Status: timeline.TimelineStatus})
+		}
+		if err := s.replaceProjectTimeline(tx, projectID, *data.Timeline); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if revisionValue(oldTimeline) != revisionValue(*data.Timeline) {
+			changes.add("timeline", oldTimeline, *data.Timeline)
+		}
+	}
+
+	if len(data.Roles) > 0 {
+		if err := s.applyRoleUpdates(tx, current, data.Roles, changes); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	// Validate team capacity with the updated roles and total team
+	var memberCount int64
+	if err := tx.Model(&model.ProjectMember{}).Where("project_id = ?", projectID).Count(&memberCount).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var roleSlots int64
+	if err := tx.Model(&model.ProjectRole{}).Where("project_id = ?", projectID).
+		Select("COALESCE(SUM(slots_available), 0)").Scan(&roleSlots).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if int(memberCount+roleSlots) > totalTeam {
+		tx.Rollback()
+		return nil, fmt.Errorf("team capacity exceeded: %d members and %d open role slots do not fit a total team of %d", memberCount, roleSlots, totalTeam)
+	}
+
+	if len(changes.revisions) == 0 {
+		tx.Rollback()
+		return s.transformProjectToResponseWithSingleProfile(current), nil
+	}
+
+	revisionGroup := uuid.New().String()
+	for i := range changes.revisions {
+		changes.revisions[i].ProjectID = projectID
+		changes.revisions[i].ChangedByID = userID
+		changes.revisions[i].RevisionGroup = revisionGroup
+	}
+	if err := tx.Create(&changes.revisions).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// Touch updated_at even when only related records changed
+	if err := tx.Model(&model.Project{}).Where("id = ?", projectID).Update("updated_at", time.Now()).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.notificationService.NotifyProjectUpdated(projectID, userID, changes.fields); err != nil {
+		log.Printf("Failed to send project updated notifications for project %d: %v", projectID, err)
+	}
+
+	projectResult, err := s.loadProjectWithRelationships(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.transformProjectToResponseWithSingleProfile(projectResult), nil
+}
+
+// replaceProjectTimeline replaces the timeline of a project, validating every status
+func (s *ProjectService) replaceProjectTimeline(tx *gorm.DB, projectID uint, timelineData []TimelineDTO) error {
+	var timelineNames []string
+	for _, timeline := range timelineData {
+		timelineNames = append(timelineNames, timeline.Name)
+	}
+
+	timelines, err := s.timelineService.findOrCreate(tx, timelineNames)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectTimeline{}).Error; err != nil {
+		return err
+	}
+
+	timelineMap := make(map[string]*model.Timeline)
+	for _, timeline := range timelines {
+		timelineMap[timeline.Name] = timeline
+	}
+
+	for i := range timelineData {
+		if timelineData[i].Status == "" {
+			timelineData[i].Status = helper.GetDefaultTimelineStatus()
+		}
+		if !helper.IsValidTimelineStatus(timelineData[i].Status) {
+			return errors.New("invalid timeline status: " + timelineData[i].Status + ". Must be one of: " + strings.Join(helper.GetValidTimelineStatuses(), ", "))
+		}
+
+		timeline, exists := timelineMap[timelineData[i].Name]
+		if !exists {
+			return errors.New("timeline not found: " + timelineData[i].Name)
+		}
+
+		projectTimeline := &model.ProjectTimeline{
+			ProjectID:      projectID,
+			TimelineID:     timeline.ID,
+			TimelineStatus: timelineData[i].Status,
+		}
+		if err := tx.Create(projectTimeline).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyRoleUpdates creates, updates or deletes project roles in place so existing members keep their role
+func (s *ProjectService) applyRoleUpdates(tx *gorm.DB, project *model.Project, roles []RoleUpdateDTO, changes *projectChangeSet) error {
+	existing := make(map[uint]*model.ProjectRole, len(project.Roles))
+	for _, role := range project.Roles {
+		existing[role.ID] = role
+	}
+
+	for _, roleData := range roles {
+		if roleData.ID == nil {
+			if roleData.Delete {
+				continue
+			}
+			if roleData.Name == nil || strings.TrimSpace(*roleData.Name) == "" {
+				return errors.New("new roles need a name")
+			}
+			role := model.ProjectRole{ProjectID: project.ID, Name: *roleData.Name}
+			if roleData.SlotsAvailable != nil {
+				role.SlotsAvailable = *roleData.SlotsAvailable
+			}
+			if roleData.Description != nil {
+				role.Description = *roleData.Description
+			}
+			if role.SlotsAvailable < 0 {
+				return errors.New("slots_available cannot be negative")
+			}
+			if err := tx.Create(&role).Error; err != nil {
+				return err
+			}
+
+			var skillNames []string
+			if roleData.SkillNames != nil {
+				skillNames = *roleData.SkillNames
+				if err := s.replaceRoleSkills(tx, role.ID, skillNames); err != nil {
+					return err
+				}
+			}
+
+			changes.add("roles", nil, RoleDTO{
+				Name:           role.Name,
+				SlotsAvailable: role.SlotsAvailable,
+				Description:    role.Description,
+				SkillNames:     skillNames,
+			})
+			continue
+		}
+
+		role, ok := existing[*roleData.ID]
+		if !ok {
+			return fmt.Errorf("role %d does not belong to this project", *roleData.ID)
+		}
+		field := fmt.Sprintf("roles.%d", role.ID)
+
+		if roleData.Delete {
+			var memberCount int64
+			if err := tx.Model(&model.ProjectMember{}).Where("project_role_id = ?", role.ID).Count(&memberCount).Error; err != nil {
+				return err
+			}
+			if memberCount > 0 {
+				return fmt.Errorf("role '%s' still has members assigned", role.Name)
+			}
+			var applicationCount int64
+			if err := tx.Model(&model.ProjectApplication{}).Where("project_role_id = ?", role.ID).Count(&applicationCount).Error; err != nil {
+				return err
+			}
+			if applicationCount > 0 {
+				return fmt.Errorf("role '%s' has applications, set its slots to 0 instead", role.Name)
+			}
+			if err := tx.Where("project_role_id = ?", role.ID).Delete(&model.ProjectRoleSkill{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&model.ProjectRole{}, role.ID).Error; err != nil {
+				return err
+			}
+			changes.add(field, role.Name, nil)
+			continue
+		}
+
+		roleUpdates := map[string]interface{}{}
+		if roleData.Name != nil && *roleData.Name != role.Name {
+			if strings.TrimSpace(*roleData.Name) == "" {
+				return errors.New("role name cannot be empty")
+			}
+			roleUpdates["name"] = *roleData.Name
+			changes.add(field+".name", role.Name, *roleData.Name)
+		}
+		if roleData.SlotsAvailable != nil && *roleData.SlotsAvailable != role.SlotsAvailable {
+			if *roleData.SlotsAvailable < 0 {
+				return errors.New("slots_available cannot be negative")
+			}
+			roleUpdates["slots_available"] = *roleData.SlotsAvailable
+			changes.add(field+".slots_available", role.SlotsAvailable, *roleData.SlotsAvailable)
+		}
+		if roleData.Description != nil && *roleData.Description != role.Description {
+			roleUpdates["description"] = *roleData.Description
+			changes.add(field+".description", role.Description, *roleData.Description)
+		}
+		if len(roleUpdates) > 0 {
+			if err := tx.Model(&model.ProjectRole{}).Where("id = ?", role.ID).Updates(roleUpdates).Error; err != nil {
+				return err
+			}
+		}
+
+		if roleData.SkillNames != nil {
+			var oldSkills []string
+			for _, skill := range role.RequiredSkills {
+				oldSkills = append(oldSkills, skill.Skill.Name)
+			}
+			if !sameStringSet(oldSkills, *roleData.SkillNames) {
+				if err := s.replaceRoleSkills(tx, role.ID, *roleData.SkillNames); err != nil {
+					return err
+				}
+				changes.add(field+".skill_names", oldSkills, *roleData.SkillNames)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *ProjectService) replaceRoleSkills(tx *gorm.DB, roleID uint, skillNames []string) error {
+	if err := tx.Where("project_role_id = ?", roleID).Delete(&model.ProjectRoleSkill{}).Error; err != nil {
+		return err
+	}
+	for _, skillName := range skillNames {
+		skill, err := s.skillService.FindOrCreateWithTx(tx, skillName)
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&model.ProjectRoleSkill{ProjectRoleID: roleID, SkillID: skill.ID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProjectRevisionResponse is a project revision with the public details of who made it
+type ProjectRevisionResponse struct {
+	model.ProjectRevision
+	ChangedBy *UserSummary `json:"changed_by"`
+}
+
+// GetProjectRevisions returns the change history of a project, newest first, to its creator and members
+func (s *ProjectService) GetProjectRevisions(projectID, userID uint) ([]ProjectRevisionResponse, error) {
+	if _, err := s.GetUserProject(userID, projectID); err != nil {
+		return nil, err
+	}
+
+	var revisions []model.ProjectRevision
+	if err := s.DB.Preload("ChangedBy.Profile").
+		Where("project_id = ?", projectID).
+		Order("created_at DESC, id ASC").
+		Find(&revisions).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve project revisions: %w", err)
+	}
+
+	response := make([]ProjectRevisionResponse, len(revisions))
+	for i := range revisions {
+		response[i] = ProjectRevisionResponse{
+			ProjectRevision: revisions[i],
+			ChangedBy:       NewUserSummary(revisions[i].ChangedBy),
+		}
+	}
+	return response, nil
+}
+
+// UpdateProjectStatus moves a project along its lifecycle. Only the creator can change the
+// status, and only to a status allowed by model.CanTransitionProjectStatus.
+func (s *ProjectService) UpdateProjectStatus(projectID, userID uint, newStatus string) (interface{}, error) {
+	if !model.IsValidProjectStatus(newStatus) {
+		return nil, fmt.Errorf("invalid status: %s", newStatus)
+	}
+
+	var project model.Project
+	if err := s.DB.First(&project, projectID).Error; err != nil {
+		return nil, errors.New("project not found")
+	}
+	if project.CreatorID != userID {
+		return nil, errors.New("only the project creator can change its status")
+	}
+
+	if newStatus == model.ProjectStatusPublished {
+		if project.CompletionStage < 5 {
+			return nil, errors.New("finish all project stages before publishing the project")
+		}
+		if !project.RegistrationDeadline.IsZero() && time.Now().After(project.RegistrationDeadline) {
+			return nil, errors.New("registration deadline has passed, extend it before reopening recruitment")
+		}
+	}
+
+	if err := s.transitionProjectStatus(&project, newStatus, userID); err != nil {
+		return nil, err
+	}
+
+	projectResult, err := s.loadProjectWithRelationships(projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.transformProjectToResponseWithSingleProfile(projectResult), nil
+}
+
+// CloseExpiredRecruitment closes recruitment on published projects whose registration deadline has passed
+func (s *ProjectService) CloseExpiredRecruitment() (int, error) {
+	var projects []model.Project
+	if err := s.DB.Where("status = ? AND registration_deadline > ? AND registration_deadline < ?",
+		model.ProjectStatusPublished, time.Time{}, time.Now()).Find(&projects).Error; err != nil {
+		return 0, fmt.Errorf("failed to find projects with expired registration: %w", err)
+	}
+
+	closed := 0
+	for i := range projects {
+		if err := s.transitionProjectStatus(&projects[i], model.ProjectStatusRecruitmentClosed, 0); err != nil {
+			log.Printf("Failed to close recruitment for project %d: %v", projects[i].ID, err)
+			continue
+		}
+		closed++
+	}
+
+	return closed, nil
+}
+
+// transitionProjectStatus validates and saves a status change, then notifies the project.
+// actorID is the user making the change, or 0 when the system does it.
+func (s *ProjectService) transitionProjectStatus(project *model.Project, newStatus string, actorID uint) error {
+	oldStatus := project.Status
+	if !model.CanTransitionProjectStatus(oldStatus, newStatus) {
+		return fmt.Errorf("cannot change project status from %s to %s, allowed: %s",
+			oldStatus, newStatus, strings.Join(model.NextProjectStatuses(oldStatus), ", "))
+	}
+
+	// Guard against a concurrent change between reading and writing the status
+	result := s.DB.Model(&model.Project{}).
+		Where("id = ? AND status = ?", project.ID, oldStatus).
+		Update("status", newStatus)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update project status: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("project status was changed by someone else, please retry")
+	}
+	project.Status = newStatus
+
+	// Completion has its own notification, members get that one instead of a status update
+	if newStatus == model.ProjectStatusCompleted {
+		if err := s.notificationService.NotifyProjectCompleted(project.ID); err != nil {
+			log.Printf("Failed to send completion notifications for project %d: %v", project.ID, err)
+		}
+	} else if err := s.notificationService.NotifyProjectStatusChange(project.ID, oldStatus, newStatus, actorID); err != nil {
+		log.Printf("Failed to send status change notifications for project %d: %v", project.ID, err)
+	}
+
+	return nil
+}
+
 // DeleteProject deletes a project by ID, only if the user is the creator
 func (s *ProjectService) DeleteProject(projectID, userID uint) error {
 	tx := s.DB.Begin()
@@ -1124,6 +1904,49 @@ func (s *ProjectService) DeleteProject(projectID, userID uint) error {
 		return fmt.Errorf("failed to delete project tags: %w", err)
 	}
 
+	// Delete the project chat room with its messages, attachments and participants
+	var chatAttachments []model.MessageAttachment
+	if err := tx.Where("chat_id IN (SELECT id FROM chats WHERE project_id = ?)", projectID).Find(&chatAttachments).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to load project chat attachments: %w", err)
+	}
+
+	if err := tx.Where("chat_id IN (SELECT id FROM chats WHERE project_id = ?)", projectID).Delete(&model.MessageAttachment{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat attachments: %w", err)
+	}
+
+	projectChatMessages := "message_id IN (SELECT id FROM messages WHERE chat_id IN (SELECT id FROM chats WHERE project_id = ?))"
+	if err := tx.Where(projectChatMessages, projectID).Delete(&model.MessageRevision{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat message revisions: %w", err)
+	}
+
+	if err := tx.Where(projectChatMessages, projectID).Delete(&model.MessageDeletion{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat message deletions: %w", err)
+	}
+
+	if err := tx.Where("chat_id IN (SELECT id FROM chats WHERE project_id = ?)", projectID).Delete(&model.Message{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat messages: %w", err)
+	}
+
+	if err := tx.Where("chat_id IN (SELECT id FROM chats WHERE project_id = ?)", projectID).Delete(&model.ChatParticipant{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat participants: %w", err)
+	}
+
+	if err := tx.Where("project_id = ?", projectID).Delete(&model.Chat{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project chat: %w", err)
+	}
+
+	if err := tx.Where("project_id = ?", projectID).Delete(&model.ProjectRevision{}).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to delete project revisions: %w", err)
+	}
+
 	// Delete notifications that reference this project
 	if err := tx.Where("project_id = ?", projectID).Delete(&model.Notification{}).Error; err != nil {
 		tx.Rollback()
@@ -1140,6 +1963,8 @@ func (s *ProjectService) DeleteProject(projectID, userID uint) error {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
+	removeAttachmentFiles(chatAttachments)
+
 	return nil
 }
 
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/model"
+)
+
+// RateLimit is a token bucket holding up to Requests tokens that refills completely over Period.
+// Every request takes one token, so bursts of Requests are allowed and the average rate is
+// Requests per Period.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitResult is the state of a bucket after a request tried to take a token from it
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token is available, zero when Allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps token buckets by key. Implementations decide whether buckets are
+// shared between instances.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key, creating a full bucket when there is none
+	Take(key string, limit RateLimit) (RateLimitResult, error)
+	// Cleanup drops buckets that have not been used for idle; they would be full by now anyway
+	Cleanup(idle time.Duration) error
+}
+
+// takeToken refills a bucket that held tokens at updatedAt and tries to take one at now.
+// Returns the tokens left and the result. Shared by the store implementations.
+func takeToken(tokens float64, updatedAt, now time.Time, limit RateLimit) (float64, RateLimitResult) {
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Period.Seconds() // tokens per second
+
+	if elapsed := now.Sub(updatedAt).Seconds(); elapsed > 0 {
+		tokens = math.Min(capacity, tokens+elapsed*rate)
+	}
+
+	result := RateLimitResult{Limit: limit.Requests}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - tokens) / rate)
+	}
+	result.Remaining = int(math.Floor(tokens))
+	result.Reset = secondsToDuration((capacity - tokens) / rate)
+	return tokens, result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+// MemoryRateLimitStore keeps buckets in this process. Limits are per instance.
+type MemoryRateLimitStore struct {
+	buckets map[string]*memoryBucket
+	mutex   sync.Mutex
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Requests), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, result := takeToken(bucket.tokens, bucket.updatedAt, now, limit)
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) Cleanup(idle time.Duration) error {
+	cutoff := time.Now().Add(-idle)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, bucket := range s.buckets {
+		if bucket.updatedAt.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// PostgresRateLimitStore keeps buckets in the rate_limit_buckets table, so every instance
+// shares the same limits. Each bucket row is locked while a token is taken.
+type PostgresRateLimitStore struct {
+	DB *gorm.DB
+}
+
+func NewPostgresRateLimitStore(db *gorm.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{DB: db}
+}
+
+func (s *PostgresRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	var result RateLimitResult
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		bucket := model.RateLimitBucket{Key: key, Tokens: float64(limit.Requests), UpdatedAt: now}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&bucket).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("key = ?", key).First(&bucket).Error; err != nil {
+			return err
+		}
+
+		var tokens float64
+		tokens, result = takeToken(bucket.Tokens, bucket.UpdatedAt, now, limit)
+		return tx.Model(&model.RateLimitBucket{}).Where("key = ?", key).
+			Updates(map[string]interface{}{"tokens": tokens, "updated_at": now}).Error
+	})
+	return result, err
+}
+
+func (s *PostgresRateLimitStore) Cleanup(idle time.Duration) error {
+	return s.DB.Where("updated_at < ?", time.Now().Add(-idle)).Delete(&model.RateLimitBucket{}).Error
+}
+
+// NewRateLimitStoreFromEnv picks the store from RATE_LIMIT_STORE: "postgres" to share limits
+// across instances, anything else for the in-memory store
+func NewRateLimitStoreFromEnv() RateLimitStore {
+	if os.Getenv("RATE_LIMIT_STORE") == "postgres" {
+		log.Println("Using Postgres rate limit store")
+		return NewPostgresRateLimitStore(config.GetDB())
+	}
+	return NewMemoryRateLimitStore()
+}
+
+var (
+	defaultRateLimitStore     RateLimitStore
+	defaultRateLimitStoreOnce sync.Once
+)
+
+// DefaultRateLimitStore returns the store shared by the whole process, created from the
+// environment on first use
+func DefaultRateLimitStore() RateLimitStore {
+	defaultRateLimitStoreOnce.Do(func() {
+		defaultRateLimitStore = NewRateLimitStoreFromEnv()
+	})
+	return defaultRateLimitStore
+}
@@ -0,0 +1,554 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+// WebSocketTicketTTL is how long a WebSocket ticket can wait before it is redeemed
+const WebSocketTicketTTL = 30 * time.Second
+
+// OAuthLoginCodeTTL is how long the frontend has to exchange the code of a social login
+const OAuthLoginCodeTTL = time.Minute
+
+type TokenService struct {
+	DB *gorm.DB
+}
+
+func NewTokenService(db *gorm.DB) *TokenService {
+	return &TokenService{DB: db}
+}
+
+func NewTokenServiceDefault() *TokenService {
+	return &TokenService{DB: config.GetDB()}
+}
+
+// ClientInfo describes the device a session was created from
+type ClientInfo struct {
+	DeviceName string
+	UserAgent  string
+	IPAddress  string
+}
+
+// TokenPair is returned on login and on every refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	SessionID    uint   `json:"session_id"`
+}
+
+// SessionResponse is a session as shown in the active sessions list
+type SessionResponse struct {
+	ID         uint      `json:"id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	Current    bool      `json:"current"`
+}
+
+// ValidateToken verifies the JWT signature and expiry and rejects tokens that were revoked
+func (s *TokenService) ValidateToken(tokenString string) (*helper.Claims, error) {
+	claims, err := helper.VerifyJWTToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID == "" {
+		return nil, errors.New("token has no ID, please log in again")
+	}
+
+	revoked, err := s.IsTokenRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return claims, nil
+}
+
+// IsTokenRevoked checks the per-token blacklist, the session the token belongs to
+// and the per-user "log out everywhere" cutoff
+func (s *TokenService) IsTokenRevoked(claims *helper.Claims) (bool, error) {
+	var count int64
+	if err := s.DB.Model(&model.RevokedToken{}).Where("jti = ?", claims.ID).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %v", err)
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if claims.SessionID != 0 {
+		var session model.UserSession
+		if err := s.DB.Select("id", "revoked_at").First(&session, claims.SessionID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return true, nil
+			}
+			return false, fmt.Errorf("failed to load session: %v", err)
+		}
+		if session.RevokedAt != nil {
+			return true, nil
+		}
+	}
+
+	var user model.Users
+	if err := s.DB.Select("id", "tokens_invalid_before").First(&user, claims.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to load token owner: %v", err)
+	}
+
+	if user.TokensInvalidBefore != nil && claims.IssuedAtTime().Before(*user.TokensInvalidBefore) {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// IssueTokenPair starts a new session for the user and returns its first access and refresh tokens
+func (s *TokenService) IssueTokenPair(userID uint, email string, client ClientInfo) (*TokenPair, error) {
+	now := time.Now()
+	session := model.UserSession{
+		UserID:     userID,
+		DeviceName: client.DeviceName,
+		UserAgent:  client.UserAgent,
+		IPAddress:  client.IPAddress,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(helper.RefreshTokenTTL()),
+	}
+
+	var refreshToken string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return fmt.Errorf("failed to create session: %v", err)
+		}
+
+		token, err := s.createRefreshToken(tx, &session)
+		if err != nil {
+			return err
+		}
+		refreshToken = token
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := helper.GenerateJWTToken(userID, email, session.ID)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(helper.AccessTokenTTL().Seconds()),
+		SessionID:    session.ID,
+	}, nil
+}
+
+// RefreshTokens rotates a refresh token. Presenting a refresh token that was already
+// rotated means it was stolen, so the whole session is revoked.
+func (s *TokenService) RefreshTokens(refreshToken string, client ClientInfo) (*TokenPair, error) {
+	if refreshToken == "" {
+		return nil, errors.New("refresh token is required")
+	}
+
+	var stored model.RefreshToken
+	if err := s.DB.Preload("Session").Where("token_hash = ?", helper.HashToken(refreshToken)).First(&stored).Error; err != nil {
+		return nil, errors.New("invalid refresh token")
+	}
+
+	session := stored.Session
+	if session.RevokedAt != nil {
+		return nil, errors.New("session has been revoked")
+	}
+
+	now := time.Now()
+	if now.After(stored.ExpiresAt) || now.After(session.ExpiresAt) {
+		return nil, errors.New("refresh token has expired")
+	}
+
+	// Claim the token atomically so two concurrent refreshes cannot both succeed
+	result := s.DB.Model(&model.RefreshToken{}).
+		Where("id = ? AND used_at IS NULL", stored.ID).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("Refresh token reuse detected for user %d, revoking session %d", stored.UserID, session.ID)
+		if err := s.revokeSession(s.DB, session.ID, model.SessionRevokedTokenReuse); err != nil {
+			log.Printf("Failed to revoke session %d after token reuse: %v", session.ID, err)
+		}
+		return nil, errors.New("refresh token has already been used, please log in again")
+	}
+
+	var user model.Users
+	if err := s.DB.First(&user, stored.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var newRefreshToken string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"last_used_at": now,
+			"expires_at":   now.Add(helper.RefreshTokenTTL()),
+		}
+		if client.IPAddress != "" {
+			updates["ip_address"] = client.IPAddress
+		}
+		if client.UserAgent != "" {
+			updates["user_agent"] = client.UserAgent
+		}
+		if err := tx.Model(&session).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update session: %v", err)
+		}
+
+		token, err := s.createRefreshToken(tx, &session)
+		if err != nil {
+			return err
+		}
+		newRefreshToken = token
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := helper.GenerateJWTToken(user.ID, user.Email, session.ID)
+	if err != nil {
+		return nil, errors.New("failed to generate token")
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int64(helper.AccessTokenTTL().Seconds()),
+		SessionID:    session.ID,
+	}, nil
+}
+
+// GetActiveSessions lists the user's sessions that are neither revoked nor expired
+func (s *TokenService) GetActiveSessions(userID, currentSessionID uint) ([]SessionResponse, error) {
+	var sessions []model.UserSession
+	if err := s.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, fmt.Errorf("failed to retrieve sessions: %v", err)
+	}
+
+	responses := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		responses[i] = SessionResponse{
+			ID:         session.ID,
+			DeviceName: session.DeviceName,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			CreatedAt:  session.CreatedAt,
+			Current:    session.ID == currentSessionID,
+		}
+	}
+
+	return responses, nil
+}
+
+// RevokeUserSession revokes one of the user's own sessions
+func (s *TokenService) RevokeUserSession(userID, sessionID uint) error {
+	var session model.UserSession
+	if err := s.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		return errors.New("session not found")
+	}
+
+	if session.RevokedAt != nil {
+		return errors.New("session already revoked")
+	}
+
+	return s.revokeSession(s.DB, session.ID, model.SessionRevokedByUser)
+}
+
+// RevokeSessionForLogout revokes the session behind the given claims, if any
+func (s *TokenService) RevokeSessionForLogout(claims *helper.Claims) error {
+	if claims.SessionID == 0 {
+		return nil
+	}
+	return s.revokeSession(s.DB, claims.SessionID, model.SessionRevokedLogout)
+}
+
+// RevokeToken blacklists a single token until it would have expired on its own
+func (s *TokenService) RevokeToken(claims *helper.Claims) error {
+	if claims.ID == "" {
+		return errors.New("token cannot be revoked")
+	}
+
+	expiresAt := time.Now().Add(helper.AccessTokenTTL())
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	revoked := model.RevokedToken{
+		JTI:       claims.ID,
+		UserID:    claims.UserID,
+		ExpiresAt: expiresAt,
+	}
+
+	if err := s.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+	return nil
+}
+
+// RevokeAllUserTokens invalidates every access token and session issued to the user up to now
+func (s *TokenService) RevokeAllUserTokens(userID uint) error {
+	// Access tokens carry their issue time in microseconds, the precision the database stores, so
+	// tokens issued before this call are rejected and tokens issued after it stay valid
+	cutoff := time.Now().Truncate(time.Microsecond)
+
+	result := s.DB.Model(&model.Users{}).Where("id = ?", userID).Update("tokens_invalid_before", cutoff)
+	if result.Error != nil {
+		return fmt.Errorf("failed to revoke user tokens: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	if err := s.DB.Model(&model.UserSession{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": model.SessionRevokedLogoutAll,
+		}).Error; err != nil {
+		return fmt.Errorf("failed to revoke user sessions: %v", err)
+	}
+
+	return nil
+}
+
+// RevokeOtherSessions signs the user out of every session except keepSessionID. Without a
+// session to keep, every token of the user is revoked.
+func (s *TokenService) RevokeOtherSessions(userID, keepSessionID uint, reason string) error {
+	if keepSessionID == 0 {
+		return s.RevokeAllUserTokens(userID)
+	}
+
+	var sessionIDs []uint
+	if err := s.DB.Model(&model.UserSession{}).
+		Where("user_id = ? AND id != ? AND revoked_at IS NULL", userID, keepSessionID).
+		Pluck("id", &sessionIDs).Error; err != nil {
+		return fmt.Errorf("failed to find user sessions: %v", err)
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		for _, sessionID := range sessionIDs {
+			if err := s.revokeSession(tx, sessionID, reason); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *TokenService) CleanupExpiredRevokedTokens() {
+	result := s.DB.Where("expires_at < ?", time.Now()).Delete(&model.RevokedToken{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up revoked tokens: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired revoked tokens", result.RowsAffected)
+	}
+}
+
+// CleanupExpiredSessions removes refresh tokens and sessions that can no longer be used
+func (s *TokenService) CleanupExpiredSessions() {
+	now := time.Now()
+
+	result := s.DB.Where("expires_at < ?", now).Delete(&model.RefreshToken{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up expired refresh tokens: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired refresh tokens", result.RowsAffected)
+	}
+
+	// Revoked sessions are kept for a while so reuse of their tokens is still detected
+	result = s.DB.Where("expires_at < ? OR revoked_at < ?", now, now.Add(-helper.RefreshTokenTTL())).Delete(&model.UserSession{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up expired sessions: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired sessions", result.RowsAffected)
+	}
+
+	if err := s.DB.Where("session_id NOT IN (SELECT id FROM user_sessions)").Delete(&model.RefreshToken{}).Error; err != nil {
+		log.Printf("Error cleaning up orphaned refresh tokens: %v", err)
+	}
+
+	if err := s.DB.Where("expires_at < ?", now).Delete(&model.WebSocketTicket{}).Error; err != nil {
+		log.Printf("Error cleaning up expired WebSocket tickets: %v", err)
+	}
+
+	if err := s.DB.Where("expires_at < ?", now).Delete(&model.OAuthLoginCode{}).Error; err != nil {
+		log.Printf("Error cleaning up expired OAuth login codes: %v", err)
+	}
+}
+
+// IssueOAuthLoginCode creates the single-use code a social login redirects to the frontend with
+func (s *TokenService) IssueOAuthLoginCode(userID uint) (string, error) {
+	code, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return "", errors.New("failed to generate login code")
+	}
+
+	record := model.OAuthLoginCode{
+		UserID:    userID,
+		CodeHash:  helper.HashToken(code),
+		ExpiresAt: time.Now().Add(OAuthLoginCodeTTL),
+	}
+	if err := s.DB.Create(&record).Error; err != nil {
+		return "", fmt.Errorf("failed to store login code: %v", err)
+	}
+
+	return code, nil
+}
+
+// RedeemOAuthLoginCode uses up a code from IssueOAuthLoginCode and returns its user
+func (s *TokenService) RedeemOAuthLoginCode(code string) (uint, error) {
+	if code == "" {
+		return 0, errors.New("code is required")
+	}
+
+	var stored model.OAuthLoginCode
+	if err := s.DB.Where("code_hash = ?", helper.HashToken(code)).First(&stored).Error; err != nil {
+		return 0, errors.New("invalid login code")
+	}
+
+	now := time.Now()
+	result := s.DB.Model(&model.OAuthLoginCode{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", stored.ID, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to redeem login code: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("login code has expired or was already used")
+	}
+
+	return stored.UserID, nil
+}
+
+// IssueWebSocketTicket creates a single-use ticket the holder of claims can exchange for a chat WebSocket connection
+func (s *TokenService) IssueWebSocketTicket(claims *helper.Claims) (string, time.Time, error) {
+	ticket, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return "", time.Time{}, errors.New("failed to generate ticket")
+	}
+
+	expiresAt := time.Now().Add(WebSocketTicketTTL)
+	record := model.WebSocketTicket{
+		UserID:     claims.UserID,
+		SessionID:  claims.SessionID,
+		TicketHash: helper.HashToken(ticket),
+		ExpiresAt:  expiresAt,
+	}
+	if err := s.DB.Create(&record).Error; err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to store ticket: %v", err)
+	}
+
+	return ticket, expiresAt, nil
+}
+
+// RedeemWebSocketTicket consumes a ticket and returns the user it was issued to.
+// A ticket works once, before it expires, and only while its session is still active and the
+// user has not logged out everywhere since it was issued.
+func (s *TokenService) RedeemWebSocketTicket(ticket string) (uint, error) {
+	if ticket == "" {
+		return 0, errors.New("ticket is required")
+	}
+
+	var stored model.WebSocketTicket
+	if err := s.DB.Where("ticket_hash = ?", helper.HashToken(ticket)).First(&stored).Error; err != nil {
+		return 0, errors.New("invalid ticket")
+	}
+
+	now := time.Now()
+	result := s.DB.Model(&model.WebSocketTicket{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", stored.ID, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to redeem ticket: %v", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("ticket has expired or was already used")
+	}
+
+	if stored.SessionID != 0 {
+		var session model.UserSession
+		if err := s.DB.Select("id", "revoked_at").First(&session, stored.SessionID).Error; err != nil || session.RevokedAt != nil {
+			return 0, errors.New("session has been revoked")
+		}
+	}
+
+	var user model.Users
+	if err := s.DB.Select("id", "tokens_invalid_before").First(&user, stored.UserID).Error; err != nil {
+		return 0, errors.New("invalid ticket")
+	}
+	if user.TokensInvalidBefore != nil && stored.CreatedAt.Before(*user.TokensInvalidBefore) {
+		return 0, errors.New("ticket has been revoked")
+	}
+
+	return stored.UserID, nil
+}
+
+func (s *TokenService) createRefreshToken(tx *gorm.DB, session *model.UserSession) (string, error) {
+	token, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return "", errors.New("failed to generate refresh token")
+	}
+
+	refreshToken := model.RefreshToken{
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		TokenHash: helper.HashToken(token),
+		ExpiresAt: time.Now().Add(helper.RefreshTokenTTL()),
+	}
+	if err := tx.Create(&refreshToken).Error; err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %v", err)
+	}
+
+	return token, nil
+}
+
+func (s *TokenService) revokeSession(tx *gorm.DB, sessionID uint, reason string) error {
+	now := time.Now()
+	if err := tx.Model(&model.UserSession{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Updates(map[string]interface{}{
+			"revoked_at":     now,
+			"revoked_reason": reason,
+		}).Error; err != nil {
+		return fmt.Errorf("failed to revoke session: %v", err)
+	}
+
+	if err := tx.Model(&model.RefreshToken{}).
+		Where("session_id = ? AND used_at IS NULL", sessionID).
+		Update("used_at", now).Error; err != nil {
+		return fmt.Errorf("failed to revoke session tokens: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,534 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"regexp"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"synergazing.com/synergazing/config"
+	"synergazing.com/synergazing/helper"
+	"synergazing.com/synergazing/model"
+)
+
+const (
+	// TwoFactorIssuer is the account name prefix shown in authenticator apps
+	TwoFactorIssuer = "Synergazing"
+	// MFAChallengeTTL is how long the "mfa_pending" token of a login can be used
+	MFAChallengeTTL = 5 * time.Minute
+	// mfaMaxAttempts wrong codes invalidate the mfa_pending token, the password has to be entered again
+	mfaMaxAttempts  = 5
+	backupCodeCount = 10
+	// backupCodeAlphabet leaves out characters that are easily confused (0/o, 1/l/i)
+	backupCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	backupCodeLength   = 10
+)
+
+var totpCodePattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+var errMFATokenInvalid = errors.New("invalid or expired two-factor session, please log in again")
+
+// ErrInvalidTwoFactorCode is wrapped by the errors of a wrong code, so the login can count it
+// against the account
+var ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+// TwoFactorStatus describes a user's two-factor setup
+type TwoFactorStatus struct {
+	Enabled              bool       `json:"enabled"`
+	EnabledAt            *time.Time `json:"enabled_at,omitempty"`
+	BackupCodesRemaining int64      `json:"backup_codes_remaining"`
+}
+
+// TwoFactorSetup is what the user needs to add the secret to their authenticator app
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	// ProvisioningURI is the otpauth:// URI to show as a QR code
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// TwoFactorService manages TOTP two-factor authentication (RFC 6238): enrollment, backup codes,
+// the second step of the login, and turning it off with an email code when the app is lost
+type TwoFactorService struct {
+	DB           *gorm.DB
+	OTPService   *OTPService
+	TokenService *TokenService
+	Outbox       *EmailOutboxService
+}
+
+func NewTwoFactorService(otpService *OTPService) *TwoFactorService {
+	return &TwoFactorService{
+		DB:           config.GetDB(),
+		OTPService:   otpService,
+		TokenService: NewTokenServiceDefault(),
+		Outbox:       DefaultEmailOutbox(),
+	}
+}
+
+// GetStatus returns whether the user has two-factor authentication on
+func (s *TwoFactorService) GetStatus(userID uint) (*TwoFactorStatus, error) {
+	status := &TwoFactorStatus{}
+
+	var twoFactor model.UserTwoFactor
+	err := s.DB.Where("user_id = ? AND enabled = ?", userID, true).First(&twoFactor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status.Enabled = true
+	status.EnabledAt = twoFactor.EnabledAt
+	if err := s.DB.Model(&model.TwoFactorBackupCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&status.BackupCodesRemaining).Error; err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// IsEnabled reports whether logins of the user need a second factor
+func (s *TwoFactorService) IsEnabled(userID uint) (bool, error) {
+	var count int64
+	err := s.DB.Model(&model.UserTwoFactor{}).Where("user_id = ? AND enabled = ?", userID, true).Count(&count).Error
+	return count > 0, err
+}
+
+// BeginSetup creates a new secret for the user. It only protects logins after EnableTwoFactor
+// confirmed a code from the app; starting over replaces a secret that was never confirmed.
+func (s *TwoFactorService) BeginSetup(userID uint) (*TwoFactorSetup, error) {
+	var user model.Users
+	if err := s.DB.Select("id", "email").First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	enabled, err := s.IsEnabled(userID)
+	if err != nil {
+		return nil, errors.New("failed to start two-factor setup")
+	}
+	if enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := helper.GenerateTOTPSecret()
+	if err != nil {
+		return nil, errors.New("failed to generate secret")
+	}
+	encrypted, err := helper.EncryptTOTPSecret(secret)
+	if err != nil {
+		log.Printf("Error encrypting TOTP secret: %v", err)
+		return nil, errors.New("failed to start two-factor setup")
+	}
+
+	twoFactor := model.UserTwoFactor{UserID: userID, SecretEncrypted: encrypted}
+	if err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"secret_encrypted": encrypted, "last_used_step": 0, "updated_at": time.Now()}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Eq{Column: clause.Column{Table: "user_two_factors", Name: "enabled"}, Value: false}}},
+	}).Create(&twoFactor).Error; err != nil {
+		log.Printf("Database error storing TOTP secret: %v", err)
+		return nil, errors.New("failed to start two-factor setup")
+	}
+
+	return &TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: helper.TOTPProvisioningURI(secret, TwoFactorIssuer, user.Email),
+	}, nil
+}
+
+// EnableTwoFactor turns two-factor authentication on once the user entered a code from the app
+// set up with BeginSetup. Returns the backup codes, which are only shown this once.
+func (s *TwoFactorService) EnableTwoFactor(userID uint, code string) ([]string, error) {
+	var twoFactor model.UserTwoFactor
+	if err := s.DB.Where("user_id = ?", userID).First(&twoFactor).Error; err != nil {
+		return nil, errors.New("two-factor setup not started")
+	}
+	if twoFactor.Enabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	if err := s.verifyTOTP(&twoFactor, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&model.UserTwoFactor{}).
+			Where("id = ? AND enabled = ?", twoFactor.ID, false).
+			Updates(map[string]interface{}{"enabled": true, "enabled_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("two-factor authentication is already enabled")
+		}
+
+		var err error
+		codes, err = s.replaceBackupCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error enabling two-factor authentication for user %d: %v", userID, err)
+		return nil, errors.New("failed to enable two-factor authentication")
+	}
+
+	s.sendAlert(userID, "two_factor_enabled")
+	return codes, nil
+}
+
+// RegenerateBackupCodes replaces all backup codes. A code from the app is needed, not a backup
+// code, so a leaked backup code cannot be turned into a fresh set.
+func (s *TwoFactorService) RegenerateBackupCodes(userID uint, code string) ([]string, error) {
+	twoFactor, err := s.enabledTwoFactor(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyTOTP(twoFactor, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		codes, err = s.replaceBackupCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error regenerating backup codes for user %d: %v", userID, err)
+		return nil, errors.New("failed to generate backup codes")
+	}
+
+	s.sendAlert(userID, "two_factor_backup_codes_regenerated")
+	return codes, nil
+}
+
+// RequestDisableCode emails a code that turns two-factor authentication off, for users who
+// lost their authenticator app and backup codes
+func (s *TwoFactorService) RequestDisableCode(userID uint, ipAddress string) error {
+	if _, err := s.enabledTwoFactor(userID); err != nil {
+		return err
+	}
+
+	var user model.Users
+	if err := s.DB.Select("id", "email").First(&user, userID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	return s.OTPService.SendOTP(user.Email, "two_factor", ipAddress)
+}
+
+// DisableTwoFactor turns two-factor authentication off. It needs either a code from the app or
+// a backup code, or the code emailed by RequestDisableCode.
+func (s *TwoFactorService) DisableTwoFactor(userID uint, code, emailCode string) error {
+	twoFactor, err := s.enabledTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case code != "":
+		if err := s.verifyCode(twoFactor, code); err != nil {
+			return err
+		}
+	case emailCode != "":
+		var user model.Users
+		if err := s.DB.Select("id", "email").First(&user, userID).Error; err != nil {
+			return errors.New("user not found")
+		}
+		if err := s.OTPService.VerifyOTP(user.Email, emailCode, "two_factor"); err != nil {
+			return err
+		}
+	default:
+		return errors.New("a two-factor code or email code is required")
+	}
+
+	if err := s.remove(userID); err != nil {
+		log.Printf("Error disabling two-factor authentication for user %d: %v", userID, err)
+		return errors.New("failed to disable two-factor authentication")
+	}
+
+	s.sendAlert(userID, "two_factor_disabled")
+	return nil
+}
+
+// CreateChallenge starts the second step of a login and returns its mfa_pending token
+func (s *TwoFactorService) CreateChallenge(userID uint) (string, time.Time, error) {
+	token, err := helper.GenerateRandomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	challenge := model.MFAChallenge{
+		UserID:    userID,
+		TokenHash: helper.HashToken(token),
+		ExpiresAt: time.Now().Add(MFAChallengeTTL),
+	}
+	if err := s.DB.Create(&challenge).Error; err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to store two-factor challenge: %v", err)
+	}
+
+	return token, challenge.ExpiresAt, nil
+}
+
+// VerifyLogin finishes a login with a code from the app or a backup code and returns the user.
+// Each wrong code counts against the mfa_pending token, which stops working after mfaMaxAttempts.
+func (s *TwoFactorService) VerifyLogin(mfaToken, code string) (*model.Users, error) {
+	challenge, err := s.findChallenge(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the attempt before checking, so parallel guesses cannot go over the limit. The new
+	// count comes back from the update, since the row may have changed since it was read.
+	counted := model.MFAChallenge{ID: challenge.ID}
+	result := s.DB.Model(&counted).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "attempts"}}}).
+		Where("used_at IS NULL AND attempts < ?", mfaMaxAttempts).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		log.Printf("Database error counting two-factor attempt: %v", result.Error)
+		return nil, errors.New("failed to verify two-factor code")
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("too many failed attempts, please log in again")
+	}
+
+	twoFactor, err := s.enabledTwoFactor(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verifyCode(twoFactor, code); err != nil {
+		if remaining := mfaMaxAttempts - counted.Attempts; remaining > 0 {
+			return nil, fmt.Errorf("%w, %d attempt(s) left", err, remaining)
+		}
+		return nil, fmt.Errorf("%w. Too many failed attempts, please log in again", err)
+	}
+
+	return s.completeChallenge(challenge)
+}
+
+// ChallengeUserID returns the user a valid mfa_pending token belongs to
+func (s *TwoFactorService) ChallengeUserID(mfaToken string) (uint, error) {
+	challenge, err := s.findChallenge(mfaToken)
+	if err != nil {
+		return 0, err
+	}
+	return challenge.UserID, nil
+}
+
+// RequestLoginResetCode emails a code that turns two-factor authentication off during a login,
+// for users who lost their authenticator app and backup codes
+func (s *TwoFactorService) RequestLoginResetCode(mfaToken, ipAddress string) error {
+	challenge, err := s.findChallenge(mfaToken)
+	if err != nil {
+		return err
+	}
+
+	var user model.Users
+	if err := s.DB.Select("id", "email").First(&user, challenge.UserID).Error; err != nil {
+		return errMFATokenInvalid
+	}
+	return s.OTPService.SendOTP(user.Email, "two_factor", ipAddress)
+}
+
+// ResetWithEmailCode turns two-factor authentication off with the emailed code and finishes the
+// login. Every other session is signed out and the user is told, in case it was not them.
+func (s *TwoFactorService) ResetWithEmailCode(mfaToken, emailCode string) (*model.Users, error) {
+	challenge, err := s.findChallenge(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var user model.Users
+	if err := s.DB.Select("id", "email").First(&user, challenge.UserID).Error; err != nil {
+		return nil, errMFATokenInvalid
+	}
+	if err := s.OTPService.VerifyOTP(user.Email, emailCode, "two_factor"); err != nil {
+		return nil, err
+	}
+
+	if err := s.remove(challenge.UserID); err != nil {
+		log.Printf("Error resetting two-factor authentication for user %d: %v", challenge.UserID, err)
+		return nil, errors.New("failed to reset two-factor authentication")
+	}
+	if err := s.TokenService.RevokeAllUserTokens(challenge.UserID); err != nil {
+		log.Printf("Error signing out user %d after two-factor reset: %v", challenge.UserID, err)
+	}
+	s.sendAlert(challenge.UserID, "two_factor_disabled")
+
+	return s.completeChallenge(challenge)
+}
+
+// CleanupExpiredChallenges removes mfa_pending tokens that can no longer be used
+func (s *TwoFactorService) CleanupExpiredChallenges() {
+	result := s.DB.Where("expires_at < ?", time.Now()).Delete(&model.MFAChallenge{})
+	if result.Error != nil {
+		log.Printf("Error cleaning up two-factor challenges: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Cleaned up %d expired two-factor challenges", result.RowsAffected)
+	}
+}
+
+func (s *TwoFactorService) findChallenge(mfaToken string) (*model.MFAChallenge, error) {
+	if mfaToken == "" {
+		return nil, errMFATokenInvalid
+	}
+
+	var challenge model.MFAChallenge
+	if err := s.DB.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", helper.HashToken(mfaToken), time.Now()).
+		First(&challenge).Error; err != nil {
+		return nil, errMFATokenInvalid
+	}
+	return &challenge, nil
+}
+
+// completeChallenge uses up the mfa_pending token and returns the user to issue tokens for
+func (s *TwoFactorService) completeChallenge(challenge *model.MFAChallenge) (*model.Users, error) {
+	result := s.DB.Model(&model.MFAChallenge{}).
+		Where("id = ? AND used_at IS NULL", challenge.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Database error completing two-factor challenge: %v", result.Error)
+		return nil, errors.New("failed to verify two-factor code")
+	}
+	if result.RowsAffected == 0 {
+		return nil, errMFATokenInvalid
+	}
+
+	var user model.Users
+	if err := s.DB.First(&user, challenge.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	user.Password = ""
+	return &user, nil
+}
+
+func (s *TwoFactorService) enabledTwoFactor(userID uint) (*model.UserTwoFactor, error) {
+	var twoFactor model.UserTwoFactor
+	if err := s.DB.Where("user_id = ? AND enabled = ?", userID, true).First(&twoFactor).Error; err != nil {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	return &twoFactor, nil
+}
+
+// verifyCode accepts a code from the app or an unused backup code
+func (s *TwoFactorService) verifyCode(twoFactor *model.UserTwoFactor, code string) error {
+	if totpCodePattern.MatchString(code) {
+		return s.verifyTOTP(twoFactor, code)
+	}
+
+	result := s.DB.Model(&model.TwoFactorBackupCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", twoFactor.UserID, helper.HashBackupCode(twoFactor.UserID, code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Database error using backup code: %v", result.Error)
+		return errors.New("failed to verify two-factor code")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// verifyTOTP checks a code from the app and records its time step, so it cannot be replayed
+func (s *TwoFactorService) verifyTOTP(twoFactor *model.UserTwoFactor, code string) error {
+	secret, err := helper.DecryptTOTPSecret(twoFactor.SecretEncrypted)
+	if err != nil {
+		log.Printf("Error decrypting TOTP secret of user %d: %v", twoFactor.UserID, err)
+		return errors.New("failed to verify two-factor code")
+	}
+
+	step, ok := helper.ValidateTOTP(secret, code, time.Now(), twoFactor.LastUsedStep)
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+
+	result := s.DB.Model(&model.UserTwoFactor{}).
+		Where("id = ? AND last_used_step < ?", twoFactor.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		log.Printf("Database error recording TOTP step: %v", result.Error)
+		return errors.New("failed to verify two-factor code")
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	twoFactor.LastUsedStep = step
+	return nil
+}
+
+// replaceBackupCodes deletes the user's backup codes and stores a new set, returning the plain codes
+func (s *TwoFactorService) replaceBackupCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&model.TwoFactorBackupCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, backupCodeCount)
+	rows := make([]model.TwoFactorBackupCode, backupCodeCount)
+	for i := range codes {
+		code, err := generateBackupCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		rows[i] = model.TwoFactorBackupCode{UserID: userID, CodeHash: helper.HashBackupCode(userID, code)}
+	}
+
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// remove deletes the user's secret and backup codes
+func (s *TwoFactorService) remove(userID uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&model.TwoFactorBackupCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&model.UserTwoFactor{}).Error
+	})
+}
+
+// sendAlert emails the user that two-factor authentication was turned on or off, or that new
+// backup codes were generated
+func (s *TwoFactorService) sendAlert(userID uint, template string) {
+	var user model.Users
+	if err := s.DB.Select("id", "name", "email").First(&user, userID).Error; err != nil {
+		log.Printf("Error loading user %d for two-factor alert: %v", userID, err)
+		return
+	}
+
+	err := s.Outbox.Enqueue(OutgoingEmail{
+		To:       user.Email,
+		Template: template,
+		Data: map[string]interface{}{
+			"Name":     user.Name,
+			"ResetURL": helper.GetFrontendURL() + "/forgot-password",
+		},
+	})
+	if err != nil {
+		log.Printf("Error queueing two-factor alert for user %d: %v", userID, err)
+	}
+}
+
+// generateBackupCode returns a random code formatted as "xxxxx-xxxxx"
+func generateBackupCode() (string, error) {
+	code := make([]byte, 0, backupCodeLength+1)
+	max := big.NewInt(int64(len(backupCodeAlphabet)))
+	for i := 0; i < backupCodeLength; i++ {
+		if i == backupCodeLength/2 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, backupCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
@@ -0,0 +1,12 @@
+// Package templates embeds the email templates. Each locale has its own directory under email/
+// with a shared layout and, per email, an .html body and a .txt file with subject and plain text.
+// The few pages the API serves itself live under page/, one .html file per page and locale.
+package templates
+
+import "embed"
+
+//go:embed email
+var Email embed.FS
+
+//go:embed page
+var Page embed.FS